@@ -20,6 +20,7 @@ import (
 	"github.com/lpmos/lpmos-go/cmd/agent-minimal/install"
 	"github.com/lpmos/lpmos-go/cmd/agent-minimal/kickstart"
 	"github.com/lpmos/lpmos-go/cmd/agent-minimal/raid"
+	"github.com/lpmos/lpmos-go/pkg/config"
 )
 
 // HardwareInfo contains collected hardware information
@@ -147,14 +148,33 @@ var (
 	serialNumber      string
 	macAddress        string
 	pollingInterval   = 10 * time.Second
+	reportAttempts    = 1
+	reportRetryDelay  = 5 * time.Second
 )
 
 func main() {
 	// Parse command-line flags
-	regionalURL := flag.String("regional-url", getEnv("REGIONAL_CLIENT_URL", "http://localhost:8081"), "Regional client URL")
+	configPath := flag.String("config", os.Getenv(config.EnvConfigPath), "Path to LPMOS config file")
+	regionalURL := flag.String("regional-url", "", "Regional client URL (overrides agent.regional_client_url)")
 	flag.Parse()
 
-	regionalClientURL = *regionalURL
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	// REGIONAL_CLIENT_URL is what the PXE kernel command line exports
+	cfg.Agent.RegionalClientURL = getEnv("REGIONAL_CLIENT_URL", cfg.Agent.RegionalClientURL)
+	if *regionalURL != "" {
+		cfg.Agent.RegionalClientURL = *regionalURL
+	}
+	if err := cfg.ValidateAgent(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	regionalClientURL = cfg.Agent.RegionalClientURL
+	pollingInterval = cfg.Agent.Reporting.Interval
+	reportAttempts = cfg.Agent.Collection.RetryAttempts + 1
+	reportRetryDelay = cfg.Agent.Collection.RetryDelay
 
 	log.Println("=== LPMOS Agent Started (OS-Agent Workflow) ===")
 	log.Printf("Regional Client: %s", regionalClientURL)
@@ -180,8 +200,16 @@ func main() {
 	}
 
 	log.Println("\n[Stage 1] Reporting hardware to regional client...")
-	if err := reportHardware(hwInfo); err != nil {
-		log.Fatalf("Failed to report hardware: %v", err)
+	for attempt := 1; ; attempt++ {
+		err := reportHardware(hwInfo)
+		if err == nil {
+			break
+		}
+		if attempt >= reportAttempts {
+			log.Fatalf("Failed to report hardware: %v", err)
+		}
+		log.Printf("  Hardware report failed (attempt %d/%d): %v, retrying in %v", attempt, reportAttempts, err, reportRetryDelay)
+		time.Sleep(reportRetryDelay)
 	}
 	log.Println("  Hardware reported successfully")
 
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/rules"
+	"github.com/lpmos/lpmos-go/pkg/webhook"
+)
+
+// autoApprover is the actor recorded on approvals made by rules
+const autoApprover = "auto-approval"
+
+// errRulesChanged is returned when the rules changed since the version the
+// caller based its update on
+var errRulesChanged = errors.New("approval rules were changed by someone else; reload and retry")
+
+// updateRulesRequest replaces the auto-approval rules. ExpectedVersion, when
+// set, makes the update fail if another one happened first.
+type updateRulesRequest struct {
+	Enabled         bool         `json:"enabled"`
+	Rules           []rules.Rule `json:"rules"`
+	Comment         string       `json:"comment"`
+	ExpectedVersion int          `json:"expected_version"`
+}
+
+// seedApprovalRules stores features.auto_approval as version 1 unless rules
+// are already in etcd; from then on the API is the source of truth
+func (cp *ControlPlane) seedApprovalRules() {
+	cfg := cp.cfg.Features.AutoApproval
+	set := rules.Set{Enabled: cfg.Enabled, Comment: "seeded from features.auto_approval", UpdatedBy: "config"}
+	for _, r := range cfg.Rules {
+		set.Rules = append(set.Rules, rules.Rule{Name: r.Name, Condition: r.Condition, Action: r.Action})
+	}
+
+	_, err := cp.createApprovalRules(set)
+	switch {
+	case err == nil:
+		log.Printf("Seeded %d auto-approval rules from config", len(set.Rules))
+	case !errors.Is(err, etcd.ErrTxnConflict):
+		log.Printf("Warning: failed to seed auto-approval rules: %v", err)
+	}
+}
+
+// createApprovalRules stores set as version 1 if there are no rules yet
+func (cp *ControlPlane) createApprovalRules(set rules.Set) (rules.Set, error) {
+	set.Version = 1
+	set.UpdatedAt = time.Now()
+	current, err := etcd.OpPut(etcd.ApprovalRulesKey(), set)
+	if err != nil {
+		return set, err
+	}
+	version, err := etcd.OpPut(etcd.ApprovalRulesVersionKey(1), set)
+	if err != nil {
+		return set, err
+	}
+	err = cp.etcdClient.Transaction([]clientv3.Op{current, version},
+		clientv3.Compare(clientv3.CreateRevision(etcd.ApprovalRulesKey()), "=", 0))
+	return set, err
+}
+
+// storeApprovalRules makes set the next version of the rules, keeping every
+// version under its own key
+func (cp *ControlPlane) storeApprovalRules(set rules.Set, expectedVersion int) (rules.Set, error) {
+	set.UpdatedAt = time.Now()
+	err := cp.etcdClient.AtomicUpdateOps(etcd.ApprovalRulesKey(), func(data []byte) (interface{}, []clientv3.Op, error) {
+		var current rules.Set
+		if err := json.Unmarshal(data, &current); err != nil {
+			return nil, nil, err
+		}
+		if expectedVersion > 0 && current.Version != expectedVersion {
+			return nil, nil, errRulesChanged
+		}
+		set.Version = current.Version + 1
+		op, err := etcd.OpPut(etcd.ApprovalRulesVersionKey(set.Version), set)
+		if err != nil {
+			return nil, nil, err
+		}
+		return set, []clientv3.Op{op}, nil
+	})
+	if etcd.IsKeyNotFound(err) {
+		if expectedVersion > 0 {
+			return set, errRulesChanged
+		}
+		set, err = cp.createApprovalRules(set)
+		if errors.Is(err, etcd.ErrTxnConflict) {
+			err = errRulesChanged
+		}
+	}
+	return set, err
+}
+
+// currentApprovalRules returns the compiled current rules, recompiling only
+// when the version changed. Without stored rules nothing is auto-approved.
+func (cp *ControlPlane) currentApprovalRules() (*rules.Engine, error) {
+	var set rules.Set
+	if err := cp.etcdClient.GetJSON(etcd.ApprovalRulesKey(), &set); err != nil && !etcd.IsKeyNotFound(err) {
+		return nil, err
+	}
+
+	cp.rulesMu.Lock()
+	defer cp.rulesMu.Unlock()
+	if cp.rules != nil && cp.rules.Set().Version == set.Version && set.Version != 0 {
+		return cp.rules, nil
+	}
+	engine, err := rules.New(set)
+	if err != nil {
+		return nil, fmt.Errorf("approval rules v%d: %w", set.Version, err)
+	}
+	cp.rules = engine
+	return engine, nil
+}
+
+// awaitingApproval reports whether a task has not been decided on yet. Tasks
+// a rule or a human put in pending_approval are left to a human.
+func awaitingApproval(task *models.TaskV3) bool {
+	return task.Status != models.TaskStatusPendingApproval && task.AwaitingApproval()
+}
+
+// decideOnHardware runs the approval rules on a hardware report and, when
+// they leave the task undecided, announces that it waits for approval. A
+// task held in pending_approval was announced by its transition.
+func (cp *ControlPlane) decideOnHardware(idc, sn string, hardware []byte) {
+	cp.autoApprove(idc, sn, hardware)
+
+	var task models.TaskV3
+	if err := cp.etcdClient.GetJSON(etcd.TaskKeyV3(idc, sn), &task); err != nil {
+		return
+	}
+	if awaitingApproval(&task) {
+		cp.webhooks.Notify(webhook.PendingApprovalEvent(idc, sn, &task, time.Now()))
+	}
+}
+
+// autoApprove evaluates the rules against a hardware report stored under the
+// meta key of a machine and approves, rejects or holds its task
+func (cp *ControlPlane) autoApprove(idc, sn string, hardware []byte) {
+	engine, err := cp.currentApprovalRules()
+	if err != nil {
+		log.Printf("[%s] Auto-approval skipped for %s: %v", idc, sn, err)
+		return
+	}
+	if !engine.Set().Enabled {
+		return
+	}
+
+	var match *rules.Match
+	var before, after models.TaskV3
+	err = cp.etcdClient.AtomicUpdate(etcd.TaskKeyV3(idc, sn), func(data []byte) (interface{}, error) {
+		var task models.TaskV3
+		if err := json.Unmarshal(data, &task); err != nil {
+			return nil, err
+		}
+		if !awaitingApproval(&task) {
+			return nil, errUnchanged
+		}
+		task.IDC = idc
+		before = task
+
+		taskJSON, err := json.Marshal(task)
+		if err != nil {
+			return nil, err
+		}
+		match, err = engine.Evaluate(hardware, taskJSON)
+		if err != nil {
+			return nil, err
+		}
+		if match == nil {
+			return nil, errUnchanged
+		}
+
+		if err := applyRuleMatch(&task, match); err != nil {
+			return nil, err
+		}
+		after = task
+		return task, nil
+	})
+
+	switch {
+	case errors.Is(err, errUnchanged):
+		if match == nil {
+			log.Printf("[%s] No auto-approval rule matched %s", idc, sn)
+		}
+	case err != nil:
+		log.Printf("[%s] Auto-approval failed for %s: %v", idc, sn, err)
+	default:
+		log.Printf("[%s] Task for %s decided by %s", idc, sn, match.Notes())
+		r := taskRecord(audit.ActionTaskAutoDecide, &before, &after, match.Notes())
+		r.Actor, r.Method = "approval-rules", "system"
+		cp.appendAudit(r)
+	}
+}
+
+// applyRuleMatch records the decision of a rule on the task
+func applyRuleMatch(task *models.TaskV3, m *rules.Match) error {
+	now := time.Now()
+	notes := m.Notes()
+
+	switch m.Rule.Action {
+	case rules.ActionApprove:
+		task.Approval = &models.Approval{
+			Status:     models.ApprovalStatusApproved,
+			ApprovedBy: autoApprover,
+			ApprovedAt: &now,
+			Notes:      notes,
+		}
+		if err := task.TransitionTo(models.TaskStatusApproved, fmt.Sprintf("Auto-approved by rule %s", m.Rule.Name)); err != nil {
+			return err
+		}
+		task.AddLog(fmt.Sprintf("[INFO] Task auto-approved: %s", notes))
+
+	case rules.ActionReject:
+		task.Approval = &models.Approval{
+			Status:     models.ApprovalStatusRejected,
+			RejectedBy: autoApprover,
+			RejectedAt: &now,
+			Reason:     fmt.Sprintf("Rejected by rule %s", m.Rule.Name),
+			Notes:      notes,
+		}
+		if err := task.TransitionTo(models.TaskStatusFailed, fmt.Sprintf("Auto-rejected by rule %s", m.Rule.Name)); err != nil {
+			return err
+		}
+		task.AddLog(fmt.Sprintf("[ERROR] Task auto-rejected: %s", notes))
+
+	case rules.ActionHold:
+		task.Approval = &models.Approval{
+			Status: models.ApprovalStatusPending,
+			Notes:  notes,
+		}
+		if err := task.TransitionTo(models.TaskStatusPendingApproval, fmt.Sprintf("Held for manual approval by rule %s", m.Rule.Name)); err != nil {
+			return err
+		}
+		task.AddLog(fmt.Sprintf("[WARN] Task held for manual approval: %s", notes))
+
+	default:
+		return fmt.Errorf("rule %s has unknown action %q", m.Rule.Name, m.Rule.Action)
+	}
+	return nil
+}
+
+// canManageRules allows changing the rules to principals that may approve
+// tasks in every IDC, since the rules apply to all of them
+func canManageRules(c *gin.Context) bool {
+	p := auth.PrincipalFrom(c)
+	if p == nil || !p.Can(auth.PermissionApprove, "") || len(p.IDCs) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "managing approval rules needs the approve permission for every IDC"})
+		return false
+	}
+	return true
+}
+
+// getApprovalRules returns the current auto-approval rules
+func (cp *ControlPlane) getApprovalRules(c *gin.Context) {
+	var set rules.Set
+	if err := cp.etcdClient.GetJSON(etcd.ApprovalRulesKey(), &set); err != nil && !etcd.IsKeyNotFound(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if set.Rules == nil {
+		set.Rules = []rules.Rule{}
+	}
+	c.JSON(http.StatusOK, set)
+}
+
+// updateApprovalRules validates and stores a new version of the rules
+func (cp *ControlPlane) updateApprovalRules(c *gin.Context) {
+	if !canManageRules(c) {
+		return
+	}
+	var req updateRulesRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	set := rules.Set{Enabled: req.Enabled, Rules: req.Rules, Comment: req.Comment, UpdatedBy: auth.Actor(c)}
+	if _, err := rules.New(set); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cp.saveApprovalRules(c, set, req.ExpectedVersion)
+}
+
+// rollbackApprovalRules stores an earlier version again as the newest one
+func (cp *ControlPlane) rollbackApprovalRules(c *gin.Context) {
+	if !canManageRules(c) {
+		return
+	}
+	var req struct {
+		Version int    `json:"version" binding:"required"`
+		Comment string `json:"comment"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var old rules.Set
+	if err := cp.etcdClient.GetJSON(etcd.ApprovalRulesVersionKey(req.Version), &old); err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	comment := req.Comment
+	if comment == "" {
+		comment = fmt.Sprintf("rollback to v%d", req.Version)
+	}
+	set := rules.Set{Enabled: old.Enabled, Rules: old.Rules, Comment: comment, UpdatedBy: auth.Actor(c)}
+	cp.saveApprovalRules(c, set, 0)
+}
+
+func (cp *ControlPlane) saveApprovalRules(c *gin.Context, set rules.Set, expectedVersion int) {
+	saved, err := cp.storeApprovalRules(set, expectedVersion)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errRulesChanged) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("Approval rules v%d saved by %s (%d rules, enabled=%v)", saved.Version, saved.UpdatedBy, len(saved.Rules), saved.Enabled)
+	cp.recordAction(c, audit.Record{Action: audit.ActionApprovalRulesSave,
+		Detail: fmt.Sprintf("v%d: %d rules, enabled=%v: %s", saved.Version, len(saved.Rules), saved.Enabled, saved.Comment)})
+	c.JSON(http.StatusOK, saved)
+}
+
+// listApprovalRuleVersions lists every version of the rules, newest first
+func (cp *ControlPlane) listApprovalRuleVersions(c *gin.Context) {
+	values, err := cp.etcdClient.GetWithPrefix(etcd.KeyPrefixApprovalRules + "versions/")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	versions := make([]rules.Set, 0, len(values))
+	for _, value := range values {
+		var set rules.Set
+		if json.Unmarshal(value, &set) == nil {
+			versions = append(versions, set)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+
+	c.JSON(http.StatusOK, gin.H{"versions": versions, "count": len(versions)})
+}
+
+// getApprovalRuleVersion returns one version of the rules
+func (cp *ControlPlane) getApprovalRuleVersion(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "version must be a positive number"})
+		return
+	}
+
+	var set rules.Set
+	if err := cp.etcdClient.GetJSON(etcd.ApprovalRulesVersionKey(version), &set); err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, set)
+}
+
+// testApprovalRules evaluates a hardware report and task against the current
+// rules, or against the rules in the request, without changing anything
+func (cp *ControlPlane) testApprovalRules(c *gin.Context) {
+	var req struct {
+		Hardware json.RawMessage `json:"hardware" binding:"required"`
+		Task     json.RawMessage `json:"task"`
+		Rules    []rules.Rule    `json:"rules"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var engine *rules.Engine
+	var err error
+	if req.Rules != nil {
+		engine, err = rules.New(rules.Set{Enabled: true, Rules: req.Rules})
+	} else {
+		engine, err = cp.currentApprovalRules()
+		if err == nil {
+			set := engine.Set()
+			set.Enabled = true // show what the rules would do even while disabled
+			engine, err = rules.New(set)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	match, err := engine.Evaluate(req.Hardware, req.Task)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if match == nil {
+		c.JSON(http.StatusOK, gin.H{"matched": false, "action": nil})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"matched": true, "rule": match.Rule, "action": match.Rule.Action, "notes": match.Notes()})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// recordAction appends an audit record of the request's principal acting.
+// The action already happened, so a failure is logged rather than returned.
+func (cp *ControlPlane) recordAction(c *gin.Context, r audit.Record) {
+	r.Actor = auth.Actor(c)
+	r.Method = "anonymous"
+	if p := auth.PrincipalFrom(c); p != nil {
+		r.Method = p.Method
+	}
+	r.SourceIP = c.ClientIP()
+	cp.appendAudit(r)
+}
+
+func (cp *ControlPlane) appendAudit(r audit.Record) {
+	if _, err := cp.audit.Append(r); err != nil {
+		log.Printf("[%s] Failed to record audit %s on %s by %s: %v", r.IDC, r.Action, r.SN, r.Actor, err)
+	}
+}
+
+// auditPruneInterval is how often records past the retention are removed
+const auditPruneInterval = time.Hour
+
+// pruneAudit removes the audit records older than the configured retention.
+// Control planes may prune at the same time; only one of them succeeds.
+func (cp *ControlPlane) pruneAudit() {
+	ticker := time.NewTicker(auditPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		retention := cp.cfg.ControlPlane.Audit.Retention
+		n, err := cp.audit.Prune(time.Now().Add(-retention))
+		switch {
+		case errors.Is(err, audit.ErrConflict):
+		case err != nil:
+			log.Printf("Failed to prune audit records: %v", err)
+		case n > 0:
+			log.Printf("Pruned %d audit records older than %s", n, retention)
+		}
+
+		select {
+		case <-cp.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// taskRecord describes a change of a task; before is nil for a new task
+func taskRecord(action string, before, after *models.TaskV3, detail string) audit.Record {
+	r := audit.Record{Action: action, Detail: detail, Changes: audit.Diff(before, after)}
+	for _, t := range []*models.TaskV3{before, after} {
+		if t != nil {
+			r.IDC, r.SN, r.TaskID = t.IDC, t.SN, t.TaskID
+		}
+	}
+	return r
+}
+
+// auditQuery reads the audit filters: actor, action, idc, sn, task_id,
+// since and until (RFC 3339) and cursor, the sequence number to continue
+// after. Records are limited to the IDCs the principal may see; records
+// not tied to an IDC need an unscoped principal.
+func auditQuery(c *gin.Context) (audit.Query, error) {
+	principal := auth.PrincipalFrom(c)
+	q := audit.Query{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		IDC:    c.Query("idc"),
+		SN:     c.Query("sn"),
+		TaskID: c.Query("task_id"),
+		Allow: func(r *audit.Record) bool {
+			if r.IDC == "" {
+				return len(principal.IDCs) == 0
+			}
+			return principal.CanAccessIDC(r.IDC)
+		},
+	}
+	for param, target := range map[string]*time.Time{
+		"since": &q.Since,
+		"until": &q.Until,
+	} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time: %v", param, err)
+			}
+			*target = t
+		}
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		seq, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor %q", cursor)
+		}
+		q.After = seq
+	}
+	return q, nil
+}
+
+// listAudit pages through the audit log, oldest first. limit is at most
+// maxListLimit; pass next_cursor back as cursor for the next page.
+func (cp *ControlPlane) listAudit(c *gin.Context) {
+	q, err := auditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.Limit = defaultListLimit
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxListLimit)})
+			return
+		}
+		q.Limit = n
+	}
+
+	records, more, err := cp.audit.List(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	next := ""
+	if more {
+		next = strconv.FormatUint(records[len(records)-1].Seq, 10)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"records":     records,
+		"count":       len(records),
+		"next_cursor": next,
+	})
+}
+
+// exportAudit streams the matching audit records as JSON lines
+func (cp *ControlPlane) exportAudit(c *gin.Context) {
+	q, err := auditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="lpmos-audit-%s.jsonl"`, time.Now().UTC().Format("20060102T150405Z")))
+	c.Status(http.StatusOK)
+	if err := cp.audit.Export(c.Writer, q); err != nil {
+		// The download is cut short without an error line, so the log is
+		// where an operator finds out why the file ends early
+		log.Printf("Audit export for %s failed: %v", auth.Actor(c), err)
+	}
+}
+
+// verifyAudit checks the hash chain of the whole audit log
+func (cp *ControlPlane) verifyAudit(c *gin.Context) {
+	checked, err := cp.audit.Verify()
+	var chainErr *audit.ChainError
+	switch {
+	case errors.As(err, &chainErr):
+		c.JSON(http.StatusOK, gin.H{"valid": false, "checked": checked, "broken_at": chainErr.Seq, "error": chainErr.Reason})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"valid": true, "checked": checked})
+	}
+}
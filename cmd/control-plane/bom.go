@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/bom"
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// canManageBOM allows changing BOM profiles to principals that may write in
+// every IDC, since any task may use a profile
+func canManageBOM(c *gin.Context) bool {
+	p := auth.PrincipalFrom(c)
+	if p == nil || !p.Can(auth.PermissionWrite, "") || len(p.IDCs) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "managing BOM profiles needs the write permission for every IDC"})
+		return false
+	}
+	return true
+}
+
+// listBOMProfiles returns every BOM profile
+func (cp *ControlPlane) listBOMProfiles(c *gin.Context) {
+	profiles, err := bom.List(cp.etcdClient)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"profiles": profiles, "count": len(profiles)})
+}
+
+// getBOMProfile returns one BOM profile
+func (cp *ControlPlane) getBOMProfile(c *gin.Context) {
+	p, err := bom.Load(cp.etcdClient, c.Param("name"))
+	if err != nil {
+		c.JSON(bomErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// saveBOMProfile creates or replaces a BOM profile. Tasks already checked
+// keep their result; the next hardware report uses the new profile.
+func (cp *ControlPlane) saveBOMProfile(c *gin.Context) {
+	if !canManageBOM(c) {
+		return
+	}
+	var p models.BOMProfile
+	if err := c.BindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.Name = c.Param("name")
+	if err := bom.Validate(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.UpdatedAt = time.Now()
+	p.UpdatedBy = auth.Actor(c)
+
+	var before *models.BOMProfile
+	if prev, err := bom.Load(cp.etcdClient, p.Name); err == nil {
+		before = prev
+	}
+	if err := cp.etcdClient.Put(etcd.BOMProfileKey(p.Name), p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("BOM profile %s saved by %s", p.Name, p.UpdatedBy)
+	r := audit.Record{Action: audit.ActionBOMProfileSave, Detail: "BOM profile " + p.Name}
+	if before != nil {
+		r.Changes = audit.Diff(before, &p)
+	} else {
+		r.Changes = audit.Diff(nil, &p)
+	}
+	cp.recordAction(c, r)
+	c.JSON(http.StatusOK, p)
+}
+
+// deleteBOMProfile removes a BOM profile. Tasks naming it fail their next
+// check until they are given another one.
+func (cp *ControlPlane) deleteBOMProfile(c *gin.Context) {
+	if !canManageBOM(c) {
+		return
+	}
+	name := c.Param("name")
+	if _, err := bom.Load(cp.etcdClient, name); err != nil {
+		c.JSON(bomErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if err := cp.etcdClient.Delete(etcd.BOMProfileKey(name)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("BOM profile %s deleted by %s", name, auth.Actor(c))
+	cp.recordAction(c, audit.Record{Action: audit.ActionBOMProfileDelete, Detail: "BOM profile " + name})
+	c.JSON(http.StatusOK, gin.H{"message": "BOM profile deleted"})
+}
+
+// testBOMProfile checks a hardware report against a profile without
+// touching any task
+func (cp *ControlPlane) testBOMProfile(c *gin.Context) {
+	var req struct {
+		Hardware *models.HardwareInfo `json:"hardware" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := bom.Load(cp.etcdClient, c.Param("name"))
+	if err != nil {
+		c.JSON(bomErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, bom.Check(p, req.Hardware, time.Now()))
+}
+
+// checkBOMProfile makes sure a profile named by a new task exists
+func (cp *ControlPlane) checkBOMProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	_, err := bom.Load(cp.etcdClient, name)
+	return err
+}
+
+// bomErrorStatus maps a bom.Load error to an HTTP status code
+func bomErrorStatus(err error) int {
+	if errors.Is(err, bom.ErrUnknownProfile) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// waiveBOMCheck records that an approver accepted hardware failing its BOM
+// check. It refuses when there is nothing to accept, so the flag is never
+// set by accident.
+func waiveBOMCheck(task *models.TaskV3, actor string) error {
+	if !task.BOMCheck.Blocking() {
+		return &models.TransitionError{From: task.Status, To: models.TaskStatusApproved, Reason: "no failed BOM check to accept"}
+	}
+	now := time.Now()
+	task.BOMCheck.WaivedBy = actor
+	task.BOMCheck.WaivedAt = &now
+	task.AddLog(fmt.Sprintf("[WARN] BOM mismatch against %s accepted by %s", task.BOMCheck.Profile, actor))
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/bulk"
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/ipam"
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/taskindex"
+)
+
+// bulkTxnRows bounds the rows per etcd transaction. A row takes up to
+// seventeen operations (task, server entry, archive, the task indexes, the
+// first log entry and the address claim) and etcd rejects transactions with
+// more than 128 by default.
+const bulkTxnRows = 7
+
+// bulkRow is the import plan for one row
+type bulkRow struct {
+	Row            int    `json:"row"`
+	IDC            string `json:"idc"`
+	SN             string `json:"sn"`
+	TaskID         string `json:"task_id"`
+	Action         string `json:"action"` // create, replace
+	ReplacesTaskID string `json:"replaces_task_id,omitempty"`
+	IP             string `json:"ip,omitempty"`
+	Hostname       string `json:"hostname,omitempty"`
+
+	req        models.CreateTaskRequestV3
+	task       models.TaskV3
+	version    int64  // task key version seen while planning, 0 if absent
+	committed  int64  // revision the row was written at
+	prevTask   []byte // replaced task, restored on rollback
+	prevServer []byte // replaced servers entry, restored on rollback
+	claim      *ipam.Claim
+}
+
+// bulkCreateTasks imports a batch of tasks from CSV or JSON. Every row is
+// validated before anything is written; with dry_run=true the plan is
+// returned without writing. The import is not atomic: rows are committed in
+// conditional transactions of bulkTxnRows, and when a later one fails the
+// earlier ones are rolled back, except rows changed in the meantime, which
+// the response lists. Watchers see the rolled-back tasks come and go.
+func (cp *ControlPlane) bulkCreateTasks(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+
+	rows, err := bulk.Parse(c.ContentType(), c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rowErrs := bulk.Validate(rows)
+	invalid := make(map[int]bool, len(rowErrs))
+	for _, e := range rowErrs {
+		invalid[e.Row] = true
+	}
+
+	principal := auth.PrincipalFrom(c)
+	actor := auth.Actor(c)
+
+	plan := make([]*bulkRow, 0, len(rows))
+	regionErrs := map[string]error{} // checked once per IDC
+	allocators := map[string]*ipam.Allocator{}
+	for i, req := range rows {
+		rowNum := i + 1
+		if invalid[rowNum] {
+			continue
+		}
+		if !principal.Can(auth.PermissionWrite, req.IDC) {
+			rowErrs = append(rowErrs, bulk.RowError{Row: rowNum, SN: req.SN, Field: "idc",
+				Error: fmt.Sprintf("%s may not create tasks in IDC %s", actor, req.IDC)})
+			continue
+		}
+		regionErr, checked := regionErrs[req.IDC]
+		if !checked {
+			regionErr = cp.checkRegion(req.IDC)
+			regionErrs[req.IDC] = regionErr
+		}
+		if regionErr != nil {
+			rowErrs = append(rowErrs, bulk.RowError{Row: rowNum, SN: req.SN, Field: "idc", Error: regionErr.Error()})
+			continue
+		}
+
+		allocator, loaded := allocators[req.IDC]
+		if !loaded {
+			if allocator, err = ipam.Load(cp.etcdClient, req.IDC); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			allocators[req.IDC] = allocator
+		}
+
+		row, err := cp.planBulkRow(rowNum, req, actor, allocator)
+		if err != nil {
+			rowErrs = append(rowErrs, bulk.RowError{Row: rowNum, SN: req.SN, Error: err.Error()})
+			continue
+		}
+		plan = append(plan, row)
+	}
+
+	if len(rowErrs) > 0 {
+		sort.SliceStable(rowErrs, func(i, j int) bool { return rowErrs[i].Row < rowErrs[j].Row })
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"dry_run": dryRun,
+			"total":   len(rows),
+			"valid":   len(plan),
+			"errors":  rowErrs,
+		})
+		return
+	}
+
+	if dryRun {
+		c.JSON(http.StatusOK, gin.H{
+			"dry_run": true,
+			"total":   len(rows),
+			"valid":   len(plan),
+			"tasks":   plan,
+		})
+		return
+	}
+
+	if kept, err := cp.commitBulk(plan); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, etcd.ErrTxnConflict) {
+			status = http.StatusConflict
+			err = errors.New("machines changed while importing; please retry")
+		}
+		resp := gin.H{"error": err.Error()}
+		if len(kept) > 0 {
+			resp["error"] = fmt.Sprintf("%v; %d rows changed after they were written and were not rolled back", err, len(kept))
+			resp["not_rolled_back"] = kept
+		}
+		c.JSON(status, resp)
+		return
+	}
+
+	log.Printf("Bulk import: created %d tasks (by %s)", len(plan), actor)
+	for _, row := range plan {
+		var replaced *models.TaskV3
+		if row.prevTask != nil {
+			replaced = &models.TaskV3{}
+			if json.Unmarshal(row.prevTask, replaced) != nil {
+				replaced = nil
+			}
+		}
+		cp.recordAction(c, taskRecord(audit.ActionTaskCreate, replaced, &row.task, fmt.Sprintf("bulk import row %d", row.Row)))
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"dry_run": false,
+		"total":   len(rows),
+		"created": len(plan),
+		"tasks":   plan,
+	})
+}
+
+// planBulkRow builds the task for a row and checks it against etcd: a
+// machine whose current task is still running cannot be re-imported. The
+// row's address is claimed from allocator, shared by the rows of its IDC.
+func (cp *ControlPlane) planBulkRow(rowNum int, req models.CreateTaskRequestV3, actor string, allocator *ipam.Allocator) (*bulkRow, error) {
+	row := &bulkRow{
+		Row:    rowNum,
+		IDC:    req.IDC,
+		SN:     req.SN,
+		Action: "create",
+		req:    req,
+		task:   newTask(req, actor),
+	}
+	row.TaskID = row.task.TaskID
+	if err := cp.checkMachineInstallable(req.IDC, req.SN); err != nil {
+		return nil, err
+	}
+	if err := cp.checkBOMProfile(req.BOMProfile); err != nil {
+		return nil, err
+	}
+
+	data, version, err := cp.etcdClient.GetWithVersion(etcd.TaskKeyV3(req.IDC, req.SN))
+	switch {
+	case etcd.IsKeyNotFound(err):
+	case err != nil:
+		return nil, err
+	default:
+		var prev models.TaskV3
+		if err := json.Unmarshal(data, &prev); err != nil {
+			return nil, fmt.Errorf("existing task is unreadable: %v", err)
+		}
+		if !models.IsFinished(prev.Status) {
+			return nil, fmt.Errorf("task %s is still %s, cancel it first", prev.TaskID, prev.Status)
+		}
+		if prev.Attempt == 0 {
+			prev.Attempt = 1
+		}
+		row.Action = "replace"
+		row.ReplacesTaskID = prev.TaskID
+		row.version = version
+		row.prevTask = data
+		row.task.Attempt = prev.Attempt + 1
+		row.task.PreviousTaskID = prev.TaskID
+	}
+
+	claim, err := cp.claimAddress(allocator, &row.task, req.IPPool)
+	if err != nil {
+		return nil, err
+	}
+	row.claim = claim
+	row.IP, row.Hostname = row.task.IP, row.task.Hostname
+
+	if server, err := cp.etcdClient.Get(etcd.ServerKey(req.IDC, req.SN)); err == nil {
+		row.prevServer = server
+	}
+	return row, nil
+}
+
+// commitBulk writes the plan in chunks of bulkTxnRows. Each chunk only
+// commits if no task key changed since planning; when a chunk fails the
+// chunks already written are rolled back and the rows that could not be
+// are returned with the error.
+func (cp *ControlPlane) commitBulk(plan []*bulkRow) ([]*bulkRow, error) {
+	for start := 0; start < len(plan); start += bulkTxnRows {
+		end := start + bulkTxnRows
+		if end > len(plan) {
+			end = len(plan)
+		}
+
+		if err := cp.commitBulkChunk(plan[start:end]); err != nil {
+			return cp.rollbackBulk(plan[:start]), err
+		}
+	}
+	return nil, nil
+}
+
+func (cp *ControlPlane) commitBulkChunk(rows []*bulkRow) error {
+	var cmps []clientv3.Cmp
+	var ops []clientv3.Op
+
+	for _, row := range rows {
+		taskKey := etcd.TaskKeyV3(row.IDC, row.SN)
+		cmps = append(cmps, clientv3.Compare(clientv3.Version(taskKey), "=", row.version))
+
+		taskData, err := json.Marshal(row.task)
+		if err != nil {
+			return err
+		}
+		serverOp, err := etcd.OpPut(etcd.ServerKey(row.IDC, row.SN), newServerEntry(row.req))
+		if err != nil {
+			return err
+		}
+		ops = append(ops, clientv3.OpPut(taskKey, string(taskData)), serverOp)
+		ops = append(ops, cp.etcdClient.IndexOps(taskKey, row.prevTask, taskData)...)
+
+		if row.prevTask != nil {
+			var prev models.TaskV3
+			if err := json.Unmarshal(row.prevTask, &prev); err != nil {
+				return err
+			}
+			if prev.Attempt == 0 {
+				prev.Attempt = 1
+			}
+			archiveOp, err := etcd.OpPut(etcd.AttemptKey(row.IDC, row.SN, prev.TaskID),
+				prev.Archive(fmt.Sprintf("Superseded by %s (bulk import)", row.TaskID)))
+			if err != nil {
+				return err
+			}
+			ops = append(ops, archiveOp)
+		}
+		if row.claim != nil {
+			ops = append(ops, row.claim.Ops...)
+			cmps = append(cmps, row.claim.Conditions...)
+		}
+	}
+
+	rev, err := cp.etcdClient.TransactionRevision(ops, cmps...)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		row.committed = rev
+	}
+	return nil
+}
+
+// rollbackBulk restores the keys written by committed rows, one row per
+// transaction. A row whose task was written again since, by an approval
+// or an agent report for example, is left alone rather than clobbered;
+// those rows are returned and logged so an operator can clean up by hand.
+func (cp *ControlPlane) rollbackBulk(rows []*bulkRow) []*bulkRow {
+	var kept []*bulkRow
+	for _, row := range rows {
+		taskKey := etcd.TaskKeyV3(row.IDC, row.SN)
+		serverKey := etcd.ServerKey(row.IDC, row.SN)
+
+		// Restore the indexes and drop the log entries of the new attempt;
+		// those of the replaced attempt were never touched
+		var ops []clientv3.Op
+		if taskData, err := json.Marshal(row.task); err == nil {
+			ops = append(ops, taskindex.Ops(taskKey, taskData, row.prevTask)...)
+		}
+		ops = append(ops, clientv3.OpDelete(etcd.TaskLogPrefix(row.IDC, row.SN, row.TaskID), clientv3.WithPrefix()))
+		if row.prevTask != nil {
+			ops = append(ops,
+				clientv3.OpPut(taskKey, string(row.prevTask)),
+				clientv3.OpDelete(etcd.AttemptKey(row.IDC, row.SN, row.ReplacesTaskID)))
+		} else {
+			ops = append(ops, clientv3.OpDelete(taskKey))
+		}
+		if row.prevServer != nil {
+			ops = append(ops, clientv3.OpPut(serverKey, string(row.prevServer)))
+		} else {
+			ops = append(ops, clientv3.OpDelete(serverKey))
+		}
+		if row.claim != nil {
+			ops = append(ops, row.claim.Undo...)
+		}
+
+		err := cp.etcdClient.Transaction(ops, clientv3.Compare(clientv3.ModRevision(taskKey), "=", row.committed))
+		if errors.Is(err, etcd.ErrTxnConflict) {
+			err = errors.New("task changed since it was written")
+		}
+		if err != nil {
+			log.Printf("[%s] Bulk import rollback failed for %s (task %s): %v", row.IDC, row.SN, row.TaskID, err)
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/stats"
+	"github.com/lpmos/lpmos-go/pkg/taskindex"
+	"github.com/lpmos/lpmos-go/pkg/webhook"
+	"github.com/lpmos/lpmos-go/pkg/websocket"
+)
+
+// snapshotLimit caps the tasks sent when a WebSocket client subscribes
+const snapshotLimit = 1000
+
+// taskSnapshot loads the tasks matching a WebSocket subscription, newest
+// first, all read at one etcd revision so the hub can skip the events the
+// snapshot already reflects
+func (cp *ControlPlane) taskSnapshot(f websocket.Filter, principal *auth.Principal) (*websocket.Snapshot, error) {
+	rev, err := cp.etcdClient.Revision()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	snapshot := &websocket.Snapshot{Revision: rev, Tasks: []models.TaskV3{}}
+	if len(f.IDCs) > 0 && len(f.SNs) > 0 {
+		// Specific machines are read directly
+		for _, idc := range f.IDCs {
+			for _, sn := range f.SNs {
+				keys = append(keys, etcd.TaskKeyV3(idc, sn))
+			}
+		}
+	} else {
+		q := taskindex.Query{Revision: rev, Allow: principal.CanAccessIDC}
+		if len(f.IDCs) == 1 {
+			q.IDC = f.IDCs[0]
+		}
+		for _, s := range f.Statuses {
+			q.Statuses = append(q.Statuses, models.TaskStatus(s))
+		}
+		err = taskindex.Each(cp.etcdClient, q, func(_ string, e taskindex.Entry) bool {
+			if !f.Match(&websocket.Event{IDC: e.IDC, SN: e.SN, Status: string(e.Status)}) {
+				return true
+			}
+			if len(keys) == snapshotLimit {
+				snapshot.Truncated = true
+				return false
+			}
+			keys = append(keys, etcd.TaskKeyV3(e.IDC, e.SN))
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	values, err := cp.etcdClient.GetManyAt(rev, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		idc, _, _ := taskindex.ParseTaskKey(key)
+		var task models.TaskV3
+		value, ok := values[key]
+		if !ok || json.Unmarshal(value, &task) != nil {
+			continue
+		}
+		task.IDC = idc
+		if principal.CanAccessIDC(idc) && f.Match(&websocket.Event{IDC: idc, SN: task.SN, Status: string(task.Status)}) {
+			snapshot.Tasks = append(snapshot.Tasks, task)
+		}
+	}
+	return snapshot, nil
+}
+
+// publishTaskWrite sends a task write to WebSocket clients: the status to v1
+// clients and what changed since prevValue as v2 events. Lifecycle changes
+// also go to webhook subscribers and failures to email. A nil value is a deleted task.
+func (cp *ControlPlane) publishTaskWrite(idc, sn string, prevValue, value []byte, rev int64) {
+	var prev, next *models.TaskV3
+	if prevValue != nil {
+		prev = &models.TaskV3{}
+		if json.Unmarshal(prevValue, prev) != nil {
+			prev = nil
+		}
+	}
+	if value != nil {
+		next = &models.TaskV3{}
+		if json.Unmarshal(value, next) != nil {
+			return
+		}
+		cp.wsHub.BroadcastStatus(idc, sn, next.TaskID, next.Status)
+		stats.ObserveTaskWrite(idc, prev, next)
+	}
+
+	events := websocket.TaskEvents(idc, sn, prev, next, rev)
+	for i := range events {
+		cp.wsHub.Publish(&events[i], nil)
+	}
+	for _, e := range webhook.TaskEvents(idc, sn, prev, next, time.Now()) {
+		cp.webhooks.Notify(e)
+		cp.emailTaskEvent(&e)
+	}
+}
+
+// publishHardware sends a hardware report stored under the meta key of a
+// machine to WebSocket clients
+func (cp *ControlPlane) publishHardware(idc, sn string, value []byte) {
+	var hardware models.HardwareInfo
+	if err := json.Unmarshal(value, &hardware); err != nil {
+		return
+	}
+	cp.wsHub.Publish(
+		&websocket.Event{Type: websocket.EventHardware, IDC: idc, SN: sn, Payload: json.RawMessage(value)},
+		&models.WebSocketMessage{Type: "hardware", IDC: idc, SN: sn, Hardware: &hardware},
+	)
+}
+
+// publishDrift announces a new hardware version of a machine when its parts
+// changed, to WebSocket clients and webhook subscribers
+func (cp *ControlPlane) publishDrift(idc, sn string, value []byte) {
+	var record models.HardwareRecord
+	if err := json.Unmarshal(value, &record); err != nil || record.Drift.Empty() {
+		return
+	}
+	cp.wsHub.Publish(&websocket.Event{Type: websocket.EventDrift, IDC: idc, SN: sn, TaskID: record.TaskID, Payload: record}, nil)
+	cp.webhooks.Notify(webhook.DriftEvent(idc, sn, &record, time.Now()))
+}
+
+// parseHardwareRecordKey splits /os/{idc}/machines/{sn}/hardware/{ts}; ok
+// is false for any other key
+func parseHardwareRecordKey(key string) (idc, sn string, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 7 || parts[0] != "" || parts[1] != "os" || parts[3] != "machines" || parts[5] != "hardware" {
+		return "", "", false
+	}
+	return parts[2], parts[4], true
+}
+
+// parseMetaKey splits /os/{idc}/machines/{sn}/meta; ok is false for any
+// other key
+func parseMetaKey(key string) (idc, sn string, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "os" || parts[3] != "machines" || parts[5] != "meta" {
+		return "", "", false
+	}
+	return parts[2], parts[4], true
+}
+
+// websocketStats reports the WebSocket hub's clients and queue counters;
+// a growing dropped count means dashboards cannot keep up
+func (cp *ControlPlane) websocketStats(c *gin.Context) {
+	c.JSON(http.StatusOK, cp.wsHub.Stats())
+}
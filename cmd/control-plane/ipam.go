@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/inventory"
+	"github.com/lpmos/lpmos-go/pkg/ipam"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// listIPPools returns the pools of an IDC with their usage
+func (cp *ControlPlane) listIPPools(c *gin.Context) {
+	a, ok := cp.loadAllocator(c)
+	if !ok {
+		return
+	}
+	pools := make([]*ipam.PoolUsage, 0)
+	for _, p := range a.Pools() {
+		u, err := a.Usage(p.Name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		pools = append(pools, u)
+	}
+	c.JSON(http.StatusOK, gin.H{"pools": pools, "count": len(pools)})
+}
+
+// getIPPool returns one pool with its usage and allocations
+func (cp *ControlPlane) getIPPool(c *gin.Context) {
+	a, ok := cp.loadAllocator(c)
+	if !ok {
+		return
+	}
+	u, err := a.Usage(c.Param("name"))
+	if err != nil {
+		c.JSON(poolErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pool": u, "allocations": a.Allocations(u.Name, "")})
+}
+
+// saveIPPool creates or replaces a pool. Addresses already allocated keep
+// their hostnames; a new template only names later machines.
+func (cp *ControlPlane) saveIPPool(c *gin.Context) {
+	idc := c.Param("idc")
+	if err := cp.checkRegion(idc); err != nil {
+		c.JSON(createErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	var p models.IPPool
+	if err := c.BindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.IDC = idc
+	p.Name = c.Param("name")
+	if err := ipam.Validate(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a, ok := cp.loadAllocator(c)
+	if !ok {
+		return
+	}
+	if err := a.CheckPool(&p); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	p.UpdatedAt = time.Now()
+	p.UpdatedBy = auth.Actor(c)
+
+	before, _ := a.Pool(p.Name)
+	if err := cp.etcdClient.Put(etcd.IPPoolKey(idc, p.Name), p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[%s] IP pool %s (%s) saved by %s", idc, p.Name, p.CIDR, p.UpdatedBy)
+	r := audit.Record{Action: audit.ActionIPPoolSave, IDC: idc, Detail: "IP pool " + p.Name}
+	if before != nil {
+		r.Changes = audit.Diff(before, &p)
+	} else {
+		r.Changes = audit.Diff(nil, &p)
+	}
+	cp.recordAction(c, r)
+	c.JSON(http.StatusOK, p)
+}
+
+// deleteIPPool removes a pool that has no allocations left
+func (cp *ControlPlane) deleteIPPool(c *gin.Context) {
+	a, ok := cp.loadAllocator(c)
+	if !ok {
+		return
+	}
+	idc, name := c.Param("idc"), c.Param("name")
+	if _, err := a.Pool(name); err != nil {
+		c.JSON(poolErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if allocs := a.Allocations(name, ""); len(allocs) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("pool %s still has %d allocated addresses", name, len(allocs))})
+		return
+	}
+	if err := cp.etcdClient.Delete(etcd.IPPoolKey(idc, name)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[%s] IP pool %s deleted by %s", idc, name, auth.Actor(c))
+	cp.recordAction(c, audit.Record{Action: audit.ActionIPPoolDelete, IDC: idc, Detail: "IP pool " + name})
+	c.JSON(http.StatusOK, gin.H{"message": "IP pool deleted"})
+}
+
+// listIPAddresses returns the allocated and reserved addresses of an IDC,
+// optionally of one pool or machine
+func (cp *ControlPlane) listIPAddresses(c *gin.Context) {
+	a, ok := cp.loadAllocator(c)
+	if !ok {
+		return
+	}
+	allocs := a.Allocations(c.Query("pool"), c.Query("sn"))
+	if allocs == nil {
+		allocs = []models.IPAllocation{}
+	}
+	c.JSON(http.StatusOK, gin.H{"addresses": allocs, "count": len(allocs)})
+}
+
+// reserveIPAddress reserves an address, for a machine or kept out of
+// allocation when no SN is given. A machine's reservation is what its next
+// task installs with.
+func (cp *ControlPlane) reserveIPAddress(c *gin.Context) {
+	var req models.IPReservationRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.IP == "" && req.SN == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ip or sn is required"})
+		return
+	}
+	a, ok := cp.loadAllocator(c)
+	if !ok {
+		return
+	}
+	idc := c.Param("idc")
+	if !a.Active() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("IDC %s has no IP pools", idc)})
+		return
+	}
+
+	r := ipam.Request{SN: req.SN, MAC: req.MAC, Pool: req.Pool, IP: req.IP, Hostname: req.Hostname,
+		Reserve: true, Note: req.Note, Actor: auth.Actor(c)}
+	var running *models.TaskV3
+	if req.SN != "" {
+		r.Rack = cp.machineRack(idc, req.SN)
+		var task models.TaskV3
+		if err := cp.etcdClient.GetJSON(etcd.TaskKeyV3(idc, req.SN), &task); err == nil && !models.IsFinished(task.Status) {
+			running = &task
+		}
+	}
+	claim, err := a.Assign(r)
+	if err != nil {
+		status, _ := ipamErrorStatus(err)
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if running != nil && running.IP != "" && running.IP != claim.Allocation.IP {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("task %s of %s is installing with %s, wait for it to finish", running.TaskID, req.SN, running.IP)})
+		return
+	}
+	if err := ipam.Commit(cp.etcdClient, claim); err != nil {
+		c.JSON(createErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	alloc := claim.Allocation
+	log.Printf("[%s] Reserved %s for %q by %s", idc, alloc.IP, alloc.SN, r.Actor)
+	cp.recordAction(c, audit.Record{Action: audit.ActionIPReserve, IDC: idc, SN: alloc.SN,
+		Detail: fmt.Sprintf("%s %s", alloc.IP, alloc.Hostname), Changes: audit.Diff(nil, &alloc)})
+	c.JSON(http.StatusCreated, alloc)
+}
+
+// releaseIPAddress frees an allocated or reserved address. The address of
+// a task still installing cannot be released.
+func (cp *ControlPlane) releaseIPAddress(c *gin.Context) {
+	a, ok := cp.loadAllocator(c)
+	if !ok {
+		return
+	}
+	idc, ip := c.Param("idc"), c.Param("ip")
+	alloc := a.Allocation(ip)
+	if alloc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s is not allocated", ip)})
+		return
+	}
+	if alloc.SN != "" {
+		var task models.TaskV3
+		if err := cp.etcdClient.GetJSON(etcd.TaskKeyV3(idc, alloc.SN), &task); err == nil &&
+			!models.IsFinished(task.Status) && task.IP == ip {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("task %s of %s is installing with %s", task.TaskID, alloc.SN, ip)})
+			return
+		}
+	}
+	released, err := ipam.Free(cp.etcdClient, idc, ip)
+	if err != nil {
+		c.JSON(createErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[%s] Released %s of %q by %s", idc, ip, released.SN, auth.Actor(c))
+	cp.recordAction(c, audit.Record{Action: audit.ActionIPRelease, IDC: idc, SN: released.SN,
+		Detail: fmt.Sprintf("%s %s", released.IP, released.Hostname), Changes: audit.Diff(released, nil)})
+	c.JSON(http.StatusOK, gin.H{"message": "address released"})
+}
+
+// listIPConflicts returns the addresses IPAM and the regional client's
+// DHCP server could both hand out
+func (cp *ControlPlane) listIPConflicts(c *gin.Context) {
+	a, ok := cp.loadAllocator(c)
+	if !ok {
+		return
+	}
+	conflicts := a.Conflicts()
+	if conflicts == nil {
+		conflicts = []ipam.Conflict{}
+	}
+	c.JSON(http.StatusOK, gin.H{"conflicts": conflicts, "count": len(conflicts)})
+}
+
+// loadAllocator reads the IPAM state of the request's IDC
+func (cp *ControlPlane) loadAllocator(c *gin.Context) (*ipam.Allocator, bool) {
+	a, err := ipam.Load(cp.etcdClient, c.Param("idc"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return a, true
+}
+
+// claimAddress gives a new task its install address and hostname from the
+// IDC's pools, keeping the ones the request names. In an IDC without pools
+// the task is left as requested.
+func (cp *ControlPlane) claimAddress(a *ipam.Allocator, task *models.TaskV3, pool string) (*ipam.Claim, error) {
+	if !a.Active() {
+		if pool != "" {
+			return nil, fmt.Errorf("%w %q: IDC %s has no IP pools", ipam.ErrUnknownPool, pool, task.IDC)
+		}
+		return nil, nil
+	}
+	claim, err := a.Assign(ipam.Request{
+		SN:       task.SN,
+		MAC:      task.MAC,
+		TaskID:   task.TaskID,
+		Pool:     pool,
+		IP:       task.IP,
+		Hostname: task.Hostname,
+		Rack:     cp.machineRack(task.IDC, task.SN),
+		Actor:    task.CreatedBy,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	alloc := claim.Allocation
+	task.IP, task.Hostname = alloc.IP, alloc.Hostname
+	source := "pool " + alloc.Pool
+	if alloc.Pool == "" {
+		source = "outside every pool"
+	}
+	task.AddLog(fmt.Sprintf("[INFO] IPAM: install address %s, hostname %q (%s)", alloc.IP, alloc.Hostname, source))
+	return claim, nil
+}
+
+// releaseAddress gives up the address of a machine whose task was deleted
+func (cp *ControlPlane) releaseAddress(idc, sn string) {
+	alloc, err := ipam.Release(cp.etcdClient, idc, sn)
+	switch {
+	case errors.Is(err, etcd.ErrTxnConflict):
+		// A new task or an operator changed the address meanwhile
+	case err != nil:
+		log.Printf("[%s] Failed to release the address of %s: %v", idc, sn, err)
+	case alloc != nil:
+		log.Printf("[%s] Released %s (%s) of deleted task of %s", idc, alloc.IP, alloc.Hostname, sn)
+	}
+}
+
+// machineRack returns the inventory rack of a machine, for hostname
+// templates; empty when the machine is not in the inventory
+func (cp *ControlPlane) machineRack(idc, sn string) string {
+	if m, err := inventory.Get(cp.etcdClient, idc, sn); err == nil {
+		return m.Rack
+	}
+	return ""
+}
+
+// ipamErrorStatus maps an ipam.Allocator error to an HTTP status code
+func ipamErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, ipam.ErrUnknownPool), errors.Is(err, ipam.ErrNoPool), errors.Is(err, ipam.ErrInvalid):
+		return http.StatusBadRequest, true
+	case errors.Is(err, ipam.ErrConflict), errors.Is(err, ipam.ErrExhausted):
+		return http.StatusConflict, true
+	}
+	return http.StatusInternalServerError, false
+}
+
+// poolErrorStatus maps an unknown pool to 404 for the pool endpoints
+func poolErrorStatus(err error) int {
+	if errors.Is(err, ipam.ErrUnknownPool) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/inventory"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// listMachines lists the inventory, filtered by idc and a comma-separated
+// state list, a page of limit machines at a time
+func (cp *ControlPlane) listMachines(c *gin.Context) {
+	q, err := machineQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	machines, next, err := inventory.List(cp.etcdClient, q)
+	if errors.Is(err, inventory.ErrBadCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"machines": machines, "count": len(machines), "next_cursor": next})
+}
+
+// machineQuery reads the inventory filters: idc, state (comma-separated),
+// cursor and limit. Machines are limited to the IDCs the principal may see.
+func machineQuery(c *gin.Context) (inventory.Query, error) {
+	principal := auth.PrincipalFrom(c)
+	q := inventory.Query{
+		IDC:    c.Query("idc"),
+		Cursor: c.Query("cursor"),
+		Allow:  principal.CanAccessIDC,
+	}
+	if s := c.Query("state"); s != "" {
+		for _, state := range strings.Split(s, ",") {
+			if !models.ValidMachineState(models.MachineState(state)) {
+				return q, fmt.Errorf("unknown machine state %q", state)
+			}
+			q.States = append(q.States, models.MachineState(state))
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > 1000 {
+			return q, errors.New("limit must be between 1 and 1000")
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+// getMachine returns one machine with its latest hardware
+func (cp *ControlPlane) getMachine(c *gin.Context) {
+	m, err := inventory.Get(cp.etcdClient, c.Param("idc"), c.Param("sn"))
+	if err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+// createMachine registers a machine, ready for installation unless another
+// state is given. Only tasks allocate machines.
+func (cp *ControlPlane) createMachine(c *gin.Context) {
+	var req models.MachineRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.IDC == "" || req.SN == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "idc and sn are required"})
+		return
+	}
+	if !auth.Authorize(c, auth.PermissionWrite, req.IDC) {
+		return
+	}
+	if err := cp.checkRegion(req.IDC); err != nil {
+		c.JSON(createErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if req.State == "" {
+		req.State = models.MachineStateReady
+	}
+	if !models.ValidMachineState(req.State) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown machine state %q", req.State)})
+		return
+	}
+	if req.State == models.MachineStateAllocated {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "machines are allocated by creating a task"})
+		return
+	}
+
+	actor := auth.Actor(c)
+	m := models.NewMachine(req.IDC, req.SN, req.State, actor, "Registered")
+	applyMachineRequest(m, &req)
+	if err := inventory.Create(cp.etcdClient, m); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, inventory.ErrExists) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[%s] Registered machine %s as %s (by %s)", m.IDC, m.SN, m.State, actor)
+	cp.recordAction(c, machineRecord(audit.ActionMachineCreate, nil, m, ""))
+	c.JSON(http.StatusCreated, m)
+}
+
+// updateMachine changes the descriptive fields given in the request
+func (cp *ControlPlane) updateMachine(c *gin.Context) {
+	idc, sn := c.Param("idc"), c.Param("sn")
+	var req models.MachineRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var before models.Machine
+	m, err := inventory.Update(cp.etcdClient, idc, sn, func(m *models.Machine) ([]clientv3.Op, error) {
+		before = *m
+		applyMachineRequest(m, &req)
+		return nil, nil
+	})
+	if err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	cp.recordAction(c, machineRecord(audit.ActionMachineUpdate, &before, m, ""))
+	c.JSON(http.StatusOK, m)
+}
+
+// setMachineState moves a machine through its lifecycle, e.g. to broken for
+// repair or retired when decommissioned
+func (cp *ControlPlane) setMachineState(c *gin.Context) {
+	idc, sn := c.Param("idc"), c.Param("sn")
+	var req models.MachineStateRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !models.ValidMachineState(req.State) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown machine state %q", req.State)})
+		return
+	}
+	if req.State == models.MachineStateAllocated {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "machines are allocated by creating a task"})
+		return
+	}
+
+	actor := auth.Actor(c)
+	var before models.Machine
+	m, err := inventory.Update(cp.etcdClient, idc, sn, func(m *models.Machine) ([]clientv3.Op, error) {
+		before = *m
+		if m.State == req.State {
+			return nil, inventory.ErrUnchanged
+		}
+		if err := m.TransitionTo(req.State, req.Reason, actor); err != nil {
+			return nil, err
+		}
+		if req.State != models.MachineStateDeployed {
+			m.CurrentTaskID = ""
+		}
+		return nil, nil
+	})
+	if err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if before.State == m.State {
+		c.JSON(http.StatusOK, m)
+		return
+	}
+
+	log.Printf("[%s] Machine %s: %s -> %s by %s: %s", idc, sn, before.State, m.State, actor, req.Reason)
+	cp.recordAction(c, machineRecord(audit.ActionMachineState, &before, m, req.Reason))
+	c.JSON(http.StatusOK, m)
+}
+
+// deleteMachine removes a machine and its hardware history. A machine an
+// installation task owns must be released first.
+func (cp *ControlPlane) deleteMachine(c *gin.Context) {
+	idc, sn := c.Param("idc"), c.Param("sn")
+	m, err := inventory.Get(cp.etcdClient, idc, sn)
+	if err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if m.State == models.MachineStateAllocated {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("machine %s is allocated to task %s", sn, m.CurrentTaskID)})
+		return
+	}
+	if err := inventory.Delete(cp.etcdClient, idc, sn); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[%s] Deleted machine %s by %s", idc, sn, auth.Actor(c))
+	cp.recordAction(c, machineRecord(audit.ActionMachineDelete, m, nil, ""))
+	c.JSON(http.StatusOK, gin.H{"message": "Machine deleted"})
+}
+
+// getMachineHardware returns every hardware version reported for a machine,
+// oldest first, each with its drift from the version before. drift=true
+// keeps only the versions whose parts changed.
+func (cp *ControlPlane) getMachineHardware(c *gin.Context) {
+	idc, sn := c.Param("idc"), c.Param("sn")
+	if _, err := inventory.Get(cp.etcdClient, idc, sn); err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	records, err := inventory.HardwareHistory(cp.etcdClient, idc, sn)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("drift") == "true" {
+		drifted := records[:0]
+		for _, r := range records {
+			if r.Drift != nil {
+				drifted = append(drifted, r)
+			}
+		}
+		records = drifted
+	}
+	c.JSON(http.StatusOK, gin.H{"idc": idc, "sn": sn, "history": records, "count": len(records)})
+}
+
+// applyMachineRequest copies the non-empty descriptive fields of req
+func applyMachineRequest(m *models.Machine, req *models.MachineRequest) {
+	if req.MAC != "" {
+		m.MAC = req.MAC
+	}
+	if req.Hostname != "" {
+		m.Hostname = req.Hostname
+	}
+	if req.Rack != "" {
+		m.Rack = req.Rack
+	}
+	if req.Tags != nil {
+		m.Tags = req.Tags
+	}
+	if req.Note != "" {
+		m.Note = req.Note
+	}
+}
+
+// machineRecord builds the audit record of a machine change
+func machineRecord(action string, before, after *models.Machine, detail string) audit.Record {
+	r := audit.Record{Action: action, Detail: detail}
+	// A nil *Machine must reach Diff as a nil interface
+	var b, a interface{}
+	for _, m := range []*models.Machine{before, after} {
+		if m != nil {
+			r.IDC, r.SN = m.IDC, m.SN
+		}
+	}
+	if before != nil {
+		b = before
+	}
+	if after != nil {
+		a = after
+	}
+	r.Changes = audit.Diff(b, a)
+	return r
+}
+
+// checkMachineInstallable refuses a new installation on a machine the
+// inventory marks broken or retired. Machines not in the inventory are
+// registered when their task is created.
+func (cp *ControlPlane) checkMachineInstallable(idc, sn string) error {
+	m, err := inventory.Get(cp.etcdClient, idc, sn)
+	if etcd.IsKeyNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !m.State.Installable() {
+		return &models.MachineTransitionError{SN: sn, From: m.State, To: models.MachineStateAllocated}
+	}
+	return nil
+}
+
+// syncMachine follows a task write with the inventory: a new attempt
+// allocates the machine, a completed one deploys it, and a cancelled or
+// deleted one releases it. A failed attempt keeps the machine allocated
+// until it is retried or cancelled.
+func (cp *ControlPlane) syncMachine(idc, sn string, prev, next []byte) {
+	var before, after *models.TaskV3
+	if prev != nil {
+		before = &models.TaskV3{}
+		if json.Unmarshal(prev, before) != nil {
+			before = nil
+		}
+	}
+	if next != nil {
+		after = &models.TaskV3{}
+		if json.Unmarshal(next, after) != nil {
+			return
+		}
+	}
+	if after != nil && before != nil && before.TaskID == after.TaskID && before.Status == after.Status {
+		return
+	}
+
+	var (
+		to     models.MachineState
+		taskID string
+		reason string
+	)
+	switch {
+	case after == nil:
+		if before == nil {
+			return
+		}
+		to, taskID, reason = models.MachineStateReady, before.TaskID, fmt.Sprintf("Task %s deleted", before.TaskID)
+	case after.Status == models.TaskStatusCompleted:
+		to, taskID, reason = models.MachineStateDeployed, after.TaskID, fmt.Sprintf("Installed %s %s by task %s", after.OSType, after.OSVersion, after.TaskID)
+	case after.Status == models.TaskStatusCancelled:
+		to, taskID, reason = models.MachineStateReady, after.TaskID, fmt.Sprintf("Task %s cancelled", after.TaskID)
+	case !models.IsFinished(after.Status):
+		to, taskID, reason = models.MachineStateAllocated, after.TaskID, fmt.Sprintf("Allocated to task %s", after.TaskID)
+	default:
+		return
+	}
+
+	var from models.MachineState
+	update := func(m *models.Machine) ([]clientv3.Op, error) {
+		from = m.State
+		// Releasing only applies to the task that holds the machine
+		if to != models.MachineStateAllocated && m.CurrentTaskID != taskID {
+			return nil, inventory.ErrUnchanged
+		}
+		if m.State == to && m.CurrentTaskID == taskID {
+			return nil, inventory.ErrUnchanged
+		}
+		if err := m.TransitionTo(to, reason, "control-plane"); err != nil {
+			return nil, err
+		}
+		if to == models.MachineStateReady {
+			m.CurrentTaskID = ""
+		} else {
+			m.CurrentTaskID = taskID
+		}
+		return nil, nil
+	}
+
+	var (
+		m   *models.Machine
+		err error
+	)
+	if to == models.MachineStateAllocated {
+		m, err = inventory.Ensure(cp.etcdClient, idc, sn, func() *models.Machine {
+			m := models.NewMachine(idc, sn, models.MachineStateDiscovered, "control-plane", "Registered by task "+taskID)
+			m.MAC, m.Hostname = after.MAC, after.Hostname
+			return m
+		}, update)
+	} else {
+		m, err = inventory.Update(cp.etcdClient, idc, sn, update)
+	}
+	switch {
+	case etcd.IsKeyNotFound(err):
+	case err != nil:
+		log.Printf("[%s] Inventory not updated for %s (task %s): %v", idc, sn, taskID, err)
+	case m.State != from:
+		log.Printf("[%s] Machine %s: %s -> %s (task %s)", idc, sn, from, m.State, taskID)
+	}
+}
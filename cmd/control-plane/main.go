@@ -3,12 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -16,63 +22,167 @@ import (
 	"github.com/google/uuid"
 	clientv3 "go.etcd.io/etcd/client/v3"
 
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/bom"
+	"github.com/lpmos/lpmos-go/pkg/config"
+	"github.com/lpmos/lpmos-go/pkg/email"
 	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/ipam"
+	"github.com/lpmos/lpmos-go/pkg/metrics"
 	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/rules"
+	"github.com/lpmos/lpmos-go/pkg/stats"
+	"github.com/lpmos/lpmos-go/pkg/taskindex"
+	"github.com/lpmos/lpmos-go/pkg/tasklog"
+	"github.com/lpmos/lpmos-go/pkg/webhook"
 	"github.com/lpmos/lpmos-go/pkg/websocket"
 )
 
+// Page sizes of GET /api/v1/tasks and GET /api/v1/audit
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
 // ControlPlane manages the central control plane for LPMOS v3.0
 type ControlPlane struct {
-	etcdClient *etcd.Client
-	wsHub      *websocket.Hub
-	ctx        context.Context
-	cancel     context.CancelFunc
+	cfg          *config.Config
+	auth         *auth.Authenticator
+	oidc         *auth.OIDC // nil unless dashboard login is enabled
+	etcdClient   *etcd.Client
+	wsHub        *websocket.Hub
+	stats        *stats.Tracker
+	rulesMu      sync.Mutex
+	rules        *rules.Engine // compiled auto-approval rules, by version
+	webhookStore *webhook.EtcdStore
+	webhooks     *webhook.Dispatcher
+	email        *email.Notifier // nil unless email is enabled
+	audit        *audit.Log
+	ctx          context.Context
+	cancel       context.CancelFunc
 }
 
 func main() {
+	configPath := flag.String("config", os.Getenv(config.EnvConfigPath), "Path to LPMOS config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if err := cfg.ValidateControlPlane(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if err := cfg.Logging.Apply(); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
 	log.Println("Starting LPMOS Control Plane v3.0...")
 
+	authenticator, err := auth.NewAuthenticator(cfg.Security.APIKeys)
+	if err != nil {
+		log.Fatalf("Invalid API key config: %v", err)
+	}
+	if authenticator.Enabled() {
+		log.Printf("API key authentication enabled (%d keys)", len(cfg.Security.APIKeys.Keys))
+	}
+
+	var oidc *auth.OIDC
+	if authCfg := cfg.ControlPlane.Auth; authCfg.Enabled {
+		sessions := auth.NewSessionCodec(authCfg.JWTSecret, authCfg.TokenExpiry, cfg.ControlPlane.API.TLS.Enabled)
+		authenticator.UseSessions(sessions)
+		oidc = auth.NewOIDC(authCfg.OIDC, sessions)
+		log.Printf("OIDC dashboard login enabled (issuer: %s)", authCfg.OIDC.IssuerURL)
+	}
+
 	// Initialize etcd client
-	etcdClient, err := etcd.NewClient(etcd.Config{
-		Endpoints:      []string{"localhost:2379"},
-		DialTimeout:    5 * time.Second,
-		RequestTimeout: 10 * time.Second,
-	})
+	etcdConfig, err := cfg.ControlPlane.Etcd.ClientConfig()
+	if err != nil {
+		log.Fatalf("Invalid etcd config: %v", err)
+	}
+	etcdClient, err := etcd.NewClient(etcdConfig)
 	if err != nil {
 		log.Fatalf("Failed to connect to etcd: %v", err)
 	}
-	defer etcdClient.Close() // Release etcd connection when done
+	defer etcdClient.Close()             // Release etcd connection when done
+	etcdClient.AddIndexer(taskindex.Ops) // keep task indexes in step with task writes
+	etcdClient.AddIndexer(tasklog.Ops)   // store appended log entries under their own keys
 
 	// Initialize WebSocket hub
 	wsHub := websocket.NewHub()
-	go wsHub.Run()
+	wsHub.AllowOrigins(cfg.ControlPlane.API.AllowedOrigins...)
 
 	// Create control plane
 	ctx, cancel := context.WithCancel(context.Background())
 	cp := &ControlPlane{
+		cfg:        cfg,
+		auth:       authenticator,
+		oidc:       oidc,
 		etcdClient: etcdClient,
 		wsHub:      wsHub,
+		stats:      stats.NewTracker(),
+		audit:      audit.NewLog(audit.NewEtcdStore(etcdClient)),
 		ctx:        ctx,
 		cancel:     cancel,
 	}
+	cp.webhookStore = webhook.NewEtcdStore(etcdClient)
+	cp.webhooks = newWebhookDispatcher(cp.webhookStore, cfg.ControlPlane.Notifications)
+	if emailCfg := cfg.ControlPlane.Notifications.Email; emailCfg.Enabled {
+		cp.email = email.NewNotifier(emailCfg, nil)
+		log.Printf("Email notifications enabled (SMTP %s:%d, digest: %v)", emailCfg.SMTPHost, emailCfg.SMTPPort, emailCfg.Digest)
+	}
+	wsHub.SetSnapshot(cp.taskSnapshot)
+	cp.seedApprovalRules()
+	cp.registerMetrics()
+
+	// Backfill the task indexes (tasks from older versions, missed writes),
+	// then keep the IDC statistics reconciled against them
+	go func() {
+		cp.rebuildTaskIndexes()
+		cp.reconcileStats()
+	}()
 
 	// Start watchers
+	go cp.webhooks.Run(ctx)
+	if cp.email != nil {
+		go cp.email.Run(ctx)
+		if cfg.ControlPlane.Notifications.Email.ApprovalWait > 0 {
+			go cp.watchApprovalWaits()
+		}
+	}
+	if cfg.ControlPlane.Watchdog.Enabled {
+		go cp.runWatchdog()
+	}
+	if cfg.ControlPlane.Audit.Retention > 0 {
+		go cp.pruneAudit()
+	}
 	go cp.watchTasks()
 	go cp.watchLeases()
+	go cp.watchRegions()
 
 	// Setup HTTP server
 	router := setupRouter(cp)
+	metrics.Serve(cfg.Monitoring.Enabled, cfg.Monitoring.Prometheus.Port, cfg.Monitoring.Prometheus.Path, router)
 
 	// Start server
+	apiConfig := cfg.ControlPlane.API
 	srv := &http.Server{
-		Addr:    ":8080",
+		Addr:    apiConfig.Addr(),
 		Handler: router,
 	}
 
 	go func() {
-		log.Println("Control plane listening on :8080")
-		log.Println("Dashboard: http://localhost:8080")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Control plane listening on %s", srv.Addr)
+		var err error
+		if apiConfig.TLS.Enabled {
+			log.Printf("Dashboard: https://localhost:%d", apiConfig.Port)
+			err = srv.ListenAndServeTLS(apiConfig.TLS.CertFile, apiConfig.TLS.KeyFile)
+		} else {
+			log.Printf("Dashboard: http://localhost:%d", apiConfig.Port)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start server: %v", err)
 		}
 	}()
@@ -91,26 +201,92 @@ func setupRouter(cp *ControlPlane) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
 
+	// Dashboard login (OIDC)
+	if cp.oidc != nil {
+		cp.oidc.RegisterRoutes(router)
+	}
+
 	// WebSocket endpoint
-	router.GET("/ws", func(c *gin.Context) {
-		websocket.ServeWs(cp.wsHub, c.Writer, c.Request)
+	router.GET("/ws", cp.auth.Middleware(), auth.Require(auth.PermissionRead), func(c *gin.Context) {
+		websocket.ServeWs(cp.wsHub, c.Writer, c.Request, auth.PrincipalFrom(c))
 	})
 
 	// API routes
 	api := router.Group("/api/v1")
+	api.Use(cp.auth.Middleware())
 	{
-		api.POST("/tasks", cp.createTask)
-		api.GET("/tasks", cp.listTasks)
-		api.GET("/tasks/:idc/:sn", cp.getTask)
-		api.POST("/tasks/:idc/:sn/approve", cp.approveTask)
-		api.POST("/tasks/:idc/:sn/reject", cp.rejectTask)
-		api.GET("/servers/:idc", cp.listServers)
-		api.GET("/stats/:idc", cp.getStats)
-		api.GET("/stats", cp.getAllStats)
+		read := auth.Require(auth.PermissionRead)
+		approve := auth.Require(auth.PermissionApprove)
+		write := auth.Require(auth.PermissionWrite)
+
+		api.POST("/tasks", cp.createTask)           // IDC comes from the body, checked in the handler
+		api.POST("/tasks/bulk", cp.bulkCreateTasks) // per-row IDC checks in the handler
+		api.GET("/tasks", read, cp.listTasks)
+		api.GET("/tasks/:idc/:sn", read, cp.getTask)
+		api.GET("/tasks/:idc/:sn/history", read, cp.taskHistory)
+		api.GET("/tasks/:idc/:sn/logs", read, cp.taskLogs)
+		api.POST("/tasks/:idc/:sn/approve", approve, cp.approveTask)
+		api.POST("/tasks/:idc/:sn/reject", approve, cp.rejectTask)
+		api.POST("/tasks/:idc/:sn/cancel", write, cp.cancelTask)
+		api.POST("/tasks/:idc/:sn/retry", write, cp.retryTask)
+		api.POST("/tasks/:idc/:sn/reinstall", write, cp.reinstallTask)
+		api.GET("/regions", read, cp.listRegions)
+		api.GET("/regions/:idc", read, cp.getRegion)
+		api.GET("/servers/:idc", read, cp.listServers)
+		api.GET("/unmatched-reports", read, cp.listUnmatchedReports)
+		api.GET("/unmatched-reports/:idc/:mac", read, cp.getUnmatchedReport)
+		api.DELETE("/unmatched-reports/:idc/:mac", write, cp.deleteUnmatchedReport)
+		api.POST("/unmatched-reports/:idc/:mac/adopt", write, cp.adoptUnmatchedReport)
+
+		// Machine inventory
+		api.GET("/machines", read, cp.listMachines)
+		api.GET("/machines/search", read, cp.searchMachines)
+		api.POST("/machines", cp.createMachine)
+		api.GET("/machines/:idc/:sn", read, cp.getMachine)
+		api.PUT("/machines/:idc/:sn", write, cp.updateMachine)
+		api.POST("/machines/:idc/:sn/state", write, cp.setMachineState)
+		api.DELETE("/machines/:idc/:sn", write, cp.deleteMachine)
+		api.GET("/machines/:idc/:sn/hardware", read, cp.getMachineHardware)
+
+		// IP address management
+		api.GET("/ipam/:idc/pools", read, cp.listIPPools)
+		api.GET("/ipam/:idc/pools/:name", read, cp.getIPPool)
+		api.PUT("/ipam/:idc/pools/:name", write, cp.saveIPPool)
+		api.DELETE("/ipam/:idc/pools/:name", write, cp.deleteIPPool)
+		api.GET("/ipam/:idc/addresses", read, cp.listIPAddresses)
+		api.POST("/ipam/:idc/addresses", write, cp.reserveIPAddress)
+		api.DELETE("/ipam/:idc/addresses/:ip", write, cp.releaseIPAddress)
+		api.GET("/ipam/:idc/conflicts", read, cp.listIPConflicts)
+		api.GET("/stats/:idc", read, cp.getStats)
+		api.GET("/stats", read, cp.getAllStats)
+		api.GET("/websocket/stats", read, cp.websocketStats)
+		api.GET("/approval-rules", read, cp.getApprovalRules)
+		api.PUT("/approval-rules", approve, cp.updateApprovalRules) // every IDC, checked in the handler
+		api.GET("/approval-rules/versions", read, cp.listApprovalRuleVersions)
+		api.GET("/approval-rules/versions/:version", read, cp.getApprovalRuleVersion)
+		api.POST("/approval-rules/rollback", approve, cp.rollbackApprovalRules)
+		api.POST("/approval-rules/test", read, cp.testApprovalRules)
+		api.GET("/bom-profiles", read, cp.listBOMProfiles)
+		api.GET("/bom-profiles/:name", read, cp.getBOMProfile)
+		api.PUT("/bom-profiles/:name", write, cp.saveBOMProfile) // every IDC, checked in the handler
+		api.DELETE("/bom-profiles/:name", write, cp.deleteBOMProfile)
+		api.POST("/bom-profiles/:name/test", read, cp.testBOMProfile)
+		api.GET("/webhooks", read, cp.listWebhooks)
+		api.POST("/webhooks", write, cp.createWebhook) // IDC scope checked in the handler
+		api.GET("/webhooks/dead-letters", read, cp.listWebhookDeadLetters)
+		api.POST("/webhooks/dead-letters/:id/retry", write, cp.retryWebhookDeadLetter)
+		api.DELETE("/webhooks/dead-letters/:id", write, cp.deleteWebhookDeadLetter)
+		api.GET("/webhooks/:id", read, cp.getWebhook)
+		api.PUT("/webhooks/:id", write, cp.updateWebhook)
+		api.DELETE("/webhooks/:id", write, cp.deleteWebhook)
+		api.GET("/audit", read, cp.listAudit)
+		api.GET("/audit/export", read, cp.exportAudit)
+		api.GET("/audit/verify", read, cp.verifyAudit)
+		api.GET("/whoami", cp.whoami)
 	}
 
 	// Serve static files from web/index.html
-	router.GET("/", func(c *gin.Context) {
+	router.GET("/", cp.auth.RequireLogin("/auth/login"), func(c *gin.Context) {
 		c.File("web/index.html")
 	})
 
@@ -125,89 +301,220 @@ func (cp *ControlPlane) createTask(c *gin.Context) {
 		return
 	}
 
-	// Step 1: Add to servers directory (INDIVIDUAL KEY)
-	serverKey := etcd.ServerKey(req.IDC, req.SN)
-	serverEntry := models.ServerEntry{
-		SN:      req.SN,
-		Status:  "pending",
-		MAC:     req.MAC,
-		AddedAt: time.Now(),
+	if !auth.Authorize(c, auth.PermissionWrite, req.IDC) {
+		return
 	}
 
-	if err := cp.etcdClient.Put(serverKey, serverEntry); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to add server: %v", err)})
+	task, superseded, err := cp.insertTask(req, auth.Actor(c))
+	if err != nil {
+		c.JSON(createErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
+	cp.recordAction(c, taskRecord(audit.ActionTaskCreate, superseded, &task, ""))
 
-	// Step 2: Initialize task (MERGED STRUCTURE)
-	taskID := fmt.Sprintf("task-%s", uuid.New().String()[:8])
-	taskKey := etcd.TaskKeyV3(req.IDC, req.SN)
+	c.JSON(http.StatusCreated, task)
+}
 
-	task := models.TaskV3{
-		TaskID:      taskID,
-		SN:          req.SN,
-		MAC:         req.MAC,
-		OSType:      req.OSType,
-		OSVersion:   req.OSVersion,
-		DiskLayout:  req.DiskLayout,
-		NetworkConf: req.NetworkConf,
-		Status:      models.TaskStatusPending,
-		StatusHistory: []models.StatusChange{
-			{
-				Status:    models.TaskStatusPending,
-				Timestamp: time.Now(),
-				Reason:    "Task created",
-			},
-		},
-		Progress:  []models.ProgressStep{},
-		Logs:      []string{fmt.Sprintf("[INFO] Task created for %s in %s", req.SN, req.IDC)},
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		CreatedBy: "admin",
+// insertTask stores a new task for req and its servers directory entry. A
+// finished task of the machine is archived as a previous attempt and
+// returned as superseded; a running one makes the creation fail. In an IDC
+// with IP pools the task's address and hostname are claimed in the same
+// transaction.
+func (cp *ControlPlane) insertTask(req models.CreateTaskRequestV3, actor string) (task models.TaskV3, superseded *models.TaskV3, err error) {
+	if err := cp.checkRegion(req.IDC); err != nil {
+		return task, nil, err
+	}
+	if err := cp.checkMachineInstallable(req.IDC, req.SN); err != nil {
+		return task, nil, err
+	}
+	if err := cp.checkBOMProfile(req.BOMProfile); err != nil {
+		return task, nil, err
 	}
 
-	if err := cp.etcdClient.Put(taskKey, task); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create task: %v", err)})
-		return
+	// A conflict means the task or an address changed since they were
+	// read; the next try sees the change
+	for tries := 1; ; tries++ {
+		task, superseded, err = cp.tryInsertTask(req, actor)
+		if !errors.Is(err, etcd.ErrTxnConflict) || tries == 3 {
+			break
+		}
+	}
+	if err != nil {
+		return task, nil, err
 	}
 
-	log.Printf("[%s] Created task %s for server %s", req.IDC, taskID, req.SN)
+	log.Printf("[%s] Created task %s for server %s (by %s)", req.IDC, task.TaskID, req.SN, actor)
+	return task, superseded, nil
+}
 
-	// Broadcast via WebSocket
-	cp.wsHub.BroadcastStatus(taskID, task.Status)
+// tryInsertTask writes the task, the archive of the one it supersedes, its
+// address claim and servers entry in one transaction that only commits
+// while none of the keys read have changed
+func (cp *ControlPlane) tryInsertTask(req models.CreateTaskRequestV3, actor string) (task models.TaskV3, superseded *models.TaskV3, err error) {
+	task = newTask(req, actor)
+	taskKey := etcd.TaskKeyV3(req.IDC, req.SN)
 
-	c.JSON(http.StatusCreated, task)
+	var ops []clientv3.Op
+	data, version, err := cp.etcdClient.GetWithVersion(taskKey)
+	switch {
+	case etcd.IsKeyNotFound(err):
+	case err != nil:
+		return task, nil, err
+	default:
+		// The machine already has a task: archive it as a previous attempt
+		// instead of overwriting it, unless it is still running
+		var prev models.TaskV3
+		if err := json.Unmarshal(data, &prev); err != nil {
+			return task, nil, err
+		}
+		if !models.IsFinished(prev.Status) {
+			return task, nil, &models.TransitionError{From: prev.Status, To: models.TaskStatusPending,
+				Reason: fmt.Sprintf("task %s is still running, cancel it first", prev.TaskID)}
+		}
+		if prev.Attempt == 0 {
+			prev.Attempt = 1
+		}
+		archiveOp, err := etcd.OpPut(etcd.AttemptKey(req.IDC, req.SN, prev.TaskID),
+			prev.Archive(fmt.Sprintf("Superseded by %s (created by %s)", task.TaskID, actor)))
+		if err != nil {
+			return task, nil, err
+		}
+		ops = append(ops, archiveOp)
+		task.Attempt = prev.Attempt + 1
+		task.PreviousTaskID = prev.TaskID
+		superseded = &prev
+	}
+	conditions := []clientv3.Cmp{clientv3.Compare(clientv3.Version(taskKey), "=", version)}
+
+	allocator, err := ipam.Load(cp.etcdClient, req.IDC)
+	if err != nil {
+		return task, nil, err
+	}
+	claim, err := cp.claimAddress(allocator, &task, req.IPPool)
+	if err != nil {
+		return task, nil, err
+	}
+	if claim != nil {
+		ops = append(ops, claim.Ops...)
+		conditions = append(conditions, claim.Conditions...)
+	}
+
+	value, err := json.Marshal(task)
+	if err != nil {
+		return task, nil, err
+	}
+	serverOp, err := etcd.OpPut(etcd.ServerKey(req.IDC, req.SN), newServerEntry(req))
+	if err != nil {
+		return task, nil, err
+	}
+	ops = append([]clientv3.Op{clientv3.OpPut(taskKey, string(value)), serverOp}, ops...)
+	ops = append(ops, cp.etcdClient.IndexOps(taskKey, data, value)...)
+	if err := cp.etcdClient.Transaction(ops, conditions...); err != nil {
+		return task, nil, err
+	}
+	return task, superseded, nil
 }
 
-// listTasks lists all tasks across all IDCs
+// createErrorStatus maps an insertTask error to an HTTP status code
+func createErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnknownIDC), errors.Is(err, bom.ErrUnknownProfile):
+		return http.StatusBadRequest
+	case errors.Is(err, etcd.ErrTxnConflict):
+		return http.StatusConflict
+	}
+	if status, ok := ipamErrorStatus(err); ok {
+		return status
+	}
+	return updateErrorStatus(err)
+}
+
+// listTasks lists tasks page by page from the task indexes. Filters: idc,
+// status (comma-separated), os_type, created_after and created_before
+// (RFC 3339). sort is -created_at (default, newest first) or created_at;
+// limit is at most maxListLimit. Pass next_cursor back as cursor for the
+// next page.
 func (cp *ControlPlane) listTasks(c *gin.Context) {
-	idc := c.Query("idc")
+	principal := auth.PrincipalFrom(c)
+	q := taskindex.Query{
+		IDC:    c.Query("idc"),
+		OSType: c.Query("os_type"),
+		Cursor: c.Query("cursor"),
+		Limit:  defaultListLimit,
+		Allow:  principal.CanAccessIDC,
+	}
 
-	var tasks []models.TaskV3
-	var prefix string
+	if status := c.Query("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			q.Statuses = append(q.Statuses, models.TaskStatus(strings.TrimSpace(s)))
+		}
+	}
+	for param, target := range map[string]*time.Time{
+		"created_after":  &q.CreatedAfter,
+		"created_before": &q.CreatedBefore,
+	} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be an RFC 3339 time: %v", param, err)})
+				return
+			}
+			*target = t
+		}
+	}
+	switch c.DefaultQuery("sort", "-created_at") {
+	case "-created_at":
+	case "created_at":
+		q.Ascending = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be created_at or -created_at"})
+		return
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxListLimit)})
+			return
+		}
+		q.Limit = n
+	}
 
-	if idc != "" {
-		prefix = etcd.MachinePrefix(idc)
-	} else {
-		prefix = "/os/"
+	entries, next, err := taskindex.List(cp.etcdClient, q)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, taskindex.ErrBadCursor) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
 	}
 
-	kvs, err := cp.etcdClient.GetWithPrefix(prefix)
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = etcd.TaskKeyV3(e.IDC, e.SN)
+	}
+	values, err := cp.etcdClient.GetMany(keys)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	for key, value := range kvs {
-		if strings.HasSuffix(key, "/task") {
-			var task models.TaskV3
-			if err := json.Unmarshal(value, &task); err == nil {
-				tasks = append(tasks, task)
+	tasks := make([]models.TaskV3, 0, len(keys))
+	for i, key := range keys {
+		var task models.TaskV3
+		if value, ok := values[key]; ok && json.Unmarshal(value, &task) == nil {
+			if task.IDC == "" {
+				task.IDC = entries[i].IDC
 			}
+			tasks = append(tasks, task)
 		}
 	}
 
-	c.JSON(http.StatusOK, tasks)
+	c.JSON(http.StatusOK, gin.H{
+		"tasks":       tasks,
+		"count":       len(tasks),
+		"next_cursor": next,
+	})
 }
 
 // getTask retrieves a specific task
@@ -222,6 +529,7 @@ func (cp *ControlPlane) getTask(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
 		return
 	}
+	task.IDC = idc
 
 	c.JSON(http.StatusOK, task)
 }
@@ -238,48 +546,50 @@ func (cp *ControlPlane) approveTask(c *gin.Context) {
 	}
 
 	taskKey := etcd.TaskKeyV3(idc, sn)
+	actor := auth.Actor(c)
 
 	// Atomic update
+	var before, after models.TaskV3
 	err := cp.etcdClient.AtomicUpdate(taskKey, func(data []byte) (interface{}, error) {
 		var task models.TaskV3
 		if err := json.Unmarshal(data, &task); err != nil {
 			return nil, err
 		}
+		before = task
+
+		if req.AcceptBOMMismatch {
+			if err := waiveBOMCheck(&task, actor); err != nil {
+				return nil, err
+			}
+		}
 
 		// Update approval
 		now := time.Now()
 		task.Approval = &models.Approval{
 			Status:     models.ApprovalStatusApproved,
-			ApprovedBy: "admin",
+			ApprovedBy: actor,
 			ApprovedAt: &now,
 			Notes:      req.Notes,
 		}
 
 		// Update status
-		task.Status = models.TaskStatusApproved
-		task.StatusHistory = append(task.StatusHistory, models.StatusChange{
-			Status:    models.TaskStatusApproved,
-			Timestamp: now,
-			Reason:    "Approved by admin",
-		})
+		if err := task.TransitionTo(models.TaskStatusApproved, fmt.Sprintf("Approved by %s", actor)); err != nil {
+			return nil, err
+		}
 
-		task.Logs = append(task.Logs, fmt.Sprintf("[INFO] Task approved: %s", req.Notes))
-		task.UpdatedAt = now
+		task.AddLog(fmt.Sprintf("[INFO] Task approved by %s: %s", actor, req.Notes))
 
+		after = task
 		return task, nil
 	})
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Printf("[%s] Approved task for %s", idc, sn)
-
-	// Broadcast update
-	var task models.TaskV3
-	cp.etcdClient.GetJSON(taskKey, &task)
-	cp.wsHub.BroadcastStatus(task.TaskID, task.Status)
+	log.Printf("[%s] Approved task for %s (by %s)", idc, sn, actor)
+	cp.recordAction(c, taskRecord(audit.ActionTaskApprove, &before, &after, req.Notes))
 
 	c.JSON(http.StatusOK, gin.H{"message": "Task approved"})
 }
@@ -296,46 +606,299 @@ func (cp *ControlPlane) rejectTask(c *gin.Context) {
 	}
 
 	taskKey := etcd.TaskKeyV3(idc, sn)
+	actor := auth.Actor(c)
 
 	// Atomic update
+	var before, after models.TaskV3
 	err := cp.etcdClient.AtomicUpdate(taskKey, func(data []byte) (interface{}, error) {
 		var task models.TaskV3
 		if err := json.Unmarshal(data, &task); err != nil {
 			return nil, err
 		}
+		before = task
 
 		// Update approval
 		now := time.Now()
 		task.Approval = &models.Approval{
 			Status:     models.ApprovalStatusRejected,
-			RejectedBy: "admin",
+			RejectedBy: actor,
 			RejectedAt: &now,
 			Reason:     req.Reason,
 		}
 
 		// Update status
-		task.Status = models.TaskStatusFailed
-		task.StatusHistory = append(task.StatusHistory, models.StatusChange{
-			Status:    models.TaskStatusFailed,
-			Timestamp: now,
-			Reason:    fmt.Sprintf("Rejected: %s", req.Reason),
-		})
+		if err := task.TransitionTo(models.TaskStatusFailed, fmt.Sprintf("Rejected by %s: %s", actor, req.Reason)); err != nil {
+			return nil, err
+		}
 
-		task.Logs = append(task.Logs, fmt.Sprintf("[ERROR] Task rejected: %s", req.Reason))
-		task.UpdatedAt = now
+		task.AddLog(fmt.Sprintf("[ERROR] Task rejected by %s: %s", actor, req.Reason))
 
+		after = task
 		return task, nil
 	})
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Printf("[%s] Rejected task for %s: %s", idc, sn, req.Reason)
+	log.Printf("[%s] Rejected task for %s by %s: %s", idc, sn, actor, req.Reason)
+	cp.recordAction(c, taskRecord(audit.ActionTaskReject, &before, &after, req.Reason))
 	c.JSON(http.StatusOK, gin.H{"message": "Task rejected"})
 }
 
+// cancelTask stops a task whose current attempt has not finished
+func (cp *ControlPlane) cancelTask(c *gin.Context) {
+	cp.taskAction(c, "Cancelled", audit.ActionTaskCancel, func(task *models.TaskV3, req models.TaskActionRequest, actor string) (*models.TaskV3, error) {
+		if err := task.TransitionTo(models.TaskStatusCancelled, fmt.Sprintf("Cancelled by %s: %s", actor, req.Reason)); err != nil {
+			return nil, err
+		}
+		task.AddLog(fmt.Sprintf("[WARN] Task cancelled by %s: %s", actor, req.Reason))
+		return nil, nil
+	})
+}
+
+// retryTask starts a new attempt of a failed or cancelled task. A standing
+// approval carries over; a rejected task goes back through approval.
+func (cp *ControlPlane) retryTask(c *gin.Context) {
+	cp.taskAction(c, "Retried", audit.ActionTaskRetry, func(task *models.TaskV3, req models.TaskActionRequest, actor string) (*models.TaskV3, error) {
+		if task.Status == models.TaskStatusCompleted {
+			return nil, &models.TransitionError{From: task.Status, To: models.TaskStatusApproved, Reason: "task completed, use reinstall"}
+		}
+		if err := cp.checkMachineInstallable(c.Param("idc"), c.Param("sn")); err != nil {
+			return nil, err
+		}
+		archived, err := task.StartNewAttempt(newTaskID(), fmt.Sprintf("Retried by %s: %s", actor, req.Reason))
+		if err != nil {
+			return nil, err
+		}
+
+		target := models.TaskStatusApproved
+		if task.Approval == nil || task.Approval.Status != models.ApprovalStatusApproved {
+			task.Approval = nil
+			target = models.TaskStatusPending
+		} else {
+			// Regenerate the boot config for the new attempt
+			task.PXEConfigured = false
+		}
+
+		if err := task.TransitionTo(target, fmt.Sprintf("Retry of %s by %s", task.PreviousTaskID, actor)); err != nil {
+			return nil, err
+		}
+		task.AddLog(fmt.Sprintf("[INFO] Attempt %d started by %s (retry): %s", task.Attempt, actor, req.Reason))
+		return archived, nil
+	})
+}
+
+// reinstallTask starts a new attempt of a completed task, optionally with a
+// different OS. Reinstalling wipes the machine, so it needs a new approval.
+func (cp *ControlPlane) reinstallTask(c *gin.Context) {
+	cp.taskAction(c, "Reinstalling", audit.ActionTaskReinstall, func(task *models.TaskV3, req models.TaskActionRequest, actor string) (*models.TaskV3, error) {
+		if task.Status != models.TaskStatusCompleted {
+			return nil, &models.TransitionError{From: task.Status, To: models.TaskStatusPending, Reason: "only completed tasks can be reinstalled, use retry"}
+		}
+		if err := cp.checkMachineInstallable(c.Param("idc"), c.Param("sn")); err != nil {
+			return nil, err
+		}
+		archived, err := task.StartNewAttempt(newTaskID(), fmt.Sprintf("Reinstall requested by %s: %s", actor, req.Reason))
+		if err != nil {
+			return nil, err
+		}
+
+		if req.OSType != "" {
+			task.OSType = req.OSType
+		}
+		if req.OSVersion != "" {
+			task.OSVersion = req.OSVersion
+		}
+		task.Approval = nil
+
+		if err := task.TransitionTo(models.TaskStatusPending, fmt.Sprintf("Reinstall of %s requested by %s", task.PreviousTaskID, actor)); err != nil {
+			return nil, err
+		}
+		task.AddLog(fmt.Sprintf("[INFO] Attempt %d (%s %s) requested by %s (reinstall): %s",
+			task.Attempt, task.OSType, task.OSVersion, actor, req.Reason))
+		return archived, nil
+	})
+}
+
+// taskAction atomically applies a lifecycle action to a task, then
+// broadcasts and returns the updated task. When apply starts a new attempt it
+// returns the finished one, which is archived in the same transaction.
+func (cp *ControlPlane) taskAction(c *gin.Context, verb, action string, apply func(*models.TaskV3, models.TaskActionRequest, string) (*models.TaskV3, error)) {
+	idc := c.Param("idc")
+	sn := c.Param("sn")
+
+	// The body is optional
+	var req models.TaskActionRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	taskKey := etcd.TaskKeyV3(idc, sn)
+	actor := auth.Actor(c)
+
+	var before, updated models.TaskV3
+	err := cp.etcdClient.AtomicUpdateOps(taskKey, func(data []byte) (interface{}, []clientv3.Op, error) {
+		var task models.TaskV3
+		if err := json.Unmarshal(data, &task); err != nil {
+			return nil, nil, err
+		}
+		before = task
+		archived, err := apply(&task, req, actor)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var ops []clientv3.Op
+		if archived != nil {
+			op, err := etcd.OpPut(etcd.AttemptKey(idc, sn, archived.TaskID), archived)
+			if err != nil {
+				return nil, nil, err
+			}
+			ops = append(ops, op)
+		}
+
+		updated = task
+		return task, ops, nil
+	})
+
+	if err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[%s] %s task %s for %s (by %s)", idc, verb, updated.TaskID, sn, actor)
+	cp.recordAction(c, taskRecord(action, &before, &updated, req.Reason))
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// taskHistory lists every installation attempt of a machine, oldest first,
+// ending with the current one
+func (cp *ControlPlane) taskHistory(c *gin.Context) {
+	idc := c.Param("idc")
+	sn := c.Param("sn")
+
+	kvs, err := cp.etcdClient.GetWithPrefix(etcd.AttemptPrefix(idc, sn))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	attempts := make([]models.TaskV3, 0, len(kvs)+1)
+	for key, value := range kvs {
+		var attempt models.TaskV3
+		if err := json.Unmarshal(value, &attempt); err != nil {
+			log.Printf("[%s] Skipping unreadable attempt %s: %v", idc, key, err)
+			continue
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	var current models.TaskV3
+	if err := cp.etcdClient.GetJSON(etcd.TaskKeyV3(idc, sn), &current); err == nil {
+		attempts = append(attempts, current)
+	} else if len(attempts) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	}
+
+	sort.SliceStable(attempts, func(i, j int) bool {
+		if attempts[i].Attempt != attempts[j].Attempt {
+			return attempts[i].Attempt < attempts[j].Attempt
+		}
+		return attempts[i].CreatedAt.Before(attempts[j].CreatedAt)
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"idc":      idc,
+		"sn":       sn,
+		"total":    len(attempts),
+		"attempts": attempts,
+	})
+}
+
+// newTask builds the first attempt of a task from a creation request
+func newTask(req models.CreateTaskRequestV3, actor string) models.TaskV3 {
+	now := time.Now()
+	task := models.TaskV3{
+		TaskID:      newTaskID(),
+		IDC:         req.IDC,
+		SN:          req.SN,
+		MAC:         req.MAC,
+		IP:          req.IP,
+		Hostname:    req.Hostname,
+		OSType:      req.OSType,
+		OSVersion:   req.OSVersion,
+		DiskLayout:  req.DiskLayout,
+		NetworkConf: req.NetworkConf,
+		BOMProfile:  req.BOMProfile,
+		SKU:         req.SKU,
+		Status:      models.TaskStatusPending,
+		StatusHistory: []models.StatusChange{
+			{
+				Status:    models.TaskStatusPending,
+				Timestamp: now,
+				Reason:    "Task created",
+			},
+		},
+		Attempt:   1,
+		CreatedAt: now,
+		UpdatedAt: now,
+		CreatedBy: actor,
+	}
+	task.AddLog(fmt.Sprintf("[INFO] Task created for %s in %s", req.SN, req.IDC))
+	return task
+}
+
+// newServerEntry builds the servers directory entry of a new task
+func newServerEntry(req models.CreateTaskRequestV3) models.ServerEntry {
+	return models.ServerEntry{
+		SN:      req.SN,
+		Status:  "pending",
+		MAC:     req.MAC,
+		AddedAt: time.Now(),
+	}
+}
+
+// newTaskID generates the ID of a new installation attempt
+func newTaskID() string {
+	return fmt.Sprintf("task-%s", uuid.New().String()[:8])
+}
+
+// rebuildTaskIndexes backfills the task indexes from the task keys
+func (cp *ControlPlane) rebuildTaskIndexes() {
+	result, err := taskindex.Rebuild(cp.etcdClient)
+	if err != nil {
+		log.Printf("Failed to rebuild task indexes: %v", err)
+		return
+	}
+	log.Printf("Task indexes checked: %d tasks, %d keys written, %d stale keys removed",
+		result.Tasks, result.Written, result.Removed)
+}
+
+// errUnchanged aborts an AtomicUpdate that has nothing to write
+var errUnchanged = errors.New("task unchanged")
+
+// updateErrorStatus maps an AtomicUpdate error to an HTTP status code
+func updateErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, models.ErrInvalidTransition):
+		return http.StatusConflict
+	case etcd.IsKeyNotFound(err):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// whoami returns the authenticated principal
+func (cp *ControlPlane) whoami(c *gin.Context) {
+	c.JSON(http.StatusOK, auth.PrincipalFrom(c))
+}
+
 // listServers lists all servers in an IDC (INDIVIDUAL KEYS)
 func (cp *ControlPlane) listServers(c *gin.Context) {
 	idc := c.Param("idc")
@@ -358,95 +921,118 @@ func (cp *ControlPlane) listServers(c *gin.Context) {
 	c.JSON(http.StatusOK, servers)
 }
 
-// getStats retrieves statistics for an IDC
+// getStats returns the live statistics of an IDC
 func (cp *ControlPlane) getStats(c *gin.Context) {
 	idc := c.Param("idc")
-	statsKey := etcd.StatsKey(idc)
-
-	var stats models.IDCStats
-	if err := cp.etcdClient.GetJSON(statsKey, &stats); err != nil {
-		// Calculate stats if not cached
-		stats = cp.calculateStats(idc)
-		cp.etcdClient.Put(statsKey, stats)
+	if !auth.Authorize(c, auth.PermissionRead, idc) {
+		return
 	}
-
-	c.JSON(http.StatusOK, stats)
+	c.JSON(http.StatusOK, cp.stats.Get(idc))
 }
 
-// getAllStats retrieves statistics for all IDCs
+// getAllStats returns the live statistics of every IDC with tasks
 func (cp *ControlPlane) getAllStats(c *gin.Context) {
-	prefix := etcd.KeyPrefixGlobalStats
-	kvs, err := cp.etcdClient.GetWithPrefix(prefix)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	principal := auth.PrincipalFrom(c)
+	allStats := []models.IDCStats{}
+	for _, s := range cp.stats.All() {
+		if principal.CanAccessIDC(s.IDC) {
+			allStats = append(allStats, s)
+		}
 	}
+	c.JSON(http.StatusOK, allStats)
+}
 
-	var allStats []models.IDCStats
-	for _, value := range kvs {
-		var stats models.IDCStats
-		if err := json.Unmarshal(value, &stats); err == nil {
-			allStats = append(allStats, stats)
+// reconcileStats recounts the IDC statistics from the task indexes every
+// stats.reconcile_interval, correcting anything the watch stream missed
+func (cp *ControlPlane) reconcileStats() {
+	ticker := time.NewTicker(cp.cfg.ControlPlane.Stats.ReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := cp.recountStats(); err != nil {
+			log.Printf("Failed to reconcile IDC stats: %v", err)
 		}
-	}
 
-	c.JSON(http.StatusOK, allStats)
+		select {
+		case <-cp.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
-// calculateStats calculates statistics for an IDC
-func (cp *ControlPlane) calculateStats(idc string) models.IDCStats {
-	stats := models.IDCStats{
-		IDC:         idc,
-		LastUpdated: time.Now(),
+// recountStats lists every task from the index, merges the result into the
+// tracker and publishes the totals under /os/global/stats/{idc}
+func (cp *ControlPlane) recountStats() error {
+	rev, err := cp.etcdClient.Revision()
+	if err != nil {
+		return err
 	}
 
-	prefix := etcd.MachinePrefix(idc)
-	kvs, _ := cp.etcdClient.GetWithPrefix(prefix)
+	var entries []taskindex.Entry
+	err = taskindex.Each(cp.etcdClient, taskindex.Query{Ascending: true}, func(_ string, e taskindex.Entry) bool {
+		entries = append(entries, e)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	cp.stats.Reconcile(entries, rev)
 
-	for key, value := range kvs {
-		if strings.HasSuffix(key, "/task") {
-			var task models.TaskV3
-			if err := json.Unmarshal(value, &task); err == nil {
-				stats.TotalMachines++
-				switch task.Status {
-				case models.TaskStatusPending:
-					stats.Pending++
-				case models.TaskStatusInstalling:
-					stats.Installing++
-				case models.TaskStatusCompleted:
-					stats.Completed++
-				case models.TaskStatusFailed:
-					stats.Failed++
-				}
-			}
+	for _, s := range cp.stats.All() {
+		if err := cp.etcdClient.Put(etcd.StatsKey(s.IDC), s); err != nil {
+			log.Printf("[%s] Failed to publish stats: %v", s.IDC, err)
 		}
 	}
-
-	return stats
+	return nil
 }
 
 // watchTasks watches for task updates and broadcasts via WebSocket
 func (cp *ControlPlane) watchTasks() {
-	watchChan := cp.etcdClient.Watch(cp.ctx, "/os/", true)
+	watchChan := cp.etcdClient.Watch(cp.ctx, "/os/", true, clientv3.WithPrevKV())
 
 	for watchResp := range watchChan {
 		for _, event := range watchResp.Events {
 			key := string(event.Kv.Key)
 
+			if idc, sn, ok := parseMetaKey(key); ok {
+				if event.Type == clientv3.EventTypePut {
+					cp.publishHardware(idc, sn, event.Kv.Value)
+					go cp.decideOnHardware(idc, sn, event.Kv.Value)
+				}
+				continue
+			}
+			if idc, sn, ok := parseHardwareRecordKey(key); ok {
+				if event.Type == clientv3.EventTypePut && event.IsCreate() {
+					cp.publishDrift(idc, sn, event.Kv.Value)
+				}
+				continue
+			}
+
 			// Only process task updates
-			if !strings.HasSuffix(key, "/task") {
+			idc, sn, ok := taskindex.ParseTaskKey(key)
+			if !ok {
 				continue
 			}
 
-			if event.Type == clientv3.EventTypePut {
-				var task models.TaskV3
-				if err := json.Unmarshal(event.Kv.Value, &task); err == nil {
-					// Extract IDC from key
-					parts := strings.Split(key, "/")
-					if len(parts) >= 3 {
-						cp.wsHub.BroadcastStatus(task.TaskID, task.Status)
-					}
-				}
+			var prev []byte
+			if event.PrevKv != nil {
+				prev = event.PrevKv.Value
+			}
+
+			if event.Type == clientv3.EventTypeDelete {
+				cp.stats.Delete(idc, sn, event.Kv.ModRevision)
+				cp.publishTaskWrite(idc, sn, prev, nil, event.Kv.ModRevision)
+				cp.syncMachine(idc, sn, prev, nil)
+				go cp.releaseAddress(idc, sn)
+				continue
+			}
+
+			var task models.TaskV3
+			if err := json.Unmarshal(event.Kv.Value, &task); err == nil {
+				cp.stats.Apply(idc, sn, task.Status, task.OSType, event.Kv.ModRevision)
+				cp.publishTaskWrite(idc, sn, prev, event.Kv.Value, event.Kv.ModRevision)
+				cp.syncMachine(idc, sn, prev, event.Kv.Value)
 			}
 		}
 	}
@@ -471,23 +1057,26 @@ func (cp *ControlPlane) watchLeases() {
 
 					// Mark task as failed using atomic update
 					taskKey := etcd.TaskKeyV3(idc, sn)
-					cp.etcdClient.AtomicUpdate(taskKey, func(data []byte) (interface{}, error) {
+					err := cp.etcdClient.AtomicUpdate(taskKey, func(data []byte) (interface{}, error) {
 						var task models.TaskV3
-						json.Unmarshal(data, &task)
-
-						if task.Status == models.TaskStatusInstalling {
-							task.Status = models.TaskStatusFailed
-							task.StatusHistory = append(task.StatusHistory, models.StatusChange{
-								Status:    models.TaskStatusFailed,
-								Timestamp: time.Now(),
-								Reason:    "Agent went offline (lease expired)",
-							})
-							task.Logs = append(task.Logs, "[ERROR] Agent connection lost")
-							task.UpdatedAt = time.Now()
+						if err := json.Unmarshal(data, &task); err != nil {
+							return nil, err
 						}
 
+						// Only an installation in progress depends on the agent
+						if task.Status != models.TaskStatusInstalling {
+							return nil, errUnchanged
+						}
+						if err := task.TransitionTo(models.TaskStatusFailed, "Agent went offline (lease expired)"); err != nil {
+							return nil, err
+						}
+						task.AddLog("[ERROR] Agent connection lost")
+
 						return task, nil
 					})
+					if err != nil && !errors.Is(err, errUnchanged) {
+						log.Printf("[%s] Failed to mark %s as failed: %v", idc, sn, err)
+					}
 				}
 			}
 		}
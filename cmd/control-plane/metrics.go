@@ -0,0 +1,33 @@
+package main
+
+import "github.com/lpmos/lpmos-go/pkg/metrics"
+
+// registerMetrics exposes the IDC statistics and WebSocket hub state, read
+// when Prometheus scrapes
+func (cp *ControlPlane) registerMetrics() {
+	metrics.NewGaugeFunc("lpmos_tasks", "Tasks by IDC and status", []string{"idc", "status"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, s := range cp.stats.All() {
+			for status, n := range s.ByStatus {
+				samples = append(samples, metrics.Sample{Labels: []string{s.IDC, string(status)}, Value: float64(n)})
+			}
+		}
+		return samples
+	})
+
+	metrics.NewGaugeFunc("lpmos_websocket_clients", "Connected WebSocket clients", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(cp.wsHub.Stats().Clients)}}
+	})
+	metrics.NewGaugeFunc("lpmos_websocket_queued_messages", "Messages waiting to be written to WebSocket clients", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(cp.wsHub.Stats().Queued)}}
+	})
+	metrics.NewCounterFunc("lpmos_websocket_messages_total", "WebSocket messages by outcome", []string{"outcome"}, func() []metrics.Sample {
+		s := cp.wsHub.Stats()
+		return []metrics.Sample{
+			{Labels: []string{"published"}, Value: float64(s.Published)},
+			{Labels: []string{"delivered"}, Value: float64(s.Delivered)},
+			{Labels: []string{"coalesced"}, Value: float64(s.Coalesced)},
+			{Labels: []string{"dropped"}, Value: float64(s.Dropped)},
+		}
+	})
+}
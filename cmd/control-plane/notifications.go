@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/email"
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/taskindex"
+	"github.com/lpmos/lpmos-go/pkg/webhook"
+)
+
+// emailTaskEvent alerts the IDC's recipients about a failed task
+func (cp *ControlPlane) emailTaskEvent(e *webhook.Event) {
+	if cp.email == nil || e.Type != webhook.EventFailed {
+		return
+	}
+	cp.email.Notify(email.Alert{
+		Kind:     email.KindFailed,
+		IDC:      e.IDC,
+		SN:       e.SN,
+		TaskID:   e.TaskID,
+		Hostname: e.Hostname,
+		OSType:   e.OSType,
+		Reason:   e.Reason,
+		Since:    e.Timestamp,
+		At:       e.Timestamp,
+	})
+}
+
+// approvalWaitStatuses are the statuses a task may wait for approval in
+var approvalWaitStatuses = []models.TaskStatus{
+	models.TaskStatusPending, models.TaskStatusReady, models.TaskStatusBooting, models.TaskStatusPendingApproval,
+}
+
+// watchApprovalWaits emails once about each task that has been waiting for
+// approval longer than email.approval_wait, counted from its hardware
+// report or, before one, its creation. Tasks already overdue when the
+// control plane starts are reported again.
+func (cp *ControlPlane) watchApprovalWaits() {
+	wait := cp.cfg.ControlPlane.Notifications.Email.ApprovalWait
+	ticker := time.NewTicker(min(wait, time.Minute))
+	defer ticker.Stop()
+
+	notified := map[string]bool{} // task IDs already reported
+	for {
+		select {
+		case <-cp.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		seen := map[string]bool{}
+		now := time.Now()
+		err := taskindex.Each(cp.etcdClient, taskindex.Query{
+			Statuses:  approvalWaitStatuses,
+			Ascending: true,
+		}, func(_ string, e taskindex.Entry) bool {
+			seen[e.TaskID] = true
+			if notified[e.TaskID] {
+				return true
+			}
+
+			var task models.TaskV3
+			if err := cp.etcdClient.GetJSON(etcd.TaskKeyV3(e.IDC, e.SN), &task); err != nil {
+				return true
+			}
+			since := task.ApprovalWaitSince()
+			if !task.AwaitingApproval() || now.Sub(since) < wait {
+				return true
+			}
+
+			notified[e.TaskID] = true
+			cp.email.Notify(email.Alert{
+				Kind:     email.KindApprovalOverdue,
+				IDC:      e.IDC,
+				SN:       e.SN,
+				TaskID:   task.TaskID,
+				Hostname: task.Hostname,
+				OSType:   task.OSType,
+				Since:    since,
+				At:       now,
+			})
+			return true
+		})
+		if err != nil {
+			log.Printf("Failed to check approval waits: %v", err)
+			continue
+		}
+
+		for id := range notified {
+			if !seen[id] {
+				delete(notified, id)
+			}
+		}
+	}
+}
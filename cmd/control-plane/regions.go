@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// listRegions returns every registered regional client with its health,
+// merged from /os/region/{idc}/info and the leased heartbeat key
+func (cp *ControlPlane) listRegions(c *gin.Context) {
+	regions, err := cp.loadRegions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	principal := auth.PrincipalFrom(c)
+	visible := []models.Region{}
+	for _, region := range regions {
+		if principal.CanAccessIDC(region.ID) {
+			visible = append(visible, region)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"regions": visible,
+		"count":   len(visible),
+	})
+}
+
+// getRegion returns the health of one regional client
+func (cp *ControlPlane) getRegion(c *gin.Context) {
+	idc := c.Param("idc")
+	if !auth.Authorize(c, auth.PermissionRead, idc) {
+		return
+	}
+
+	region, err := cp.loadRegion(idc)
+	if etcd.IsKeyNotFound(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("IDC %s has no registered regional client", idc)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, region)
+}
+
+// loadRegions reads all region keys in one request, sorted by IDC
+func (cp *ControlPlane) loadRegions() ([]models.Region, error) {
+	kvs, err := cp.etcdClient.GetWithPrefix(etcd.KeyPrefixRegions)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := map[string]models.RegionInfo{}
+	heartbeats := map[string]*models.RegionHeartbeat{}
+	for key, value := range kvs {
+		// Key layout: /os/region/{idc}/{info|heartbeat}
+		idc, name, ok := strings.Cut(strings.TrimPrefix(key, etcd.KeyPrefixRegions), "/")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "info":
+			var info models.RegionInfo
+			if err := json.Unmarshal(value, &info); err != nil {
+				log.Printf("[%s] Unreadable region info: %v", idc, err)
+				continue
+			}
+			infos[idc] = info
+		case "heartbeat":
+			var heartbeat models.RegionHeartbeat
+			if err := json.Unmarshal(value, &heartbeat); err == nil {
+				heartbeats[idc] = &heartbeat
+			}
+		}
+	}
+
+	now := time.Now()
+	regions := make([]models.Region, 0, len(infos))
+	for idc, info := range infos {
+		regions = append(regions, models.NewRegion(idc, info, heartbeats[idc], now))
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].ID < regions[j].ID })
+	return regions, nil
+}
+
+// loadRegion reads the region keys of one IDC. It fails with ErrKeyNotFound
+// when the IDC never registered.
+func (cp *ControlPlane) loadRegion(idc string) (models.Region, error) {
+	var info models.RegionInfo
+	if err := cp.etcdClient.GetJSON(etcd.RegionKey(idc, "info"), &info); err != nil {
+		return models.Region{}, err
+	}
+
+	var heartbeat *models.RegionHeartbeat
+	var hb models.RegionHeartbeat
+	if err := cp.etcdClient.GetJSON(etcd.RegionKey(idc, "heartbeat"), &hb); err == nil {
+		heartbeat = &hb
+	}
+	return models.NewRegion(idc, info, heartbeat, time.Now()), nil
+}
+
+// errUnknownIDC is returned by checkRegion for IDCs that never registered
+var errUnknownIDC = errors.New("unknown IDC")
+
+// checkRegion refuses IDCs that no regional client has ever registered:
+// nothing would pick their tasks up. Offline IDCs are fine, their tasks wait.
+func (cp *ControlPlane) checkRegion(idc string) error {
+	_, err := cp.etcdClient.Get(etcd.RegionKey(idc, "info"))
+	if etcd.IsKeyNotFound(err) {
+		return fmt.Errorf("%w %s: no regional client has registered it", errUnknownIDC, idc)
+	}
+	return err
+}
+
+// watchRegions broadcasts regional clients going online (heartbeat created)
+// and offline (heartbeat lease expired or revoked)
+func (cp *ControlPlane) watchRegions() {
+	watchChan := cp.etcdClient.Watch(cp.ctx, etcd.KeyPrefixRegions, true)
+
+	for watchResp := range watchChan {
+		for _, event := range watchResp.Events {
+			idc, name, ok := strings.Cut(strings.TrimPrefix(string(event.Kv.Key), etcd.KeyPrefixRegions), "/")
+			if !ok || name != "heartbeat" {
+				continue
+			}
+
+			switch {
+			case event.Type == clientv3.EventTypeDelete:
+				log.Printf("[%s] Regional client went offline", idc)
+			case event.IsCreate():
+				log.Printf("[%s] Regional client came online", idc)
+			default:
+				continue // heartbeat rewritten on the same lease
+			}
+
+			region, err := cp.loadRegion(idc)
+			if err != nil {
+				log.Printf("[%s] Failed to load region: %v", idc, err)
+				continue
+			}
+			cp.wsHub.BroadcastRegion(region)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/inventory"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// searchMachines finds inventory machines whose hardware matches q, an
+// expression in the approval rule language over the machine and hardware
+// roots. On top of the inventory filters it takes:
+//
+//   - fields: comma-separated expressions to return instead of the machines
+//   - format=csv: stream every match as CSV with fields as the columns
+//   - facet: an expression whose distinct values are counted over every match
+func (cp *ControlPlane) searchMachines(c *gin.Context) {
+	q, err := machineQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if s := c.Query("q"); s != "" {
+		if q.Where, err = inventory.CompileSearch(s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "q: " + err.Error()})
+			return
+		}
+	}
+
+	if s := c.Query("facet"); s != "" {
+		cp.facetMachines(c, q, s)
+		return
+	}
+
+	var columns []inventory.Column
+	if s := c.Query("fields"); s != "" || c.Query("format") == "csv" {
+		if columns, err = inventory.ParseColumns(s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "fields: " + err.Error()})
+			return
+		}
+	}
+
+	switch c.Query("format") {
+	case "", "json":
+	case "csv":
+		cp.exportMachinesCSV(c, q, columns)
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	machines, next, err := inventory.List(cp.etcdClient, q)
+	if errors.Is(err, inventory.ErrBadCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if columns == nil {
+		c.JSON(http.StatusOK, gin.H{"machines": machines, "count": len(machines), "next_cursor": next})
+		return
+	}
+
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+	}
+	rows := make([][]interface{}, 0, len(machines))
+	for i := range machines {
+		env := inventory.Env(&machines[i])
+		row := make([]interface{}, len(columns))
+		for j, col := range columns {
+			row[j] = col.Value(env)
+		}
+		rows = append(rows, row)
+	}
+	c.JSON(http.StatusOK, gin.H{"columns": names, "rows": rows, "count": len(rows), "next_cursor": next})
+}
+
+// exportMachinesCSV streams every machine matching q, ignoring the page
+// limit, one CSV row per machine
+func (cp *ControlPlane) exportMachinesCSV(c *gin.Context, q inventory.Query, columns []inventory.Column) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="lpmos-machines-%s.csv"`, time.Now().UTC().Format("20060102T150405Z")))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = col.Name
+	}
+	w.Write(header)
+
+	record := make([]string, len(columns))
+	err := inventory.Each(cp.etcdClient, q, func(_ string, m *models.Machine) bool {
+		env := inventory.Env(m)
+		for i, col := range columns {
+			record[i] = inventory.FormatValue(col.Value(env))
+		}
+		return w.Write(record) == nil
+	})
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		// A truncated CSV looks complete to a spreadsheet; log it so the
+		// short export can be traced
+		log.Printf("Machine export for %s failed: %v", auth.Actor(c), err)
+	}
+}
+
+// facetMachines counts the distinct values of expression over every machine
+// matching q, e.g. hardware.bios.version for the BIOS versions in use
+func (cp *ControlPlane) facetMachines(c *gin.Context, q inventory.Query, expression string) {
+	expr, err := inventory.CompileSearch(expression)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "facet: " + err.Error()})
+		return
+	}
+
+	facet := inventory.NewFacet()
+	total := 0
+	err = inventory.Each(cp.etcdClient, q, func(_ string, m *models.Machine) bool {
+		facet.Add(expr.Eval(inventory.Env(m)))
+		total++
+		return true
+	})
+	if errors.Is(err, inventory.ErrBadCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"facet": expression, "values": facet.Counts(), "machines": total})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/tasklog"
+)
+
+// taskLogs returns the log lines and progress steps of an attempt, the
+// current one unless task_id names an archived one. after skips entries up
+// to that sequence number. With follow=true the entries are streamed as
+// JSON lines, followed by new ones as they are written until the attempt
+// finishes or the client goes away.
+func (cp *ControlPlane) taskLogs(c *gin.Context) {
+	idc := c.Param("idc")
+	sn := c.Param("sn")
+
+	var after int64
+	if value := c.Query("after"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid after %q", value)})
+			return
+		}
+		after = n
+	}
+	follow := c.Query("follow") == "true"
+
+	// A machine without a current task may still have archived attempts
+	var attempt models.TaskV3
+	_ = cp.etcdClient.GetJSON(etcd.TaskKeyV3(idc, sn), &attempt)
+	taskID := c.DefaultQuery("task_id", attempt.TaskID)
+	if taskID != attempt.TaskID {
+		attempt = models.TaskV3{}
+		_ = cp.etcdClient.GetJSON(etcd.AttemptKey(idc, sn, taskID), &attempt)
+	}
+	if taskID == "" || attempt.TaskID != taskID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	}
+
+	entries, rev, err := tasklog.List(cp.etcdClient, idc, sn, taskID, after)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Tasks written before logs had their own keys keep them in the value
+	if len(entries) == 0 && after == 0 {
+		entries = append(entries, attempt.LegacyLogEntries()...)
+	}
+
+	if !follow {
+		c.JSON(http.StatusOK, gin.H{
+			"idc":     idc,
+			"sn":      sn,
+			"task_id": taskID,
+			"count":   len(entries),
+			"entries": entries,
+		})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	write := func(e models.TaskLogEntry) error {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+	for _, e := range entries {
+		if err := write(e); err != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	running, err := cp.attemptRunning(idc, sn, taskID, rev)
+	if err != nil || !running {
+		return
+	}
+
+	// Stop on client disconnect or shutdown, whichever comes first
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-cp.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := tasklog.Follow(ctx, cp.etcdClient, idc, sn, taskID, rev, write); err != nil && ctx.Err() == nil {
+		// The entries sent so far stand; the client can reconnect with
+		// after set to the seq of the last one it got
+		log.Printf("[%s] Following logs of %s (%s) failed: %v", idc, sn, taskID, err)
+	}
+}
+
+// attemptRunning reports whether taskID was the current, unfinished attempt
+// of the machine at revision rev, so more entries may follow
+func (cp *ControlPlane) attemptRunning(idc, sn, taskID string, rev int64) (bool, error) {
+	key := etcd.TaskKeyV3(idc, sn)
+	kvs, _, _, err := cp.etcdClient.Range(key, key+"\x00", 1, false, rev)
+	if err != nil || len(kvs) == 0 {
+		return false, err
+	}
+	var task models.TaskV3
+	if err := json.Unmarshal(kvs[0].Value, &task); err != nil {
+		return false, err
+	}
+	return task.TaskID == taskID && !models.IsFinished(task.Status), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// listUnmatchedReports lists the hardware reports no task matched, newest
+// first, optionally for one idc
+func (cp *ControlPlane) listUnmatchedReports(c *gin.Context) {
+	principal := auth.PrincipalFrom(c)
+	kvs, err := cp.etcdClient.GetWithPrefix(etcd.UnmatchedReportPrefix(c.Query("idc")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reports := make([]models.UnmatchedReport, 0, len(kvs))
+	for key, value := range kvs {
+		report, err := decodeUnmatchedReport(key, value)
+		if err != nil {
+			log.Printf("Skipping unreadable unmatched report %s: %v", key, err)
+			continue
+		}
+		if principal.CanAccessIDC(report.IDC) {
+			reports = append(reports, *report)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].ReportedAt.After(reports[j].ReportedAt)
+	})
+
+	c.JSON(http.StatusOK, gin.H{"reports": reports, "count": len(reports)})
+}
+
+// getUnmatchedReport returns one unmatched report with its hardware
+func (cp *ControlPlane) getUnmatchedReport(c *gin.Context) {
+	report, err := cp.unmatchedReport(c.Param("idc"), c.Param("mac"))
+	if err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// deleteUnmatchedReport discards an unmatched report. The agent stores a
+// new one on its next report unless a task exists by then.
+func (cp *ControlPlane) deleteUnmatchedReport(c *gin.Context) {
+	idc, mac := c.Param("idc"), c.Param("mac")
+	report, err := cp.unmatchedReport(idc, mac)
+	if err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if err := cp.etcdClient.Delete(etcd.UnmatchedReportKey(idc, mac)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[%s] Deleted unmatched report of %s (%s) by %s", idc, mac, report.SN, auth.Actor(c))
+	cp.recordAction(c, audit.Record{Action: audit.ActionReportDelete, IDC: idc, SN: report.SN, Detail: "MAC " + mac})
+	c.JSON(http.StatusOK, gin.H{"message": "Unmatched report deleted"})
+}
+
+// adoptUnmatchedReport enrolls the machine of an unmatched report: it
+// creates a task prefilled with the reported SN and MAC, or with as=server
+// only a servers directory entry. The report is removed afterwards.
+func (cp *ControlPlane) adoptUnmatchedReport(c *gin.Context) {
+	idc, mac := c.Param("idc"), c.Param("mac")
+
+	var req models.AdoptReportRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report, err := cp.unmatchedReport(idc, mac)
+	if err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if req.SN == "" {
+		req.SN = report.SN
+	}
+	if req.SN == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the report has no serial number, sn is required"})
+		return
+	}
+	actor := auth.Actor(c)
+
+	switch req.As {
+	case "", "task":
+		if req.OSType == "" || req.OSVersion == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "os_type and os_version are required to adopt as a task"})
+			return
+		}
+		task, superseded, err := cp.insertTask(models.CreateTaskRequestV3{
+			IDC:         idc,
+			SN:          req.SN,
+			MAC:         report.MAC,
+			IP:          req.IP,
+			Hostname:    req.Hostname,
+			OSType:      req.OSType,
+			OSVersion:   req.OSVersion,
+			DiskLayout:  req.DiskLayout,
+			NetworkConf: req.NetworkConf,
+			Tags:        req.Tags,
+		}, actor)
+		if err != nil {
+			c.JSON(createErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		cp.removeAdoptedReport(idc, mac)
+		cp.recordAction(c, taskRecord(audit.ActionReportAdopt, superseded, &task, "MAC "+mac))
+		c.JSON(http.StatusCreated, task)
+
+	case "server":
+		if err := cp.checkRegion(idc); err != nil {
+			c.JSON(createErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		note := req.Note
+		if note == "" {
+			note = fmt.Sprintf("Adopted from unmatched report by %s", actor)
+		}
+		entry := models.ServerEntry{SN: req.SN, Status: "registered", MAC: report.MAC, AddedAt: time.Now(), Note: note}
+		created, err := cp.etcdClient.PutIfAbsent(etcd.ServerKey(idc, req.SN), entry)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !created {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("server %s is already in the servers directory of %s", req.SN, idc)})
+			return
+		}
+		cp.removeAdoptedReport(idc, mac)
+		log.Printf("[%s] Adopted %s (%s) as a server (by %s)", idc, req.SN, mac, actor)
+		cp.recordAction(c, audit.Record{Action: audit.ActionReportAdopt, IDC: idc, SN: req.SN, Detail: "as server, MAC " + mac})
+		c.JSON(http.StatusCreated, entry)
+
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("as must be task or server, got %q", req.As)})
+	}
+}
+
+// removeAdoptedReport deletes a report whose machine was enrolled. The
+// enrollment stands either way, so a failure is only logged.
+func (cp *ControlPlane) removeAdoptedReport(idc, mac string) {
+	if err := cp.etcdClient.Delete(etcd.UnmatchedReportKey(idc, mac)); err != nil {
+		log.Printf("[%s] Failed to remove adopted report of %s: %v", idc, mac, err)
+	}
+}
+
+// unmatchedReport loads the report of mac in idc
+func (cp *ControlPlane) unmatchedReport(idc, mac string) (*models.UnmatchedReport, error) {
+	key := etcd.UnmatchedReportKey(idc, mac)
+	value, err := cp.etcdClient.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeUnmatchedReport(key, value)
+}
+
+// decodeUnmatchedReport reads a stored report. Reports written before they
+// carried their IDC and time get the IDC and MAC from the key.
+func decodeUnmatchedReport(key string, value []byte) (*models.UnmatchedReport, error) {
+	var report models.UnmatchedReport
+	if err := json.Unmarshal(value, &report); err != nil {
+		return nil, err
+	}
+	idc, mac, ok := strings.Cut(strings.TrimPrefix(key, etcd.UnmatchedReportPrefix("")), "/")
+	if !ok {
+		return nil, fmt.Errorf("unexpected key %s", key)
+	}
+	if report.IDC == "" {
+		report.IDC = idc
+	}
+	if report.MAC == "" {
+		report.MAC = mac
+	}
+	return &report, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/config"
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/metrics"
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/taskindex"
+	"github.com/lpmos/lpmos-go/pkg/watchdog"
+)
+
+var taskTimeouts = metrics.NewCounter("lpmos_task_timeouts_total",
+	"Installations failed by the watchdog", "idc", "code")
+
+// runWatchdog fails approved and installing tasks that ran past their
+// deadlines, every watchdog.interval
+func (cp *ControlPlane) runWatchdog() {
+	cfg := cp.cfg.ControlPlane.Watchdog
+	policy := watchdog.NewPolicy(cfg, cp.cfg.RegionalClient.Installation)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cp.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var running []taskindex.Entry
+		err := taskindex.Each(cp.etcdClient, taskindex.Query{
+			Statuses:  []models.TaskStatus{models.TaskStatusApproved, models.TaskStatusInstalling},
+			Ascending: true,
+		}, func(_ string, e taskindex.Entry) bool {
+			running = append(running, e)
+			return true
+		})
+		if err != nil {
+			log.Printf("Failed to list running tasks for the watchdog: %v", err)
+			continue
+		}
+		for _, e := range running {
+			cp.expireTask(e.IDC, e.SN, e.TaskID, policy, cfg)
+		}
+	}
+}
+
+// expireTask fails the task when it is still attempt taskID and past its
+// limits, then starts a new attempt when auto_retry allows one
+func (cp *ControlPlane) expireTask(idc, sn, taskID string, policy *watchdog.Policy, cfg config.WatchdogConfig) {
+	var (
+		before, after models.TaskV3
+		limits        watchdog.Limits
+		taskErr       *models.TaskError
+	)
+	err := cp.etcdClient.AtomicUpdate(etcd.TaskKeyV3(idc, sn), func(data []byte) (interface{}, error) {
+		var task models.TaskV3
+		if err := json.Unmarshal(data, &task); err != nil {
+			return nil, err
+		}
+		if task.TaskID != taskID {
+			return nil, errUnchanged
+		}
+		limits = policy.Limits(idc, task.OSType)
+		taskErr = watchdog.Check(&task, limits, time.Now())
+		if taskErr == nil {
+			return nil, errUnchanged
+		}
+		before = task
+
+		if err := task.TransitionTo(models.TaskStatusFailed, taskErr.Message); err != nil {
+			return nil, err
+		}
+		task.Error = taskErr
+		task.AddLog("[ERROR] " + taskErr.Message)
+		after = task
+		return task, nil
+	})
+	if errors.Is(err, errUnchanged) || errors.Is(err, etcd.ErrKeyNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] Failed to time out task %s for %s: %v", idc, taskID, sn, err)
+		return
+	}
+
+	log.Printf("[%s] Task %s for %s timed out (%s): %s", idc, taskID, sn, taskErr.Code, taskErr.Message)
+	taskTimeouts.With(idc, taskErr.Code).Inc()
+	r := taskRecord(audit.ActionTaskTimeout, &before, &after, taskErr.Message)
+	r.Actor, r.Method = "watchdog", "system"
+	cp.appendAudit(r)
+
+	if cfg.AutoRetry && watchdog.RetryAllowed(&after, limits) {
+		cp.retryTimedOut(idc, sn, taskID, taskErr)
+	}
+}
+
+// retryTimedOut starts a new attempt of a task the watchdog failed. The
+// approval stands, so the attempt goes straight back to approved.
+func (cp *ControlPlane) retryTimedOut(idc, sn, taskID string, taskErr *models.TaskError) {
+	var before, after models.TaskV3
+	err := cp.etcdClient.AtomicUpdateOps(etcd.TaskKeyV3(idc, sn), func(data []byte) (interface{}, []clientv3.Op, error) {
+		var task models.TaskV3
+		if err := json.Unmarshal(data, &task); err != nil {
+			return nil, nil, err
+		}
+		// Someone else already retried or cancelled it
+		if task.TaskID != taskID || task.Status != models.TaskStatusFailed {
+			return nil, nil, errUnchanged
+		}
+		before = task
+		if err := cp.checkMachineInstallable(idc, sn); err != nil {
+			return nil, nil, err
+		}
+
+		archived, err := task.StartNewAttempt(newTaskID(), "Automatic retry after "+taskErr.Code)
+		if err != nil {
+			return nil, nil, err
+		}
+		task.PXEConfigured = false
+		if err := task.TransitionTo(models.TaskStatusApproved, fmt.Sprintf("Automatic retry of %s after %s", taskID, taskErr.Code)); err != nil {
+			return nil, nil, err
+		}
+		task.AddLog(fmt.Sprintf("[INFO] Attempt %d started by the watchdog (retry): %s", task.Attempt, taskErr.Message))
+
+		op, err := etcd.OpPut(etcd.AttemptKey(idc, sn, archived.TaskID), archived)
+		if err != nil {
+			return nil, nil, err
+		}
+		after = task
+		return task, []clientv3.Op{op}, nil
+	})
+	if errors.Is(err, errUnchanged) {
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] Failed to retry timed out task %s for %s: %v", idc, taskID, sn, err)
+		return
+	}
+
+	log.Printf("[%s] Retried task %s for %s as %s (attempt %d)", idc, taskID, sn, after.TaskID, after.Attempt)
+	r := taskRecord(audit.ActionTaskRetry, &before, &after, taskErr.Message)
+	r.Actor, r.Method = "watchdog", "system"
+	cp.appendAudit(r)
+}
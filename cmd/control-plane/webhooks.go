@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/config"
+	"github.com/lpmos/lpmos-go/pkg/webhook"
+)
+
+// configWebhookID identifies the subscription made from
+// notifications.webhook_url in dead letters
+const configWebhookID = "config"
+
+// webhookRequest creates or changes a subscription. On update, omitted
+// fields keep their value; an empty secret keeps the current one.
+type webhookRequest struct {
+	URL         *string   `json:"url"`
+	Secret      string    `json:"secret"`
+	Events      *[]string `json:"events"`
+	IDCs        *[]string `json:"idcs"`
+	Enabled     *bool     `json:"enabled"`
+	Description *string   `json:"description"`
+}
+
+// newWebhookDispatcher builds the dispatcher from the notification settings
+func newWebhookDispatcher(store *webhook.EtcdStore, cfg config.NotificationsConfig) *webhook.Dispatcher {
+	opts := webhook.Options{
+		MaxAttempts:    cfg.Webhooks.MaxAttempts,
+		InitialBackoff: cfg.Webhooks.InitialBackoff,
+		MaxBackoff:     cfg.Webhooks.MaxBackoff,
+		Timeout:        cfg.Webhooks.Timeout,
+	}
+	if cfg.WebhookURL != "" {
+		opts.Static = append(opts.Static, webhook.Subscription{
+			ID:          configWebhookID,
+			URL:         cfg.WebhookURL,
+			Secret:      cfg.WebhookSecret,
+			Enabled:     true,
+			Description: "notifications.webhook_url",
+		})
+	}
+	return webhook.NewDispatcher(store, opts)
+}
+
+// canManageWebhook allows principals scoped to some IDCs to see and change
+// only subscriptions limited to those IDCs
+func canManageWebhook(p *auth.Principal, sub *webhook.Subscription) bool {
+	if p == nil {
+		return false
+	}
+	if len(p.IDCs) == 0 {
+		return true
+	}
+	if len(sub.IDCs) == 0 {
+		return false
+	}
+	for _, idc := range sub.IDCs {
+		if !p.CanAccessIDC(idc) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadWebhook reads the subscription named by :id, writing a 404 or 403
+// response when the caller cannot have it
+func (cp *ControlPlane) loadWebhook(c *gin.Context) (*webhook.Subscription, bool) {
+	sub, err := cp.webhookStore.Subscription(c.Param("id"))
+	if err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if !canManageWebhook(auth.PrincipalFrom(c), sub) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "webhook covers IDCs you cannot access"})
+		return nil, false
+	}
+	return sub, true
+}
+
+// listWebhooks lists the subscriptions the caller may see, secrets redacted
+func (cp *ControlPlane) listWebhooks(c *gin.Context) {
+	subs, err := cp.webhookStore.Subscriptions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	principal := auth.PrincipalFrom(c)
+	visible := make([]webhook.Subscription, 0, len(subs))
+	for i := range subs {
+		if canManageWebhook(principal, &subs[i]) {
+			visible = append(visible, subs[i].Redacted())
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": visible, "count": len(visible), "events": webhook.EventTypes})
+}
+
+// getWebhook returns one subscription, secret redacted
+func (cp *ControlPlane) getWebhook(c *gin.Context) {
+	sub, ok := cp.loadWebhook(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, sub.Redacted())
+}
+
+// createWebhook adds a subscription. Without a secret one is generated; the
+// response is the only place it is shown.
+func (cp *ControlPlane) createWebhook(c *gin.Context) {
+	var req webhookRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.URL == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+		return
+	}
+
+	now := time.Now()
+	sub := webhook.Subscription{
+		ID:        uuid.New().String(),
+		Enabled:   true,
+		CreatedBy: auth.Actor(c),
+		CreatedAt: now,
+	}
+	applyWebhookRequest(&sub, &req)
+	if sub.Secret == "" {
+		sub.Secret = newWebhookSecret()
+	}
+	if !cp.saveWebhook(c, &sub) {
+		return
+	}
+
+	log.Printf("Webhook %s to %s created by %s (events %v, IDCs %v)", sub.ID, sub.URL, sub.CreatedBy, sub.Events, sub.IDCs)
+	cp.recordAction(c, audit.Record{Action: audit.ActionWebhookCreate, Detail: fmt.Sprintf("webhook %s to %s", sub.ID, sub.URL)})
+	c.JSON(http.StatusCreated, sub)
+}
+
+// updateWebhook changes the fields given in the request
+func (cp *ControlPlane) updateWebhook(c *gin.Context) {
+	sub, ok := cp.loadWebhook(c)
+	if !ok {
+		return
+	}
+	var req webhookRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	applyWebhookRequest(sub, &req)
+	if !cp.saveWebhook(c, sub) {
+		return
+	}
+
+	log.Printf("Webhook %s updated by %s", sub.ID, auth.Actor(c))
+	cp.recordAction(c, audit.Record{Action: audit.ActionWebhookUpdate, Detail: fmt.Sprintf("webhook %s to %s", sub.ID, sub.URL)})
+	c.JSON(http.StatusOK, sub.Redacted())
+}
+
+// deleteWebhook removes a subscription; retries still queued for it are dropped
+func (cp *ControlPlane) deleteWebhook(c *gin.Context) {
+	sub, ok := cp.loadWebhook(c)
+	if !ok {
+		return
+	}
+	if err := cp.webhookStore.DeleteSubscription(sub.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("Webhook %s to %s deleted by %s", sub.ID, sub.URL, auth.Actor(c))
+	cp.recordAction(c, audit.Record{Action: audit.ActionWebhookDelete, Detail: fmt.Sprintf("webhook %s to %s", sub.ID, sub.URL)})
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted", "id": sub.ID})
+}
+
+func applyWebhookRequest(sub *webhook.Subscription, req *webhookRequest) {
+	if req.URL != nil {
+		sub.URL = *req.URL
+	}
+	if req.Secret != "" {
+		sub.Secret = req.Secret
+	}
+	if req.Events != nil {
+		sub.Events = *req.Events
+	}
+	if req.IDCs != nil {
+		sub.IDCs = *req.IDCs
+	}
+	if req.Enabled != nil {
+		sub.Enabled = *req.Enabled
+	}
+	if req.Description != nil {
+		sub.Description = *req.Description
+	}
+}
+
+// saveWebhook validates and stores a subscription, writing the error
+// response when it cannot
+func (cp *ControlPlane) saveWebhook(c *gin.Context, sub *webhook.Subscription) bool {
+	if err := sub.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if !canManageWebhook(auth.PrincipalFrom(c), sub) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "webhook must be limited to IDCs you can access"})
+		return false
+	}
+	sub.UpdatedAt = time.Now()
+	if err := cp.webhookStore.SaveSubscription(sub); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// listWebhookDeadLetters lists deliveries that failed for good, newest first,
+// for the IDCs the caller can access
+func (cp *ControlPlane) listWebhookDeadLetters(c *gin.Context) {
+	letters, err := cp.webhookStore.DeadLetters()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	principal := auth.PrincipalFrom(c)
+	visible := make([]webhook.DeadLetter, 0, len(letters))
+	for _, dl := range letters {
+		if principal.CanAccessIDC(dl.Event.IDC) {
+			visible = append(visible, dl)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"dead_letters": visible, "count": len(visible)})
+}
+
+// loadDeadLetter reads the dead letter named by :id for a caller allowed to
+// write to its IDC
+func (cp *ControlPlane) loadDeadLetter(c *gin.Context) (*webhook.DeadLetter, bool) {
+	dl, err := cp.webhookStore.DeadLetter(c.Param("id"))
+	if err != nil {
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if !auth.Authorize(c, auth.PermissionWrite, dl.Event.IDC) {
+		return nil, false
+	}
+	return dl, true
+}
+
+// retryWebhookDeadLetter queues a dead letter for delivery again and removes
+// it from the list; if it fails again it comes back as a new dead letter
+func (cp *ControlPlane) retryWebhookDeadLetter(c *gin.Context) {
+	dl, ok := cp.loadDeadLetter(c)
+	if !ok {
+		return
+	}
+
+	if err := cp.webhooks.Redeliver(*dl); err != nil {
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, webhook.ErrUnknownSubscription) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err := cp.webhookStore.DeleteDeadLetter(dl.ID); err != nil {
+		log.Printf("Warning: failed to remove webhook dead letter %s: %v", dl.ID, err)
+	}
+
+	log.Printf("Webhook dead letter %s (%s for %s/%s) requeued by %s", dl.ID, dl.Event.Type, dl.Event.IDC, dl.Event.SN, auth.Actor(c))
+	c.JSON(http.StatusAccepted, gin.H{"message": "Delivery queued", "id": dl.ID})
+}
+
+// deleteWebhookDeadLetter drops a dead letter without delivering it
+func (cp *ControlPlane) deleteWebhookDeadLetter(c *gin.Context) {
+	dl, ok := cp.loadDeadLetter(c)
+	if !ok {
+		return
+	}
+	if err := cp.webhookStore.DeleteDeadLetter(dl.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Dead letter deleted", "id": dl.ID})
+}
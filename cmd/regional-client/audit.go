@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// auditQueueSize bounds the agent audit records waiting to be appended
+const auditQueueSize = 1000
+
+// agentIgnoredFields are the task fields left out of agent audit records:
+// the log and progress change on every report and are kept by the task log
+var agentIgnoredFields = []string{"log", "log_seq", "logs", "progress", "last_progress", "step_started", "updated_at"}
+
+// recordAgentAction queues an audit record of an agent changing its task.
+// Agents are not authenticated, so the actor is the serial number they
+// claimed. The change already happened, so a failure is only logged.
+func (rc *RegionalClient) recordAgentAction(c *gin.Context, action, sn string, before, after *models.TaskV3, detail string) {
+	r := audit.Record{
+		Actor:    "agent/" + sn,
+		Method:   "agent",
+		SourceIP: c.ClientIP(),
+		Action:   action,
+		IDC:      rc.idc,
+		SN:       sn,
+		TaskID:   after.TaskID,
+		Detail:   detail,
+		Changes:  audit.Diff(before, after, agentIgnoredFields...),
+	}
+	if !rc.audit.Add(r) {
+		log.Printf("[%s] Audit queue full, dropped %s on %s", rc.idc, action, sn)
+	}
+}
+
+// appendAudit appends the queued agent audit records until the client stops
+func (rc *RegionalClient) appendAudit() {
+	rc.audit.Run(rc.ctx, func(r audit.Record, err error) {
+		log.Printf("[%s] Failed to record audit %s on %s: %v", rc.idc, r.Action, r.SN, err)
+	})
+}
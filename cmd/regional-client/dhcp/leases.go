@@ -120,6 +120,19 @@ func (lm *LeaseManager) GetAll() []*Lease {
 	return leases
 }
 
+// Usage returns the number of leased addresses and the size of the pool
+func (lm *LeaseManager) Usage() (active, size int) {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	start := lm.startIP.To4()
+	end := lm.endIP.To4()
+	if start != nil && end != nil && !ipGreaterThan(start, end) {
+		size = int(ipToUint32(end)-ipToUint32(start)) + 1
+	}
+	return len(lm.leases), size
+}
+
 // findAvailableIP finds an available IP in the pool
 func (lm *LeaseManager) findAvailableIP() net.IP {
 	// Iterate through IP range
@@ -168,6 +181,11 @@ func incIP(ip net.IP) {
 	}
 }
 
+// ipToUint32 converts an IPv4 address to its numeric value
+func ipToUint32(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
 // ipGreaterThan checks if ip1 > ip2
 func ipGreaterThan(ip1, ip2 net.IP) bool {
 	ip1 = ip1.To4()
@@ -4,12 +4,17 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/krolaw/dhcp4"
+
+	"github.com/lpmos/lpmos-go/pkg/metrics"
 )
 
+var packetsReceived = metrics.NewCounter("lpmos_dhcp_packets_total", "DHCP packets received, by message type", "type")
+
 // Server represents a DHCP server
 type Server struct {
 	Interface    string
@@ -184,8 +189,10 @@ func (s *Server) serve() {
 func (s *Server) handlePacket(packet dhcp4.Packet, addr net.Addr) error {
 	msgType := packet.ParseOptions()[dhcp4.OptionDHCPMessageType]
 	if len(msgType) == 0 {
+		packetsReceived.With("unknown").Inc()
 		return fmt.Errorf("no message type")
 	}
+	packetsReceived.With(messageTypeLabel(dhcp4.MessageType(msgType[0]))).Inc()
 
 	mac := packet.CHAddr()
 
@@ -203,6 +210,15 @@ func (s *Server) handlePacket(packet dhcp4.Packet, addr net.Addr) error {
 	return nil
 }
 
+// messageTypeLabel names a message type for metrics, folding values
+// outside the standard set into "unknown"
+func messageTypeLabel(t dhcp4.MessageType) string {
+	if t < dhcp4.Discover || t > dhcp4.Inform {
+		return "unknown"
+	}
+	return strings.ToLower(t.String())
+}
+
 // handleDiscover handles DHCP Discover
 func (s *Server) handleDiscover(packet dhcp4.Packet, mac net.HardwareAddr) error {
 	log.Printf("[DHCP] DISCOVER from %s", mac)
@@ -394,6 +410,11 @@ func (s *Server) GetLeases() []*Lease {
 	return s.leases.GetAll()
 }
 
+// PoolUsage returns the number of dynamic leases and the size of the pool
+func (s *Server) PoolUsage() (active, size int) {
+	return s.leases.Usage()
+}
+
 // GetStaticBindings returns all static bindings
 func (s *Server) GetStaticBindings() map[string]*StaticBinding {
 	s.mu.RLock()
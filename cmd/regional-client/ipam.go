@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+const (
+	// dhcpLeasesInterval is how often the dynamic leases are published
+	dhcpLeasesInterval = 30 * time.Second
+	// dhcpLeasesTTL lets the published leases expire when the regional
+	// client stops
+	dhcpLeasesTTL = 90
+)
+
+// publishDHCPLeases keeps /os/ipam/{idc}/dhcp_leases up to date, so the
+// control plane's IPAM neither allocates an address the DHCP server has
+// leased nor lets a pool overlap its dynamic range unnoticed
+func (rc *RegionalClient) publishDHCPLeases() {
+	ticker := time.NewTicker(dhcpLeasesInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := rc.etcdClient.PutWithLease(etcd.DHCPLeasesKey(rc.idc), rc.dhcpLeases(), dhcpLeasesTTL); err != nil {
+			log.Printf("[%s] Failed to publish DHCP leases: %v", rc.idc, err)
+		}
+		select {
+		case <-rc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dhcpLeases returns the dynamic range and active leases of the DHCP server
+func (rc *RegionalClient) dhcpLeases() models.DHCPLeases {
+	now := time.Now()
+	published := models.DHCPLeases{
+		RangeStart: rc.dhcpServer.StartIP.String(),
+		RangeEnd:   rc.dhcpServer.EndIP.String(),
+		Leases:     []models.DHCPLease{},
+		UpdatedAt:  now,
+	}
+	for _, lease := range rc.dhcpServer.GetLeases() {
+		if lease.ExpireTime.Before(now) {
+			continue
+		}
+		published.Leases = append(published.Leases, models.DHCPLease{
+			IP:        lease.IP.String(),
+			MAC:       lease.MAC.String(),
+			Hostname:  lease.Hostname,
+			ExpiresAt: lease.ExpireTime,
+		})
+	}
+	return published
+}
+
+// checkLeaseConflict warns when the install address of a task is leased to
+// another machine, which would then share it once the task boots
+func (rc *RegionalClient) checkLeaseConflict(task *models.TaskV3) {
+	ip := net.ParseIP(task.IP)
+	if rc.dhcpServer == nil || ip == nil {
+		return
+	}
+	now := time.Now()
+	for _, lease := range rc.dhcpServer.GetLeases() {
+		if !lease.IP.Equal(ip) || lease.ExpireTime.Before(now) || strings.EqualFold(lease.MAC.String(), task.MAC) {
+			continue
+		}
+
+		msg := fmt.Sprintf("[WARN] Install address %s is leased by DHCP to %s until %s",
+			task.IP, lease.MAC, lease.ExpireTime.Format(time.RFC3339))
+		log.Printf("[%s] %s (task %s of %s)", rc.idc, msg, task.TaskID, task.SN)
+		rc.etcdClient.AtomicUpdate(etcd.TaskKeyV3(rc.idc, task.SN), func(data []byte) (interface{}, error) {
+			var t models.TaskV3
+			if err := json.Unmarshal(data, &t); err != nil {
+				return nil, err
+			}
+			t.AddLog(msg)
+			t.UpdatedAt = time.Now()
+			return t, nil
+		})
+		return
+	}
+}
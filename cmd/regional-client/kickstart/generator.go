@@ -6,9 +6,12 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/lpmos/lpmos-go/pkg/metrics"
 	"github.com/lpmos/lpmos-go/pkg/models"
 )
 
+var renders = metrics.NewCounter("lpmos_kickstart_renders_total", "Kickstart/preseed renders by OS type and result", "os_type", "result")
+
 // Generator generates kickstart/preseed files
 type Generator struct {
 	templates map[string]*template.Template
@@ -59,6 +62,17 @@ type KickstartData struct {
 
 // Generate generates kickstart/preseed content
 func (g *Generator) Generate(task *models.TaskV3, config *models.OSInstallConfig) (string, error) {
+	content, err := g.render(task, config)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	renders.With(config.OSType, result).Inc()
+	return content, err
+}
+
+// render executes the template matching the OS type and version
+func (g *Generator) render(task *models.TaskV3, config *models.OSInstallConfig) (string, error) {
 	// 选择模板
 	templateKey := fmt.Sprintf("%s-%s", config.OSType, config.OSVersion)
 	tmpl, ok := g.templates[templateKey]
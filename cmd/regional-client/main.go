@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -20,14 +23,23 @@ import (
 	"github.com/lpmos/lpmos-go/cmd/regional-client/kickstart"
 	"github.com/lpmos/lpmos-go/cmd/regional-client/pxe"
 	"github.com/lpmos/lpmos-go/cmd/regional-client/tftp"
+	"github.com/lpmos/lpmos-go/pkg/audit"
+	"github.com/lpmos/lpmos-go/pkg/bom"
+	"github.com/lpmos/lpmos-go/pkg/config"
 	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/inventory"
+	"github.com/lpmos/lpmos-go/pkg/metrics"
 	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/taskindex"
+	"github.com/lpmos/lpmos-go/pkg/tasklog"
 )
 
 // RegionalClient handles regional PXE/TFTP services with OPTIMIZED SCHEMA v3.0
 type RegionalClient struct {
+	cfg        *config.RegionalClientConfig
 	idc        string
 	etcdClient *etcd.Client
+	audit      *audit.Queue
 	ctx        context.Context
 	cancel     context.CancelFunc
 	leases     map[string]clientv3.LeaseID // sn -> leaseID mapping
@@ -52,65 +64,62 @@ type RegionalClient struct {
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatal("Usage: regional-client --idc=<idc> [--api-port=8081] [--enable-dhcp] [--enable-tftp] [--server-ip=192.168.100.1] [--interface=eth1]")
+	configPath := flag.String("config", os.Getenv(config.EnvConfigPath), "Path to LPMOS config file")
+	flag.String("idc", "", "IDC served by this regional client (regional_client.region_id)")
+	flag.String("api-port", "", "Agent API port (regional_client.api.port)")
+	flag.Bool("enable-dhcp", false, "Run the DHCP server (regional_client.services.pxe.enabled)")
+	flag.Bool("enable-tftp", false, "Run the TFTP server (regional_client.services.tftp.enabled)")
+	flag.String("server-ip", "", "PXE server IP (regional_client.services.pxe.server_ip)")
+	flag.String("interface", "", "DHCP interface (regional_client.services.pxe.interface)")
+	flag.String("static-root", "", "Root directory for TFTP/static files (regional_client.services.tftp.root_dir)")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
 	}
-
-	var idc string
-	apiPort := "8081"
-	enableDHCP := false
-	enableTFTP := false
-	serverIP := "192.168.100.1"
-	networkIface := "eth1"
-	staticRoot := "/tftpboot" // Root directory for static files
-
-	for _, arg := range os.Args[1:] {
-		if strings.HasPrefix(arg, "--idc=") {
-			idc = strings.TrimPrefix(arg, "--idc=")
-		}
-		if strings.HasPrefix(arg, "--api-port=") {
-			apiPort = strings.TrimPrefix(arg, "--api-port=")
-		}
-		if arg == "--enable-dhcp" {
-			enableDHCP = true
-		}
-		if arg == "--enable-tftp" {
-			enableTFTP = true
-		}
-		if strings.HasPrefix(arg, "--server-ip=") {
-			serverIP = strings.TrimPrefix(arg, "--server-ip=")
-		}
-		if strings.HasPrefix(arg, "--interface=") {
-			networkIface = strings.TrimPrefix(arg, "--interface=")
-		}
-		if strings.HasPrefix(arg, "--static-root=") {
-			staticRoot = strings.TrimPrefix(arg, "--static-root=")
-		}
+	if err := applyFlags(&cfg.RegionalClient); err != nil {
+		log.Fatalf("Invalid flag: %v", err)
 	}
-
-	if idc == "" {
-		log.Fatal("--idc flag is required")
+	if err := cfg.ValidateRegionalClient(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
 	}
+	if err := cfg.Logging.Apply(); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	rcConfig := cfg.RegionalClient
+	idc := rcConfig.RegionID
+	apiPort := strconv.Itoa(rcConfig.API.Port)
+	serverIP := rcConfig.Services.PXE.ServerIP
+	networkIface := rcConfig.Services.PXE.Interface
+	staticRoot := rcConfig.Services.TFTP.RootDir
+	enableDHCP := rcConfig.Services.PXE.Enabled
+	enableTFTP := rcConfig.Services.TFTP.Enabled
 
 	log.Printf("Starting LPMOS Regional Client v3.0 for IDC: %s", idc)
 	log.Printf("Configuration: API Port=%s, Server IP=%s, Interface=%s, Static Root=%s", apiPort, serverIP, networkIface, staticRoot)
 
 	// Initialize etcd client
-	etcdClient, err := etcd.NewClient(etcd.Config{
-		Endpoints:      []string{"localhost:2379"},
-		DialTimeout:    5 * time.Second,
-		RequestTimeout: 10 * time.Second,
-	})
+	etcdConfig, err := rcConfig.Etcd.ClientConfig()
+	if err != nil {
+		log.Fatalf("Invalid etcd config: %v", err)
+	}
+	etcdClient, err := etcd.NewClient(etcdConfig)
 	if err != nil {
 		log.Fatalf("Failed to connect to etcd: %v", err)
 	}
-	defer etcdClient.Close() // Release etcd connection when done
+	defer etcdClient.Close()             // Release etcd connection when done
+	etcdClient.AddIndexer(taskindex.Ops) // keep task indexes in step with task writes
+	etcdClient.AddIndexer(tasklog.Ops)   // store appended log entries under their own keys
 
 	// Create regional client
 	ctx, cancel := context.WithCancel(context.Background())
 	rc := &RegionalClient{
+		cfg:                &rcConfig,
 		idc:                idc,
 		etcdClient:         etcdClient,
+		audit:              audit.NewQueue(audit.NewLog(audit.NewEtcdStore(etcdClient)), auditQueueSize),
 		ctx:                ctx,
 		cancel:             cancel,
 		leases:             make(map[string]clientv3.LeaseID),
@@ -160,14 +169,17 @@ func main() {
 			log.Fatalf("Failed to initialize DHCP server: %v", err)
 		}
 		log.Println("✓ DHCP server initialized and started")
+		go rc.publishDHCPLeases()
 	}
 
 	// Start watchers
+	go rc.appendAudit()
 	go rc.watchServers()
 	go rc.watchTasks()
 
 	// Setup HTTP server for agents
 	router := setupRouter(rc)
+	metrics.Serve(cfg.Monitoring.Enabled, cfg.Monitoring.Prometheus.Port, cfg.Monitoring.Prometheus.Path, router)
 	srv := &http.Server{
 		Addr:    ":" + apiPort,
 		Handler: router,
@@ -206,6 +218,36 @@ func main() {
 	srv.Shutdown(context.Background())
 }
 
+// applyFlags overrides config values with command-line flags that were set explicitly
+func applyFlags(rcConfig *config.RegionalClientConfig) error {
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch f.Name {
+		case "idc":
+			rcConfig.RegionID = value
+		case "api-port":
+			port, convErr := strconv.Atoi(value)
+			if convErr != nil {
+				err = fmt.Errorf("--api-port %q is not a number", value)
+				return
+			}
+			rcConfig.API.Port = port
+		case "enable-dhcp":
+			rcConfig.Services.PXE.Enabled = value == "true"
+		case "enable-tftp":
+			rcConfig.Services.TFTP.Enabled = value == "true"
+		case "server-ip":
+			rcConfig.Services.PXE.ServerIP = value
+		case "interface":
+			rcConfig.Services.PXE.Interface = value
+		case "static-root":
+			rcConfig.Services.TFTP.RootDir = value
+		}
+	})
+	return err
+}
+
 func setupRouter(rc *RegionalClient) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
@@ -304,7 +346,7 @@ func (rc *RegionalClient) initTFTP() error {
 	// Create TFTP server
 	tftpConfig := tftp.Config{
 		RootDir:    tftpRoot,
-		ListenAddr: ":69",
+		ListenAddr: fmt.Sprintf(":%d", rc.cfg.Services.TFTP.Port),
 		MaxClients: 100,
 		Timeout:    30 * time.Second,
 		BlockSize:  512,
@@ -320,7 +362,7 @@ func (rc *RegionalClient) initTFTP() error {
 	}
 
 	rc.tftpServer = server
-	log.Printf("[%s] TFTP server started: root=%s, port=69", rc.idc, tftpRoot)
+	log.Printf("[%s] TFTP server started: root=%s, port=%d", rc.idc, tftpRoot, rc.cfg.Services.TFTP.Port)
 	return nil
 }
 
@@ -345,17 +387,31 @@ func (rc *RegionalClient) initPXE() error {
 
 // initDHCP initializes and starts the DHCP server
 func (rc *RegionalClient) initDHCP() error {
+	pxeConfig := rc.cfg.Services.PXE
+	subnet := rc.serverIP[:strings.LastIndex(rc.serverIP, ".")]
+
 	dhcpConfig := dhcp.Config{
 		Interface:  rc.networkIface,
 		ServerIP:   rc.serverIP,
-		Gateway:    rc.serverIP,
-		DNSServers: []string{rc.serverIP, "8.8.8.8"},
+		Gateway:    rc.gateway(),
+		DNSServers: pxeConfig.DNSServers,
 		TFTPServer: rc.serverIP,
 		BootFile:   "pxelinux.0",
-		LeaseTime:  24 * 3600 * time.Second, // 24 hours (extended for installation)
-		StartIP:    rc.serverIP[:strings.LastIndex(rc.serverIP, ".")] + ".10",
-		EndIP:      rc.serverIP[:strings.LastIndex(rc.serverIP, ".")] + ".200",
-		Netmask:    "255.255.255.0",
+		LeaseTime:  pxeConfig.LeaseTime, // extended for installation
+		StartIP:    pxeConfig.DHCPRangeStart,
+		EndIP:      pxeConfig.DHCPRangeEnd,
+		Netmask:    pxeConfig.Netmask,
+	}
+
+	// Fall back to the historical defaults derived from the server IP
+	if len(dhcpConfig.DNSServers) == 0 {
+		dhcpConfig.DNSServers = []string{rc.serverIP, "8.8.8.8"}
+	}
+	if dhcpConfig.StartIP == "" {
+		dhcpConfig.StartIP = subnet + ".10"
+	}
+	if dhcpConfig.EndIP == "" {
+		dhcpConfig.EndIP = subnet + ".200"
 	}
 
 	server, err := dhcp.NewServer(dhcpConfig)
@@ -368,11 +424,50 @@ func (rc *RegionalClient) initDHCP() error {
 	}
 
 	rc.dhcpServer = server
+	rc.registerDHCPMetrics()
 	log.Printf("[%s] DHCP server started: pool=%s-%s, port=67",
 		rc.idc, dhcpConfig.StartIP, dhcpConfig.EndIP)
 	return nil
 }
 
+// baseURL returns the regional client's HTTP base URL as seen by agents
+func (rc *RegionalClient) baseURL() string {
+	return fmt.Sprintf("http://%s:%s", rc.serverIP, rc.apiPort)
+}
+
+// gateway returns the default gateway handed to PXE clients and installed systems
+func (rc *RegionalClient) gateway() string {
+	if rc.cfg.Services.PXE.Gateway != "" {
+		return rc.cfg.Services.PXE.Gateway
+	}
+	return rc.serverIP
+}
+
+// installNetwork builds the network configuration for the installed system
+func (rc *RegionalClient) installNetwork(task *models.TaskV3) models.NetworkConfig {
+	return models.NetworkConfig{
+		Interface: rc.cfg.Installation.PrimaryNIC,
+		Method:    "static",
+		IP:        task.IP,
+		Netmask:   rc.cfg.Services.PXE.Netmask,
+		Gateway:   rc.gateway(),
+		DNS:       rc.serverIP,
+		Hostname:  task.Hostname,
+	}
+}
+
+// updateErrorStatus maps an AtomicUpdate error to an HTTP status code
+func updateErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, models.ErrInvalidTransition):
+		return http.StatusConflict
+	case etcd.IsKeyNotFound(err):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // configurePXEBoot configures PXE boot environment for a task
 func (rc *RegionalClient) configurePXEBoot(task *models.TaskV3) {
 	log.Printf("[%s] Configuring PXE boot for %s (MAC: %s, IP: %s)",
@@ -387,6 +482,7 @@ func (rc *RegionalClient) configurePXEBoot(task *models.TaskV3) {
 
 	// Step 1: Add DHCP static binding (if DHCP is enabled)
 	if rc.dhcpServer != nil {
+		rc.checkLeaseConflict(task)
 		if err := rc.dhcpServer.AddStaticBinding(
 			task.MAC,
 			task.IP,
@@ -409,7 +505,7 @@ func (rc *RegionalClient) configurePXEBoot(task *models.TaskV3) {
 			OSVersion:    task.OSVersion,
 			KernelPath:   fmt.Sprintf("/static/kernels/vmlinuz-%s-%s", task.OSType, task.OSVersion),
 			InitrdPath:   fmt.Sprintf("/static/initramfs/initrd-%s-%s.img", task.OSType, task.OSVersion),
-			RegionalURL:  fmt.Sprintf("http://%s:8081/api/v1", rc.serverIP),
+			RegionalURL:  rc.baseURL() + "/api/v1",
 			SerialNumber: task.SN,
 			DataCenter:   rc.idc,
 		}
@@ -441,8 +537,7 @@ func (rc *RegionalClient) configurePXEBoot(task *models.TaskV3) {
 
 		// Set PXE configured flag to prevent reconfiguration
 		t.PXEConfigured = true
-		// Don't add logs to etcd to prevent database bloat
-		// Logs are already written to Regional Client's log output
+		t.AddLog("[INFO] PXE boot environment configured")
 		t.UpdatedAt = time.Now()
 
 		return t, nil
@@ -485,6 +580,25 @@ func (rc *RegionalClient) cleanupPXEBoot(task *models.TaskV3) {
 	log.Printf("[%s] ✓ PXE boot configuration cleaned up for %s", rc.idc, task.SN)
 }
 
+// releasePXEBoot removes the PXE boot configuration of a task and clears its
+// PXEConfigured flag so a later attempt configures it afresh
+func (rc *RegionalClient) releasePXEBoot(task *models.TaskV3) {
+	rc.cleanupPXEBoot(task)
+
+	taskKey := etcd.TaskKeyV3(rc.idc, task.SN)
+	err := rc.etcdClient.AtomicUpdate(taskKey, func(data []byte) (interface{}, error) {
+		var t models.TaskV3
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, err
+		}
+		t.PXEConfigured = false
+		return t, nil
+	})
+	if err != nil {
+		log.Printf("[%s] Warning: Failed to clear PXE flag for %s: %v", rc.idc, task.SN, err)
+	}
+}
+
 // getDHCPStatus returns DHCP server status
 func (rc *RegionalClient) getDHCPStatus(c *gin.Context) {
 	if rc.dhcpServer == nil {
@@ -683,17 +797,9 @@ func listDirectory(dir string, prefix string) ([]map[string]interface{}, error)
 // registerToEtcd registers Regional Client to etcd with heartbeat
 func (rc *RegionalClient) registerToEtcd() error {
 	// Create Regional Client info
-	info := map[string]interface{}{
-		"idc":          rc.idc,
-		"server_ip":    rc.serverIP,
-		"api_port":     rc.apiPort,
-		"dhcp_enabled": rc.enableDHCP,
-		"tftp_enabled": rc.enableTFTP,
-		"started_at":   rc.startedAt.Format(time.RFC3339),
-		"status":       "online",
-	}
+	info := rc.regionInfo(models.RegionOnline)
 
-	infoKey := fmt.Sprintf("/os/region/%s/info", rc.idc)
+	infoKey := etcd.RegionKey(rc.idc, "info")
 	if err := rc.etcdClient.Put(infoKey, info); err != nil {
 		return fmt.Errorf("failed to put regional client info: %w", err)
 	}
@@ -704,9 +810,22 @@ func (rc *RegionalClient) registerToEtcd() error {
 	return nil
 }
 
+// regionInfo describes this regional client for /os/region/{idc}/info
+func (rc *RegionalClient) regionInfo(status string) models.RegionInfo {
+	return models.RegionInfo{
+		IDC:         rc.idc,
+		ServerIP:    rc.serverIP,
+		APIPort:     rc.apiPort,
+		DHCPEnabled: rc.enableDHCP,
+		TFTPEnabled: rc.enableTFTP,
+		StartedAt:   rc.startedAt,
+		Status:      status,
+	}
+}
+
 // maintainHeartbeat maintains Regional Client heartbeat with lease
 func (rc *RegionalClient) maintainHeartbeat() {
-	heartbeatKey := fmt.Sprintf("/os/region/%s/heartbeat", rc.idc)
+	heartbeatKey := etcd.RegionKey(rc.idc, "heartbeat")
 
 	for {
 		// Create lease with 30s TTL
@@ -719,14 +838,14 @@ func (rc *RegionalClient) maintainHeartbeat() {
 
 		rc.selfLeaseID = leaseID
 
-		// Put heartbeat key with lease
-		heartbeatValue := map[string]interface{}{
-			"status":       "online",
-			"last_updated": time.Now().Format(time.RFC3339),
-			"lease_id":     leaseID,
+		// Put heartbeat key with lease: it disappears when we stop renewing
+		heartbeatValue := models.RegionHeartbeat{
+			Status:      models.RegionOnline,
+			LastUpdated: time.Now(),
+			LeaseID:     int64(leaseID),
 		}
 
-		if err := rc.etcdClient.Put(heartbeatKey, heartbeatValue); err != nil {
+		if err := rc.etcdClient.PutWithLeaseID(heartbeatKey, heartbeatValue, leaseID); err != nil {
 			log.Printf("[%s] Failed to put heartbeat: %v", rc.idc, err)
 			time.Sleep(5 * time.Second)
 			continue
@@ -767,17 +886,10 @@ func (rc *RegionalClient) unregisterFromEtcd() {
 	log.Printf("[%s] Unregistering from etcd...", rc.idc)
 
 	// Update status to offline
-	infoKey := fmt.Sprintf("/os/region/%s/info", rc.idc)
-	info := map[string]interface{}{
-		"idc":          rc.idc,
-		"server_ip":    rc.serverIP,
-		"api_port":     rc.apiPort,
-		"dhcp_enabled": rc.enableDHCP,
-		"tftp_enabled": rc.enableTFTP,
-		"started_at":   rc.startedAt.Format(time.RFC3339),
-		"stopped_at":   time.Now().Format(time.RFC3339),
-		"status":       "offline",
-	}
+	infoKey := etcd.RegionKey(rc.idc, "info")
+	info := rc.regionInfo(models.RegionOffline)
+	stoppedAt := time.Now()
+	info.StoppedAt = &stoppedAt
 
 	if err := rc.etcdClient.Put(infoKey, info); err != nil {
 		log.Printf("[%s] Warning: Failed to update status to offline: %v", rc.idc, err)
@@ -841,6 +953,16 @@ func (rc *RegionalClient) watchTasks() {
 						// Configure PXE boot environment
 						go rc.configurePXEBoot(&task)
 					}
+
+					// Cancelled, sent back for approval by retry/reinstall, or
+					// its approval withdrawn by a failed BOM check: the machine
+					// must not keep booting into the installer
+					withdrawn := task.Status == models.TaskStatusCancelled || task.Status == models.TaskStatusPending ||
+						task.Status == models.TaskStatusPendingApproval
+					if withdrawn && task.PXEConfigured {
+						log.Printf("[%s] Task %s for %s, removing PXE boot...", rc.idc, task.Status, task.SN)
+						go rc.releasePXEBoot(&task)
+					}
 				}
 			}
 		}
@@ -898,11 +1020,13 @@ func (rc *RegionalClient) handleHardwareReport(c *gin.Context) {
 	taskKey := etcd.TaskKeyV3(rc.idc, req.SN)
 
 	// Atomic update to merged task structure
+	var before, after models.TaskV3
 	err := rc.etcdClient.AtomicUpdate(taskKey, func(data []byte) (interface{}, error) {
 		var task models.TaskV3
 		if err := json.Unmarshal(data, &task); err != nil {
 			return nil, fmt.Errorf("task not found or invalid")
 		}
+		before = task
 
 		// Verify MAC matches (if provided in task)
 		if task.MAC != "" && !strings.EqualFold(task.MAC, req.MAC) {
@@ -915,7 +1039,7 @@ func (rc *RegionalClient) handleHardwareReport(c *gin.Context) {
 		}
 
 		// Add hardware collection progress
-		task.Progress = append(task.Progress, models.ProgressStep{
+		task.AddProgress(models.ProgressStep{
 			Step:      "hardware_collect",
 			Percent:   100,
 			Timestamp: time.Now(),
@@ -923,25 +1047,36 @@ func (rc *RegionalClient) handleHardwareReport(c *gin.Context) {
 		})
 
 		// Add log entry
-		task.Logs = append(task.Logs, fmt.Sprintf("[INFO] Hardware collected: %d cores, %dGB RAM", req.Hardware.CPU.Cores, req.Hardware.Memory.TotalGB))
+		task.AddLog(fmt.Sprintf("[INFO] Hardware collected: %d cores, %dGB RAM", req.Hardware.CPU.Cores, req.Hardware.Memory.TotalGB))
+		if task.HardwareReportedAt == nil {
+			now := time.Now()
+			task.HardwareReportedAt = &now
+		}
+
+		// Acceptance check against the expected bill of materials
+		if err := rc.checkBOM(&task, &req.Hardware); err != nil {
+			return nil, err
+		}
 		task.UpdatedAt = time.Now()
 
+		after = task
 		return task, nil
 	})
 
 	if err != nil {
-		// Store as unmatched report (without timestamp in key)
-		unmatchedKey := fmt.Sprintf("/os/unmatched_reports/%s/%s", rc.idc, req.MAC)
-		rc.etcdClient.Put(unmatchedKey, req)
-
-		log.Printf("[%s] Hardware report unmatched (stored): %s", rc.idc, req.MAC)
+		rc.storeUnmatchedReport(req, err)
+		// A machine without any task is still racked here; a MAC mismatch
+		// may be another machine claiming the SN, so it is not recorded
+		if etcd.IsKeyNotFound(err) {
+			rc.recordMachineHardware(req, "")
+		}
 		c.JSON(http.StatusNotFound, gin.H{"error": "No matching task found", "retry_after": 10})
 		return
 	}
-
-	// Store hardware metadata separately
-	metaKey := etcd.MetaKey(rc.idc, req.SN)
-	rc.etcdClient.Put(metaKey, req.Hardware)
+	// A report stored while the machine had no task is settled now
+	if err := rc.etcdClient.Delete(etcd.UnmatchedReportKey(rc.idc, req.MAC)); err != nil {
+		log.Printf("[%s] Warning: Failed to remove unmatched report of %s: %v", rc.idc, req.MAC, err)
+	}
 
 	// Update server entry with agent info
 	serverKey := etcd.ServerKey(rc.idc, req.SN)
@@ -954,11 +1089,98 @@ func (rc *RegionalClient) handleHardwareReport(c *gin.Context) {
 	if err := rc.etcdClient.Put(serverKey, serverEntry); err != nil {
 		log.Printf("[%s] Warning: Failed to update server entry: %v", rc.idc, err)
 	}
+	m, record := rc.recordMachineHardware(req, after.TaskID)
+
+	// The meta key carries the hardware to the approval rules and WebSocket
+	// clients; a repeated report of a task already decided is not news
+	waiting := after.Approval == nil || after.Approval.Status == models.ApprovalStatusPending
+	if m != nil && (record != nil || waiting) {
+		if err := rc.etcdClient.Put(etcd.MetaKey(rc.idc, req.SN), m.Hardware); err != nil {
+			log.Printf("[%s] Warning: Failed to store hardware metadata of %s: %v", rc.idc, req.SN, err)
+		}
+	}
 
 	log.Printf("[%s] Hardware report processed for %s", rc.idc, req.SN)
+	rc.recordAgentAction(c, audit.ActionAgentReport, req.SN, &before, &after, "MAC "+req.MAC)
 	c.JSON(http.StatusOK, gin.H{"message": "Hardware reported successfully"})
 }
 
+// storeUnmatchedReport keeps a report no task matched for operators to
+// adopt. A machine already in the servers directory under the same MAC is
+// known and only waiting for a task, so its reports are not stored.
+func (rc *RegionalClient) storeUnmatchedReport(req models.AgentReportRequestV3, cause error) {
+	var server models.ServerEntry
+	if err := rc.etcdClient.GetJSON(etcd.ServerKey(rc.idc, req.SN), &server); err == nil && strings.EqualFold(server.MAC, req.MAC) {
+		log.Printf("[%s] Hardware report from enrolled server %s, no task yet", rc.idc, req.SN)
+		return
+	}
+
+	reason := cause.Error()
+	if etcd.IsKeyNotFound(cause) {
+		reason = "no task for serial number " + req.SN
+	}
+	report := models.UnmatchedReport{
+		IDC:        rc.idc,
+		SN:         req.SN,
+		MAC:        req.MAC,
+		Hardware:   req.Hardware,
+		Reason:     reason,
+		ReportedAt: time.Now(),
+	}
+	if err := rc.etcdClient.Put(etcd.UnmatchedReportKey(rc.idc, req.MAC), report); err != nil {
+		log.Printf("[%s] Failed to store unmatched report of %s: %v", rc.idc, req.MAC, err)
+		return
+	}
+	log.Printf("[%s] Hardware report unmatched (stored): %s (%s)", rc.idc, req.MAC, reason)
+}
+
+// checkBOM compares the reported hardware with the BOM profile of the task,
+// if it has one. A profile that cannot be loaded fails the check rather than
+// letting unchecked hardware through; the next report checks again.
+func (rc *RegionalClient) checkBOM(task *models.TaskV3, hw *models.HardwareInfo) error {
+	profile, err := bom.ForTask(rc.etcdClient, task)
+	var check *models.BOMCheck
+	switch {
+	case err != nil:
+		name := task.BOMProfile
+		if name == "" {
+			name = "for SKU " + task.SKU
+		}
+		check = &models.BOMCheck{Profile: name, CheckedAt: time.Now(), Mismatches: []models.BOMMismatch{
+			{Field: "profile", Expected: name, Message: err.Error()},
+		}}
+	case profile == nil:
+		return nil
+	default:
+		check = bom.Check(profile, hw, time.Now())
+	}
+
+	if !check.Passed {
+		log.Printf("[%s] Hardware of %s fails BOM profile %s: %d mismatches", rc.idc, task.SN, check.Profile, len(check.Mismatches))
+	}
+	return bom.Apply(task, check)
+}
+
+// recordMachineHardware stores the reported hardware in the machine
+// inventory, registering the machine as discovered when it is new there. It
+// returns the machine, nil when the inventory could not be updated, and the
+// new hardware version, nil when the hardware is unchanged.
+func (rc *RegionalClient) recordMachineHardware(req models.AgentReportRequestV3, taskID string) (*models.Machine, *models.HardwareRecord) {
+	m, record, err := inventory.RecordHardware(rc.etcdClient, rc.idc, req.SN, req.MAC, req.Hardware, "agent", taskID)
+	if err != nil {
+		log.Printf("[%s] Warning: Failed to record hardware of %s in the inventory: %v", rc.idc, req.SN, err)
+		return nil, nil
+	}
+	if record == nil {
+		return m, nil
+	}
+	log.Printf("[%s] Inventory hardware of %s updated (machine %s)", rc.idc, req.SN, m.State)
+	if record.Drift != nil {
+		log.Printf("[%s] Warning: Hardware of %s drifted: %s", rc.idc, req.SN, record.Drift.Summary())
+	}
+	return m, record
+}
+
 // handleProgressUpdate handles progress updates from agents (ATOMIC UPDATE)
 func (rc *RegionalClient) handleProgressUpdate(c *gin.Context) {
 	var req models.AgentProgressRequestV3
@@ -972,11 +1194,13 @@ func (rc *RegionalClient) handleProgressUpdate(c *gin.Context) {
 	taskKey := etcd.TaskKeyV3(rc.idc, req.SN)
 
 	// Atomic update to merged task
+	var before, after models.TaskV3
 	err := rc.etcdClient.AtomicUpdate(taskKey, func(data []byte) (interface{}, error) {
 		var task models.TaskV3
 		if err := json.Unmarshal(data, &task); err != nil {
 			return nil, err
 		}
+		before = task
 
 		// Verify task ID matches
 		if task.TaskID != req.TaskID {
@@ -984,7 +1208,7 @@ func (rc *RegionalClient) handleProgressUpdate(c *gin.Context) {
 		}
 
 		// Add progress step
-		task.Progress = append(task.Progress, models.ProgressStep{
+		task.AddProgress(models.ProgressStep{
 			Step:      req.Step,
 			Percent:   req.Percent,
 			Timestamp: time.Now(),
@@ -993,34 +1217,33 @@ func (rc *RegionalClient) handleProgressUpdate(c *gin.Context) {
 
 		// Update status based on progress
 		if req.Percent >= 100 && req.Step == "completed" {
-			task.Status = models.TaskStatusCompleted
-			task.StatusHistory = append(task.StatusHistory, models.StatusChange{
-				Status:    models.TaskStatusCompleted,
-				Timestamp: time.Now(),
-				Reason:    "Installation completed successfully",
-			})
+			if err := task.TransitionTo(models.TaskStatusCompleted, "Installation completed successfully"); err != nil {
+				return nil, err
+			}
 		} else if req.Percent > 0 && task.Status != models.TaskStatusInstalling {
-			task.Status = models.TaskStatusInstalling
-			task.StatusHistory = append(task.StatusHistory, models.StatusChange{
-				Status:    models.TaskStatusInstalling,
-				Timestamp: time.Now(),
-				Reason:    "Installation started",
-			})
+			if err := task.TransitionTo(models.TaskStatusInstalling, "Installation started"); err != nil {
+				return nil, err
+			}
 		}
 
 		// Add log entry
 		logEntry := fmt.Sprintf("[INFO] %s: %s (%d%%)", req.Step, req.Message, req.Percent)
-		task.Logs = append(task.Logs, logEntry)
+		task.AddLog(logEntry)
 		task.UpdatedAt = time.Now()
 
+		after = task
 		return task, nil
 	})
 
 	if err != nil {
 		log.Printf("[%s] Failed to update progress: %v", rc.idc, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(updateErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
+	// Progress within a status is in the task log; only transitions are audited
+	if after.Status != before.Status {
+		rc.recordAgentAction(c, audit.ActionAgentProgress, req.SN, &before, &after, fmt.Sprintf("%s %d%%", req.Step, req.Percent))
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Progress updated"})
 }
@@ -1108,9 +1331,9 @@ func (rc *RegionalClient) getNextOperation(c *gin.Context) {
 		// Check progress to determine next step
 		lastProgress := 0
 		lastStep := ""
-		if len(task.Progress) > 0 {
-			lastProgress = task.Progress[len(task.Progress)-1].Percent
-			lastStep = task.Progress[len(task.Progress)-1].Step
+		if step := task.LatestProgress(); step != nil {
+			lastProgress = step.Percent
+			lastStep = step.Step
 		}
 
 		if lastProgress < 40 || lastStep == "" {
@@ -1129,20 +1352,12 @@ func (rc *RegionalClient) getNextOperation(c *gin.Context) {
 				Method:    installMethod,
 				OSType:    task.OSType,
 				OSVersion: task.OSVersion,
-				MirrorURL: fmt.Sprintf("http://%s:8081", rc.serverIP),
-				Network: models.NetworkConfig{
-					Interface: "eth0",
-					Method:    "static",
-					IP:        task.IP,
-					Netmask:   "255.255.255.0",
-					Gateway:   rc.serverIP,
-					DNS:       rc.serverIP,
-					Hostname:  task.Hostname,
-				},
+				MirrorURL: rc.baseURL(),
+				Network:   rc.installNetwork(&task),
 			}
 
 			if installMethod == models.InstallMethodKickstart {
-				config.KickstartURL = fmt.Sprintf("http://%s:8081/api/v1/kickstart/%s", rc.serverIP, req.SN)
+				config.KickstartURL = fmt.Sprintf("%s/api/v1/kickstart/%s", rc.baseURL(), req.SN)
 			} else {
 				config.DiskLayout = models.DiskLayoutConfig{
 					RootDisk:       "/dev/sda",
@@ -1226,52 +1441,64 @@ func (rc *RegionalClient) operationComplete(c *gin.Context) {
 	// Update task status based on operation
 	taskKey := etcd.TaskKeyV3(rc.idc, req.SN)
 	var completedTask *models.TaskV3
+	var before, after models.TaskV3
 	err := rc.etcdClient.AtomicUpdate(taskKey, func(data []byte) (interface{}, error) {
 		var task models.TaskV3
 		if err := json.Unmarshal(data, &task); err != nil {
 			return nil, err
 		}
+		before = task
 
 		// Add progress entry
 		percent := 0
 		switch req.Operation {
 		case "hardware_config":
 			percent = 40
-			task.Status = models.TaskStatusInstalling
+			if task.Status != models.TaskStatusInstalling {
+				if err := task.TransitionTo(models.TaskStatusInstalling, "Hardware configuration finished"); err != nil {
+					return nil, err
+				}
+			}
 		case "network_config":
 			percent = 50
 		case "os_install":
 			percent = 100
 			if req.Success {
-				task.Status = models.TaskStatusCompleted
+				if err := task.TransitionTo(models.TaskStatusCompleted, "OS installation completed successfully"); err != nil {
+					return nil, err
+				}
 				completedTask = &task
 			} else {
-				task.Status = models.TaskStatusFailed
+				if err := task.TransitionTo(models.TaskStatusFailed, fmt.Sprintf("OS installation failed: %s", req.Message)); err != nil {
+					return nil, err
+				}
 			}
 		}
 
-		task.Progress = append(task.Progress, models.ProgressStep{
+		task.AddProgress(models.ProgressStep{
 			Step:      req.Operation,
 			Percent:   percent,
 			Timestamp: time.Now(),
 			Message:   req.Message,
 		})
 
-		task.Logs = append(task.Logs, fmt.Sprintf("[INFO] %s: %s", req.Operation, req.Message))
+		task.AddLog(fmt.Sprintf("[INFO] %s: %s", req.Operation, req.Message))
 		task.UpdatedAt = time.Now()
 
+		after = task
 		return task, nil
 	})
 
 	if err != nil {
 		log.Printf("[%s] Failed to update task for operation complete: %v", rc.idc, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update task"})
+		c.JSON(updateErrorStatus(err), gin.H{"error": "Failed to update task: " + err.Error()})
 		return
 	}
+	rc.recordAgentAction(c, audit.ActionAgentOperation, req.SN, &before, &after, fmt.Sprintf("%s success=%v", req.Operation, req.Success))
 
 	// Clean up PXE boot configuration if installation completed
 	if completedTask != nil {
-		go rc.cleanupPXEBoot(completedTask)
+		go rc.releasePXEBoot(completedTask)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Operation status updated"})
@@ -1325,22 +1552,14 @@ func (rc *RegionalClient) getOSInstallConfig(c *gin.Context) {
 		Method:    installMethod,
 		OSType:    task.OSType,
 		OSVersion: task.OSVersion,
-		MirrorURL: fmt.Sprintf("http://%s:8081", rc.serverIP),
-		Network: models.NetworkConfig{
-			Interface: "eth0",
-			Method:    "static",
-			IP:        task.IP,
-			Netmask:   "255.255.255.0",
-			Gateway:   rc.serverIP,
-			DNS:       rc.serverIP,
-			Hostname:  task.Hostname,
-		},
+		MirrorURL: rc.baseURL(),
+		Network:   rc.installNetwork(&task),
 	}
 
 	// 根据安装方式配置不同的参数
 	if installMethod == models.InstallMethodKickstart {
 		// Kickstart 方式：提供 kickstart URL
-		config.KickstartURL = fmt.Sprintf("http://%s:8081/api/v1/kickstart/%s", rc.serverIP, req.SN)
+		config.KickstartURL = fmt.Sprintf("%s/api/v1/kickstart/%s", rc.baseURL(), req.SN)
 	} else {
 		// Agent 直接安装方式：提供详细的安装参数
 		config.DiskLayout = models.DiskLayoutConfig{
@@ -1386,17 +1605,9 @@ func (rc *RegionalClient) generateKickstart(c *gin.Context) {
 		Method:      models.InstallMethodKickstart,
 		OSType:      task.OSType,
 		OSVersion:   task.OSVersion,
-		MirrorURL:   fmt.Sprintf("http://%s:8081/repos/%s/%s", rc.serverIP, task.OSType, task.OSVersion),
-		RegionalURL: fmt.Sprintf("http://%s:8081", rc.serverIP),
-		Network: models.NetworkConfig{
-			Interface: "eth0",
-			Method:    "static",
-			IP:        task.IP,
-			Netmask:   "255.255.255.0",
-			Gateway:   rc.serverIP,
-			DNS:       rc.serverIP,
-			Hostname:  task.Hostname,
-		},
+		MirrorURL:   fmt.Sprintf("%s/repos/%s/%s", rc.baseURL(), task.OSType, task.OSVersion),
+		RegionalURL: rc.baseURL(),
+		Network:     rc.installNetwork(&task),
 		DiskLayout: models.DiskLayoutConfig{
 			RootDisk:       "/dev/sda",
 			PartitionTable: "gpt",
@@ -1444,16 +1655,8 @@ func (rc *RegionalClient) generatePreseed(c *gin.Context) {
 		Method:    models.InstallMethodKickstart,
 		OSType:    task.OSType,
 		OSVersion: task.OSVersion,
-		MirrorURL: fmt.Sprintf("http://%s:8081/repos/%s/%s", rc.serverIP, task.OSType, task.OSVersion),
-		Network: models.NetworkConfig{
-			Interface: "eth0",
-			Method:    "static",
-			IP:        task.IP,
-			Netmask:   "255.255.255.0",
-			Gateway:   rc.serverIP,
-			DNS:       rc.serverIP,
-			Hostname:  task.Hostname,
-		},
+		MirrorURL: fmt.Sprintf("%s/repos/%s/%s", rc.baseURL(), task.OSType, task.OSVersion),
+		Network:   rc.installNetwork(&task),
 		DiskLayout: models.DiskLayoutConfig{
 			RootDisk:       "/dev/sda",
 			PartitionTable: "gpt",
@@ -1495,52 +1698,50 @@ func (rc *RegionalClient) installComplete(c *gin.Context) {
 		rc.idc, req.SN, req.Status, req.Message)
 
 	taskKey := etcd.TaskKeyV3(rc.idc, req.SN)
+	var before, after models.TaskV3
 	err := rc.etcdClient.AtomicUpdate(taskKey, func(data []byte) (interface{}, error) {
 		var task models.TaskV3
 		if err := json.Unmarshal(data, &task); err != nil {
 			return nil, err
 		}
+		before = task
 
 		// 更新任务状态
 		if req.Status == "success" {
-			task.Status = models.TaskStatusCompleted
-			task.StatusHistory = append(task.StatusHistory, models.StatusChange{
-				Status:    models.TaskStatusCompleted,
-				Timestamp: time.Now(),
-				Reason:    "OS installation completed successfully",
-			})
+			if err := task.TransitionTo(models.TaskStatusCompleted, "OS installation completed successfully"); err != nil {
+				return nil, err
+			}
 		} else {
-			task.Status = models.TaskStatusFailed
-			task.StatusHistory = append(task.StatusHistory, models.StatusChange{
-				Status:    models.TaskStatusFailed,
-				Timestamp: time.Now(),
-				Reason:    fmt.Sprintf("OS installation failed: %s", req.Message),
-			})
+			if err := task.TransitionTo(models.TaskStatusFailed, fmt.Sprintf("OS installation failed: %s", req.Message)); err != nil {
+				return nil, err
+			}
 		}
 
-		task.Progress = append(task.Progress, models.ProgressStep{
+		task.AddProgress(models.ProgressStep{
 			Step:      "os_install",
 			Percent:   100,
 			Timestamp: time.Now(),
 			Message:   req.Message,
 		})
 
-		task.Logs = append(task.Logs, fmt.Sprintf("[INFO] Installation %s: %s", req.Status, req.Message))
+		task.AddLog(fmt.Sprintf("[INFO] Installation %s: %s", req.Status, req.Message))
 		task.UpdatedAt = time.Now()
 
+		after = task
 		return task, nil
 	})
 
 	if err != nil {
 		log.Printf("[%s] Failed to update task status: %v", rc.idc, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update task"})
+		c.JSON(updateErrorStatus(err), gin.H{"error": "Failed to update task: " + err.Error()})
 		return
 	}
+	rc.recordAgentAction(c, audit.ActionAgentInstallResult, req.SN, &before, &after, req.Status)
 
 	// 清理 PXE 配置
 	var task models.TaskV3
 	if err := rc.etcdClient.GetJSON(taskKey, &task); err == nil {
-		go rc.cleanupPXEBoot(&task)
+		go rc.releasePXEBoot(&task)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Installation status updated"})
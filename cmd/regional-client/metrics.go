@@ -0,0 +1,22 @@
+package main
+
+import "github.com/lpmos/lpmos-go/pkg/metrics"
+
+// registerDHCPMetrics exposes the utilisation of the DHCP lease pool
+func (rc *RegionalClient) registerDHCPMetrics() {
+	metrics.NewGaugeFunc("lpmos_dhcp_leases_active", "Dynamic DHCP leases in use", []string{"idc"}, func() []metrics.Sample {
+		active, _ := rc.dhcpServer.PoolUsage()
+		return []metrics.Sample{{Labels: []string{rc.idc}, Value: float64(active)}}
+	})
+	metrics.NewGaugeFunc("lpmos_dhcp_pool_size", "Addresses in the DHCP pool", []string{"idc"}, func() []metrics.Sample {
+		_, size := rc.dhcpServer.PoolUsage()
+		return []metrics.Sample{{Labels: []string{rc.idc}, Value: float64(size)}}
+	})
+	metrics.NewGaugeFunc("lpmos_dhcp_pool_utilization", "Fraction of the DHCP pool leased", []string{"idc"}, func() []metrics.Sample {
+		active, size := rc.dhcpServer.PoolUsage()
+		if size == 0 {
+			return nil
+		}
+		return []metrics.Sample{{Labels: []string{rc.idc}, Value: float64(active) / float64(size)}}
+	})
+}
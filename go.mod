@@ -10,6 +10,8 @@ require (
 	github.com/pin/tftp/v3 v3.1.0
 	github.com/shirou/gopsutil/v3 v3.24.1
 	go.etcd.io/etcd/client/v3 v3.5.12
+	google.golang.org/grpc v1.62.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -55,7 +57,5 @@ require (
 	google.golang.org/genproto v0.0.0-20240227224415-6ceb2ff114de // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20240227224415-6ceb2ff114de // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240227224415-6ceb2ff114de // indirect
-	google.golang.org/grpc v1.62.0 // indirect
 	google.golang.org/protobuf v1.34.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
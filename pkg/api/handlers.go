@@ -11,6 +11,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/lpmos/lpmos-go/pkg/auth"
 	"github.com/lpmos/lpmos-go/pkg/etcd"
 	"github.com/lpmos/lpmos-go/pkg/models"
 )
@@ -45,7 +46,7 @@ func (h *Handler) CreateTask(c *gin.Context) {
 		DiskLayout:  req.DiskLayout,
 		NetworkConf: req.NetworkConf,
 		CreatedAt:   time.Now(),
-		CreatedBy:   "admin@example.com", // TODO: Get from auth context
+		CreatedBy:   auth.Actor(c),
 		Tags:        req.Tags,
 		Status:      models.TaskStatusPending,
 		UpdatedAt:   time.Now(),
@@ -165,7 +166,7 @@ func (h *Handler) ApproveTask(c *gin.Context) {
 
 	// Check if task is in pending_approval status
 	if task.Status != models.TaskStatusPendingApproval {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("task is not in pending_approval status (current: %s)", task.Status)})
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("task is not in pending_approval status (current: %s)", task.Status)})
 		return
 	}
 
@@ -177,12 +178,12 @@ func (h *Handler) ApproveTask(c *gin.Context) {
 
 	if req.Approved {
 		approval.Status = models.ApprovalStatusApproved
-		approval.ApprovedBy = "admin@example.com" // TODO: Get from auth context
+		approval.ApprovedBy = auth.Actor(c)
 		approval.ApprovedAt = &now
 		task.Status = models.TaskStatusApproved
 	} else {
 		approval.Status = models.ApprovalStatusRejected
-		approval.RejectedBy = "admin@example.com" // TODO: Get from auth context
+		approval.RejectedBy = auth.Actor(c)
 		approval.RejectedAt = &now
 		approval.Reason = req.Reason
 		task.Status = models.TaskStatusFailed
@@ -310,7 +311,7 @@ func (h *Handler) StartTaskWatcher(ctx context.Context) {
 					taskID = strings.TrimSuffix(taskID, "/status")
 
 					log.Printf("Task %s requires approval - notifying operators", taskID)
-					// TODO: Send webhook/email notification
+					// Notifications are sent by the control plane's webhook dispatcher (pkg/webhook)
 				}
 			}
 		}
@@ -2,11 +2,12 @@ package api
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/lpmos/lpmos-go/pkg/auth"
 	"github.com/lpmos/lpmos-go/pkg/etcd"
 )
 
 // SetupRouter creates and configures the Gin router
-func SetupRouter(etcdClient *etcd.Client) *gin.Engine {
+func SetupRouter(etcdClient *etcd.Client, authenticator *auth.Authenticator) *gin.Engine {
 	router := gin.Default()
 
 	handler := NewHandler(etcdClient)
@@ -14,13 +15,6 @@ func SetupRouter(etcdClient *etcd.Client) *gin.Engine {
 	// API v1 routes
 	v1 := router.Group("/api/v1")
 	{
-		// Task management
-		v1.POST("/tasks", handler.CreateTask)
-		v1.GET("/tasks", handler.ListTasks)
-		v1.GET("/tasks/:id", handler.GetTask)
-		v1.PUT("/tasks/:id/approve", handler.ApproveTask)
-		v1.DELETE("/tasks/:id", handler.DeleteTask)
-
 		// Health check
 		v1.GET("/health", func(c *gin.Context) {
 			c.JSON(200, gin.H{
@@ -28,6 +22,14 @@ func SetupRouter(etcdClient *etcd.Client) *gin.Engine {
 				"service": "control-plane",
 			})
 		})
+
+		// Task management
+		tasks := v1.Group("/tasks", authenticator.Middleware())
+		tasks.POST("", auth.Require(auth.PermissionWrite), handler.CreateTask)
+		tasks.GET("", auth.Require(auth.PermissionRead), handler.ListTasks)
+		tasks.GET("/:id", auth.Require(auth.PermissionRead), handler.GetTask)
+		tasks.PUT("/:id/approve", auth.Require(auth.PermissionApprove), handler.ApproveTask)
+		tasks.DELETE("/:id", auth.Require(auth.PermissionWrite), handler.DeleteTask)
 	}
 
 	return router
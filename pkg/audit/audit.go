@@ -0,0 +1,304 @@
+// Package audit keeps an append-only log of operator and agent actions.
+// Records are numbered in order and each carries the SHA-256 hash of its
+// predecessor, so rewriting or removing a stored record breaks the chain
+// and Verify reports where.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Actions
+const (
+	ActionTaskCreate         = "task.create"
+	ActionTaskApprove        = "task.approve"
+	ActionTaskReject         = "task.reject"
+	ActionTaskAutoDecide     = "task.auto_decide"
+	ActionTaskCancel         = "task.cancel"
+	ActionTaskRetry          = "task.retry"
+	ActionTaskReinstall      = "task.reinstall"
+	ActionTaskTimeout        = "task.timeout"
+	ActionReportAdopt        = "unmatched_report.adopt"
+	ActionReportDelete       = "unmatched_report.delete"
+	ActionMachineCreate      = "machine.create"
+	ActionMachineUpdate      = "machine.update"
+	ActionMachineState       = "machine.state"
+	ActionMachineDelete      = "machine.delete"
+	ActionApprovalRulesSave  = "approval_rules.save"
+	ActionBOMProfileSave     = "bom_profile.save"
+	ActionBOMProfileDelete   = "bom_profile.delete"
+	ActionIPPoolSave         = "ip_pool.save"
+	ActionIPPoolDelete       = "ip_pool.delete"
+	ActionIPReserve          = "ip.reserve"
+	ActionIPRelease          = "ip.release"
+	ActionWebhookCreate      = "webhook.create"
+	ActionWebhookUpdate      = "webhook.update"
+	ActionWebhookDelete      = "webhook.delete"
+	ActionAgentReport        = "agent.report"
+	ActionAgentProgress      = "agent.progress"
+	ActionAgentOperation     = "agent.operation_complete"
+	ActionAgentInstallResult = "agent.install_complete"
+)
+
+// Record is one audited action. Seq, Time, PrevHash and Hash are set when
+// the record is appended.
+type Record struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Method   string    `json:"method,omitempty"` // api_key, session, anonymous, agent, system
+	SourceIP string    `json:"source_ip,omitempty"`
+	Action   string    `json:"action"`
+	IDC      string    `json:"idc,omitempty"`
+	SN       string    `json:"sn,omitempty"`
+	TaskID   string    `json:"task_id,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Changes  []Change  `json:"changes,omitempty"` // task fields before and after
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// ComputeHash hashes the record with its Hash field left out
+func (r *Record) ComputeHash() string {
+	unsigned := *r
+	unsigned.Hash = ""
+	data, _ := json.Marshal(unsigned)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ErrConflict is returned by Store.Insert when the sequence number is taken
+var ErrConflict = errors.New("audit record already exists")
+
+// Store persists records. Implementations must never replace a record.
+type Store interface {
+	// Last returns the newest record, nil when the log is empty
+	Last() (*Record, error)
+	// Insert stores r, or returns ErrConflict when r.Seq is taken
+	Insert(r *Record) error
+	// Scan calls fn with the records from sequence number from onward, in
+	// order, until fn returns false
+	Scan(from uint64, fn func(Record) bool) error
+	// Prune removes the records up to and including last and keeps last as
+	// the checkpoint. It returns ErrConflict when last is already gone.
+	Prune(last *Record) error
+	// Checkpoint returns the newest pruned record, nil when none was
+	Checkpoint() (*Record, error)
+}
+
+// Log appends hash-chained records to a store
+type Log struct {
+	store Store
+	mu    sync.Mutex
+	now   func() time.Time
+}
+
+// NewLog creates a log on store
+func NewLog(store Store) *Log {
+	return &Log{store: store, now: time.Now}
+}
+
+// appendRetries bounds the attempts when other processes append at the
+// same time
+const appendRetries = 10
+
+// Append numbers, chains and stores r, returning the stored record. Time is
+// set to now unless r already has one, as records queued earlier do.
+func (l *Log) Append(r Record) (*Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stamped := !r.Time.IsZero()
+	for attempt := 0; attempt < appendRetries; attempt++ {
+		last, err := l.store.Last()
+		if err != nil {
+			return nil, err
+		}
+		r.Seq, r.PrevHash = 1, ""
+		if last != nil {
+			r.Seq, r.PrevHash = last.Seq+1, last.Hash
+		}
+		if !stamped {
+			r.Time = l.now().UTC()
+		}
+		r.Hash = r.ComputeHash()
+
+		err = l.store.Insert(&r)
+		if err == nil {
+			return &r, nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return nil, err
+		}
+		time.Sleep(time.Duration(attempt+1) * 10 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("failed to append audit record after %d attempts", appendRetries)
+}
+
+// Query selects records; zero fields match everything
+type Query struct {
+	Actor  string
+	Action string
+	IDC    string
+	SN     string
+	TaskID string
+	Since  time.Time
+	Until  time.Time
+	After  uint64 // only records with a higher sequence number
+	Limit  int    // 0 is unlimited
+	Allow  func(*Record) bool
+}
+
+// Matches reports whether r is selected by q
+func (q *Query) Matches(r *Record) bool {
+	switch {
+	case q.Actor != "" && r.Actor != q.Actor,
+		q.Action != "" && r.Action != q.Action,
+		q.IDC != "" && r.IDC != q.IDC,
+		q.SN != "" && r.SN != q.SN,
+		q.TaskID != "" && r.TaskID != q.TaskID,
+		!q.Since.IsZero() && r.Time.Before(q.Since),
+		!q.Until.IsZero() && !r.Time.Before(q.Until):
+		return false
+	}
+	return q.Allow == nil || q.Allow(r)
+}
+
+// Each calls fn with the records matching q, oldest first, until fn
+// returns false or Limit records were passed
+func (l *Log) Each(q Query, fn func(*Record) bool) error {
+	n := 0
+	return l.store.Scan(q.After+1, func(r Record) bool {
+		if !q.Matches(&r) {
+			return true
+		}
+		n++
+		return fn(&r) && (q.Limit <= 0 || n < q.Limit)
+	})
+}
+
+// List returns the records matching q, oldest first, and whether more
+// follow the last one
+func (l *Log) List(q Query) ([]Record, bool, error) {
+	limit := q.Limit
+	if limit > 0 {
+		q.Limit++ // read one ahead to tell whether there is another page
+	}
+	records := []Record{}
+	err := l.Each(q, func(r *Record) bool {
+		records = append(records, *r)
+		return true
+	})
+	more := limit > 0 && len(records) > limit
+	if more {
+		records = records[:limit]
+	}
+	return records, more, err
+}
+
+// Export writes the records matching q as JSON lines
+func (l *Log) Export(w io.Writer, q Query) error {
+	enc := json.NewEncoder(w)
+	var werr error
+	err := l.Each(q, func(r *Record) bool {
+		werr = enc.Encode(r)
+		return werr == nil
+	})
+	if werr != nil {
+		return werr
+	}
+	return err
+}
+
+// Prune removes the records older than before, keeping the newest record
+// so the chain goes on from it. It returns how many records were removed.
+func (l *Log) Prune(before time.Time) (int, error) {
+	checkpoint, err := l.store.Checkpoint()
+	if err != nil {
+		return 0, err
+	}
+	newest, err := l.store.Last()
+	if err != nil || newest == nil {
+		return 0, err
+	}
+	var from uint64 = 1
+	if checkpoint != nil {
+		from = checkpoint.Seq + 1
+	}
+
+	var last *Record
+	n := 0
+	err = l.store.Scan(from, func(r Record) bool {
+		if !r.Time.Before(before) || r.Seq >= newest.Seq {
+			return false
+		}
+		last = &r
+		n++
+		return true
+	})
+	if err != nil || last == nil {
+		return 0, err
+	}
+	if err := l.store.Prune(last); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ChainError describes the first record that breaks the hash chain
+type ChainError struct {
+	Seq    uint64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit chain broken at record %d: %s", e.Seq, e.Reason)
+}
+
+// Verify walks the log checking sequence numbers and hashes, from the
+// checkpoint on when records were pruned. It returns how many records were
+// checked and a *ChainError at the first inconsistency.
+func (l *Log) Verify() (uint64, error) {
+	var (
+		checked  uint64
+		seq      uint64
+		prevHash string
+		chainErr *ChainError
+	)
+	checkpoint, err := l.store.Checkpoint()
+	if err != nil {
+		return 0, err
+	}
+	if checkpoint != nil {
+		seq, prevHash = checkpoint.Seq, checkpoint.Hash
+	}
+	err = l.store.Scan(seq+1, func(r Record) bool {
+		switch {
+		case r.Seq != seq+1:
+			chainErr = &ChainError{Seq: seq + 1, Reason: fmt.Sprintf("missing, next record is %d", r.Seq)}
+		case r.PrevHash != prevHash:
+			chainErr = &ChainError{Seq: r.Seq, Reason: "previous hash does not match"}
+		case r.ComputeHash() != r.Hash:
+			chainErr = &ChainError{Seq: r.Seq, Reason: "content does not match its hash"}
+		default:
+			checked++
+			seq, prevHash = r.Seq, r.Hash
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return checked, err
+	}
+	if chainErr != nil {
+		return checked, chainErr
+	}
+	return checked, nil
+}
@@ -0,0 +1,326 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// memStore keeps records in memory, refusing to replace one like etcd
+type memStore struct {
+	mu         sync.Mutex
+	records    map[uint64][]byte
+	last       uint64
+	checkpoint *Record
+}
+
+func newMemStore() *memStore { return &memStore{records: map[uint64][]byte{}} }
+
+func (s *memStore) Last() (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == 0 {
+		return nil, nil
+	}
+	var r Record
+	return &r, json.Unmarshal(s.records[s.last], &r)
+}
+
+func (s *memStore) Insert(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[r.Seq]; ok {
+		return ErrConflict
+	}
+	data, _ := json.Marshal(r)
+	s.records[r.Seq] = data
+	s.last = max(s.last, r.Seq)
+	return nil
+}
+
+func (s *memStore) Scan(from uint64, fn func(Record) bool) error {
+	s.mu.Lock()
+	last := s.last
+	s.mu.Unlock()
+	for seq := from; seq <= last; seq++ {
+		s.mu.Lock()
+		data, ok := s.records[seq]
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if !fn(r) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Prune(last *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[last.Seq]; !ok {
+		return ErrConflict
+	}
+	for seq := range s.records {
+		if seq <= last.Seq {
+			delete(s.records, seq)
+		}
+	}
+	s.checkpoint = last
+	return nil
+}
+
+func (s *memStore) Checkpoint() (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoint, nil
+}
+
+func TestAppendChains(t *testing.T) {
+	l := NewLog(newMemStore())
+	first, err := l.Append(Record{Actor: "alice", Action: ActionTaskCreate, IDC: "dc1", SN: "sn-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := l.Append(Record{Actor: "bob", Action: ActionTaskApprove, IDC: "dc1", SN: "sn-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Seq != 1 || first.PrevHash != "" || first.Hash == "" {
+		t.Errorf("first = %+v", first)
+	}
+	if second.Seq != 2 || second.PrevHash != first.Hash || second.Hash != second.ComputeHash() {
+		t.Errorf("second = %+v", second)
+	}
+	if n, err := l.Verify(); n != 2 || err != nil {
+		t.Errorf("Verify = %d, %v", n, err)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	store := newMemStore()
+	logs := []*Log{NewLog(store), NewLog(store)} // e.g. control plane and a regional client
+
+	var wg sync.WaitGroup
+	for _, l := range logs {
+		wg.Add(1)
+		go func(l *Log) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if _, err := l.Append(Record{Action: ActionAgentProgress}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(l)
+	}
+	wg.Wait()
+
+	if n, err := logs[0].Verify(); n != 40 || err != nil {
+		t.Errorf("Verify = %d, %v", n, err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	store := newMemStore()
+	l := NewLog(store)
+	for _, actor := range []string{"alice", "bob", "carol"} {
+		l.Append(Record{Actor: actor, Action: ActionTaskApprove})
+	}
+
+	// Rewrite the actor of record 2 without fixing its hash
+	tampered := strings.Replace(string(store.records[2]), `"bob"`, `"mallory"`, 1)
+	store.records[2] = []byte(tampered)
+	var chainErr *ChainError
+	if _, err := l.Verify(); !errors.As(err, &chainErr) || chainErr.Seq != 2 {
+		t.Errorf("tampered record: %v", err)
+	}
+
+	// Rehashing it breaks the link from record 3 instead
+	var r Record
+	json.Unmarshal(store.records[2], &r)
+	r.Hash = r.ComputeHash()
+	store.records[2], _ = json.Marshal(r)
+	if n, err := l.Verify(); !errors.As(err, &chainErr) || chainErr.Seq != 3 || n != 2 {
+		t.Errorf("rehashed record: %d, %v", n, err)
+	}
+
+	// A removed record leaves a gap
+	delete(store.records, 2)
+	if _, err := l.Verify(); !errors.As(err, &chainErr) || chainErr.Seq != 2 {
+		t.Errorf("removed record: %v", err)
+	}
+}
+
+func TestListAndExport(t *testing.T) {
+	l := NewLog(newMemStore())
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := start
+	l.now = func() time.Time { clock = clock.Add(time.Minute); return clock }
+
+	for i, idc := range []string{"dc1", "dc2", "dc1", "dc1", ""} {
+		l.Append(Record{Actor: "alice", Action: ActionTaskCreate, IDC: idc, SN: "sn-" + string(rune('a'+i))})
+	}
+
+	page, more, err := l.List(Query{IDC: "dc1", Limit: 2})
+	if err != nil || !more || len(page) != 2 || page[0].Seq != 1 || page[1].Seq != 3 {
+		t.Fatalf("first page = %+v, %v, %v", page, more, err)
+	}
+	page, more, _ = l.List(Query{IDC: "dc1", Limit: 2, After: page[1].Seq})
+	if more || len(page) != 1 || page[0].Seq != 4 {
+		t.Errorf("second page = %+v, %v", page, more)
+	}
+
+	page, _, _ = l.List(Query{Since: start.Add(2 * time.Minute), Until: start.Add(4 * time.Minute)})
+	if len(page) != 2 || page[0].Seq != 2 || page[1].Seq != 3 {
+		t.Errorf("time window = %+v", page)
+	}
+
+	page, _, _ = l.List(Query{Allow: func(r *Record) bool { return r.IDC != "" }})
+	if len(page) != 4 {
+		t.Errorf("Allow kept %d records", len(page))
+	}
+
+	var out strings.Builder
+	if err := l.Export(&out, Query{IDC: "dc2"}); err != nil {
+		t.Fatal(err)
+	}
+	sc := bufio.NewScanner(strings.NewReader(out.String()))
+	var lines []Record
+	for sc.Scan() {
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		lines = append(lines, r)
+	}
+	if len(lines) != 1 || lines[0].Seq != 2 || lines[0].Hash != lines[0].ComputeHash() {
+		t.Errorf("export = %+v", lines)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	before := &models.TaskV3{TaskID: "t1", Status: models.TaskStatusPendingApproval, Logs: []string{"created"}}
+	after := *before
+	after.Status = models.TaskStatusApproved
+	after.Logs = append(append([]string{}, before.Logs...), "approved by alice")
+	after.Approval = &models.Approval{Status: models.ApprovalStatusApproved, ApprovedBy: "alice"}
+
+	changes := map[string]Change{}
+	for _, c := range Diff(before, &after) {
+		changes[c.Field] = c
+	}
+	if c := changes["status"]; string(c.Before) != `"pending_approval"` || string(c.After) != `"approved"` {
+		t.Errorf("status change = %+v", c)
+	}
+	if c, ok := changes["logs[1]"]; !ok || c.Before != nil || string(c.After) != `"approved by alice"` {
+		t.Errorf("appended log = %+v", c)
+	}
+	if c := changes["approval"]; c.Before != nil || !strings.Contains(string(c.After), `"approved_by":"alice"`) {
+		t.Errorf("approval change = %+v", c)
+	}
+	if _, ok := changes["task_id"]; ok {
+		t.Error("unchanged field reported")
+	}
+
+	if ignored := Diff(before, &after, "logs", "approval"); len(ignored) != 1 || ignored[0].Field != "status" {
+		t.Errorf("Diff() ignoring logs and approval = %+v", ignored)
+	}
+
+	var none *models.TaskV3
+	if created := Diff(none, before); len(created) == 0 {
+		t.Error("new task has no changes")
+	}
+}
+
+func TestQueue(t *testing.T) {
+	l := NewLog(newMemStore())
+	q := NewQueue(l, 2)
+	queuedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if !q.Add(Record{Actor: "agent/sn-1", Action: ActionAgentReport, Time: queuedAt}) || !q.Add(Record{Actor: "agent/sn-2", Action: ActionAgentReport}) {
+		t.Fatal("Add() refused a record with room in the queue")
+	}
+	if q.Add(Record{Actor: "agent/sn-3", Action: ActionAgentReport}) {
+		t.Error("Add() accepted a record into a full queue")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx, func(r Record, err error) { t.Errorf("append of %s failed: %v", r.Actor, err) })
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if last, _ := l.store.Last(); last != nil && last.Seq == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("queued records were not appended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	records, _, _ := l.List(Query{})
+	if len(records) != 2 || !records[0].Time.Equal(queuedAt) || records[1].Actor != "agent/sn-2" {
+		t.Errorf("appended = %+v", records)
+	}
+	if _, err := l.Verify(); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	store := newMemStore()
+	l := NewLog(store)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := start
+	l.now = func() time.Time { clock = clock.Add(time.Hour); return clock }
+	for i := 0; i < 5; i++ {
+		l.Append(Record{Actor: "alice", Action: ActionTaskCreate})
+	}
+
+	// Records 1 and 2 are older than 3 hours after start
+	if n, err := l.Prune(start.Add(3 * time.Hour)); err != nil || n != 2 {
+		t.Fatalf("Prune() = %d, %v, want 2", n, err)
+	}
+	if checked, err := l.Verify(); err != nil || checked != 3 {
+		t.Errorf("Verify() after pruning = %d, %v, want 3", checked, err)
+	}
+	if n, err := l.Prune(start.Add(3 * time.Hour)); err != nil || n != 0 {
+		t.Errorf("second Prune() = %d, %v, want 0", n, err)
+	}
+
+	// The newest record stays so the chain goes on
+	if n, err := l.Prune(start.Add(48 * time.Hour)); err != nil || n != 2 {
+		t.Errorf("Prune() of everything = %d, %v, want 2", n, err)
+	}
+	next, err := l.Append(Record{Actor: "bob", Action: ActionTaskApprove})
+	if err != nil || next.Seq != 6 {
+		t.Fatalf("Append() after pruning = %+v, %v", next, err)
+	}
+	if checked, err := l.Verify(); err != nil || checked != 2 {
+		t.Errorf("Verify() = %d, %v, want 2", checked, err)
+	}
+
+	// A record removed behind the checkpoint's back still breaks the chain
+	delete(store.records, 5)
+	var chainErr *ChainError
+	if _, err := l.Verify(); !errors.As(err, &chainErr) || chainErr.Seq != 5 {
+		t.Errorf("Verify() with record 5 removed = %v", err)
+	}
+}
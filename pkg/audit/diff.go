@@ -0,0 +1,123 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+// Change is one field that differs between two versions of a value. Field
+// is a dotted JSON path; list elements added at the end are reported one by
+// one as path[i] with no Before.
+type Change struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Diff compares the JSON forms of before and after. A nil side counts as
+// an empty object, so Diff(nil, task) lists every field of a new task.
+// Top-level fields named in ignore are left out.
+func Diff(before, after interface{}, ignore ...string) []Change {
+	b, err := toJSONValue(before)
+	if err != nil {
+		return nil
+	}
+	a, err := toJSONValue(after)
+	if err != nil {
+		return nil
+	}
+	for _, field := range ignore {
+		if m, ok := b.(map[string]interface{}); ok {
+			delete(m, field)
+		}
+		if m, ok := a.(map[string]interface{}); ok {
+			delete(m, field)
+		}
+	}
+	var changes []Change
+	diffValue("", b, a, &changes)
+	return changes
+}
+
+func toJSONValue(v interface{}) (interface{}, error) {
+	if v == nil {
+		return map[string]interface{}{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	if out == nil {
+		out = map[string]interface{}{}
+	}
+	return out, nil
+}
+
+func diffValue(path string, before, after interface{}, changes *[]Change) {
+	bm, bIsMap := before.(map[string]interface{})
+	am, aIsMap := after.(map[string]interface{})
+	if bIsMap && aIsMap {
+		keys := make(map[string]bool, len(bm)+len(am))
+		for k := range bm {
+			keys[k] = true
+		}
+		for k := range am {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			field := k
+			if path != "" {
+				field = path + "." + k
+			}
+			diffValue(field, bm[k], am[k], changes)
+		}
+		return
+	}
+
+	bj, aj := rawJSON(before), rawJSON(after)
+	if bytes.Equal(bj, aj) {
+		return
+	}
+
+	// Lists that only grew, such as logs and status history, record the
+	// new elements instead of the whole list twice
+	if bl, ok := before.([]interface{}); ok {
+		if al, ok := after.([]interface{}); ok && len(al) > len(bl) && isPrefix(bl, al) {
+			for i := len(bl); i < len(al); i++ {
+				*changes = append(*changes, Change{Field: path + "[" + strconv.Itoa(i) + "]", After: rawJSON(al[i])})
+			}
+			return
+		}
+	}
+
+	*changes = append(*changes, Change{Field: path, Before: bj, After: aj})
+}
+
+func isPrefix(prefix, list []interface{}) bool {
+	for i := range prefix {
+		if !bytes.Equal(rawJSON(prefix[i]), rawJSON(list[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// rawJSON encodes a decoded JSON value; nil (absent) stays empty
+func rawJSON(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, _ := json.Marshal(v)
+	return data
+}
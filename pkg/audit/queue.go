@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"context"
+	"time"
+)
+
+// Queue appends records in the background, so a request path neither waits
+// for the store nor for other processes appending at the same time. Records
+// keep the time they were queued at.
+type Queue struct {
+	log     *Log
+	records chan Record
+}
+
+// NewQueue creates a queue holding up to size records for l
+func NewQueue(l *Log, size int) *Queue {
+	return &Queue{log: l, records: make(chan Record, size)}
+}
+
+// Add queues r. It never blocks: when the queue is full r is dropped and
+// Add returns false.
+func (q *Queue) Add(r Record) bool {
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	select {
+	case q.records <- r:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run appends queued records until ctx is done, calling onError with each
+// record that could not be appended
+func (q *Queue) Run(ctx context.Context, onError func(Record, error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-q.records:
+			if _, err := q.log.Append(r); err != nil {
+				onError(r, err)
+			}
+		}
+	}
+}
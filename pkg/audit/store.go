@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+)
+
+// scanPage is how many records Scan reads per etcd request
+const scanPage = 500
+
+// EtcdStore keeps records under /os/global/audit/, one key per sequence
+// number. A key is only ever created, never overwritten; retention removes
+// the oldest and keeps the newest removed under /os/global/audit_pruned.
+type EtcdStore struct {
+	client *etcd.Client
+}
+
+// NewEtcdStore creates a store backed by etcd
+func NewEtcdStore(client *etcd.Client) *EtcdStore {
+	return &EtcdStore{client: client}
+}
+
+// Last implements Store
+func (s *EtcdStore) Last() (*Record, error) {
+	kvs, _, _, err := s.client.Range(etcd.KeyPrefixAudit, clientv3.GetPrefixRangeEnd(etcd.KeyPrefixAudit), 1, true, 0)
+	if err != nil || len(kvs) == 0 {
+		return nil, err
+	}
+	var r Record
+	if err := json.Unmarshal(kvs[0].Value, &r); err != nil {
+		return nil, fmt.Errorf("invalid audit record %s: %w", kvs[0].Key, err)
+	}
+	return &r, nil
+}
+
+// Insert implements Store
+func (s *EtcdStore) Insert(r *Record) error {
+	key := etcd.AuditRecordKey(r.Seq)
+	op, err := etcd.OpPut(key, r)
+	if err != nil {
+		return err
+	}
+	err = s.client.Transaction([]clientv3.Op{op}, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+	if errors.Is(err, etcd.ErrTxnConflict) {
+		return ErrConflict
+	}
+	return err
+}
+
+// Scan implements Store. All pages are read at the revision of the first
+// so records appended meanwhile do not show up halfway.
+func (s *EtcdStore) Scan(from uint64, fn func(Record) bool) error {
+	start := etcd.AuditRecordKey(from)
+	end := clientv3.GetPrefixRangeEnd(etcd.KeyPrefixAudit)
+	var rev int64
+	for {
+		kvs, readRev, more, err := s.client.Range(start, end, scanPage, false, rev)
+		if err != nil {
+			return err
+		}
+		rev = readRev
+		for _, kv := range kvs {
+			var r Record
+			if err := json.Unmarshal(kv.Value, &r); err != nil {
+				return fmt.Errorf("invalid audit record %s: %w", kv.Key, err)
+			}
+			if !fn(r) {
+				return nil
+			}
+		}
+		if !more || len(kvs) == 0 {
+			return nil
+		}
+		start = kvs[len(kvs)-1].Key + "\x00"
+	}
+}
+
+// Prune implements Store. Removing the records and moving the checkpoint
+// happen in one transaction, which fails when another process pruned past
+// last meanwhile.
+func (s *EtcdStore) Prune(last *Record) error {
+	key := etcd.AuditRecordKey(last.Seq)
+	put, err := etcd.OpPut(etcd.KeyAuditPruned, last)
+	if err != nil {
+		return err
+	}
+	err = s.client.Transaction([]clientv3.Op{
+		clientv3.OpDelete(etcd.KeyPrefixAudit, clientv3.WithRange(etcd.AuditRecordKey(last.Seq+1))),
+		put,
+	}, clientv3.Compare(clientv3.CreateRevision(key), ">", 0))
+	if errors.Is(err, etcd.ErrTxnConflict) {
+		return ErrConflict
+	}
+	return err
+}
+
+// Checkpoint implements Store
+func (s *EtcdStore) Checkpoint() (*Record, error) {
+	var r Record
+	if err := s.client.GetJSON(etcd.KeyAuditPruned, &r); err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &r, nil
+}
@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/config"
+)
+
+// Permission is an action a principal may perform
+type Permission string
+
+const (
+	PermissionRead    Permission = "read"
+	PermissionWrite   Permission = "write"
+	PermissionApprove Permission = "approve"
+)
+
+// HeaderAPIKey is the header carrying an API key
+const HeaderAPIKey = "X-API-Key"
+
+// AnonymousName is the principal name used when authentication is disabled
+const AnonymousName = "anonymous"
+
+// contextKey is the gin context key holding the authenticated principal
+const contextKey = "lpmos.principal"
+
+// Principal is an authenticated caller
+type Principal struct {
+	Name        string              `json:"name"`
+	Permissions map[Permission]bool `json:"permissions"`
+	IDCs        map[string]bool     `json:"idcs,omitempty"` // empty means every IDC
+	Roles       []string            `json:"roles,omitempty"`
+	Method      string              `json:"method"` // api_key, session, anonymous
+	ExpiresAt   time.Time           `json:"expires_at,omitempty"`
+}
+
+// Can reports whether the principal holds perm for the given IDC.
+// An empty idc checks the permission without an IDC scope.
+func (p *Principal) Can(perm Permission, idc string) bool {
+	if p == nil || !p.Permissions[perm] {
+		return false
+	}
+	return idc == "" || p.CanAccessIDC(idc)
+}
+
+// CanAccessIDC reports whether the principal is scoped to idc
+func (p *Principal) CanAccessIDC(idc string) bool {
+	return len(p.IDCs) == 0 || p.IDCs[idc]
+}
+
+// Expired reports whether a session-bound principal has outlived its session
+func (p *Principal) Expired() bool {
+	return p != nil && !p.ExpiresAt.IsZero() && time.Now().After(p.ExpiresAt)
+}
+
+// SessionSource resolves a browser session to a principal
+type SessionSource interface {
+	PrincipalFromRequest(r *http.Request) (*Principal, bool)
+}
+
+// Authenticator resolves API keys and sessions to principals
+type Authenticator struct {
+	enabled  bool
+	keys     map[[sha256.Size]byte]*Principal
+	sessions SessionSource
+}
+
+// NewAuthenticator builds an authenticator from the security.api_keys block
+func NewAuthenticator(cfg config.APIKeysConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		enabled: cfg.Enabled,
+		keys:    make(map[[sha256.Size]byte]*Principal),
+	}
+
+	for _, spec := range cfg.Keys {
+		p := &Principal{
+			Name:        spec.Name,
+			Permissions: make(map[Permission]bool),
+			IDCs:        make(map[string]bool),
+			Method:      "api_key",
+		}
+		for _, perm := range spec.Permissions {
+			switch Permission(perm) {
+			case PermissionRead, PermissionWrite, PermissionApprove:
+				p.Permissions[Permission(perm)] = true
+			default:
+				return nil, fmt.Errorf("api key %s: unknown permission %q", spec.Name, perm)
+			}
+		}
+		for _, idc := range spec.IDCs {
+			p.IDCs[idc] = true
+		}
+		a.keys[sha256.Sum256([]byte(spec.Key))] = p
+	}
+
+	return a, nil
+}
+
+// Enabled reports whether API keys are enforced
+func (a *Authenticator) Enabled() bool {
+	return a.enabled
+}
+
+// UseSessions accepts browser sessions (dashboard login) in addition to API keys
+func (a *Authenticator) UseSessions(s SessionSource) {
+	a.sessions = s
+}
+
+// Required reports whether anonymous access is refused
+func (a *Authenticator) Required() bool {
+	return a.enabled || a.sessions != nil
+}
+
+// Authenticate resolves a raw API key. Keys are compared by hash so the
+// lookup does not leak timing information about stored keys.
+func (a *Authenticator) Authenticate(key string) (*Principal, bool) {
+	if key == "" {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(key))
+	for stored, p := range a.keys {
+		if subtle.ConstantTimeCompare(stored[:], sum[:]) == 1 {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Middleware authenticates every request with an API key or a session
+// cookie. When neither API keys nor sessions are configured every caller is
+// the anonymous principal with full permissions.
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	anonymous := &Principal{
+		Name: AnonymousName,
+		Permissions: map[Permission]bool{
+			PermissionRead:    true,
+			PermissionWrite:   true,
+			PermissionApprove: true,
+		},
+		Method: "anonymous",
+	}
+
+	return func(c *gin.Context) {
+		if p, ok := a.resolve(c.Request); ok {
+			c.Set(contextKey, p)
+			c.Next()
+			return
+		}
+
+		if !a.Required() {
+			c.Set(contextKey, anonymous)
+			c.Next()
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+	}
+}
+
+// RequireLogin guards HTML pages: unauthenticated browsers are redirected
+// to loginPath with the original URL in the next parameter.
+func (a *Authenticator) RequireLogin(loginPath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.sessions == nil {
+			c.Next()
+			return
+		}
+		if p, ok := a.resolve(c.Request); ok {
+			c.Set(contextKey, p)
+			c.Next()
+			return
+		}
+		c.Redirect(http.StatusFound, loginPath+"?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+		c.Abort()
+	}
+}
+
+// resolve finds the principal for an API key or a session cookie
+func (a *Authenticator) resolve(r *http.Request) (*Principal, bool) {
+	if a.enabled {
+		if key := keyFromRequest(r); key != "" {
+			return a.Authenticate(key)
+		}
+	}
+	if a.sessions != nil {
+		return a.sessions.PrincipalFromRequest(r)
+	}
+	return nil, false
+}
+
+// Require rejects requests whose principal lacks perm. The IDC scope is taken
+// from the :idc path parameter or the idc query parameter when present;
+// handlers that read the IDC from the body must call Authorize themselves.
+func Require(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idc := c.Param("idc")
+		if idc == "" {
+			idc = c.Query("idc")
+		}
+		if !Authorize(c, perm, idc) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Authorize checks perm for idc and writes a 403 response when it is missing
+func Authorize(c *gin.Context, perm Permission, idc string) bool {
+	p := PrincipalFrom(c)
+	if p.Can(perm, idc) {
+		return true
+	}
+
+	if idc != "" && p != nil && p.Permissions[perm] {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s is not allowed to access IDC %s", p.Name, idc)})
+	} else {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s permission required", perm)})
+	}
+	return false
+}
+
+// PrincipalFrom returns the authenticated principal, or nil outside the middleware
+func PrincipalFrom(c *gin.Context) *Principal {
+	if v, ok := c.Get(contextKey); ok {
+		if p, ok := v.(*Principal); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// Actor returns the principal name to record in task audit fields
+func Actor(c *gin.Context) string {
+	if p := PrincipalFrom(c); p != nil {
+		return p.Name
+	}
+	return AnonymousName
+}
+
+// keyFromRequest extracts the API key from X-API-Key or a Bearer token
+func keyFromRequest(r *http.Request) string {
+	if key := r.Header.Get(HeaderAPIKey); key != "" {
+		return key
+	}
+	if authz := r.Header.Get("Authorization"); strings.HasPrefix(authz, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authz, "Bearer "))
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/config"
+)
+
+func newTestRouter(t *testing.T, enabled bool) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	a, err := NewAuthenticator(config.APIKeysConfig{
+		Enabled: enabled,
+		Keys: []config.APIKeySpec{
+			{Name: "admin", Key: "admin-key", Permissions: []string{"read", "write", "approve"}},
+			{Name: "readonly", Key: "ro-key", Permissions: []string{"read"}},
+			{Name: "dc1-op", Key: "dc1-key", Permissions: []string{"read", "approve"}, IDCs: []string{"dc1"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewAuthenticator() error = %v", err)
+	}
+
+	router := gin.New()
+	router.Use(a.Middleware())
+	router.GET("/tasks/:idc", Require(PermissionRead), func(c *gin.Context) {
+		c.String(http.StatusOK, Actor(c))
+	})
+	router.POST("/tasks/:idc/approve", Require(PermissionApprove), func(c *gin.Context) {
+		c.String(http.StatusOK, Actor(c))
+	})
+	return router
+}
+
+func TestMiddleware(t *testing.T) {
+	router := newTestRouter(t, true)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		value  string
+		want   int
+		actor  string
+	}{
+		{"no key", "GET", "/tasks/dc1", "", "", http.StatusUnauthorized, ""},
+		{"bad key", "GET", "/tasks/dc1", HeaderAPIKey, "nope", http.StatusUnauthorized, ""},
+		{"admin reads", "GET", "/tasks/dc2", HeaderAPIKey, "admin-key", http.StatusOK, "admin"},
+		{"bearer token", "POST", "/tasks/dc2/approve", "Authorization", "Bearer admin-key", http.StatusOK, "admin"},
+		{"readonly cannot approve", "POST", "/tasks/dc1/approve", HeaderAPIKey, "ro-key", http.StatusForbidden, ""},
+		{"scoped key in scope", "POST", "/tasks/dc1/approve", HeaderAPIKey, "dc1-key", http.StatusOK, "dc1-op"},
+		{"scoped key out of scope", "GET", "/tasks/dc2", HeaderAPIKey, "dc1-key", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.want, w.Body.String())
+			}
+			if tt.actor != "" && w.Body.String() != tt.actor {
+				t.Errorf("actor = %q, want %q", w.Body.String(), tt.actor)
+			}
+		})
+	}
+}
+
+func TestMiddlewareDisabled(t *testing.T) {
+	router := newTestRouter(t, false)
+
+	req := httptest.NewRequest("POST", "/tasks/dc1/approve", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != AnonymousName {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), AnonymousName)
+	}
+}
+
+func TestNewAuthenticatorRejectsUnknownPermission(t *testing.T) {
+	_, err := NewAuthenticator(config.APIKeysConfig{
+		Enabled: true,
+		Keys:    []config.APIKeySpec{{Name: "x", Key: "k", Permissions: []string{"delete"}}},
+	})
+	if err == nil {
+		t.Error("NewAuthenticator() accepted unknown permission")
+	}
+}
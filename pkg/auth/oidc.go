@@ -0,0 +1,493 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/config"
+)
+
+// stateCookie carries the state, nonce and PKCE verifier of a login in flight
+const stateCookie = "lpmos_oidc"
+
+// loginTimeout bounds how long a user may spend at the identity provider
+const loginTimeout = 10 * time.Minute
+
+// clockSkew tolerates small clock differences when checking token expiry
+const clockSkew = time.Minute
+
+// rolePermissions maps dashboard roles to API permissions
+var rolePermissions = map[string][]Permission{
+	"viewer":   {PermissionRead},
+	"operator": {PermissionRead, PermissionWrite},
+	"approver": {PermissionRead, PermissionApprove},
+	"admin":    {PermissionRead, PermissionWrite, PermissionApprove},
+}
+
+// OIDC is an OpenID Connect relying party using the authorization code flow
+type OIDC struct {
+	cfg        config.OIDCConfig
+	sessions   *SessionCodec
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// oidcDiscovery is the subset of .well-known/openid-configuration we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint,omitempty"`
+}
+
+// loginState is sealed into the state cookie during a login
+type loginState struct {
+	State     string    `json:"state"`
+	Nonce     string    `json:"nonce"`
+	Verifier  string    `json:"verifier"`
+	Next      string    `json:"next"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+// NewOIDC creates a relying party. The provider is discovered lazily on the
+// first login so the control plane can start while the IdP is unreachable.
+func NewOIDC(cfg config.OIDCConfig, sessions *SessionCodec) *OIDC {
+	return &OIDC{
+		cfg:        cfg,
+		sessions:   sessions,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		keys:       make(map[string]*rsa.PublicKey),
+	}
+}
+
+// RegisterRoutes mounts /auth/login, /auth/callback and /auth/logout
+func (o *OIDC) RegisterRoutes(router gin.IRouter) {
+	group := router.Group("/auth")
+	group.GET("/login", o.Login)
+	group.GET("/callback", o.Callback)
+	group.GET("/logout", o.Logout)
+	group.POST("/logout", o.Logout)
+}
+
+// Login redirects the browser to the identity provider
+func (o *OIDC) Login(c *gin.Context) {
+	d, err := o.provider()
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+		return
+	}
+
+	st := loginState{
+		State:     randomString(),
+		Nonce:     randomString(),
+		Verifier:  randomString(),
+		Next:      safeNext(c.Query("next")),
+		ExpiresAt: time.Now().Add(loginTimeout),
+	}
+	sealed, err := o.sessions.Seal(st)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	o.sessions.setCookie(c.Writer, stateCookie, "/auth", sealed, loginTimeout)
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.cfg.ClientID},
+		"redirect_uri":          {o.cfg.RedirectURL},
+		"scope":                 {strings.Join(o.cfg.Scopes, " ")},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	c.Redirect(http.StatusFound, d.AuthorizationEndpoint+"?"+params.Encode())
+}
+
+// Callback completes the login: it exchanges the code, verifies the ID
+// token, maps groups to roles and issues the session cookie.
+func (o *OIDC) Callback(c *gin.Context) {
+	if errCode := c.Query("error"); errCode != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("login failed: %s %s", errCode, c.Query("error_description"))})
+		return
+	}
+
+	var st loginState
+	cookie, err := c.Request.Cookie(stateCookie)
+	if err != nil || o.sessions.Open(cookie.Value, &st) != nil || time.Now().After(st.ExpiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "login state missing or expired, please retry"})
+		return
+	}
+	o.sessions.setCookie(c.Writer, stateCookie, "/auth", "", -1)
+
+	if c.Query("state") != st.State {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "login state mismatch"})
+		return
+	}
+
+	rawIDToken, err := o.exchange(c.Query("code"), st.Verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "code exchange failed"})
+		return
+	}
+
+	claims, err := o.verifyIDToken(rawIDToken, st.Nonce)
+	if err != nil {
+		log.Printf("OIDC ID token rejected: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid ID token"})
+		return
+	}
+
+	session := o.sessionFromClaims(claims)
+	if len(session.Roles) == 0 {
+		log.Printf("OIDC login denied for %s: no group maps to a dashboard role (groups: %v)", session.Name, session.Groups)
+		c.JSON(http.StatusForbidden, gin.H{"error": "your account has no LPMOS role"})
+		return
+	}
+
+	if err := o.sessions.SetSession(c.Writer, session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("OIDC login: %s (roles: %v)", session.Name, session.Roles)
+	c.Redirect(http.StatusFound, st.Next)
+}
+
+// Logout clears the session cookie
+func (o *OIDC) Logout(c *gin.Context) {
+	o.sessions.ClearSession(c.Writer)
+	if c.Request.Method == http.MethodGet {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// provider returns the cached discovery document, fetching it on first use
+func (o *OIDC) provider() (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	wellKnown := strings.TrimSuffix(o.cfg.IssuerURL, "/") + "/.well-known/openid-configuration"
+	var d oidcDiscovery
+	if err := o.getJSON(wellKnown, &d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != o.cfg.IssuerURL && d.Issuer != strings.TrimSuffix(o.cfg.IssuerURL, "/") {
+		return nil, fmt.Errorf("issuer mismatch: configured %s, provider reports %s", o.cfg.IssuerURL, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+// exchange trades an authorization code for the raw ID token
+func (o *OIDC) exchange(code, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing authorization code")
+	}
+	d, err := o.provider()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"client_id":     {o.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if o.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	}
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// verifyIDToken checks the RS256 signature and the standard claims
+func (o *OIDC) verifyIDToken(raw, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	key, err := o.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT signature encoding: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("JWT signature verification failed")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+
+	d, _ := o.provider()
+	if iss, _ := claims["iss"].(string); iss != d.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !audienceContains(claims["aud"], o.cfg.ClientID) {
+		return nil, errors.New("token audience does not include this client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("token expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	return claims, nil
+}
+
+// signingKey returns the JWKS key for kid, refreshing the key set once when
+// the kid is unknown (the provider may have rotated keys).
+func (o *OIDC) signingKey(kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	key, ok := o.keys[kid]
+	o.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	d, err := o.provider()
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(d.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	o.mu.Lock()
+	o.keys = keys
+	o.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key with kid %q", kid)
+}
+
+// sessionFromClaims maps ID token claims to a session via group mappings
+func (o *OIDC) sessionFromClaims(claims map[string]interface{}) *Session {
+	s := &Session{Subject: stringClaim(claims, "sub")}
+
+	for _, claim := range []string{o.cfg.UsernameClaim, "preferred_username", "email", "sub"} {
+		if v := stringClaim(claims, claim); v != "" {
+			s.Name = v
+			break
+		}
+	}
+
+	if raw, ok := claims[o.cfg.GroupsClaim].([]interface{}); ok {
+		for _, g := range raw {
+			if name, ok := g.(string); ok {
+				s.Groups = append(s.Groups, name)
+			}
+		}
+	}
+
+	s.Roles, s.Permissions, s.AllIDCs, s.IDCs = ResolveGroups(o.cfg.GroupMappings, s.Groups)
+	return s
+}
+
+// ResolveGroups maps identity provider groups to roles, permissions and IDC
+// scope. A mapping without idcs grants its role in every IDC.
+func ResolveGroups(mappings []config.GroupMapping, groups []string) (roles []string, perms []Permission, allIDCs bool, idcs []string) {
+	member := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		member[g] = true
+	}
+
+	roleSet := make(map[string]bool)
+	permSet := make(map[Permission]bool)
+	idcSet := make(map[string]bool)
+	for _, m := range mappings {
+		if !member[m.Group] {
+			continue
+		}
+		roleSet[m.Role] = true
+		for _, p := range rolePermissions[m.Role] {
+			permSet[p] = true
+		}
+		if len(m.IDCs) == 0 {
+			allIDCs = true
+		}
+		for _, idc := range m.IDCs {
+			idcSet[idc] = true
+		}
+	}
+
+	for r := range roleSet {
+		roles = append(roles, r)
+	}
+	for p := range permSet {
+		perms = append(perms, p)
+	}
+	for idc := range idcSet {
+		idcs = append(idcs, idc)
+	}
+	sort.Strings(roles)
+	sort.Slice(perms, func(i, j int) bool { return perms[i] < perms[j] })
+	sort.Strings(idcs)
+	return roles, perms, allIDCs, idcs
+}
+
+func (o *OIDC) getJSON(url string, target interface{}) error {
+	resp, err := o.httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(target)
+}
+
+func decodeSegment(seg string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stringClaim(claims map[string]interface{}, name string) string {
+	v, _ := claims[name].(string)
+	return v
+}
+
+// safeNext only allows local redirect targets after login
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
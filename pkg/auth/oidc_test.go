@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lpmos/lpmos-go/pkg/config"
+)
+
+// fakeProvider is a minimal OIDC provider issuing RS256 ID tokens
+type fakeProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	groups []string
+
+	// captured from the authorization request
+	nonce     string
+	challenge string
+}
+
+func newFakeProvider(t *testing.T, groups []string) *fakeProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := &fakeProvider{t: t, key: key, groups: groups}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 fp.server.URL,
+			"authorization_endpoint": fp.server.URL + "/authorize",
+			"token_endpoint":         fp.server.URL + "/token",
+			"jwks_uri":               fp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != fp.challenge {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": fp.idToken("test-client", fp.nonce)})
+	})
+	fp.server = httptest.NewServer(mux)
+	t.Cleanup(fp.server.Close)
+	return fp
+}
+
+func (fp *fakeProvider) idToken(aud, nonce string) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":    fp.server.URL,
+		"sub":    "u-123",
+		"aud":    aud,
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"nonce":  nonce,
+		"email":  "alice@example.com",
+		"groups": fp.groups,
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, fp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		fp.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newOIDCRouter(t *testing.T, fp *fakeProvider) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	sessions := NewSessionCodec("0123456789abcdef", time.Hour, false)
+	a, err := NewAuthenticator(config.APIKeysConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.UseSessions(sessions)
+
+	o := NewOIDC(config.OIDCConfig{
+		IssuerURL:     fp.server.URL,
+		ClientID:      "test-client",
+		RedirectURL:   "http://lpmos.test/auth/callback",
+		Scopes:        []string{"openid"},
+		UsernameClaim: "email",
+		GroupsClaim:   "groups",
+		GroupMappings: []config.GroupMapping{
+			{Group: "ops", Role: "operator"},
+			{Group: "dc1-approvers", Role: "approver", IDCs: []string{"dc1"}},
+		},
+	}, sessions)
+
+	router := gin.New()
+	o.RegisterRoutes(router)
+	router.GET("/", a.RequireLogin("/auth/login"), func(c *gin.Context) { c.String(http.StatusOK, "dashboard") })
+	api := router.Group("/api", a.Middleware())
+	api.GET("/whoami", func(c *gin.Context) { c.JSON(http.StatusOK, PrincipalFrom(c)) })
+	return router
+}
+
+// login drives the browser side of the authorization code flow and returns
+// the cookies set by the callback
+func login(t *testing.T, router *gin.Engine, fp *fakeProvider, code string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login?next=/tasks", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status = %d (%s)", w.Code, w.Body.String())
+	}
+	authURL, _ := url.Parse(w.Header().Get("Location"))
+	q := authURL.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "test-client" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	fp.nonce, fp.challenge = q.Get("nonce"), q.Get("code_challenge")
+
+	req := httptest.NewRequest("GET", "/auth/callback?code="+code+"&state="+url.QueryEscape(q.Get("state")), nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	cb := httptest.NewRecorder()
+	router.ServeHTTP(cb, req)
+	return cb
+}
+
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookie && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	fp := newFakeProvider(t, []string{"ops", "dc1-approvers"})
+	router := newOIDCRouter(t, fp)
+
+	// Unauthenticated dashboard visits are sent to the login page
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "/auth/login?next=") {
+		t.Fatalf("dashboard without session: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	cb := login(t, router, fp, "good-code")
+	if cb.Code != http.StatusFound || cb.Header().Get("Location") != "/tasks" {
+		t.Fatalf("callback: %d %s (%s)", cb.Code, cb.Header().Get("Location"), cb.Body.String())
+	}
+	cookie := sessionCookie(cb)
+	if cookie == nil || !cookie.HttpOnly {
+		t.Fatal("callback did not set an HttpOnly session cookie")
+	}
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("whoami: %d %s", w.Code, w.Body.String())
+	}
+	var p Principal
+	json.Unmarshal(w.Body.Bytes(), &p)
+	if p.Name != "alice@example.com" || p.Method != "session" {
+		t.Errorf("principal = %+v", p)
+	}
+	if !reflect.DeepEqual(p.Roles, []string{"approver", "operator"}) {
+		t.Errorf("roles = %v", p.Roles)
+	}
+	if !p.Permissions[PermissionWrite] || !p.Permissions[PermissionApprove] {
+		t.Errorf("permissions = %v", p.Permissions)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	t.Run("bad code", func(t *testing.T) {
+		fp := newFakeProvider(t, []string{"ops"})
+		cb := login(t, newOIDCRouter(t, fp), fp, "bad-code")
+		if cb.Code != http.StatusUnauthorized || sessionCookie(cb) != nil {
+			t.Errorf("got %d, want 401 without session", cb.Code)
+		}
+	})
+
+	t.Run("no mapped group", func(t *testing.T) {
+		fp := newFakeProvider(t, []string{"finance"})
+		cb := login(t, newOIDCRouter(t, fp), fp, "good-code")
+		if cb.Code != http.StatusForbidden || sessionCookie(cb) != nil {
+			t.Errorf("got %d, want 403 without session", cb.Code)
+		}
+	})
+
+	t.Run("missing state cookie", func(t *testing.T) {
+		fp := newFakeProvider(t, []string{"ops"})
+		w := httptest.NewRecorder()
+		newOIDCRouter(t, fp).ServeHTTP(w, httptest.NewRequest("GET", "/auth/callback?code=good-code&state=x", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got %d, want 400", w.Code)
+		}
+	})
+}
+
+func TestOIDCRejectsWrongAudience(t *testing.T) {
+	fp := newFakeProvider(t, []string{"ops"})
+	o := NewOIDC(config.OIDCConfig{IssuerURL: fp.server.URL, ClientID: "test-client"}, nil)
+
+	if _, err := o.verifyIDToken(fp.idToken("other-client", "n"), "n"); err == nil {
+		t.Error("accepted token for another audience")
+	}
+	if _, err := o.verifyIDToken(fp.idToken("test-client", "n"), "other-nonce"); err == nil {
+		t.Error("accepted token with wrong nonce")
+	}
+	if _, err := o.verifyIDToken(fp.idToken("test-client", "n"), "n"); err != nil {
+		t.Errorf("valid token rejected: %v", err)
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	for in, want := range map[string]string{
+		"/tasks":              "/tasks",
+		"":                    "/",
+		"//evil.example.com":  "/",
+		"https://evil.com/x":  "/",
+		"/\\evil.example.com": "/",
+	} {
+		if got := safeNext(in); got != want {
+			t.Errorf("safeNext(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
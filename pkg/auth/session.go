@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SessionCookie is the name of the dashboard session cookie
+const SessionCookie = "lpmos_session"
+
+var (
+	errBadSignature   = errors.New("invalid signature")
+	errSessionExpired = errors.New("session expired")
+)
+
+// Session is the signed payload stored in the session cookie
+type Session struct {
+	Subject   string    `json:"sub"`
+	Name      string    `json:"name"`
+	Roles     []string  `json:"roles"`
+	Groups    []string  `json:"groups,omitempty"`
+	ExpiresAt time.Time `json:"exp"`
+
+	// Scope resolved from group mappings at login time
+	Permissions []Permission `json:"perms"`
+	AllIDCs     bool         `json:"all_idcs"`
+	IDCs        []string     `json:"idcs,omitempty"`
+}
+
+// Principal converts the session into an authenticated principal
+func (s *Session) Principal() *Principal {
+	p := &Principal{
+		Name:        s.Name,
+		Permissions: make(map[Permission]bool),
+		IDCs:        make(map[string]bool),
+		Roles:       s.Roles,
+		Method:      "session",
+		ExpiresAt:   s.ExpiresAt,
+	}
+	for _, perm := range s.Permissions {
+		p.Permissions[perm] = true
+	}
+	if !s.AllIDCs {
+		for _, idc := range s.IDCs {
+			p.IDCs[idc] = true
+		}
+		if len(p.IDCs) == 0 {
+			// Scoped to no IDC at all: deny everything IDC-bound
+			p.Permissions = map[Permission]bool{}
+		}
+	}
+	return p
+}
+
+// SessionCodec signs and verifies cookie payloads with HMAC-SHA256
+type SessionCodec struct {
+	key    []byte
+	ttl    time.Duration
+	secure bool
+}
+
+// NewSessionCodec creates a codec. secure marks cookies HTTPS-only.
+func NewSessionCodec(secret string, ttl time.Duration, secure bool) *SessionCodec {
+	return &SessionCodec{key: []byte(secret), ttl: ttl, secure: secure}
+}
+
+// Seal serialises and signs v as "<payload>.<signature>"
+func (sc *SessionCodec) Seal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal cookie payload: %w", err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + sc.sign(payload), nil
+}
+
+// Open verifies a sealed value and unmarshals it into v
+func (sc *SessionCodec) Open(value string, v interface{}) error {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sc.sign(payload))) {
+		return errBadSignature
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return fmt.Errorf("invalid cookie payload: %w", err)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (sc *SessionCodec) sign(payload string) string {
+	mac := hmac.New(sha256.New, sc.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SetSession writes the session cookie
+func (sc *SessionCodec) SetSession(w http.ResponseWriter, s *Session) error {
+	s.ExpiresAt = time.Now().Add(sc.ttl)
+	value, err := sc.Seal(s)
+	if err != nil {
+		return err
+	}
+	sc.setCookie(w, SessionCookie, "/", value, sc.ttl)
+	return nil
+}
+
+// ClearSession removes the session cookie
+func (sc *SessionCodec) ClearSession(w http.ResponseWriter) {
+	sc.setCookie(w, SessionCookie, "/", "", -1)
+}
+
+// SessionFromRequest returns the verified, unexpired session of a request
+func (sc *SessionCodec) SessionFromRequest(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	var s Session
+	if err := sc.Open(cookie.Value, &s); err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, errSessionExpired
+	}
+	return &s, nil
+}
+
+// PrincipalFromRequest implements SessionSource
+func (sc *SessionCodec) PrincipalFromRequest(r *http.Request) (*Principal, bool) {
+	s, err := sc.SessionFromRequest(r)
+	if err != nil {
+		return nil, false
+	}
+	return s.Principal(), true
+}
+
+func (sc *SessionCodec) setCookie(w http.ResponseWriter, name, path, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		HttpOnly: true,
+		Secure:   sc.secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	} else {
+		cookie.MaxAge = int(maxAge.Seconds())
+	}
+	http.SetCookie(w, cookie)
+}
@@ -0,0 +1,294 @@
+// Package bom checks reported hardware against BOM profiles, the bill of
+// materials a server is expected to ship with, so a vendor shipping the
+// wrong parts is caught before the OS is installed.
+package bom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// ErrUnknownProfile is returned for a task naming a profile that does not exist
+var ErrUnknownProfile = errors.New("unknown BOM profile")
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// Validate checks a profile before it is stored
+func Validate(p *models.BOMProfile) error {
+	var errs []string
+	if !namePattern.MatchString(p.Name) {
+		errs = append(errs, "name must be 1-64 letters, digits, '.', '_' or '-'")
+	}
+	for name, v := range map[string]int{
+		"cpu_cores": p.CPUCores, "dimm_count": p.DIMMCount, "dimm_size_gb": p.DIMMSizeGB,
+		"nic_count": p.NICCount, "size_tolerance_pct": p.SizeTolerancePct,
+	} {
+		if v < 0 {
+			errs = append(errs, name+" must not be negative")
+		}
+	}
+	if p.SizeTolerancePct > 50 {
+		errs = append(errs, "size_tolerance_pct must be at most 50")
+	}
+	for i, d := range p.Disks {
+		if d.Count < 0 || d.SizeGB < 0 {
+			errs = append(errs, fmt.Sprintf("disks[%d]: count and size_gb must not be negative", i))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Compare lists where hw differs from the profile; none means it passes
+func Compare(p *models.BOMProfile, hw *models.HardwareInfo) []models.BOMMismatch {
+	var m []models.BOMMismatch
+	add := func(field string, expected, actual interface{}, format string, args ...interface{}) {
+		m = append(m, models.BOMMismatch{Field: field, Expected: expected, Actual: actual, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if p.CPUModel != "" && !strings.Contains(strings.ToLower(hw.CPU.Model), strings.ToLower(p.CPUModel)) {
+		add("cpu.model", p.CPUModel, hw.CPU.Model, "CPU is %q, expected %q", hw.CPU.Model, p.CPUModel)
+	}
+	if p.CPUCores > 0 && hw.CPU.Cores != p.CPUCores {
+		add("cpu.cores", p.CPUCores, hw.CPU.Cores, "%d CPU cores, expected %d", hw.CPU.Cores, p.CPUCores)
+	}
+
+	m = append(m, compareMemory(p, &hw.Memory)...)
+	m = append(m, compareDisks(p, hw.Disks)...)
+
+	if p.NICCount > 0 && len(hw.Network) != p.NICCount {
+		add("network.count", p.NICCount, len(hw.Network), "%d NICs, expected %d", len(hw.Network), p.NICCount)
+	}
+	return m
+}
+
+// compareMemory checks the populated DIMMs, or the total memory when the
+// agent could not read the DIMMs
+func compareMemory(p *models.BOMProfile, mem *models.MemoryInfo) []models.BOMMismatch {
+	var m []models.BOMMismatch
+	var populated []models.DIMMInfo
+	for _, d := range mem.DIMMs {
+		if d.SizeGB > 0 {
+			populated = append(populated, d)
+		}
+	}
+
+	if len(populated) == 0 {
+		if p.DIMMCount > 0 && p.DIMMSizeGB > 0 {
+			want := p.DIMMCount * p.DIMMSizeGB
+			if !withinTolerance(mem.TotalGB, want, p.SizeTolerancePct) {
+				m = append(m, models.BOMMismatch{Field: "memory.total_gb", Expected: want, Actual: mem.TotalGB,
+					Message: fmt.Sprintf("%dGB memory, expected %d x %dGB", mem.TotalGB, p.DIMMCount, p.DIMMSizeGB)})
+			}
+		}
+		return m
+	}
+
+	if p.DIMMCount > 0 && len(populated) != p.DIMMCount {
+		m = append(m, models.BOMMismatch{Field: "memory.dimm_count", Expected: p.DIMMCount, Actual: len(populated),
+			Message: fmt.Sprintf("%d DIMMs populated, expected %d", len(populated), p.DIMMCount)})
+	}
+	if p.DIMMSizeGB > 0 {
+		var wrong []string
+		for _, d := range populated {
+			if d.SizeGB != p.DIMMSizeGB {
+				wrong = append(wrong, fmt.Sprintf("%s=%dGB", d.Slot, d.SizeGB))
+			}
+		}
+		if len(wrong) > 0 {
+			m = append(m, models.BOMMismatch{Field: "memory.dimm_size_gb", Expected: p.DIMMSizeGB, Actual: wrong,
+				Message: fmt.Sprintf("%d DIMMs are not %dGB: %s", len(wrong), p.DIMMSizeGB, strings.Join(wrong, ", "))})
+		}
+	}
+	return m
+}
+
+// compareDisks counts the disks fitting each expected group, then reports
+// the disks no group took
+func compareDisks(p *models.BOMProfile, disks []models.DiskInfo) []models.BOMMismatch {
+	if len(p.Disks) == 0 {
+		return nil
+	}
+	var m []models.BOMMismatch
+	used := make([]bool, len(disks))
+	for _, g := range p.Disks {
+		got := 0
+		for i, d := range disks {
+			if used[i] || (g.Type != "" && !strings.EqualFold(d.Type, g.Type)) ||
+				(g.SizeGB > 0 && !withinTolerance(d.SizeGB, g.SizeGB, p.SizeTolerancePct)) {
+				continue
+			}
+			if got < g.Count {
+				used[i] = true
+			}
+			got++
+		}
+		if got != g.Count {
+			field := "disks[" + describeDisk(g) + "]"
+			m = append(m, models.BOMMismatch{Field: field, Expected: g.Count, Actual: got,
+				Message: fmt.Sprintf("%d %s disks, expected %d", got, describeDisk(g), g.Count)})
+		}
+	}
+
+	var unexpected []string
+	for i, d := range disks {
+		if !used[i] {
+			unexpected = append(unexpected, fmt.Sprintf("%s %s %dGB", d.Device, d.Type, d.SizeGB))
+		}
+	}
+	if len(unexpected) > 0 {
+		m = append(m, models.BOMMismatch{Field: "disks.unexpected", Expected: 0, Actual: unexpected,
+			Message: fmt.Sprintf("disks not in the profile: %s", strings.Join(unexpected, ", "))})
+	}
+	return m
+}
+
+func describeDisk(g models.BOMDisk) string {
+	parts := []string{}
+	if g.Type != "" {
+		parts = append(parts, g.Type)
+	}
+	if g.SizeGB > 0 {
+		parts = append(parts, fmt.Sprintf("%dGB", g.SizeGB))
+	}
+	if len(parts) == 0 {
+		return "any"
+	}
+	return strings.Join(parts, " ")
+}
+
+// withinTolerance reports whether got is within pct percent of want
+func withinTolerance(got, want, pct int) bool {
+	diff := got - want
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff*100 <= want*pct
+}
+
+// Check runs the acceptance check of hw against p
+func Check(p *models.BOMProfile, hw *models.HardwareInfo, now time.Time) *models.BOMCheck {
+	mismatches := Compare(p, hw)
+	return &models.BOMCheck{
+		Profile:    p.Name,
+		Passed:     len(mismatches) == 0,
+		Mismatches: mismatches,
+		CheckedAt:  now,
+	}
+}
+
+// Apply stores the check on the task. A failed check sends a task that is
+// waiting for, or already has, approval to pending_approval so an approver
+// decides; an installation already running is left alone. A waiver carries
+// over to a check that finds the same mismatches against the same profile,
+// so a repeated report does not undo the approval.
+func Apply(task *models.TaskV3, check *models.BOMCheck) error {
+	prev := task.BOMCheck
+	task.BOMCheck = check
+	if !check.Passed && prev != nil && prev.WaivedBy != "" && sameMismatches(prev, check) {
+		check.WaivedBy, check.WaivedAt = prev.WaivedBy, prev.WaivedAt
+		task.AddLog(fmt.Sprintf("[INFO] Hardware still differs from BOM profile %s as accepted by %s", check.Profile, check.WaivedBy))
+		return nil
+	}
+	if check.Passed {
+		task.AddLog(fmt.Sprintf("[INFO] Hardware matches BOM profile %s", check.Profile))
+		return nil
+	}
+
+	fields := make([]string, len(check.Mismatches))
+	for i, mm := range check.Mismatches {
+		fields[i] = mm.Message
+	}
+	summary := fmt.Sprintf("Hardware does not match BOM profile %s: %s", check.Profile, strings.Join(fields, "; "))
+	task.AddLog("[WARN] " + summary)
+
+	switch task.Status {
+	case models.TaskStatusPending, models.TaskStatusReady, models.TaskStatusBooting, models.TaskStatusApproved:
+	default:
+		return nil
+	}
+	if task.Approval != nil && task.Approval.Status == models.ApprovalStatusRejected {
+		return nil
+	}
+	task.Approval = &models.Approval{Status: models.ApprovalStatusPending, Notes: summary}
+	return task.TransitionTo(models.TaskStatusPendingApproval, "BOM check failed")
+}
+
+// sameMismatches reports whether two checks found the same mismatches
+// against the same profile. Messages are compared rather than values, which
+// come back from JSON with other types.
+func sameMismatches(a, b *models.BOMCheck) bool {
+	if a.Profile != b.Profile || len(a.Mismatches) != len(b.Mismatches) {
+		return false
+	}
+	for i := range a.Mismatches {
+		if a.Mismatches[i].Field != b.Mismatches[i].Field || a.Mismatches[i].Message != b.Mismatches[i].Message {
+			return false
+		}
+	}
+	return true
+}
+
+// Load returns the profile called name
+func Load(client *etcd.Client, name string) (*models.BOMProfile, error) {
+	var p models.BOMProfile
+	if err := client.GetJSON(etcd.BOMProfileKey(name), &p); err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, fmt.Errorf("%w %q", ErrUnknownProfile, name)
+		}
+		return nil, err
+	}
+	return &p, nil
+}
+
+// List returns every profile, sorted by name
+func List(client *etcd.Client) ([]models.BOMProfile, error) {
+	kvs, err := client.GetWithPrefix(etcd.BOMProfileKey(""))
+	if err != nil {
+		return nil, err
+	}
+	profiles := make([]models.BOMProfile, 0, len(kvs))
+	for key, value := range kvs {
+		var p models.BOMProfile
+		if err := json.Unmarshal(value, &p); err != nil {
+			return nil, fmt.Errorf("invalid BOM profile %s: %w", key, err)
+		}
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles, nil
+}
+
+// ForTask returns the profile the task is checked against: the one it
+// names, else the first by name listing its SKU, else nil
+func ForTask(client *etcd.Client, task *models.TaskV3) (*models.BOMProfile, error) {
+	if task.BOMProfile != "" {
+		return Load(client, task.BOMProfile)
+	}
+	if task.SKU == "" {
+		return nil, nil
+	}
+	profiles, err := List(client)
+	if err != nil {
+		return nil, err
+	}
+	for i := range profiles {
+		for _, sku := range profiles[i].SKUs {
+			if strings.EqualFold(sku, task.SKU) {
+				return &profiles[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
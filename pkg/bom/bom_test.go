@@ -0,0 +1,155 @@
+package bom
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+var profile = &models.BOMProfile{
+	Name:       "r640-std",
+	CPUModel:   "gold 6248",
+	CPUCores:   40,
+	DIMMCount:  4,
+	DIMMSizeGB: 32,
+	Disks: []models.BOMDisk{
+		{Type: "NVMe", SizeGB: 960, Count: 2},
+		{Type: "HDD", SizeGB: 4000, Count: 1},
+	},
+	NICCount:         2,
+	SizeTolerancePct: 5,
+}
+
+func goodHardware() *models.HardwareInfo {
+	return &models.HardwareInfo{
+		CPU: models.CPUInfo{Model: "Intel(R) Xeon(R) Gold 6248 CPU @ 2.50GHz", Cores: 40},
+		Memory: models.MemoryInfo{TotalGB: 128, DIMMs: []models.DIMMInfo{
+			{Slot: "A1", SizeGB: 32}, {Slot: "A2", SizeGB: 32}, {Slot: "B1", SizeGB: 32}, {Slot: "B2", SizeGB: 32}, {Slot: "C1"},
+		}},
+		Disks: []models.DiskInfo{
+			{Device: "/dev/nvme0n1", Type: "nvme", SizeGB: 953},
+			{Device: "/dev/nvme1n1", Type: "NVMe", SizeGB: 953},
+			{Device: "/dev/sda", Type: "HDD", SizeGB: 3726 + 200},
+		},
+		Network: []models.NetworkInfo{{Interface: "eth0"}, {Interface: "eth1"}},
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(hw *models.HardwareInfo)
+		want   []string
+	}{
+		{"matches", func(*models.HardwareInfo) {}, nil},
+		{"wrong CPU", func(hw *models.HardwareInfo) { hw.CPU.Model = "Xeon Silver 4210"; hw.CPU.Cores = 20 }, []string{"cpu.model", "cpu.cores"}},
+		{"missing DIMM", func(hw *models.HardwareInfo) { hw.Memory.DIMMs[3].SizeGB = 0 }, []string{"memory.dimm_count"}},
+		{"wrong DIMM size", func(hw *models.HardwareInfo) { hw.Memory.DIMMs[0].SizeGB = 16 }, []string{"memory.dimm_size_gb"}},
+		{"no DIMM details", func(hw *models.HardwareInfo) { hw.Memory.DIMMs = nil; hw.Memory.TotalGB = 125 }, nil},
+		{"no DIMM details, too little", func(hw *models.HardwareInfo) { hw.Memory.DIMMs = nil; hw.Memory.TotalGB = 96 }, []string{"memory.total_gb"}},
+		{"SSD instead of NVMe", func(hw *models.HardwareInfo) { hw.Disks[1].Type = "SSD" }, []string{"disks[NVMe 960GB]", "disks.unexpected"}},
+		{"small HDD", func(hw *models.HardwareInfo) { hw.Disks[2].SizeGB = 2000 }, []string{"disks[HDD 4000GB]", "disks.unexpected"}},
+		{"extra disk", func(hw *models.HardwareInfo) {
+			hw.Disks = append(hw.Disks, models.DiskInfo{Device: "/dev/sdb", Type: "HDD", SizeGB: 4000})
+		}, []string{"disks[HDD 4000GB]", "disks.unexpected"}},
+		{"missing NIC", func(hw *models.HardwareInfo) { hw.Network = hw.Network[:1] }, []string{"network.count"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hw := goodHardware()
+			tt.modify(hw)
+			got := Compare(profile, hw)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Compare() = %+v, want fields %v", got, tt.want)
+			}
+			for i, m := range got {
+				if m.Field != tt.want[i] || m.Message == "" {
+					t.Errorf("mismatch %d = %+v, want field %s", i, m, tt.want[i])
+				}
+			}
+		})
+	}
+
+	// An empty profile checks nothing
+	if got := Compare(&models.BOMProfile{Name: "any"}, &models.HardwareInfo{}); len(got) != 0 {
+		t.Errorf("empty profile: %+v", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	failed := func() *models.BOMCheck {
+		hw := goodHardware()
+		hw.CPU.Cores = 20
+		return Check(profile, hw, time.Now())
+	}
+
+	// An approved task that has not started installing loses its approval
+	task := &models.TaskV3{Status: models.TaskStatusApproved, Approval: &models.Approval{Status: models.ApprovalStatusApproved}}
+	if err := Apply(task, failed()); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if task.Status != models.TaskStatusPendingApproval || task.Approval.Status != models.ApprovalStatusPending || !task.BOMCheck.Blocking() {
+		t.Errorf("after failed check: status %s, approval %+v", task.Status, task.Approval)
+	}
+
+	// ...and cannot be approved again until the mismatch is accepted
+	task.Approval = &models.Approval{Status: models.ApprovalStatusApproved}
+	if err := task.TransitionTo(models.TaskStatusApproved, "approve"); err == nil {
+		t.Error("approved a task whose BOM check failed")
+	}
+	task.BOMCheck.WaivedBy = "alice"
+	if err := task.TransitionTo(models.TaskStatusApproved, "approve"); err != nil {
+		t.Errorf("approve after waiver: %v", err)
+	}
+
+	// The same report again keeps the waiver and the approval, also after
+	// the task went through etcd
+	data, _ := json.Marshal(task)
+	task = &models.TaskV3{}
+	if err := json.Unmarshal(data, task); err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(task, failed()); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if task.Status != models.TaskStatusApproved || task.BOMCheck.WaivedBy != "alice" || task.BOMCheck.Blocking() {
+		t.Errorf("after repeated report: status %s, check %+v", task.Status, task.BOMCheck)
+	}
+
+	// Different hardware needs a new decision
+	hw := goodHardware()
+	hw.Network = hw.Network[:1]
+	if err := Apply(task, Check(profile, hw, time.Now())); err != nil || task.Status != models.TaskStatusPendingApproval || !task.BOMCheck.Blocking() {
+		t.Errorf("after new mismatch: err %v, status %s, check %+v", err, task.Status, task.BOMCheck)
+	}
+
+	// A running installation is only annotated
+	task = &models.TaskV3{Status: models.TaskStatusInstalling}
+	if err := Apply(task, failed()); err != nil || task.Status != models.TaskStatusInstalling || task.BOMCheck == nil {
+		t.Errorf("installing task: err %v, status %s", err, task.Status)
+	}
+
+	// A passing check changes nothing but the record
+	task = &models.TaskV3{Status: models.TaskStatusPending}
+	if err := Apply(task, Check(profile, goodHardware(), time.Now())); err != nil || task.Status != models.TaskStatusPending || !task.BOMCheck.Passed {
+		t.Errorf("passing check: err %v, status %s, check %+v", err, task.Status, task.BOMCheck)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(profile); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+	for name, p := range map[string]*models.BOMProfile{
+		"bad name":       {Name: "r640 std"},
+		"negative cores": {Name: "p", CPUCores: -1},
+		"tolerance":      {Name: "p", SizeTolerancePct: 80},
+		"negative disks": {Name: "p", Disks: []models.BOMDisk{{Count: -1}}},
+	} {
+		if err := Validate(p); err == nil {
+			t.Errorf("%s: Validate() succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Package bulk parses and validates batches of task creation rows
+// submitted as CSV or JSON.
+package bulk
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// MaxRows bounds a single import
+const MaxRows = 1000
+
+// RowError describes why a row cannot be imported. Row is 1-based and
+// counts data rows only (the CSV header is not a row).
+type RowError struct {
+	Row   int    `json:"row"`
+	SN    string `json:"sn,omitempty"`
+	Field string `json:"field,omitempty"`
+	Error string `json:"error"`
+}
+
+// headerAliases maps accepted CSV column names to canonical fields
+var headerAliases = map[string]string{
+	"idc":            "idc",
+	"region":         "idc",
+	"sn":             "sn",
+	"serial":         "sn",
+	"mac":            "mac",
+	"mac_address":    "mac",
+	"ip":             "ip",
+	"ip_pool":        "ip_pool",
+	"pool":           "ip_pool",
+	"hostname":       "hostname",
+	"os":             "os",
+	"os_type":        "os_type",
+	"os_version":     "os_version",
+	"layout":         "disk_layout",
+	"disk_layout":    "disk_layout",
+	"network_config": "network_config",
+	"bom":            "bom_profile",
+	"bom_profile":    "bom_profile",
+	"sku":            "sku",
+}
+
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// Parse reads rows according to the request content type: text/csv or
+// application/json (an array of rows or {"tasks": [...]}).
+func Parse(contentType string, body io.Reader) ([]models.CreateTaskRequestV3, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv", "application/csv":
+		return ParseCSV(body)
+	case "application/json", "":
+		return ParseJSON(body)
+	default:
+		return nil, fmt.Errorf("unsupported content type %q, use text/csv or application/json", mediaType)
+	}
+}
+
+// ParseJSON reads a JSON array of rows or an object with a "tasks" array
+func ParseJSON(r io.Reader) ([]models.CreateTaskRequestV3, error) {
+	data, err := io.ReadAll(io.LimitReader(r, 8<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []models.CreateTaskRequestV3
+	if err := json.Unmarshal(data, &rows); err != nil {
+		var wrapped struct {
+			Tasks []models.CreateTaskRequestV3 `json:"tasks"`
+		}
+		if err2 := json.Unmarshal(data, &wrapped); err2 != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		rows = wrapped.Tasks
+	}
+	return checkCount(rows)
+}
+
+// ParseCSV reads rows from CSV with a header line. Column names are
+// case-insensitive; "os" may hold "<type> <version>" instead of separate
+// os_type and os_version columns.
+func ParseCSV(r io.Reader) ([]models.CreateTaskRequestV3, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("empty CSV")
+		}
+		return nil, fmt.Errorf("invalid CSV header: %w", err)
+	}
+
+	columns := make([]string, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		canonical, ok := headerAliases[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		columns[i] = canonical
+	}
+
+	var rows []models.CreateTaskRequestV3
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		if len(rows) >= MaxRows {
+			return nil, fmt.Errorf("too many rows, at most %d per import", MaxRows)
+		}
+
+		var row models.CreateTaskRequestV3
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			switch columns[i] {
+			case "idc":
+				row.IDC = value
+			case "sn":
+				row.SN = value
+			case "mac":
+				row.MAC = value
+			case "ip":
+				row.IP = value
+			case "ip_pool":
+				row.IPPool = value
+			case "hostname":
+				row.Hostname = value
+			case "os":
+				osType, osVersion, _ := strings.Cut(value, " ")
+				row.OSType, row.OSVersion = osType, strings.TrimSpace(osVersion)
+			case "os_type":
+				row.OSType = value
+			case "os_version":
+				row.OSVersion = value
+			case "disk_layout":
+				row.DiskLayout = value
+			case "network_config":
+				row.NetworkConf = value
+			case "bom_profile":
+				row.BOMProfile = value
+			case "sku":
+				row.SKU = value
+			}
+		}
+		rows = append(rows, row)
+	}
+	return checkCount(rows)
+}
+
+func checkCount(rows []models.CreateTaskRequestV3) ([]models.CreateTaskRequestV3, error) {
+	if len(rows) == 0 {
+		return nil, errors.New("no rows to import")
+	}
+	if len(rows) > MaxRows {
+		return nil, fmt.Errorf("too many rows, at most %d per import", MaxRows)
+	}
+	return rows, nil
+}
+
+// Validate checks every row on its own and against the rest of the batch.
+// MAC addresses are normalised in place to lower-case colon form.
+func Validate(rows []models.CreateTaskRequestV3) []RowError {
+	var errs []RowError
+	fail := func(i int, field, format string, args ...interface{}) {
+		errs = append(errs, RowError{Row: i + 1, SN: rows[i].SN, Field: field, Error: fmt.Sprintf(format, args...)})
+	}
+
+	seen := map[string]int{} // "<field>|<idc>|<value>" -> first row index
+	unique := func(i int, field, scope, value string) {
+		key := field + "|" + scope + "|" + strings.ToLower(value)
+		if first, dup := seen[key]; dup {
+			fail(i, field, "duplicate %s %s (also in row %d)", field, value, first+1)
+			return
+		}
+		seen[key] = i
+	}
+
+	for i := range rows {
+		row := &rows[i]
+
+		for _, f := range []struct{ name, value string }{
+			{"idc", row.IDC},
+			{"sn", row.SN},
+			{"os_type", row.OSType},
+			{"os_version", row.OSVersion},
+		} {
+			if f.value == "" {
+				fail(i, f.name, "%s is required", f.name)
+			}
+		}
+		if strings.ContainsAny(row.SN, "/ ") {
+			fail(i, "sn", "sn must not contain spaces or slashes")
+		}
+
+		if row.MAC != "" {
+			if mac, err := net.ParseMAC(row.MAC); err != nil {
+				fail(i, "mac", "invalid MAC address %q", row.MAC)
+			} else {
+				row.MAC = mac.String()
+				unique(i, "mac", "", row.MAC)
+			}
+		}
+		if row.IP != "" {
+			if net.ParseIP(row.IP).To4() == nil {
+				fail(i, "ip", "invalid IPv4 address %q", row.IP)
+			} else {
+				unique(i, "ip", row.IDC, row.IP)
+			}
+		}
+		if row.Hostname != "" {
+			if len(row.Hostname) > 253 || !hostnamePattern.MatchString(row.Hostname) {
+				fail(i, "hostname", "invalid hostname %q", row.Hostname)
+			} else {
+				unique(i, "hostname", row.IDC, row.Hostname)
+			}
+		}
+		if row.SN != "" {
+			unique(i, "sn", row.IDC, row.SN)
+		}
+	}
+	return errs
+}
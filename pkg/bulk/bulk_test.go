@@ -0,0 +1,98 @@
+package bulk
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCSV(t *testing.T) {
+	input := "IDC,SN,MAC,IP,Hostname,OS,Layout,IP_Pool\n" +
+		"dc1,SN001,00:1A:2B:3C:4D:01,10.0.0.11,node-01,ubuntu 22.04,lvm,\n" +
+		"# comment lines are skipped\n" +
+		"dc1, SN002 ,00-1a-2b-3c-4d-02,,,centos 7,,prod\n"
+
+	rows, err := Parse("text/csv; charset=utf-8", strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	if r := rows[0]; r.IDC != "dc1" || r.OSType != "ubuntu" || r.OSVersion != "22.04" || r.DiskLayout != "lvm" || r.Hostname != "node-01" {
+		t.Errorf("row 1 = %+v", r)
+	}
+	if rows[1].SN != "SN002" {
+		t.Errorf("row 2 SN = %q, want trimmed", rows[1].SN)
+	}
+	if rows[1].IPPool != "prod" {
+		t.Errorf("row 2 ip_pool = %q, want prod", rows[1].IPPool)
+	}
+
+	if errs := Validate(rows); len(errs) != 0 {
+		t.Fatalf("Validate() = %+v", errs)
+	}
+	if rows[1].MAC != "00:1a:2b:3c:4d:02" {
+		t.Errorf("MAC not normalised: %s", rows[1].MAC)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	for name, input := range map[string]string{
+		"array":   `[{"idc":"dc1","sn":"SN1","os_type":"ubuntu","os_version":"22.04"}]`,
+		"wrapped": `{"tasks":[{"idc":"dc1","sn":"SN1","os_type":"ubuntu","os_version":"22.04"}]}`,
+	} {
+		rows, err := Parse("application/json", strings.NewReader(input))
+		if err != nil || len(rows) != 1 || rows[0].SN != "SN1" {
+			t.Errorf("%s: rows = %+v, err = %v", name, rows, err)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for name, tc := range map[string]struct{ contentType, body string }{
+		"unknown column": {"text/csv", "idc,sn,colour\ndc1,SN1,red\n"},
+		"empty":          {"text/csv", ""},
+		"header only":    {"text/csv", "idc,sn\n"},
+		"bad json":       {"application/json", "{"},
+		"content type":   {"application/xml", "<tasks/>"},
+	} {
+		if _, err := Parse(tc.contentType, strings.NewReader(tc.body)); err == nil {
+			t.Errorf("%s: Parse() accepted invalid input", name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	input := "idc,sn,mac,ip,hostname,os_type,os_version\n" +
+		"dc1,SN1,00:1a:2b:3c:4d:01,10.0.0.1,a,ubuntu,22.04\n" +
+		"dc1,SN1,00:1a:2b:3c:4d:02,10.0.0.2,b,ubuntu,22.04\n" + // duplicate SN
+		"dc1,SN3,00:1A:2B:3C:4D:01,10.0.0.3,c,ubuntu,22.04\n" + // duplicate MAC (case-insensitive)
+		"dc1,SN4,not-a-mac,10.0.0.1,d,ubuntu,22.04\n" + // bad MAC, duplicate IP
+		"dc2,SN1,,10.0.0.1,a,ubuntu,\n" + // other IDC: SN/IP/hostname fine, os_version missing
+		"dc1,SN6,,,bad_host!,ubuntu,22.04\n"
+
+	rows, err := ParseCSV(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[int][]string{}
+	for _, e := range Validate(rows) {
+		got[e.Row] = append(got[e.Row], e.Field)
+	}
+	want := map[int][]string{
+		2: {"sn"},
+		3: {"mac"},
+		4: {"mac", "ip"},
+		5: {"os_version"},
+		6: {"hostname"},
+	}
+	for row, fields := range want {
+		if strings.Join(got[row], ",") != strings.Join(fields, ",") {
+			t.Errorf("row %d errors = %v, want %v", row, got[row], fields)
+		}
+	}
+	if len(got[1]) != 0 {
+		t.Errorf("row 1 should be valid, got %v", got[1])
+	}
+}
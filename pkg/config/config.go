@@ -0,0 +1,581 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+)
+
+// EnvConfigPath is the environment variable that points to the config file
+const EnvConfigPath = "LPMOS_CONFIG"
+
+// Config is the root of the LPMOS configuration file (configs/config.example.yaml)
+type Config struct {
+	ControlPlane   ControlPlaneConfig   `yaml:"control_plane"`
+	RegionalClient RegionalClientConfig `yaml:"regional_client"`
+	Agent          AgentConfig          `yaml:"agent"`
+	Logging        LoggingConfig        `yaml:"logging"`
+	Monitoring     MonitoringConfig     `yaml:"monitoring"`
+	Security       SecurityConfig       `yaml:"security"`
+	Features       FeaturesConfig       `yaml:"features"`
+}
+
+// ===== Shared blocks =====
+
+// TLSConfig holds certificate paths for a TLS endpoint
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	CAFile   string `yaml:"ca_file,omitempty"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// APIConfig holds HTTP listener settings
+type APIConfig struct {
+	Port           int       `yaml:"port"`
+	Host           string    `yaml:"host"`
+	TLS            TLSConfig `yaml:"tls"`
+	AllowedOrigins []string  `yaml:"allowed_origins"` // extra WebSocket origins besides the API's own host
+}
+
+// EtcdConfig holds etcd connection settings
+type EtcdConfig struct {
+	Endpoints      []string      `yaml:"endpoints"`
+	DialTimeout    time.Duration `yaml:"dial_timeout"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	Username       string        `yaml:"username,omitempty"`
+	Password       string        `yaml:"password,omitempty"`
+	TLS            TLSConfig     `yaml:"tls"`
+}
+
+// ===== Control plane =====
+
+// ControlPlaneConfig holds control plane settings
+type ControlPlaneConfig struct {
+	API           APIConfig           `yaml:"api"`
+	Etcd          EtcdConfig          `yaml:"etcd"`
+	Auth          AuthConfig          `yaml:"auth"`
+	Notifications NotificationsConfig `yaml:"notifications"`
+	Stats         StatsConfig         `yaml:"stats"`
+	Watchdog      WatchdogConfig      `yaml:"watchdog"`
+	Audit         AuditConfig         `yaml:"audit"`
+}
+
+// AuditConfig holds the audit log settings
+type AuditConfig struct {
+	Retention time.Duration `yaml:"retention"` // records older than this are removed; 0 keeps them all
+}
+
+// StatsConfig holds the live IDC statistics settings
+type StatsConfig struct {
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"` // full recount from the task indexes
+}
+
+// WatchdogConfig holds the installation deadlines enforced by the control
+// plane. Overrides apply in order to tasks of their IDC and OS, each
+// replacing the limits it sets.
+type WatchdogConfig struct {
+	Enabled   bool               `yaml:"enabled"`
+	Interval  time.Duration      `yaml:"interval"`   // how often tasks are checked
+	AutoRetry bool               `yaml:"auto_retry"` // start a new attempt after a timeout
+	Limits    InstallLimits      `yaml:",inline"`
+	Overrides []WatchdogOverride `yaml:"overrides"`
+}
+
+// InstallLimits are the deadlines of one installation attempt. A limit
+// left out (nil) is inherited, an explicit zero disables it.
+// InstallTimeout and RetryAttempts are inherited from
+// regional_client.installation.timeout and retry_attempts.
+type InstallLimits struct {
+	BootTimeout    *time.Duration           `yaml:"boot_timeout"`    // approved until the agent reports progress
+	InstallTimeout *time.Duration           `yaml:"install_timeout"` // approved until the installation finishes
+	StepTimeout    *time.Duration           `yaml:"step_timeout"`    // any one progress step
+	StepTimeouts   map[string]time.Duration `yaml:"step_timeouts"`   // by step name
+	RetryAttempts  *int                     `yaml:"retry_attempts"`  // automatic retries after timeouts
+}
+
+// Duration returns a pointer to d, for the optional limits of InstallLimits
+func Duration(d time.Duration) *time.Duration {
+	return &d
+}
+
+// Int returns a pointer to n, for the optional limits of InstallLimits
+func Int(n int) *int {
+	return &n
+}
+
+// WatchdogOverride sets limits for the tasks of an IDC, an OS type or both
+type WatchdogOverride struct {
+	IDC    string        `yaml:"idc"`
+	OSType string        `yaml:"os_type"`
+	Limits InstallLimits `yaml:",inline"`
+}
+
+// AuthConfig holds dashboard authentication settings
+type AuthConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	JWTSecret   string        `yaml:"jwt_secret"`   // signs session cookies
+	TokenExpiry time.Duration `yaml:"token_expiry"` // session lifetime
+	OIDC        OIDCConfig    `yaml:"oidc"`
+}
+
+// OIDCConfig holds the OpenID Connect relying party settings
+type OIDCConfig struct {
+	IssuerURL     string         `yaml:"issuer_url"`
+	ClientID      string         `yaml:"client_id"`
+	ClientSecret  string         `yaml:"client_secret"`
+	RedirectURL   string         `yaml:"redirect_url"`
+	Scopes        []string       `yaml:"scopes"`
+	UsernameClaim string         `yaml:"username_claim"`
+	GroupsClaim   string         `yaml:"groups_claim"`
+	GroupMappings []GroupMapping `yaml:"group_mappings"`
+}
+
+// GroupMapping grants a dashboard role to members of an identity provider group
+type GroupMapping struct {
+	Group string   `yaml:"group"`
+	Role  string   `yaml:"role"` // viewer, operator, approver, admin
+	IDCs  []string `yaml:"idcs"` // empty means every IDC
+}
+
+// NotificationsConfig holds outbound notification settings
+type NotificationsConfig struct {
+	WebhookURL    string        `yaml:"webhook_url"`    // receives every task event, besides API subscriptions
+	WebhookSecret string        `yaml:"webhook_secret"` // signs webhook_url deliveries when set
+	Webhooks      WebhookConfig `yaml:"webhooks"`
+	Email         EmailConfig   `yaml:"email"`
+}
+
+// WebhookConfig holds webhook delivery settings
+type WebhookConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts"` // then the delivery is dead-lettered
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	Timeout        time.Duration `yaml:"timeout"`
+}
+
+// EmailConfig holds SMTP notification settings
+type EmailConfig struct {
+	Enabled        bool                `yaml:"enabled"`
+	SMTPHost       string              `yaml:"smtp_host"`
+	SMTPPort       int                 `yaml:"smtp_port"`
+	Username       string              `yaml:"username,omitempty"`
+	Password       string              `yaml:"password,omitempty"`
+	From           string              `yaml:"from"`
+	To             []string            `yaml:"to"`             // recipients for IDCs not in idc_recipients
+	IDCRecipients  map[string][]string `yaml:"idc_recipients"` // per-IDC recipients
+	BaseURL        string              `yaml:"base_url"`       // external control plane URL, for task links
+	ApprovalWait   time.Duration       `yaml:"approval_wait"`  // alert on approvals pending longer; 0 disables
+	Digest         bool                `yaml:"digest"`         // batch alerts instead of one email each
+	DigestInterval time.Duration       `yaml:"digest_interval"`
+}
+
+// Recipients returns the addresses alerted about idc
+func (e EmailConfig) Recipients(idc string) []string {
+	if to, ok := e.IDCRecipients[idc]; ok {
+		return to
+	}
+	return e.To
+}
+
+// ===== Regional client =====
+
+// RegionalClientConfig holds regional client settings
+type RegionalClientConfig struct {
+	RegionID     string             `yaml:"region_id"`
+	API          APIConfig          `yaml:"api"`
+	Etcd         EtcdConfig         `yaml:"etcd"`
+	Services     ServicesConfig     `yaml:"services"`
+	Installation InstallationConfig `yaml:"installation"`
+}
+
+// ServicesConfig holds the PXE/TFTP/HTTP services run by a regional client
+type ServicesConfig struct {
+	PXE  PXEConfig  `yaml:"pxe"`
+	TFTP TFTPConfig `yaml:"tftp"`
+	HTTP HTTPConfig `yaml:"http"`
+}
+
+// PXEConfig holds DHCP/PXE settings
+type PXEConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	Interface      string        `yaml:"interface"`
+	ServerIP       string        `yaml:"server_ip"`
+	Netmask        string        `yaml:"netmask"`
+	DHCPRangeStart string        `yaml:"dhcp_range_start"`
+	DHCPRangeEnd   string        `yaml:"dhcp_range_end"`
+	Gateway        string        `yaml:"gateway"`
+	DNSServers     []string      `yaml:"dns_servers"`
+	LeaseTime      time.Duration `yaml:"lease_time"`
+}
+
+// TFTPConfig holds TFTP server settings
+type TFTPConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Port    int    `yaml:"port"`
+	RootDir string `yaml:"root_dir"`
+}
+
+// HTTPConfig holds static HTTP file server settings
+type HTTPConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Port    int    `yaml:"port"`
+	RootDir string `yaml:"root_dir"`
+}
+
+// InstallationConfig holds OS installation settings
+type InstallationConfig struct {
+	Timeout       time.Duration          `yaml:"timeout"`
+	RetryAttempts int                    `yaml:"retry_attempts"`
+	PrimaryNIC    string                 `yaml:"primary_nic"`
+	OSImages      map[string]OSImageSpec `yaml:"os_images"`
+}
+
+// OSImageSpec describes where an OS image can be fetched from
+type OSImageSpec struct {
+	URL      string `yaml:"url"`
+	Checksum string `yaml:"checksum"`
+}
+
+// ===== Agent =====
+
+// AgentConfig holds agent settings
+type AgentConfig struct {
+	RegionalClientURL string                `yaml:"regional_client_url"`
+	Collection        CollectionConfig      `yaml:"collection"`
+	Hardware          HardwareCollectConfig `yaml:"hardware"`
+	Reporting         ReportingConfig       `yaml:"reporting"`
+}
+
+// CollectionConfig holds hardware collection retry settings
+type CollectionConfig struct {
+	Timeout       time.Duration `yaml:"timeout"`
+	RetryAttempts int           `yaml:"retry_attempts"`
+	RetryDelay    time.Duration `yaml:"retry_delay"`
+}
+
+// HardwareCollectConfig toggles optional hardware collectors
+type HardwareCollectConfig struct {
+	CollectBIOS         bool `yaml:"collect_bios"`
+	CollectDmidecode    bool `yaml:"collect_dmidecode"`
+	CollectNetworkSpeed bool `yaml:"collect_network_speed"`
+}
+
+// ReportingConfig holds agent polling settings
+type ReportingConfig struct {
+	Interval  time.Duration `yaml:"interval"`
+	BatchSize int           `yaml:"batch_size"`
+}
+
+// ===== Logging / monitoring =====
+
+// LoggingConfig holds log output settings
+type LoggingConfig struct {
+	Level  string        `yaml:"level"`
+	Format string        `yaml:"format"`
+	Output string        `yaml:"output"`
+	File   LogFileConfig `yaml:"file"`
+}
+
+// LogFileConfig holds log file settings
+type LogFileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSize    int    `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAge     int    `yaml:"max_age"`
+}
+
+// MonitoringConfig holds metrics and health check settings
+type MonitoringConfig struct {
+	Enabled     bool              `yaml:"enabled"`
+	Prometheus  PrometheusConfig  `yaml:"prometheus"`
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+}
+
+// PrometheusConfig holds the metrics endpoint settings
+type PrometheusConfig struct {
+	Port int    `yaml:"port"` // 0 serves metrics on the API port
+	Path string `yaml:"path"`
+}
+
+// HealthCheckConfig holds health check settings
+type HealthCheckConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// TracingConfig holds tracing settings
+type TracingConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	JaegerEndpoint string `yaml:"jaeger_endpoint"`
+}
+
+// ===== Security =====
+
+// SecurityConfig holds API security settings
+type SecurityConfig struct {
+	APIKeys             APIKeysConfig             `yaml:"api_keys"`
+	AgentAuthentication AgentAuthenticationConfig `yaml:"agent_authentication"`
+	RateLimiting        RateLimitingConfig        `yaml:"rate_limiting"`
+}
+
+// APIKeysConfig holds static API keys
+type APIKeysConfig struct {
+	Enabled bool         `yaml:"enabled"`
+	Keys    []APIKeySpec `yaml:"keys"`
+}
+
+// APIKeySpec describes a single API key
+type APIKeySpec struct {
+	Name        string   `yaml:"name"`
+	Key         string   `yaml:"key"`
+	Permissions []string `yaml:"permissions"` // read, write, approve
+	IDCs        []string `yaml:"idcs"`        // empty means every IDC
+}
+
+// AgentAuthenticationConfig holds agent token settings
+type AgentAuthenticationConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	TokenRotation bool          `yaml:"token_rotation"`
+	TokenTTL      time.Duration `yaml:"token_ttl"`
+}
+
+// RateLimitingConfig holds API rate limit settings
+type RateLimitingConfig struct {
+	Enabled           bool `yaml:"enabled"`
+	RequestsPerMinute int  `yaml:"requests_per_minute"`
+	Burst             int  `yaml:"burst"`
+}
+
+// ===== Feature flags =====
+
+// FeaturesConfig holds feature flags
+type FeaturesConfig struct {
+	AutoApproval          AutoApprovalConfig          `yaml:"auto_approval"`
+	MultiOSSupport        MultiOSSupportConfig        `yaml:"multi_os_support"`
+	PostInstallAutomation PostInstallAutomationConfig `yaml:"post_install_automation"`
+}
+
+// AutoApprovalConfig holds auto-approval rules
+type AutoApprovalConfig struct {
+	Enabled bool               `yaml:"enabled"`
+	Rules   []AutoApprovalRule `yaml:"rules"`
+}
+
+// AutoApprovalRule is a single auto-approval rule
+type AutoApprovalRule struct {
+	Name      string `yaml:"name"`
+	Condition string `yaml:"condition"`
+	Action    string `yaml:"action"`
+}
+
+// MultiOSSupportConfig lists the OS types that may be installed
+type MultiOSSupportConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	SupportedOS []string `yaml:"supported_os"`
+}
+
+// PostInstallAutomationConfig holds post-install hook settings
+type PostInstallAutomationConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	AnsiblePlaybook string `yaml:"ansible_playbook"`
+}
+
+// Default returns the built-in configuration used when no file is given.
+// The values match what the binaries used before the config file existed.
+func Default() *Config {
+	return &Config{
+		ControlPlane: ControlPlaneConfig{
+			API: APIConfig{Port: 8080, Host: "0.0.0.0"},
+			Etcd: EtcdConfig{
+				Endpoints:      []string{"localhost:2379"},
+				DialTimeout:    etcd.DefaultDialTimeout,
+				RequestTimeout: etcd.DefaultRequestTimeout,
+			},
+			Auth: AuthConfig{
+				TokenExpiry: 24 * time.Hour,
+				OIDC: OIDCConfig{
+					Scopes:        []string{"openid", "profile", "email", "groups"},
+					UsernameClaim: "email",
+					GroupsClaim:   "groups",
+				},
+			},
+			Notifications: NotificationsConfig{
+				Webhooks: WebhookConfig{
+					MaxAttempts:    8,
+					InitialBackoff: 10 * time.Second,
+					MaxBackoff:     15 * time.Minute,
+					Timeout:        10 * time.Second,
+				},
+				Email: EmailConfig{
+					SMTPPort:       587,
+					BaseURL:        "http://localhost:8080",
+					ApprovalWait:   30 * time.Minute,
+					DigestInterval: time.Hour,
+				},
+			},
+			Stats: StatsConfig{ReconcileInterval: 5 * time.Minute},
+			Watchdog: WatchdogConfig{
+				Interval: 30 * time.Second,
+				Limits: InstallLimits{
+					BootTimeout: Duration(30 * time.Minute),
+					StepTimeout: Duration(30 * time.Minute),
+				},
+			},
+			Audit: AuditConfig{Retention: 90 * 24 * time.Hour},
+		},
+		RegionalClient: RegionalClientConfig{
+			API: APIConfig{Port: 8081, Host: "0.0.0.0"},
+			Etcd: EtcdConfig{
+				Endpoints:      []string{"localhost:2379"},
+				DialTimeout:    etcd.DefaultDialTimeout,
+				RequestTimeout: etcd.DefaultRequestTimeout,
+			},
+			Services: ServicesConfig{
+				PXE: PXEConfig{
+					Interface: "eth1",
+					ServerIP:  "192.168.100.1",
+					Netmask:   "255.255.255.0",
+					LeaseTime: 24 * time.Hour,
+				},
+				TFTP: TFTPConfig{Port: 69, RootDir: "/tftpboot"},
+				HTTP: HTTPConfig{Port: 80},
+			},
+			Installation: InstallationConfig{
+				Timeout:       time.Hour,
+				RetryAttempts: 3,
+				PrimaryNIC:    "eth0",
+			},
+		},
+		Agent: AgentConfig{
+			RegionalClientURL: "http://localhost:8081",
+			Collection: CollectionConfig{
+				Timeout:       60 * time.Second,
+				RetryAttempts: 3,
+				RetryDelay:    5 * time.Second,
+			},
+			Hardware: HardwareCollectConfig{
+				CollectBIOS:         true,
+				CollectDmidecode:    true,
+				CollectNetworkSpeed: true,
+			},
+			Reporting: ReportingConfig{Interval: 10 * time.Second, BatchSize: 1},
+		},
+		Logging: LoggingConfig{Level: "info", Format: "text", Output: "stdout"},
+		Monitoring: MonitoringConfig{
+			Prometheus:  PrometheusConfig{Path: "/metrics"},
+			HealthCheck: HealthCheckConfig{Interval: 30 * time.Second, Timeout: 5 * time.Second},
+		},
+		Security: SecurityConfig{
+			AgentAuthentication: AgentAuthenticationConfig{TokenTTL: time.Hour},
+			RateLimiting:        RateLimitingConfig{RequestsPerMinute: 100, Burst: 20},
+		},
+		Features: FeaturesConfig{
+			MultiOSSupport: MultiOSSupportConfig{
+				Enabled:     true,
+				SupportedOS: []string{"ubuntu", "centos", "rocky", "debian"},
+			},
+		},
+	}
+}
+
+// Load builds a configuration from the defaults, the YAML file at path (if
+// non-empty) and LPMOS_* environment variable overrides, in that order.
+// Validation is left to the caller because each binary only needs its own
+// section; see ValidateControlPlane, ValidateRegionalClient and ValidateAgent.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := ApplyEnv(cfg, os.Environ()); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// ClientConfig converts the etcd block into an etcd.Config
+func (e EtcdConfig) ClientConfig() (etcd.Config, error) {
+	cfg := etcd.Config{
+		Endpoints:      e.Endpoints,
+		DialTimeout:    e.DialTimeout,
+		RequestTimeout: e.RequestTimeout,
+		Username:       e.Username,
+		Password:       e.Password,
+	}
+
+	if e.TLS.Enabled {
+		tlsCfg, err := e.TLS.ClientTLS()
+		if err != nil {
+			return etcd.Config{}, err
+		}
+		cfg.TLS = tlsCfg
+	}
+
+	return cfg, nil
+}
+
+// ClientTLS builds a client-side tls.Config from the certificate paths
+func (t TLSConfig) ClientTLS() (*tls.Config, error) {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.CAFile != "" {
+		caData, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file %s: %w", t.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no valid certificates in CA file %s", t.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	return tlsCfg, nil
+}
+
+// Addr returns the host:port listen address
+func (a APIConfig) Addr() string {
+	return fmt.Sprintf("%s:%d", a.Host, a.Port)
+}
+
+// Apply redirects the standard logger according to the logging block.
+// The binaries use the standard library logger, so level and format are
+// informational only.
+func (l LoggingConfig) Apply() error {
+	if l.Output != "file" {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.File.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %w", l.File.Path, err)
+	}
+	log.SetOutput(f)
+	return nil
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadExampleConfig(t *testing.T) {
+	cfg, err := Load("../../configs/config.example.yaml")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if got := len(cfg.ControlPlane.Etcd.Endpoints); got != 3 {
+		t.Errorf("control_plane.etcd.endpoints = %d entries, want 3", got)
+	}
+	if cfg.ControlPlane.Etcd.DialTimeout != 5*time.Second {
+		t.Errorf("control_plane.etcd.dial_timeout = %v, want 5s", cfg.ControlPlane.Etcd.DialTimeout)
+	}
+	if cfg.RegionalClient.RegionID != "dc1" {
+		t.Errorf("regional_client.region_id = %q, want dc1", cfg.RegionalClient.RegionID)
+	}
+	if cfg.RegionalClient.Installation.Timeout != time.Hour {
+		t.Errorf("regional_client.installation.timeout = %v, want 1h", cfg.RegionalClient.Installation.Timeout)
+	}
+	if cfg.Agent.Reporting.Interval != 30*time.Second {
+		t.Errorf("agent.reporting.interval = %v, want 30s", cfg.Agent.Reporting.Interval)
+	}
+	if got := cfg.ControlPlane.Watchdog; got.Limits.StepTimeouts["packages"] != 45*time.Minute ||
+		got.Limits.InstallTimeout != nil || got.Limits.RetryAttempts != nil || len(got.Overrides) != 2 ||
+		got.Overrides[0].Limits.InstallTimeout == nil || *got.Overrides[0].Limits.InstallTimeout != 2*time.Hour ||
+		got.Overrides[1].Limits.StepTimeout == nil || *got.Overrides[1].Limits.StepTimeout != 0 {
+		t.Errorf("control_plane.watchdog = %+v", got)
+	}
+	if cfg.ControlPlane.Audit.Retention != 90*24*time.Hour {
+		t.Errorf("control_plane.audit.retention = %v, want 2160h", cfg.ControlPlane.Audit.Retention)
+	}
+	if got := len(cfg.Features.AutoApproval.Rules); got != 2 {
+		t.Errorf("features.auto_approval.rules = %d entries, want 2", got)
+	}
+
+	for name, validate := range map[string]func() error{
+		"control plane":   cfg.ValidateControlPlane,
+		"regional client": cfg.ValidateRegionalClient,
+		"agent":           cfg.ValidateAgent,
+	} {
+		if err := validate(); err != nil {
+			t.Errorf("%s validation error = %v", name, err)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg := Default()
+	err := ApplyEnv(cfg, []string{
+		"LPMOS_CONTROL_PLANE_API_PORT=9080",
+		"LPMOS_REGIONAL_CLIENT_ETCD_ENDPOINTS=etcd-1:2379, etcd-2:2379",
+		"LPMOS_REGIONAL_CLIENT_SERVICES_PXE_ENABLED=true",
+		"LPMOS_AGENT_REPORTING_INTERVAL=45s",
+		"UNRELATED=1",
+	})
+	if err != nil {
+		t.Fatalf("ApplyEnv() error = %v", err)
+	}
+
+	if cfg.ControlPlane.API.Port != 9080 {
+		t.Errorf("control_plane.api.port = %d, want 9080", cfg.ControlPlane.API.Port)
+	}
+	if got := cfg.RegionalClient.Etcd.Endpoints; len(got) != 2 || got[1] != "etcd-2:2379" {
+		t.Errorf("regional_client.etcd.endpoints = %v", got)
+	}
+	if !cfg.RegionalClient.Services.PXE.Enabled {
+		t.Error("regional_client.services.pxe.enabled = false, want true")
+	}
+	if cfg.Agent.Reporting.Interval != 45*time.Second {
+		t.Errorf("agent.reporting.interval = %v, want 45s", cfg.Agent.Reporting.Interval)
+	}
+
+	if err := ApplyEnv(cfg, []string{"LPMOS_CONTROL_PLANE_API_PORT=http"}); err == nil {
+		t.Error("ApplyEnv() accepted a non-numeric port")
+	}
+}
+
+func TestValidateRegionalClient(t *testing.T) {
+	cfg := Default()
+	if err := cfg.ValidateRegionalClient(); err == nil || !strings.Contains(err.Error(), "region_id") {
+		t.Errorf("missing region_id not reported, got %v", err)
+	}
+
+	cfg.RegionalClient.RegionID = "dc1"
+	cfg.RegionalClient.Services.PXE.Enabled = true
+	cfg.RegionalClient.Services.PXE.DHCPRangeStart = "192.168.100.200"
+	cfg.RegionalClient.Services.PXE.DHCPRangeEnd = "192.168.100.10"
+	if err := cfg.ValidateRegionalClient(); err == nil || !strings.Contains(err.Error(), "reversed") {
+		t.Errorf("reversed DHCP range not reported, got %v", err)
+	}
+
+	cfg.RegionalClient.Services.PXE.DHCPRangeStart = "192.168.100.10"
+	cfg.RegionalClient.Services.PXE.DHCPRangeEnd = "192.168.100.200"
+	if err := cfg.ValidateRegionalClient(); err != nil {
+		t.Errorf("valid config rejected: %v", err)
+	}
+}
+
+func TestEmailRecipients(t *testing.T) {
+	cfg := Default()
+	email := &cfg.ControlPlane.Notifications.Email
+	email.Enabled = true
+	email.SMTPHost = "smtp.example.com"
+	email.From = "lpmos@example.com"
+	email.To = []string{"ops@example.com"}
+	email.IDCRecipients = map[string][]string{"dc1": {"dc1-oncall@example.com"}}
+
+	if got := email.Recipients("dc1"); len(got) != 1 || got[0] != "dc1-oncall@example.com" {
+		t.Errorf("Recipients(dc1) = %v", got)
+	}
+	if got := email.Recipients("dc2"); len(got) != 1 || got[0] != "ops@example.com" {
+		t.Errorf("Recipients(dc2) = %v", got)
+	}
+	if err := cfg.ValidateControlPlane(); err != nil {
+		t.Errorf("valid email config rejected: %v", err)
+	}
+
+	email.IDCRecipients["dc2"] = []string{"not an address"}
+	if err := cfg.ValidateControlPlane(); err == nil || !strings.Contains(err.Error(), "idc_recipients.dc2") {
+		t.Errorf("bad recipient not reported, got %v", err)
+	}
+}
+
+func TestValidateWatchdog(t *testing.T) {
+	cfg := Default()
+	watchdog := &cfg.ControlPlane.Watchdog
+	watchdog.Enabled = true
+	watchdog.Overrides = []WatchdogOverride{{OSType: "centos", Limits: InstallLimits{InstallTimeout: Duration(2 * time.Hour)}}}
+	if err := cfg.ValidateControlPlane(); err != nil {
+		t.Errorf("valid watchdog config rejected: %v", err)
+	}
+
+	watchdog.Overrides = append(watchdog.Overrides, WatchdogOverride{Limits: InstallLimits{StepTimeouts: map[string]time.Duration{"packages": -time.Minute}}})
+	err := cfg.ValidateControlPlane()
+	if err == nil || !strings.Contains(err.Error(), "overrides[1] needs an idc or os_type") ||
+		!strings.Contains(err.Error(), "overrides[1].step_timeouts.packages") {
+		t.Errorf("bad override not reported, got %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/rules"
+)
+
+// ValidateControlPlane checks the sections used by the control plane
+func (c *Config) ValidateControlPlane() error {
+	var errs []error
+	errs = append(errs, validateAPI("control_plane.api", c.ControlPlane.API)...)
+	errs = append(errs, validateEtcd("control_plane.etcd", c.ControlPlane.Etcd)...)
+
+	if authCfg := c.ControlPlane.Auth; authCfg.Enabled {
+		if len(authCfg.JWTSecret) < 16 {
+			errs = append(errs, errors.New("control_plane.auth.jwt_secret must be at least 16 characters when auth is enabled"))
+		}
+		if authCfg.TokenExpiry <= 0 {
+			errs = append(errs, errors.New("control_plane.auth.token_expiry must be positive"))
+		}
+		oidc := authCfg.OIDC
+		for name, value := range map[string]string{
+			"issuer_url":   oidc.IssuerURL,
+			"client_id":    oidc.ClientID,
+			"redirect_url": oidc.RedirectURL,
+		} {
+			if value == "" {
+				errs = append(errs, fmt.Errorf("control_plane.auth.oidc.%s is required when auth is enabled", name))
+			}
+		}
+		for i, m := range oidc.GroupMappings {
+			switch m.Role {
+			case "viewer", "operator", "approver", "admin":
+			default:
+				errs = append(errs, fmt.Errorf("control_plane.auth.oidc.group_mappings[%d] (%s) has unknown role %q", i, m.Group, m.Role))
+			}
+		}
+	}
+
+	if c.ControlPlane.Stats.ReconcileInterval <= 0 {
+		errs = append(errs, errors.New("control_plane.stats.reconcile_interval must be positive"))
+	}
+
+	if c.ControlPlane.Audit.Retention < 0 {
+		errs = append(errs, errors.New("control_plane.audit.retention must not be negative"))
+	}
+
+	if watchdog := c.ControlPlane.Watchdog; watchdog.Enabled {
+		if watchdog.Interval <= 0 {
+			errs = append(errs, errors.New("control_plane.watchdog.interval must be positive when the watchdog is enabled"))
+		}
+		errs = append(errs, validateInstallLimits("control_plane.watchdog", watchdog.Limits)...)
+		for i, o := range watchdog.Overrides {
+			field := fmt.Sprintf("control_plane.watchdog.overrides[%d]", i)
+			if o.IDC == "" && o.OSType == "" {
+				errs = append(errs, fmt.Errorf("%s needs an idc or os_type", field))
+			}
+			errs = append(errs, validateInstallLimits(field, o.Limits)...)
+		}
+	}
+
+	notifications := c.ControlPlane.Notifications
+	if notifications.WebhookURL != "" {
+		if u, err := url.Parse(notifications.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("control_plane.notifications.webhook_url %q is not a valid http or https URL", notifications.WebhookURL))
+		}
+	}
+	webhooks := notifications.Webhooks
+	if webhooks.MaxAttempts < 1 {
+		errs = append(errs, errors.New("control_plane.notifications.webhooks.max_attempts must be at least 1"))
+	}
+	if webhooks.InitialBackoff <= 0 || webhooks.MaxBackoff < webhooks.InitialBackoff {
+		errs = append(errs, errors.New("control_plane.notifications.webhooks needs a positive initial_backoff no larger than max_backoff"))
+	}
+	if webhooks.Timeout <= 0 {
+		errs = append(errs, errors.New("control_plane.notifications.webhooks.timeout must be positive"))
+	}
+
+	email := notifications.Email
+	if email.Enabled {
+		if email.SMTPHost == "" {
+			errs = append(errs, errors.New("control_plane.notifications.email.smtp_host is required when email is enabled"))
+		}
+		if !validPort(email.SMTPPort) {
+			errs = append(errs, fmt.Errorf("control_plane.notifications.email.smtp_port %d is out of range", email.SMTPPort))
+		}
+		if _, err := mail.ParseAddress(email.From); err != nil {
+			errs = append(errs, fmt.Errorf("control_plane.notifications.email.from %q is not a valid address", email.From))
+		}
+		recipients := map[string][]string{"to": email.To}
+		for idc, to := range email.IDCRecipients {
+			recipients["idc_recipients."+idc] = to
+		}
+		for name, to := range recipients {
+			for _, addr := range to {
+				if _, err := mail.ParseAddress(addr); err != nil {
+					errs = append(errs, fmt.Errorf("control_plane.notifications.email.%s entry %q is not a valid address", name, addr))
+				}
+			}
+		}
+		if email.ApprovalWait < 0 {
+			errs = append(errs, errors.New("control_plane.notifications.email.approval_wait must not be negative"))
+		}
+		if email.Digest && email.DigestInterval <= 0 {
+			errs = append(errs, errors.New("control_plane.notifications.email.digest_interval must be positive in digest mode"))
+		}
+	}
+
+	errs = append(errs, c.validateShared()...)
+	return errors.Join(errs...)
+}
+
+func validateInstallLimits(field string, l InstallLimits) []error {
+	var errs []error
+	for name, d := range map[string]*time.Duration{
+		"boot_timeout":    l.BootTimeout,
+		"install_timeout": l.InstallTimeout,
+		"step_timeout":    l.StepTimeout,
+	} {
+		if d != nil && *d < 0 {
+			errs = append(errs, fmt.Errorf("%s.%s must not be negative", field, name))
+		}
+	}
+	for step, d := range l.StepTimeouts {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s.step_timeouts.%s must not be negative", field, step))
+		}
+	}
+	if l.RetryAttempts != nil && *l.RetryAttempts < 0 {
+		errs = append(errs, fmt.Errorf("%s.retry_attempts must not be negative", field))
+	}
+	return errs
+}
+
+// ValidateRegionalClient checks the sections used by the regional client
+func (c *Config) ValidateRegionalClient() error {
+	rc := c.RegionalClient
+	var errs []error
+
+	if rc.RegionID == "" {
+		errs = append(errs, errors.New("regional_client.region_id is required"))
+	}
+	errs = append(errs, validateAPI("regional_client.api", rc.API)...)
+	errs = append(errs, validateEtcd("regional_client.etcd", rc.Etcd)...)
+
+	pxe := rc.Services.PXE
+	if net.ParseIP(pxe.ServerIP).To4() == nil {
+		errs = append(errs, fmt.Errorf("regional_client.services.pxe.server_ip %q is not a valid IPv4 address", pxe.ServerIP))
+	}
+	if pxe.Enabled {
+		if pxe.Interface == "" {
+			errs = append(errs, errors.New("regional_client.services.pxe.interface is required when pxe is enabled"))
+		}
+		if net.ParseIP(pxe.Netmask).To4() == nil {
+			errs = append(errs, fmt.Errorf("regional_client.services.pxe.netmask %q is not a valid IPv4 mask", pxe.Netmask))
+		}
+		for _, f := range []struct{ name, value string }{
+			{"dhcp_range_start", pxe.DHCPRangeStart},
+			{"dhcp_range_end", pxe.DHCPRangeEnd},
+			{"gateway", pxe.Gateway},
+		} {
+			if f.value != "" && net.ParseIP(f.value).To4() == nil {
+				errs = append(errs, fmt.Errorf("regional_client.services.pxe.%s %q is not a valid IPv4 address", f.name, f.value))
+			}
+		}
+		for _, dns := range pxe.DNSServers {
+			if net.ParseIP(dns) == nil {
+				errs = append(errs, fmt.Errorf("regional_client.services.pxe.dns_servers entry %q is not a valid IP address", dns))
+			}
+		}
+		start, end := net.ParseIP(pxe.DHCPRangeStart).To4(), net.ParseIP(pxe.DHCPRangeEnd).To4()
+		if start != nil && end != nil && bytes.Compare(start, end) > 0 {
+			errs = append(errs, fmt.Errorf("regional_client.services.pxe dhcp range %s-%s is reversed", pxe.DHCPRangeStart, pxe.DHCPRangeEnd))
+		}
+		if pxe.LeaseTime <= 0 {
+			errs = append(errs, errors.New("regional_client.services.pxe.lease_time must be positive"))
+		}
+	}
+
+	tftp := rc.Services.TFTP
+	if tftp.RootDir == "" {
+		errs = append(errs, errors.New("regional_client.services.tftp.root_dir is required"))
+	}
+	if tftp.Enabled && !validPort(tftp.Port) {
+		errs = append(errs, fmt.Errorf("regional_client.services.tftp.port %d is out of range", tftp.Port))
+	}
+
+	if rc.Installation.Timeout <= 0 {
+		errs = append(errs, errors.New("regional_client.installation.timeout must be positive"))
+	}
+	if rc.Installation.RetryAttempts < 0 {
+		errs = append(errs, errors.New("regional_client.installation.retry_attempts must not be negative"))
+	}
+
+	errs = append(errs, c.validateShared()...)
+	return errors.Join(errs...)
+}
+
+// ValidateAgent checks the sections used by the agent
+func (c *Config) ValidateAgent() error {
+	a := c.Agent
+	var errs []error
+
+	if u, err := url.Parse(a.RegionalClientURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("agent.regional_client_url %q is not a valid URL", a.RegionalClientURL))
+	}
+	if a.Reporting.Interval <= 0 {
+		errs = append(errs, errors.New("agent.reporting.interval must be positive"))
+	}
+	if a.Collection.RetryAttempts < 0 {
+		errs = append(errs, errors.New("agent.collection.retry_attempts must not be negative"))
+	}
+	if a.Collection.RetryDelay < 0 {
+		errs = append(errs, errors.New("agent.collection.retry_delay must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateShared checks the top-level sections every server binary reads
+func (c *Config) validateShared() []error {
+	var errs []error
+
+	switch c.Logging.Output {
+	case "stdout", "":
+	case "file":
+		if c.Logging.File.Path == "" {
+			errs = append(errs, errors.New("logging.file.path is required when logging.output is file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("logging.output %q must be stdout or file", c.Logging.Output))
+	}
+
+	if prom := c.Monitoring.Prometheus; c.Monitoring.Enabled {
+		if prom.Port != 0 && !validPort(prom.Port) {
+			errs = append(errs, fmt.Errorf("monitoring.prometheus.port %d is out of range", prom.Port))
+		}
+		if !strings.HasPrefix(prom.Path, "/") {
+			errs = append(errs, fmt.Errorf("monitoring.prometheus.path %q must start with /", prom.Path))
+		}
+	}
+
+	if c.Security.APIKeys.Enabled {
+		seen := make(map[string]bool)
+		for i, k := range c.Security.APIKeys.Keys {
+			if k.Name == "" || k.Key == "" {
+				errs = append(errs, fmt.Errorf("security.api_keys.keys[%d] needs both name and key", i))
+			}
+			if seen[k.Key] {
+				errs = append(errs, fmt.Errorf("security.api_keys.keys[%d] (%s) reuses an existing key", i, k.Name))
+			}
+			seen[k.Key] = true
+		}
+	}
+
+	for i, r := range c.Features.AutoApproval.Rules {
+		if err := rules.ValidateAction(r.Action); err != nil {
+			errs = append(errs, fmt.Errorf("features.auto_approval.rules[%d] (%s): %v", i, r.Name, err))
+		}
+		if _, err := rules.Compile(r.Condition); err != nil {
+			errs = append(errs, fmt.Errorf("features.auto_approval.rules[%d] (%s) condition: %v", i, r.Name, err))
+		}
+	}
+
+	return errs
+}
+
+func validateAPI(section string, api APIConfig) []error {
+	var errs []error
+	if !validPort(api.Port) {
+		errs = append(errs, fmt.Errorf("%s.port %d is out of range", section, api.Port))
+	}
+	if api.TLS.Enabled && (api.TLS.CertFile == "" || api.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("%s.tls needs cert_file and key_file when enabled", section))
+	}
+	return errs
+}
+
+func validateEtcd(section string, e EtcdConfig) []error {
+	var errs []error
+	if len(e.Endpoints) == 0 {
+		errs = append(errs, fmt.Errorf("%s.endpoints must not be empty", section))
+	}
+	if e.DialTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s.dial_timeout must be positive", section))
+	}
+	if e.RequestTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s.request_timeout must be positive", section))
+	}
+	return errs
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
@@ -0,0 +1,264 @@
+// Package email alerts operators by SMTP when a task fails or waits too long
+// for approval. Alerts go to the recipients configured for the task's IDC,
+// one email each or batched into a digest sent on an interval.
+package email
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/lpmos/lpmos-go/pkg/config"
+)
+
+// Alert kinds
+const (
+	KindFailed          = "failed"
+	KindApprovalOverdue = "approval_overdue"
+)
+
+// Alert is one thing operators should look at
+type Alert struct {
+	Kind     string
+	IDC      string
+	SN       string
+	TaskID   string
+	Hostname string
+	OSType   string
+	Reason   string
+	Since    time.Time // when the task entered its current status
+	At       time.Time
+	Link     string // filled in by the notifier
+}
+
+// Waiting is how long the task has been in its status at the alert time
+func (a Alert) Waiting() time.Duration {
+	if a.Since.IsZero() {
+		return 0
+	}
+	return a.At.Sub(a.Since).Round(time.Minute)
+}
+
+// Sender delivers a message to its recipients
+type Sender interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// SMTPSender sends through an SMTP server, using STARTTLS when the server
+// offers it and authenticating when a username is set
+type SMTPSender struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+// Send implements Sender
+func (s *SMTPSender) Send(from string, to []string, msg []byte) error {
+	var a smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		a = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, a, from, to, msg)
+}
+
+var (
+	subjectTmpl = template.Must(template.New("subject").Parse(
+		`{{if eq .Kind "failed"}}[LPMOS][{{.IDC}}] Installation of {{.SN}} failed` +
+			`{{else}}[LPMOS][{{.IDC}}] {{.SN}} has waited {{.Waiting}} for approval{{end}}`))
+
+	bodyTmpl = template.Must(template.New("body").Parse(`{{define "alert"}}{{if eq .Kind "failed"}}Installation failed
+{{- else}}Waiting for approval since {{.Since.Format "2006-01-02 15:04 MST"}} ({{.Waiting}}){{end}}
+  IDC:      {{.IDC}}
+  Serial:   {{.SN}}
+{{- if .Hostname}}
+  Hostname: {{.Hostname}}{{end}}
+{{- if .OSType}}
+  OS:       {{.OSType}}{{end}}
+  Task:     {{.TaskID}}
+{{- if .Reason}}
+  Reason:   {{.Reason}}{{end}}
+  Link:     {{.Link}}
+{{end}}{{template "alert" .}}
+--
+Sent by the LPMOS control plane
+`))
+
+	digestTmpl = template.Must(template.Must(bodyTmpl.Clone()).New("digest").Parse(
+		`{{len .}} LPMOS alert{{if ne (len .) 1}}s{{end}} since the last digest.
+{{range .}}
+[{{.At.Format "15:04"}}] {{template "alert" .}}{{end}}
+--
+Sent by the LPMOS control plane
+`))
+)
+
+// Notifier queues alerts and sends them from Run
+type Notifier struct {
+	cfg    config.EmailConfig
+	sender Sender
+	queue  chan Alert
+
+	mu      sync.Mutex
+	pending map[string][]Alert // digest mode: alerts by recipient list
+}
+
+// NewNotifier creates a notifier for the email settings. A nil sender sends
+// through cfg's SMTP server.
+func NewNotifier(cfg config.EmailConfig, sender Sender) *Notifier {
+	if sender == nil {
+		sender = &SMTPSender{
+			Addr:     net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+			Username: cfg.Username,
+			Password: cfg.Password,
+		}
+	}
+	return &Notifier{
+		cfg:     cfg,
+		sender:  sender,
+		queue:   make(chan Alert, 256),
+		pending: make(map[string][]Alert),
+	}
+}
+
+// Notify queues an alert. It never blocks; the alert is dropped when the
+// queue is full or nobody is configured to receive it.
+func (n *Notifier) Notify(a Alert) {
+	if len(n.cfg.Recipients(a.IDC)) == 0 {
+		return
+	}
+	if a.At.IsZero() {
+		a.At = time.Now()
+	}
+	a.Link = n.taskLink(a.IDC, a.SN)
+
+	select {
+	case n.queue <- a:
+	default:
+		log.Printf("Email queue full, dropping %s alert for %s/%s", a.Kind, a.IDC, a.SN)
+	}
+}
+
+// Run sends queued alerts until ctx is cancelled. In digest mode they are
+// collected and sent every digest interval, and once more on shutdown.
+func (n *Notifier) Run(ctx context.Context) {
+	var tick <-chan time.Time
+	if n.cfg.Digest {
+		ticker := time.NewTicker(n.cfg.DigestInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if n.cfg.Digest {
+				n.drain()
+				n.Flush()
+			}
+			return
+		case a := <-n.queue:
+			if n.cfg.Digest {
+				n.add(a)
+			} else {
+				n.sendAlert(a)
+			}
+		case <-tick:
+			n.Flush()
+		}
+	}
+}
+
+// drain moves queued alerts into the digest
+func (n *Notifier) drain() {
+	for {
+		select {
+		case a := <-n.queue:
+			n.add(a)
+		default:
+			return
+		}
+	}
+}
+
+func (n *Notifier) add(a Alert) {
+	key := strings.Join(n.cfg.Recipients(a.IDC), ",")
+	n.mu.Lock()
+	n.pending[key] = append(n.pending[key], a)
+	n.mu.Unlock()
+}
+
+// Flush sends one digest to each recipient list with collected alerts
+func (n *Notifier) Flush() {
+	n.mu.Lock()
+	pending := n.pending
+	n.pending = make(map[string][]Alert)
+	n.mu.Unlock()
+
+	for key, alerts := range pending {
+		sort.Slice(alerts, func(i, j int) bool { return alerts[i].At.Before(alerts[j].At) })
+		subject := fmt.Sprintf("[LPMOS] Digest: %d alert", len(alerts))
+		if len(alerts) != 1 {
+			subject += "s"
+		}
+		var body bytes.Buffer
+		if err := digestTmpl.Execute(&body, alerts); err != nil {
+			log.Printf("Failed to render email digest: %v", err)
+			continue
+		}
+		n.send(strings.Split(key, ","), subject, body.Bytes())
+	}
+}
+
+func (n *Notifier) sendAlert(a Alert) {
+	var subject, body bytes.Buffer
+	if err := subjectTmpl.Execute(&subject, a); err != nil {
+		log.Printf("Failed to render %s email for %s/%s: %v", a.Kind, a.IDC, a.SN, err)
+		return
+	}
+	if err := bodyTmpl.Execute(&body, a); err != nil {
+		log.Printf("Failed to render %s email for %s/%s: %v", a.Kind, a.IDC, a.SN, err)
+		return
+	}
+	n.send(n.cfg.Recipients(a.IDC), subject.String(), body.Bytes())
+}
+
+func (n *Notifier) send(to []string, subject string, body []byte) {
+	msg := message(n.cfg.From, to, subject, body, time.Now())
+	if err := n.sender.Send(n.cfg.From, to, msg); err != nil {
+		log.Printf("Failed to send email %q to %v: %v", subject, to, err)
+	}
+}
+
+// taskLink points at the task in the control plane API
+func (n *Notifier) taskLink(idc, sn string) string {
+	return strings.TrimSuffix(n.cfg.BaseURL, "/") + "/api/v1/tasks/" + url.PathEscape(idc) + "/" + url.PathEscape(sn)
+}
+
+// message builds a plain-text RFC 5322 message with CRLF line endings
+func message(from string, to []string, subject string, body []byte, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@lpmos>\r\n", uuid.New().String())
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.Write(bytes.ReplaceAll(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n")))
+	return b.Bytes()
+}
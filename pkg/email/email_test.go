@@ -0,0 +1,191 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/config"
+)
+
+// received is one message accepted by the SMTP stand-in
+type received struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpServer accepts mail on a local port and hands each message to the
+// returned channel. It speaks just enough SMTP for net/smtp.
+func smtpServer(t *testing.T) (host string, port int, messages <-chan received) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	ch := make(chan received, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, ch)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, ch
+}
+
+func serveSMTP(conn net.Conn, ch chan<- received) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP stand-in")
+
+	var msg received
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			tp.PrintfLine("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg = received{from: strings.Trim(line[len("MAIL FROM:"):], "<> ")}
+			tp.PrintfLine("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			tp.PrintfLine("250 OK")
+		case cmd == "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			ch <- msg
+			tp.PrintfLine("250 OK")
+		case cmd == "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func testConfig(host string, port int) config.EmailConfig {
+	return config.EmailConfig{
+		Enabled:        true,
+		SMTPHost:       host,
+		SMTPPort:       port,
+		From:           "lpmos@example.com",
+		To:             []string{"ops@example.com"},
+		IDCRecipients:  map[string][]string{"dc1": {"dc1-a@example.com", "dc1-b@example.com"}},
+		BaseURL:        "https://lpmos.example.com/",
+		DigestInterval: time.Hour,
+	}
+}
+
+func waitMessage(t *testing.T, messages <-chan received) received {
+	t.Helper()
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("no email received")
+		return received{}
+	}
+}
+
+func TestNotifierSendsAlert(t *testing.T) {
+	host, port, messages := smtpServer(t)
+	n := NewNotifier(testConfig(host, port), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Run(ctx)
+
+	n.Notify(Alert{Kind: KindFailed, IDC: "dc1", SN: "sn-001", TaskID: "t1", Hostname: "web-01", Reason: "disk error"})
+
+	m := waitMessage(t, messages)
+	if m.from != "lpmos@example.com" || strings.Join(m.to, ",") != "dc1-a@example.com,dc1-b@example.com" {
+		t.Errorf("envelope = %s -> %v", m.from, m.to)
+	}
+	for _, want := range []string{
+		"Subject: [LPMOS][dc1] Installation of sn-001 failed",
+		"Reason:   disk error",
+		"Hostname: web-01",
+		"https://lpmos.example.com/api/v1/tasks/dc1/sn-001",
+	} {
+		if !strings.Contains(m.data, want) {
+			t.Errorf("message lacks %q:\n%s", want, m.data)
+		}
+	}
+
+	// Other IDCs fall back to the default recipients
+	n.Notify(Alert{Kind: KindApprovalOverdue, IDC: "dc2", SN: "sn-002", Since: time.Now().Add(-45 * time.Minute)})
+	m = waitMessage(t, messages)
+	if strings.Join(m.to, ",") != "ops@example.com" || !strings.Contains(m.data, "has waited 45m0s for approval") {
+		t.Errorf("approval alert to %v:\n%s", m.to, m.data)
+	}
+}
+
+func TestNotifierDigest(t *testing.T) {
+	host, port, messages := smtpServer(t)
+	cfg := testConfig(host, port)
+	cfg.Digest = true
+	n := NewNotifier(cfg, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.Run(ctx)
+
+	for i := 1; i <= 3; i++ {
+		n.Notify(Alert{Kind: KindFailed, IDC: "dc1", SN: "sn-00" + strconv.Itoa(i)})
+	}
+	n.Notify(Alert{Kind: KindFailed, IDC: "dc2", SN: "sn-100"})
+
+	select {
+	case m := <-messages:
+		t.Fatalf("digest mode sent immediately: %s", m.data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Shutting down flushes the digest: one email per recipient list
+	cancel()
+	byRecipient := map[string]string{}
+	for i := 0; i < 2; i++ {
+		m := waitMessage(t, messages)
+		byRecipient[strings.Join(m.to, ",")] = m.data
+	}
+	dc1 := byRecipient["dc1-a@example.com,dc1-b@example.com"]
+	if !strings.Contains(dc1, "Digest: 3 alerts") || strings.Count(dc1, "Installation failed") != 3 {
+		t.Errorf("dc1 digest:\n%s", dc1)
+	}
+	if dc2 := byRecipient["ops@example.com"]; !strings.Contains(dc2, "Digest: 1 alert\n") || !strings.Contains(dc2, "sn-100") {
+		t.Errorf("dc2 digest:\n%s", dc2)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	msg := message("a@example.com", []string{"b@example.com", "c@example.com"}, "Über", []byte("line 1\nline 2\n"), time.Now())
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(string(msg))))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("To") != "b@example.com, c@example.com" || header.Get("Subject") != "=?utf-8?q?=C3=9Cber?=" {
+		t.Errorf("header = %v", header)
+	}
+	if !strings.HasSuffix(string(msg), "\r\n\r\nline 1\r\nline 2\r\n") {
+		t.Errorf("body not CRLF-terminated: %q", msg)
+	}
+}
@@ -2,11 +2,17 @@ package etcd
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"path"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+
+	"github.com/lpmos/lpmos-go/pkg/metrics"
 )
 
 const (
@@ -19,16 +25,51 @@ const (
 	KeyPrefixServers        = "/os/%s/servers/"          // Individual server keys
 	KeyPrefixMachines       = "/os/%s/machines//"         // Machine details
 	KeyPrefixGlobalStats    = "/os/global/stats/"        // Cross-IDC stats
+	KeyPrefixApprovalRules  = "/os/global/approval_rules/" // Auto-approval rule sets
+	KeyPrefixWebhooks       = "/os/global/webhooks/"       // Webhook subscriptions and dead letters
+	KeyPrefixAudit          = "/os/global/audit/"          // Append-only audit records
+	KeyAuditPruned          = "/os/global/audit_pruned"    // Newest audit record removed by retention
+	KeyPrefixInventory      = "/os/inventory/"             // Machine registry, by IDC and SN
+	KeyPrefixBOMProfiles    = "/os/global/bom_profiles/"   // Expected hardware for acceptance checks
+	KeyPrefixIPAM           = "/os/ipam/"                  // IP pools, allocations and DHCP leases, by IDC
 
 	// Default timeouts
 	DefaultDialTimeout    = 5 * time.Second
 	DefaultRequestTimeout = 10 * time.Second
 )
 
+// ErrKeyNotFound is wrapped by reads of keys that do not exist
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrTxnConflict is returned when the conditions of a transaction fail
+var ErrTxnConflict = errors.New("transaction conditions not met")
+
+var (
+	requestDuration = metrics.NewHistogram("lpmos_etcd_request_duration_seconds",
+		"Latency of etcd requests by RPC", metrics.DefBuckets, "op")
+	requestErrors = metrics.NewCounter("lpmos_etcd_request_errors_total",
+		"etcd requests that failed, by RPC", "op")
+	atomicConflicts = metrics.NewCounter("lpmos_etcd_atomic_update_conflicts_total",
+		"AtomicUpdate attempts retried because the key changed underneath")
+)
+
 // Client wraps etcd client with LPMOS-specific operations
 type Client struct {
 	cli            *clientv3.Client
 	requestTimeout time.Duration
+	indexers       []Indexer
+}
+
+// Indexer derives secondary index operations from a write to key. prev is
+// nil when the key is created and next is nil when it is deleted. Indexers
+// must ignore keys they do not index.
+type Indexer func(key string, prev, next []byte) []clientv3.Op
+
+// KeyValue is a key returned by Range
+type KeyValue struct {
+	Key         string
+	Value       []byte
+	ModRevision int64
 }
 
 // Config holds etcd client configuration
@@ -38,7 +79,7 @@ type Config struct {
 	RequestTimeout time.Duration
 	Username       string
 	Password       string
-	// TLS configuration can be added here
+	TLS            *tls.Config // nil for plaintext connections
 }
 
 // NewClient creates a new etcd client
@@ -55,6 +96,8 @@ func NewClient(cfg Config) (*Client, error) {
 		DialTimeout: cfg.DialTimeout,
 		Username:    cfg.Username,
 		Password:    cfg.Password,
+		TLS:         cfg.TLS,
+		DialOptions: []grpc.DialOption{grpc.WithChainUnaryInterceptor(observeRequest)},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create etcd client: %w", err)
@@ -66,6 +109,19 @@ func NewClient(cfg Config) (*Client, error) {
 	}, nil
 }
 
+// observeRequest records the latency of every unary etcd RPC (Range, Put,
+// Txn, LeaseGrant, ...), whichever Client method issued it
+func observeRequest(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	op := path.Base(method)
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	requestDuration.With(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		requestErrors.With(op).Inc()
+	}
+	return err
+}
+
 // Close closes the etcd client connection
 // Should be called when the client is no longer needed to release resources
 func (c *Client) Close() error {
@@ -86,26 +142,83 @@ func (c *Client) Put(key string, value interface{}) error {
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
 	defer cancel()
 
-	var valueStr string
+	valueStr, err := encodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.cli.Put(ctx, key, valueStr)
+	if err != nil {
+		return fmt.Errorf("failed to put key %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// AddIndexer registers an indexer whose operations are committed with every
+// PutIfAbsent and AtomicUpdate(Ops) write. It must be called before the
+// client is shared between goroutines.
+func (c *Client) AddIndexer(fn Indexer) {
+	c.indexers = append(c.indexers, fn)
+}
+
+// IndexOps returns the operations of all registered indexers for a write to
+// key. Callers building their own Transaction use it to keep indexes in step.
+func (c *Client) IndexOps(key string, prev, next []byte) []clientv3.Op {
+	var ops []clientv3.Op
+	for _, fn := range c.indexers {
+		ops = append(ops, fn(key, prev, next)...)
+	}
+	return ops
+}
+
+// PutIfAbsent stores a value only if the key does not exist yet.
+// It reports whether the value was stored.
+func (c *Client) PutIfAbsent(key string, value interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+
+	valueStr, err := encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	ops := append([]clientv3.Op{clientv3.OpPut(key, valueStr)}, c.IndexOps(key, nil, []byte(valueStr))...)
+	resp, err := c.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.Version(key), "=", 0)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return false, fmt.Errorf("failed to put key %s: %w", key, err)
+	}
+
+	return resp.Succeeded, nil
+}
+
+// OpPut builds a put operation for Transaction or AtomicUpdateOps,
+// encoding value the same way as Put
+func OpPut(key string, value interface{}) (clientv3.Op, error) {
+	valueStr, err := encodeValue(value)
+	if err != nil {
+		return clientv3.Op{}, err
+	}
+	return clientv3.OpPut(key, valueStr), nil
+}
+
+// encodeValue stores strings and bytes as-is and everything else as JSON
+func encodeValue(value interface{}) (string, error) {
 	switch v := value.(type) {
 	case string:
-		valueStr = v
+		return v, nil
 	case []byte:
-		valueStr = string(v)
+		return string(v), nil
 	default:
 		data, err := json.Marshal(value)
 		if err != nil {
-			return fmt.Errorf("failed to marshal value: %w", err)
+			return "", fmt.Errorf("failed to marshal value: %w", err)
 		}
-		valueStr = string(data)
-	}
-
-	_, err := c.cli.Put(ctx, key, valueStr)
-	if err != nil {
-		return fmt.Errorf("failed to put key %s: %w", key, err)
+		return string(data), nil
 	}
-
-	return nil
 }
 
 // Get retrieves a value from etcd
@@ -119,7 +232,7 @@ func (c *Client) Get(key string) ([]byte, error) {
 	}
 
 	if len(resp.Kvs) == 0 {
-		return nil, fmt.Errorf("key not found: %s", key)
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
 	}
 
 	return resp.Kvs[0].Value, nil
@@ -157,6 +270,89 @@ func (c *Client) GetWithPrefix(prefix string) (map[string][]byte, error) {
 	return result, nil
 }
 
+// GetMany retrieves several keys in as few round trips as possible.
+// Missing keys are left out of the result.
+func (c *Client) GetMany(keys []string) (map[string][]byte, error) {
+	return c.GetManyAt(0, keys)
+}
+
+// GetManyAt is GetMany reading the keyspace as of revision rev (0 for the
+// latest), so the values are consistent with an earlier read at rev
+func (c *Client) GetManyAt(rev int64, keys []string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+
+	var opts []clientv3.OpOption
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev))
+	}
+
+	// etcd limits the operations per transaction (128 by default)
+	const chunk = 100
+	result := make(map[string][]byte, len(keys))
+	for start := 0; start < len(keys); start += chunk {
+		end := start + chunk
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, key := range keys[start:end] {
+			ops = append(ops, clientv3.OpGet(key, opts...))
+		}
+		resp, err := c.cli.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %d keys: %w", end-start, err)
+		}
+		for _, r := range resp.Responses {
+			for _, kv := range r.GetResponseRange().Kvs {
+				result[string(kv.Key)] = kv.Value
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Range returns up to limit keys in [start, end) ordered by key, descending
+// when desc is set. A positive rev reads the keyspace as of that revision.
+// It also returns the revision that was read and whether more keys follow.
+func (c *Client) Range(start, end string, limit int64, desc bool, rev int64) ([]KeyValue, int64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+
+	opts := []clientv3.OpOption{clientv3.WithRange(end), clientv3.WithLimit(limit)}
+	if desc {
+		opts = append(opts, clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	}
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev))
+	}
+
+	resp, err := c.cli.Get(ctx, start, opts...)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to range %s - %s: %w", start, end, err)
+	}
+
+	kvs := make([]KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, KeyValue{Key: string(kv.Key), Value: kv.Value, ModRevision: kv.ModRevision})
+	}
+	return kvs, resp.Header.Revision, resp.More, nil
+}
+
+// Revision returns the current revision of the etcd keyspace
+func (c *Client) Revision() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+
+	resp, err := c.cli.Get(ctx, KeyPrefixGlobalStats, clientv3.WithCountOnly())
+	if err != nil {
+		return 0, fmt.Errorf("failed to read revision: %w", err)
+	}
+	return resp.Header.Revision, nil
+}
+
 // Delete removes a key from etcd
 func (c *Client) Delete(key string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
@@ -170,12 +366,13 @@ func (c *Client) Delete(key string) error {
 	return nil
 }
 
-// Watch watches for changes on a key or prefix
-func (c *Client) Watch(ctx context.Context, key string, prefix bool) clientv3.WatchChan {
+// Watch watches for changes on a key or prefix. Extra options such as
+// clientv3.WithPrevKV are passed to etcd.
+func (c *Client) Watch(ctx context.Context, key string, prefix bool, opts ...clientv3.OpOption) clientv3.WatchChan {
 	if prefix {
-		return c.cli.Watch(ctx, key, clientv3.WithPrefix())
+		opts = append(opts, clientv3.WithPrefix())
 	}
-	return c.cli.Watch(ctx, key)
+	return c.cli.Watch(ctx, key, opts...)
 }
 
 // PutWithLease stores a value with a TTL lease
@@ -211,19 +408,49 @@ func (c *Client) PutWithLease(key string, value interface{}, ttlSeconds int64) e
 	return nil
 }
 
-// Transaction executes multiple operations atomically
-func (c *Client) Transaction(ops []clientv3.Op) error {
+// PutWithLeaseID stores a value attached to an existing lease, so the key is
+// deleted when the lease expires or is revoked
+func (c *Client) PutWithLeaseID(key string, value interface{}, leaseID clientv3.LeaseID) error {
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
 	defer cancel()
 
-	_, err := c.cli.Txn(ctx).Then(ops...).Commit()
+	valueStr, err := encodeValue(value)
 	if err != nil {
-		return fmt.Errorf("failed to execute transaction: %w", err)
+		return err
+	}
+
+	if _, err := c.cli.Put(ctx, key, valueStr, clientv3.WithLease(leaseID)); err != nil {
+		return fmt.Errorf("failed to put key %s with lease: %w", key, err)
 	}
 
 	return nil
 }
 
+// Transaction executes multiple operations atomically. When conditions are
+// given the operations only run if all of them hold; otherwise ErrTxnConflict
+// is returned and nothing is written.
+func (c *Client) Transaction(ops []clientv3.Op, conditions ...clientv3.Cmp) error {
+	_, err := c.TransactionRevision(ops, conditions...)
+	return err
+}
+
+// TransactionRevision is Transaction that also returns the revision of the
+// commit, which is the ModRevision of every key the operations wrote
+func (c *Client) TransactionRevision(ops []clientv3.Op, conditions ...clientv3.Cmp) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+
+	resp, err := c.cli.Txn(ctx).If(conditions...).Then(ops...).Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute transaction: %w", err)
+	}
+	if !resp.Succeeded {
+		return 0, ErrTxnConflict
+	}
+
+	return resp.Header.Revision, nil
+}
+
 // GetWithVersion retrieves a value and its version (for CAS operations)
 func (c *Client) GetWithVersion(key string) ([]byte, int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
@@ -235,7 +462,7 @@ func (c *Client) GetWithVersion(key string) ([]byte, int64, error) {
 	}
 
 	if len(resp.Kvs) == 0 {
-		return nil, 0, fmt.Errorf("key not found: %s", key)
+		return nil, 0, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
 	}
 
 	return resp.Kvs[0].Value, resp.Kvs[0].Version, nil
@@ -248,6 +475,16 @@ func (c *Client) Txn(ctx context.Context) clientv3.Txn {
 
 // AtomicUpdate performs an atomic read-modify-write with version check (v3.0)
 func (c *Client) AtomicUpdate(key string, updateFn func([]byte) (interface{}, error)) error {
+	return c.AtomicUpdateOps(key, func(data []byte) (interface{}, []clientv3.Op, error) {
+		newValue, err := updateFn(data)
+		return newValue, nil, err
+	})
+}
+
+// AtomicUpdateOps is AtomicUpdate with extra operations committed in the same
+// transaction as the new value, e.g. archiving the previous value elsewhere.
+// Registered indexers are applied as well.
+func (c *Client) AtomicUpdateOps(key string, updateFn func([]byte) (interface{}, []clientv3.Op, error)) error {
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
 	defer cancel()
 
@@ -259,31 +496,24 @@ func (c *Client) AtomicUpdate(key string, updateFn func([]byte) (interface{}, er
 		}
 
 		// Apply update function
-		newValue, err := updateFn(data)
+		newValue, ops, err := updateFn(data)
 		if err != nil {
 			return err
 		}
 
 		// Marshal new value
-		var valueStr string
-		switch v := newValue.(type) {
-		case string:
-			valueStr = v
-		case []byte:
-			valueStr = string(v)
-		default:
-			jsonData, err := json.Marshal(newValue)
-			if err != nil {
-				return fmt.Errorf("failed to marshal value: %w", err)
-			}
-			valueStr = string(jsonData)
+		valueStr, err := encodeValue(newValue)
+		if err != nil {
+			return err
 		}
 
+		ops = append(ops, c.IndexOps(key, data, []byte(valueStr))...)
+
 		// Atomic compare-and-swap
 		txn := c.cli.Txn(ctx)
 		resp, err := txn.
 			If(clientv3.Compare(clientv3.Version(key), "=", version)).
-			Then(clientv3.OpPut(key, valueStr)).
+			Then(append([]clientv3.Op{clientv3.OpPut(key, valueStr)}, ops...)...).
 			Else(clientv3.OpGet(key)).
 			Commit()
 
@@ -296,6 +526,7 @@ func (c *Client) AtomicUpdate(key string, updateFn func([]byte) (interface{}, er
 		}
 
 		// Conflict - retry
+		atomicConflicts.With().Inc()
 		time.Sleep(time.Duration(retries+1) * 100 * time.Millisecond)
 	}
 
@@ -346,11 +577,20 @@ func RegionKey(regionID string, suffix ...string) string {
 }
 
 // UnmatchedReportKey builds an unmatched report key
-// Example: UnmatchedReportKey("dc1", "20260130-fe:b7:02:c0:95:e0")
+// Example: UnmatchedReportKey("dc1", "fe:b7:02:c0:95:e0")
 func UnmatchedReportKey(regionID string, identifier string) string {
 	return KeyPrefixUnmatchedReports + regionID + "/" + identifier
 }
 
+// UnmatchedReportPrefix returns the prefix of the unmatched reports of a
+// region, or of every region when regionID is empty
+func UnmatchedReportPrefix(regionID string) string {
+	if regionID == "" {
+		return KeyPrefixUnmatchedReports
+	}
+	return KeyPrefixUnmatchedReports + regionID + "/"
+}
+
 // AgentKey builds an agent key path (deprecated, kept for compatibility)
 func AgentKey(macAddr string, suffix ...string) string {
 	key := "/os/agents/" + macAddr
@@ -362,7 +602,7 @@ func AgentKey(macAddr string, suffix ...string) string {
 
 // IsKeyNotFound checks if error is key not found
 func IsKeyNotFound(err error) bool {
-	return err != nil && err.Error() == "key not found"
+	return errors.Is(err, ErrKeyNotFound)
 }
 
 // OPTIMIZED SCHEMA v3.0 key helpers
@@ -397,12 +637,62 @@ func TaskKeyV3(idc string, sn string) string {
 	return MachineKey(idc, sn, "task")
 }
 
+// AttemptKey builds the key of an archived installation attempt
+// Example: AttemptKey("dc1", "sn-001", "task-1a2b3c4d") -> "/os/dc1/machines/sn-001/attempts/task-1a2b3c4d"
+func AttemptKey(idc string, sn string, taskID string) string {
+	return MachineKey(idc, sn, "attempts/"+taskID)
+}
+
+// AttemptPrefix returns the prefix of all archived attempts of a machine
+// Example: AttemptPrefix("dc1", "sn-001") -> "/os/dc1/machines/sn-001/attempts/"
+func AttemptPrefix(idc string, sn string) string {
+	return MachineKey(idc, sn, "attempts/")
+}
+
 // MetaKey builds the hardware metadata key path (v3.0)
 // Example: MetaKey("dc1", "sn-001") -> "/os/dc1/machines/sn-001/meta"
 func MetaKey(idc string, sn string) string {
 	return MachineKey(idc, sn, "meta")
 }
 
+// TaskLogPrefix is the prefix of the log entries of one installation attempt
+// Example: TaskLogPrefix("dc1", "sn-001", "t1") -> "/os/dc1/machines/sn-001/logs/t1/"
+func TaskLogPrefix(idc string, sn string, taskID string) string {
+	return MachineKey(idc, sn, "logs/"+taskID+"/")
+}
+
+// TaskLogKey is the key of one log entry; sequence numbers are zero-padded
+// so entries list in order
+// Example: TaskLogKey("dc1", "sn-001", "t1", 7) -> "/os/dc1/machines/sn-001/logs/t1/000000000007"
+func TaskLogKey(idc string, sn string, taskID string, seq int64) string {
+	return fmt.Sprintf("%s%012d", TaskLogPrefix(idc, sn, taskID), seq)
+}
+
+// InventoryKey builds the registry key of a machine
+// Example: InventoryKey("dc1", "sn-001") -> "/os/inventory/dc1/sn-001"
+func InventoryKey(idc string, sn string) string {
+	return KeyPrefixInventory + idc + "/" + sn
+}
+
+// InventoryPrefix returns the prefix of the machines of an IDC, or of every
+// IDC when idc is empty
+func InventoryPrefix(idc string) string {
+	if idc == "" {
+		return KeyPrefixInventory
+	}
+	return KeyPrefixInventory + idc + "/"
+}
+
+// HardwareHistoryPrefix is the prefix of the hardware versions of a machine
+func HardwareHistoryPrefix(idc string, sn string) string {
+	return MachineKey(idc, sn, "hardware/")
+}
+
+// HardwareHistoryKey builds the key of a hardware version, ordered by time
+func HardwareHistoryKey(idc string, sn string, reportedAt time.Time) string {
+	return fmt.Sprintf("%s%020d", HardwareHistoryPrefix(idc, sn), reportedAt.UnixNano())
+}
+
 // LeaseKey builds the lease key path for heartbeats (v3.0)
 // Example: LeaseKey("dc1", "sn-001") -> "/os/dc1/machines/sn-001/lease"
 func LeaseKey(idc string, sn string) string {
@@ -414,3 +704,76 @@ func LeaseKey(idc string, sn string) string {
 func StatsKey(idc string) string {
 	return fmt.Sprintf("%s%s", KeyPrefixGlobalStats, idc)
 }
+
+// ApprovalRulesKey is the key of the current auto-approval rule set
+// Example: ApprovalRulesKey() -> "/os/global/approval_rules/current"
+func ApprovalRulesKey() string {
+	return KeyPrefixApprovalRules + "current"
+}
+
+// ApprovalRulesVersionKey is the key keeping one version of the auto-approval
+// rule set; versions are zero-padded so they list in order
+// Example: ApprovalRulesVersionKey(3) -> "/os/global/approval_rules/versions/00000003"
+func ApprovalRulesVersionKey(version int) string {
+	return fmt.Sprintf("%sversions/%08d", KeyPrefixApprovalRules, version)
+}
+
+// WebhookSubscriptionKey is the key of a webhook subscription; an empty id
+// gives the prefix of all of them
+// Example: WebhookSubscriptionKey("ab12") -> "/os/global/webhooks/subscriptions/ab12"
+func WebhookSubscriptionKey(id string) string {
+	return KeyPrefixWebhooks + "subscriptions/" + id
+}
+
+// WebhookDeadLetterKey is the key of a webhook delivery that failed for good;
+// an empty id gives the prefix of all of them
+// Example: WebhookDeadLetterKey("cd34") -> "/os/global/webhooks/dead_letters/cd34"
+func WebhookDeadLetterKey(id string) string {
+	return KeyPrefixWebhooks + "dead_letters/" + id
+}
+
+// BOMProfileKey is the key of a BOM profile; an empty name gives the prefix
+// of all of them
+// Example: BOMProfileKey("r640-std") -> "/os/global/bom_profiles/r640-std"
+func BOMProfileKey(name string) string {
+	return KeyPrefixBOMProfiles + name
+}
+
+// IPAMPrefix is the prefix of every IPAM key of an IDC
+// Example: IPAMPrefix("dc1") -> "/os/ipam/dc1/"
+func IPAMPrefix(idc string) string {
+	return KeyPrefixIPAM + idc + "/"
+}
+
+// IPPoolKey builds the key of an IP pool of an IDC
+// Example: IPPoolKey("dc1", "prod") -> "/os/ipam/dc1/pools/prod"
+func IPPoolKey(idc string, name string) string {
+	return IPAMPrefix(idc) + "pools/" + name
+}
+
+// IPAllocationKey builds the key of an allocated or reserved address
+// Example: IPAllocationKey("dc1", "10.0.0.5") -> "/os/ipam/dc1/ips/10.0.0.5"
+func IPAllocationKey(idc string, ip string) string {
+	return IPAMPrefix(idc) + "ips/" + ip
+}
+
+// HostnameKey builds the key claiming a lower-case hostname in an IDC; its
+// value is the address the hostname belongs to
+// Example: HostnameKey("dc1", "dc1-a12-001") -> "/os/ipam/dc1/hostnames/dc1-a12-001"
+func HostnameKey(idc string, hostname string) string {
+	return IPAMPrefix(idc) + "hostnames/" + hostname
+}
+
+// DHCPLeasesKey builds the key where a regional client publishes its
+// dynamic DHCP leases
+// Example: DHCPLeasesKey("dc1") -> "/os/ipam/dc1/dhcp_leases"
+func DHCPLeasesKey(idc string) string {
+	return IPAMPrefix(idc) + "dhcp_leases"
+}
+
+// AuditRecordKey is the key of one audit record; sequence numbers are
+// zero-padded so records list in order
+// Example: AuditRecordKey(42) -> "/os/global/audit/00000000000000000042"
+func AuditRecordKey(seq uint64) string {
+	return fmt.Sprintf("%s%020d", KeyPrefixAudit, seq)
+}
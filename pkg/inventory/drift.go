@@ -0,0 +1,82 @@
+package inventory
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// Diff returns the hardware drift from prev to next, or nil when no part
+// appeared or disappeared and the BIOS version is the same.
+//
+// Parts are matched by what they are, not where the kernel put them: disks
+// by type, model and size, DIMMs by slot, size, type and speed, NICs by
+// MAC. A disk pulled from a machine renames the ones after it, which is
+// not drift by itself. Empty DIMM slots are ignored.
+func Diff(prev, next *models.HardwareInfo) *models.HardwareDrift {
+	var d models.HardwareDrift
+	d.DisksAdded, d.DisksRemoved = diffParts(prev.Disks, next.Disks, diskKey)
+	d.DIMMsAdded, d.DIMMsRemoved = diffParts(populatedDIMMs(prev.Memory.DIMMs), populatedDIMMs(next.Memory.DIMMs), dimmKey)
+	d.NICsAdded, d.NICsRemoved = diffParts(prev.Network, next.Network, nicKey)
+	if prev.BIOS.Version != next.BIOS.Version {
+		d.BIOS = &models.BIOSChange{From: prev.BIOS.Version, To: next.BIOS.Version}
+	}
+	if d.Empty() {
+		return nil
+	}
+	return &d
+}
+
+// diffParts compares two lists as multisets of key: added are the parts of
+// next without a match in prev, removed those of prev without one in next
+func diffParts[T any](prev, next []T, key func(T) string) (added, removed []T) {
+	left := make(map[string]int, len(prev))
+	for _, p := range prev {
+		left[key(p)]++
+	}
+	for _, n := range next {
+		k := key(n)
+		if left[k] > 0 {
+			left[k]--
+			continue
+		}
+		added = append(added, n)
+	}
+	// Of identical parts the last ones are reported missing, since the
+	// kernel names the survivors first
+	for i := len(prev) - 1; i >= 0; i-- {
+		k := key(prev[i])
+		if left[k] > 0 {
+			left[k]--
+			removed = append([]T{prev[i]}, removed...)
+		}
+	}
+	return added, removed
+}
+
+func diskKey(d models.DiskInfo) string {
+	return fmt.Sprintf("%s|%s|%d", strings.ToLower(d.Type), d.Model, d.SizeGB)
+}
+
+func dimmKey(d models.DIMMInfo) string {
+	return fmt.Sprintf("%s|%d|%s|%d", d.Slot, d.SizeGB, d.Type, d.SpeedMHz)
+}
+
+// nicKey falls back to the interface name for NICs reported without a MAC
+func nicKey(n models.NetworkInfo) string {
+	if n.MAC != "" {
+		return strings.ToLower(n.MAC)
+	}
+	return "if:" + n.Interface
+}
+
+func populatedDIMMs(dimms []models.DIMMInfo) []models.DIMMInfo {
+	var populated []models.DIMMInfo
+	for _, d := range dimms {
+		if d.SizeGB > 0 {
+			populated = append(populated, d)
+		}
+	}
+	return populated
+}
@@ -0,0 +1,53 @@
+package inventory
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+func TestDiff(t *testing.T) {
+	base := models.HardwareInfo{
+		Memory: models.MemoryInfo{DIMMs: []models.DIMMInfo{
+			{Slot: "A1", SizeGB: 32, Type: "DDR4"},
+			{Slot: "A2", SizeGB: 32, Type: "DDR4"},
+			{Slot: "A3"},
+		}},
+		Disks: []models.DiskInfo{
+			{Device: "/dev/sda", Type: "SSD", Model: "PM883", SizeGB: 960},
+			{Device: "/dev/sdb", Type: "HDD", Model: "ST4000", SizeGB: 4000},
+			{Device: "/dev/sdc", Type: "HDD", Model: "ST4000", SizeGB: 4000},
+		},
+		Network: []models.NetworkInfo{{Interface: "eth0", MAC: "00:11:22:33:44:55"}},
+		BIOS:    models.BIOSInfo{Version: "2.1"},
+	}
+
+	if d := Diff(&base, &base); d != nil {
+		t.Errorf("Diff() of the same hardware = %+v", d)
+	}
+
+	// sdb pulled: the kernel renames sdc to sdb, which is not drift
+	pulled := base
+	pulled.Disks = []models.DiskInfo{base.Disks[0], {Device: "/dev/sdb", Type: "HDD", Model: "ST4000", SizeGB: 4000}}
+	d := Diff(&base, &pulled)
+	if d == nil || len(d.DisksAdded) != 0 || !reflect.DeepEqual(d.DisksRemoved, base.Disks[2:]) {
+		t.Fatalf("Diff() after pulling a disk = %+v", d)
+	}
+
+	changed := base
+	changed.Memory.DIMMs = []models.DIMMInfo{base.Memory.DIMMs[0], {Slot: "A2"}, {Slot: "A3", SizeGB: 64, Type: "DDR4"}}
+	changed.Network = []models.NetworkInfo{{Interface: "eth0", MAC: "00:11:22:33:44:66"}}
+	changed.BIOS.Version = "2.3"
+	d = Diff(&base, &changed)
+	want := &models.HardwareDrift{
+		DIMMsAdded:   []models.DIMMInfo{{Slot: "A3", SizeGB: 64, Type: "DDR4"}},
+		DIMMsRemoved: []models.DIMMInfo{{Slot: "A2", SizeGB: 32, Type: "DDR4"}},
+		NICsAdded:    changed.Network,
+		NICsRemoved:  base.Network,
+		BIOS:         &models.BIOSChange{From: "2.1", To: "2.3"},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("Diff() = %+v, want %+v", d, want)
+	}
+}
@@ -0,0 +1,275 @@
+// Package inventory keeps the machine registry: one record per physical
+// server at /os/inventory/{idc}/{sn} with its lifecycle state and latest
+// hardware, independent of installation tasks. Every hardware version
+// reported is kept under /os/{idc}/machines/{sn}/hardware/.
+package inventory
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/rules"
+)
+
+// ErrExists is returned by Create for a machine already registered
+var ErrExists = errors.New("machine already exists")
+
+// ErrUnchanged is returned by an Update function that has nothing to write
+var ErrUnchanged = errors.New("machine unchanged")
+
+// ErrBadCursor is returned when a cursor does not belong to the query
+var ErrBadCursor = errors.New("invalid cursor")
+
+// listPage is how many machines Each reads per etcd request
+const listPage = 200
+
+// Get returns the machine idc/sn; the error matches etcd.ErrKeyNotFound
+// when it is not registered
+func Get(client *etcd.Client, idc, sn string) (*models.Machine, error) {
+	var m models.Machine
+	if err := client.GetJSON(etcd.InventoryKey(idc, sn), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Create registers m, or returns ErrExists
+func Create(client *etcd.Client, m *models.Machine) error {
+	created, err := client.PutIfAbsent(etcd.InventoryKey(m.IDC, m.SN), m)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("%w: %s/%s", ErrExists, m.IDC, m.SN)
+	}
+	return nil
+}
+
+// Update applies fn to the stored machine atomically and returns the
+// result. fn may return more operations for the same transaction, or
+// ErrUnchanged to write nothing.
+func Update(client *etcd.Client, idc, sn string, fn func(*models.Machine) ([]clientv3.Op, error)) (*models.Machine, error) {
+	var result models.Machine
+	err := client.AtomicUpdateOps(etcd.InventoryKey(idc, sn), func(data []byte) (interface{}, []clientv3.Op, error) {
+		var m models.Machine
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, nil, err
+		}
+		ops, err := fn(&m)
+		result = m // returned as is on ErrUnchanged
+		if err != nil {
+			return nil, nil, err
+		}
+		m.UpdatedAt = time.Now()
+		result = m
+		return m, ops, nil
+	})
+	if err != nil && !errors.Is(err, ErrUnchanged) {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Ensure is Update for a machine that may not be registered yet: create
+// builds the record stored first in that case
+func Ensure(client *etcd.Client, idc, sn string, create func() *models.Machine, fn func(*models.Machine) ([]clientv3.Op, error)) (*models.Machine, error) {
+	m, err := Update(client, idc, sn, fn)
+	if !etcd.IsKeyNotFound(err) {
+		return m, err
+	}
+	// Another writer may register it first; either way Update then applies
+	if _, err := client.PutIfAbsent(etcd.InventoryKey(idc, sn), create()); err != nil {
+		return nil, err
+	}
+	return Update(client, idc, sn, fn)
+}
+
+// Delete removes the machine and its hardware history
+func Delete(client *etcd.Client, idc, sn string) error {
+	return client.Transaction([]clientv3.Op{
+		clientv3.OpDelete(etcd.InventoryKey(idc, sn)),
+		clientv3.OpDelete(etcd.HardwareHistoryPrefix(idc, sn), clientv3.WithPrefix()),
+	})
+}
+
+// RecordHardware stores hw as the current hardware of the machine and, when
+// it differs from the previous report, as a new version in its history
+// along with the drift from the previous version. Machines not registered
+// yet are registered as discovered. It returns the new version, or nil when
+// the hardware is unchanged.
+func RecordHardware(client *etcd.Client, idc, sn, mac string, hw models.HardwareInfo, source, taskID string) (*models.Machine, *models.HardwareRecord, error) {
+	var record *models.HardwareRecord
+	m, err := Ensure(client, idc, sn, func() *models.Machine {
+		m := models.NewMachine(idc, sn, models.MachineStateDiscovered, source, "Hardware reported")
+		m.MAC = mac
+		return m
+	}, func(m *models.Machine) ([]clientv3.Op, error) {
+		record = nil // fn runs again when the machine changed underneath
+		macSet := false
+		if m.MAC == "" && mac != "" {
+			m.MAC, macSet = mac, true
+		}
+		if m.Hardware != nil && SameHardware(*m.Hardware, hw) {
+			if macSet {
+				return nil, nil
+			}
+			return nil, ErrUnchanged
+		}
+
+		now := time.Now()
+		r := &models.HardwareRecord{
+			ReportedAt: now,
+			Source:     source,
+			TaskID:     taskID,
+			Hardware:   hw,
+		}
+		if m.Hardware != nil {
+			r.Drift = Diff(m.Hardware, &hw)
+		}
+		op, err := etcd.OpPut(etcd.HardwareHistoryKey(idc, sn, now), r)
+		if err != nil {
+			return nil, err
+		}
+		m.Hardware = &hw
+		m.HardwareUpdatedAt = &now
+		record = r
+		return []clientv3.Op{op}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, record, nil
+}
+
+// SameHardware reports whether two reports describe the same hardware,
+// ignoring when they were collected
+func SameHardware(a, b models.HardwareInfo) bool {
+	a.CollectedAt, b.CollectedAt = time.Time{}, time.Time{}
+	aj, errA := json.Marshal(a)
+	bj, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aj, bj)
+}
+
+// HardwareHistory returns the hardware versions of a machine, oldest first.
+// Versions stored without a drift get it computed from the one before.
+func HardwareHistory(client *etcd.Client, idc, sn string) ([]models.HardwareRecord, error) {
+	kvs, err := client.GetWithPrefix(etcd.HardwareHistoryPrefix(idc, sn))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	records := make([]models.HardwareRecord, 0, len(keys))
+	for i, key := range keys {
+		var r models.HardwareRecord
+		if err := json.Unmarshal(kvs[key], &r); err != nil {
+			return nil, fmt.Errorf("invalid hardware record %s: %w", key, err)
+		}
+		if r.Drift == nil && i > 0 {
+			r.Drift = Diff(&records[i-1].Hardware, &r.Hardware)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// Query selects machines; zero fields match everything
+type Query struct {
+	IDC    string
+	States []models.MachineState
+	Cursor string
+	Limit  int
+	Where  *rules.Expr           // a search expression, see CompileSearch
+	Allow  func(idc string) bool // IDCs the caller may see
+}
+
+// Matches reports whether m is selected by q
+func (q *Query) Matches(m *models.Machine) bool {
+	if len(q.States) > 0 {
+		found := false
+		for _, s := range q.States {
+			found = found || s == m.State
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Allow != nil && !q.Allow(m.IDC) {
+		return false
+	}
+	return q.Where == nil || q.Where.Match(Env(m))
+}
+
+// List returns up to q.Limit machines matching q, ordered by IDC and SN,
+// and the cursor of the next page, which is empty on the last page
+func List(client *etcd.Client, q Query) ([]models.Machine, string, error) {
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+
+	machines := []models.Machine{}
+	var keys []string
+	err := Each(client, q, func(key string, m *models.Machine) bool {
+		machines = append(machines, *m)
+		keys = append(keys, key)
+		return len(machines) <= q.Limit // one extra tells whether a next page exists
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(machines) <= q.Limit {
+		return machines, "", nil
+	}
+	return machines[:q.Limit], base64.RawURLEncoding.EncodeToString([]byte(keys[q.Limit-1])), nil
+}
+
+// Each calls fn for every machine matching q in key order until fn returns
+// false. q.Limit is ignored.
+func Each(client *etcd.Client, q Query, fn func(key string, m *models.Machine) bool) error {
+	prefix := etcd.InventoryPrefix(q.IDC)
+	start, end := prefix, clientv3.GetPrefixRangeEnd(prefix)
+	if q.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil || !strings.HasPrefix(string(raw), prefix) {
+			return ErrBadCursor
+		}
+		start = string(raw) + "\x00"
+	}
+
+	var rev int64
+	for {
+		kvs, readRev, more, err := client.Range(start, end, listPage, false, rev)
+		if err != nil {
+			return err
+		}
+		rev = readRev
+		for _, kv := range kvs {
+			var m models.Machine
+			if json.Unmarshal(kv.Value, &m) != nil || !q.Matches(&m) {
+				continue
+			}
+			if !fn(kv.Key, &m) {
+				return nil
+			}
+		}
+		if !more || len(kvs) == 0 {
+			return nil
+		}
+		start = kvs[len(kvs)-1].Key + "\x00"
+	}
+}
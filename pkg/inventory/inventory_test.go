@@ -0,0 +1,59 @@
+package inventory
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+func TestSameHardware(t *testing.T) {
+	a := models.HardwareInfo{
+		CPU:         models.CPUInfo{Cores: 32},
+		Memory:      models.MemoryInfo{TotalGB: 256},
+		Disks:       []models.DiskInfo{{Device: "/dev/sda"}},
+		CollectedAt: time.Now(),
+	}
+	b := a
+	b.CollectedAt = a.CollectedAt.Add(time.Hour)
+	if !SameHardware(a, b) {
+		t.Error("reports differing only in time are not the same")
+	}
+
+	b.Disks = append([]models.DiskInfo{}, a.Disks...)
+	b.Disks = append(b.Disks, models.DiskInfo{Device: "/dev/sdb"})
+	if SameHardware(a, b) {
+		t.Error("an added disk is not a change")
+	}
+}
+
+func TestQueryMatches(t *testing.T) {
+	m := &models.Machine{IDC: "dc1", State: models.MachineStateBroken}
+	tests := []struct {
+		name string
+		q    Query
+		want bool
+	}{
+		{"no filter", Query{}, true},
+		{"state", Query{States: []models.MachineState{models.MachineStateReady, models.MachineStateBroken}}, true},
+		{"other state", Query{States: []models.MachineState{models.MachineStateReady}}, false},
+		{"allowed", Query{Allow: func(idc string) bool { return idc == "dc1" }}, true},
+		{"not allowed", Query{Allow: func(idc string) bool { return idc == "dc2" }}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.q.Matches(m); got != tt.want {
+			t.Errorf("%s: Matches() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEachRejectsForeignCursor(t *testing.T) {
+	for _, cursor := range []string{"!!", base64.RawURLEncoding.EncodeToString([]byte("/os/inventory/dc2/SN1"))} {
+		err := Each(nil, Query{IDC: "dc1", Cursor: cursor}, func(string, *models.Machine) bool { return true })
+		if !errors.Is(err, ErrBadCursor) {
+			t.Errorf("cursor %q: err = %v, want ErrBadCursor", cursor, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package inventory
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/rules"
+)
+
+// SearchRoots are the names a search expression may start a path with:
+// machine is the inventory record without its hardware, hardware the latest
+// HardwareInfo reported
+var SearchRoots = []string{"machine", "hardware"}
+
+// DefaultColumns are exported when a search names no fields
+var DefaultColumns = []string{
+	"machine.idc", "machine.sn", "machine.state", "machine.hostname", "machine.rack",
+	"hardware.cpu.model", "hardware.cpu.cores", "hardware.memory.total_gb",
+	"len(hardware.disks)", "hardware.disks.type", "sum(hardware.disks.size_gb)",
+	"hardware.network.mac", "hardware.bios.vendor", "hardware.bios.version",
+}
+
+// CompileSearch parses a search expression in the approval rule language,
+// for example
+//
+//	hardware.memory.total_gb >= 256 && hardware.disks.type contains 'NVMe'
+func CompileSearch(source string) (*rules.Expr, error) {
+	return rules.CompileWith(source, SearchRoots...)
+}
+
+// Env is what search expressions and columns read for m
+func Env(m *models.Machine) map[string]interface{} {
+	env := map[string]interface{}{"machine": nil, "hardware": nil}
+	bare := *m
+	bare.Hardware = nil
+	for name, v := range map[string]interface{}{"machine": bare, "hardware": m.Hardware} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		var decoded interface{}
+		if json.Unmarshal(data, &decoded) == nil {
+			env[name] = decoded
+		}
+	}
+	return env
+}
+
+// Column is one field of a search result, an expression such as
+// hardware.bios.version or len(hardware.disks)
+type Column struct {
+	Name string
+	expr *rules.Expr
+}
+
+// Value evaluates the column against an Env
+func (c Column) Value(env map[string]interface{}) interface{} {
+	return c.expr.Eval(env)
+}
+
+// ParseColumns compiles a comma-separated column list; an empty list means
+// DefaultColumns
+func ParseColumns(spec string) ([]Column, error) {
+	names := DefaultColumns
+	if strings.TrimSpace(spec) != "" {
+		names = strings.Split(spec, ",")
+	}
+	columns := make([]Column, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		expr, err := CompileSearch(name)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, Column{Name: name, expr: expr})
+	}
+	return columns, nil
+}
+
+// FormatValue renders a column value as a CSV cell: lists are joined with
+// ";" and objects written as JSON. A cell a spreadsheet would take for a
+// formula, one starting with =, +, -, @, a tab or a carriage return, is
+// prefixed with a quote.
+func FormatValue(v interface{}) string {
+	cell := formatValue(v)
+	if _, number := v.(float64); !number && cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+func formatValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case []interface{}:
+		parts := make([]string, len(x))
+		for i, item := range x {
+			parts[i] = formatValue(item)
+		}
+		return strings.Join(parts, ";")
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// FacetCount is how many machines share a value
+type FacetCount struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+}
+
+// Facet counts the distinct values of a column across machines. A list
+// value counts each distinct element once per machine.
+type Facet struct {
+	counts map[string]*FacetCount
+}
+
+// NewFacet returns an empty facet
+func NewFacet() *Facet {
+	return &Facet{counts: make(map[string]*FacetCount)}
+}
+
+// Add counts the value of one machine
+func (f *Facet) Add(v interface{}) {
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+	seen := make(map[string]bool)
+	for _, item := range items {
+		key, _ := json.Marshal(item)
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		if fc := f.counts[string(key)]; fc != nil {
+			fc.Count++
+		} else {
+			f.counts[string(key)] = &FacetCount{Value: item, Count: 1}
+		}
+	}
+}
+
+// Counts returns the values, most common first
+func (f *Facet) Counts() []FacetCount {
+	counts := make([]FacetCount, 0, len(f.counts))
+	for _, fc := range f.counts {
+		counts = append(counts, *fc)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return formatValue(counts[i].Value) < formatValue(counts[j].Value)
+	})
+	return counts
+}
@@ -0,0 +1,108 @@
+package inventory
+
+import (
+	"testing"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+func searchMachine(sn string, memGB int, bios string, diskTypes ...string) *models.Machine {
+	m := models.NewMachine("dc2", sn, models.MachineStateReady, "tester", "")
+	hw := &models.HardwareInfo{
+		CPU:     models.CPUInfo{Model: "Xeon Gold 6248", Cores: 40},
+		Memory:  models.MemoryInfo{TotalGB: memGB},
+		BIOS:    models.BIOSInfo{Vendor: "Dell Inc.", Version: bios},
+		Network: []models.NetworkInfo{{Interface: "eth0", MAC: "00:1a:2b:3c:4d:01"}},
+	}
+	for _, t := range diskTypes {
+		hw.Disks = append(hw.Disks, models.DiskInfo{Type: t, SizeGB: 960})
+	}
+	m.Hardware = hw
+	return m
+}
+
+func TestSearchMatches(t *testing.T) {
+	big := searchMachine("SN1", 512, "2.1.0", "NVMe", "HDD")
+	small := searchMachine("SN2", 128, "2.1.0", "NVMe")
+	bare := models.NewMachine("dc2", "SN3", models.MachineStateDiscovered, "tester", "")
+
+	tests := []struct {
+		expr string
+		want []bool // big, small, bare
+	}{
+		{"hardware.memory.total_gb >= 256 && hardware.disks.type contains 'NVMe'", []bool{true, false, false}},
+		{"machine.idc == 'dc2' and machine.state == 'ready'", []bool{true, true, false}},
+		{"hardware.network.mac contains '00:1a:2b:3c:4d:01'", []bool{true, true, false}},
+		{"sum(hardware.disks.size_gb) > 1000", []bool{true, false, false}},
+		{"!hardware", []bool{false, false, true}},
+	}
+	for _, tt := range tests {
+		expr, err := CompileSearch(tt.expr)
+		if err != nil {
+			t.Fatalf("CompileSearch(%q) error = %v", tt.expr, err)
+		}
+		q := Query{Where: expr}
+		for i, m := range []*models.Machine{big, small, bare} {
+			if got := q.Matches(m); got != tt.want[i] {
+				t.Errorf("%s on %s = %v, want %v", tt.expr, m.SN, got, tt.want[i])
+			}
+		}
+	}
+
+	if _, err := CompileSearch("task.os_type == 'ubuntu'"); err == nil {
+		t.Error("CompileSearch() accepted the task root")
+	}
+}
+
+func TestColumns(t *testing.T) {
+	columns, err := ParseColumns("machine.sn, hardware.disks.type, len(hardware.disks), hardware.bios")
+	if err != nil {
+		t.Fatalf("ParseColumns() error = %v", err)
+	}
+	env := Env(searchMachine("SN1", 512, "2.1.0", "NVMe", "HDD"))
+	want := []string{"SN1", "NVMe;HDD", "2", `{"serial":"","vendor":"Dell Inc.","version":"2.1.0"}`}
+	for i, col := range columns {
+		if got := FormatValue(col.Value(env)); got != want[i] {
+			t.Errorf("%s = %q, want %q", col.Name, got, want[i])
+		}
+	}
+
+	cells := map[interface{}]string{
+		"=HYPERLINK(\"x\")": `'=HYPERLINK("x")`,
+		"@SUM(A1)":          "'@SUM(A1)",
+		"-2+3":              "'-2+3",
+		"+1":                "'+1",
+		"a=b":               "a=b",
+		float64(-5):         "-5",
+	}
+	for v, want := range cells {
+		if got := FormatValue(v); got != want {
+			t.Errorf("FormatValue(%v) = %q, want %q", v, got, want)
+		}
+	}
+	if got := FormatValue([]interface{}{"=1", "x"}); got != "'=1;x" {
+		t.Errorf("FormatValue() of a list = %q", got)
+	}
+
+	if columns, err := ParseColumns(""); err != nil || len(columns) != len(DefaultColumns) {
+		t.Errorf("default columns: %d, err %v", len(columns), err)
+	}
+	if _, err := ParseColumns("machine.sn,cpu.cores"); err == nil {
+		t.Error("ParseColumns() accepted a path without a root")
+	}
+}
+
+func TestFacet(t *testing.T) {
+	expr, _ := CompileSearch("hardware.disks.type")
+	f := NewFacet()
+	for _, m := range []*models.Machine{
+		searchMachine("SN1", 512, "2.1.0", "NVMe", "NVMe", "HDD"),
+		searchMachine("SN2", 512, "2.1.0", "NVMe"),
+	} {
+		f.Add(expr.Eval(Env(m)))
+	}
+	counts := f.Counts()
+	if len(counts) != 2 || counts[0].Value != "NVMe" || counts[0].Count != 2 || counts[1].Value != "HDD" || counts[1].Count != 1 {
+		t.Errorf("Counts() = %+v", counts)
+	}
+}
@@ -0,0 +1,341 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// maxSeq bounds the search for a free {seq} hostname
+const maxSeq = 99999
+
+// Request asks for the address of a machine. IP and Hostname are used as
+// given when set; otherwise the machine keeps what it already holds, or
+// gets the next free address of Pool (the default pool when empty) and a
+// name from the pool's template.
+type Request struct {
+	SN       string
+	MAC      string
+	TaskID   string
+	Pool     string
+	IP       string
+	Hostname string
+	Rack     string // for {rack} in hostname templates
+	Reserve  bool
+	Note     string
+	Actor    string
+}
+
+// Claim is an address given to a machine and the etcd writes recording it.
+// Ops only commit while Conditions hold, i.e. no key they touch changed
+// since the Allocator read it.
+type Claim struct {
+	Allocation models.IPAllocation
+	Ops        []clientv3.Op
+	Conditions []clientv3.Cmp
+	Undo       []clientv3.Op // restores the keys Ops wrote, to roll a committed claim back
+}
+
+func (c *Claim) put(key, value string, rev int64, prev []byte) {
+	c.Conditions = append(c.Conditions, clientv3.Compare(clientv3.ModRevision(key), "=", rev))
+	c.Ops = append(c.Ops, clientv3.OpPut(key, value))
+	c.undo(key, prev)
+}
+
+func (c *Claim) remove(key string, rev int64, prev []byte) {
+	c.Conditions = append(c.Conditions, clientv3.Compare(clientv3.ModRevision(key), "=", rev))
+	c.Ops = append(c.Ops, clientv3.OpDelete(key))
+	c.undo(key, prev)
+}
+
+func (c *Claim) undo(key string, prev []byte) {
+	if prev != nil {
+		c.Undo = append(c.Undo, clientv3.OpPut(key, string(prev)))
+	} else {
+		c.Undo = append(c.Undo, clientv3.OpDelete(key))
+	}
+}
+
+// Assign claims an address and hostname for r. The Allocator remembers the
+// claim, so later requests do not get the same address.
+func (a *Allocator) Assign(r Request) (*Claim, error) {
+	own := a.bySN[r.SN]
+	ip, pool, err := a.chooseIP(r, own)
+	if err != nil {
+		return nil, err
+	}
+	// chooseIP never returns an address held by another machine, so an
+	// allocation already on ip is the machine's own
+	prev := own
+	if own != nil && own.alloc.IP != ip {
+		prev = nil
+	}
+	hostname, err := a.chooseHostname(r, own, ip, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	alloc := models.IPAllocation{
+		IP:        ip,
+		IDC:       a.idc,
+		SN:        r.SN,
+		MAC:       r.MAC,
+		Hostname:  hostname,
+		TaskID:    r.TaskID,
+		Reserved:  r.Reserve,
+		Note:      r.Note,
+		CreatedAt: now,
+		CreatedBy: r.Actor,
+		UpdatedAt: now,
+	}
+	if pool != nil {
+		alloc.Pool = pool.Name
+	}
+	if prev != nil {
+		alloc.CreatedAt, alloc.CreatedBy = prev.alloc.CreatedAt, prev.alloc.CreatedBy
+		alloc.Reserved = alloc.Reserved || prev.alloc.Reserved
+		if alloc.MAC == "" {
+			alloc.MAC = prev.alloc.MAC
+		}
+		if alloc.TaskID == "" {
+			alloc.TaskID = prev.alloc.TaskID
+		}
+		if alloc.Note == "" {
+			alloc.Note = prev.alloc.Note
+		}
+	}
+
+	value, err := json.Marshal(alloc)
+	if err != nil {
+		return nil, err
+	}
+	c := &Claim{Allocation: alloc}
+	if prev != nil {
+		c.put(etcd.IPAllocationKey(a.idc, ip), string(value), prev.rev, prev.raw)
+	} else {
+		c.put(etcd.IPAllocationKey(a.idc, ip), string(value), 0, nil)
+	}
+
+	// A machine moving to another address or name gives up the old ones
+	if own != nil && own.alloc.IP != ip {
+		c.remove(etcd.IPAllocationKey(a.idc, own.alloc.IP), own.rev, own.raw)
+		delete(a.byIP, own.alloc.IP)
+	}
+	if own != nil && own.alloc.Hostname != "" && own.alloc.Hostname != hostname {
+		if n, ok := a.hostnames[own.alloc.Hostname]; ok && n.ip == own.alloc.IP {
+			c.remove(etcd.HostnameKey(a.idc, own.alloc.Hostname), n.rev, []byte(n.ip))
+			delete(a.hostnames, own.alloc.Hostname)
+		}
+	}
+	if hostname != "" {
+		n, taken := a.hostnames[hostname]
+		switch {
+		case !taken:
+			c.put(etcd.HostnameKey(a.idc, hostname), ip, 0, nil)
+		case n.ip != ip:
+			c.put(etcd.HostnameKey(a.idc, hostname), ip, n.rev, []byte(n.ip))
+		}
+		a.hostnames[hostname] = hostnameEntry{ip: ip, rev: a.hostnames[hostname].rev}
+	}
+
+	h := &held{alloc: alloc, raw: value}
+	a.byIP[ip] = h
+	if r.SN != "" {
+		a.bySN[r.SN] = h
+	}
+	return c, nil
+}
+
+// chooseIP picks the address of r and the pool it belongs to (nil for an
+// address outside every pool)
+func (a *Allocator) chooseIP(r Request, own *held) (string, *models.IPPool, error) {
+	if r.IP != "" {
+		n, ok := toUint32(r.IP)
+		if !ok {
+			return "", nil, fmt.Errorf("%w: %q is not an IPv4 address", ErrInvalid, r.IP)
+		}
+		ip := fromUint32(n).String()
+		if h, taken := a.byIP[ip]; taken && (h.alloc.SN == "" || h.alloc.SN != r.SN) {
+			return "", nil, fmt.Errorf("%w: %s is %s", ErrConflict, ip, describe(&h.alloc))
+		}
+		if lease, leased := a.leasedToOther(ip, r.MAC); leased {
+			return "", nil, fmt.Errorf("%w: %s has a DHCP lease for %s until %s", ErrConflict, ip, lease.MAC, lease.ExpiresAt.Format(time.RFC3339))
+		}
+		if p := a.poolOf(n); p != nil && isExcluded(p, n) {
+			return "", nil, fmt.Errorf("%w: %s is excluded from pool %s", ErrConflict, ip, p.Name)
+		}
+		return ip, a.poolOf(n), nil
+	}
+
+	var pool *models.IPPool
+	var err error
+	switch {
+	case r.Pool != "":
+		pool, err = a.Pool(r.Pool)
+	case own != nil:
+		pool = a.pools[own.alloc.Pool]
+		if pool == nil {
+			return own.alloc.IP, nil, nil
+		}
+	default:
+		pool, err = a.defaultPool()
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if own != nil && own.alloc.Pool == pool.Name {
+		return own.alloc.IP, pool, nil
+	}
+
+	first, last, err := span(pool)
+	if err != nil {
+		return "", nil, fmt.Errorf("pool %s: %w", pool.Name, err)
+	}
+	for n := first; ; n++ {
+		ip := fromUint32(n).String()
+		_, taken := a.byIP[ip]
+		_, leased := a.leasedToOther(ip, r.MAC)
+		if !taken && !leased && !isExcluded(pool, n) {
+			return ip, pool, nil
+		}
+		if n == last {
+			break
+		}
+	}
+	return "", nil, fmt.Errorf("%w: no free address left in %s/%s", ErrExhausted, a.idc, pool.Name)
+}
+
+// chooseHostname picks the hostname of r: the requested one, the one the
+// machine already has on ip, or the lowest free name of the pool template
+func (a *Allocator) chooseHostname(r Request, own *held, ip string, pool *models.IPPool) (string, error) {
+	free := func(hostname string) bool {
+		n, taken := a.hostnames[hostname]
+		return !taken || n.ip == ip || (own != nil && n.ip == own.alloc.IP)
+	}
+
+	if r.Hostname != "" {
+		hostname := strings.ToLower(r.Hostname)
+		if len(hostname) > 253 || !hostnamePattern.MatchString(hostname) {
+			return "", fmt.Errorf("%w: %q is not a valid hostname", ErrInvalid, r.Hostname)
+		}
+		if !free(hostname) {
+			return "", fmt.Errorf("%w: hostname %s belongs to %s", ErrConflict, hostname, a.hostnames[hostname].ip)
+		}
+		return hostname, nil
+	}
+	if own != nil && own.alloc.IP == ip && own.alloc.Hostname != "" {
+		return own.alloc.Hostname, nil
+	}
+	if pool == nil || pool.HostnameTemplate == "" {
+		return "", nil
+	}
+
+	vars := Vars{IDC: a.idc, Rack: r.Rack, SN: r.SN, Pool: pool.Name}
+	numbered := strings.Contains(pool.HostnameTemplate, "{seq")
+	for seq := 1; seq <= maxSeq; seq++ {
+		hostname, err := Render(pool.HostnameTemplate, vars, seq)
+		if err != nil {
+			return "", fmt.Errorf("%w: hostname template of pool %s: %v", ErrInvalid, pool.Name, err)
+		}
+		if free(hostname) {
+			return hostname, nil
+		}
+		if !numbered {
+			return "", fmt.Errorf("%w: hostname %s belongs to %s", ErrConflict, hostname, a.hostnames[hostname].ip)
+		}
+	}
+	return "", fmt.Errorf("%w: no free hostname left for template %s", ErrExhausted, pool.HostnameTemplate)
+}
+
+func isExcluded(p *models.IPPool, n uint32) bool {
+	for _, ex := range p.Exclude {
+		if x, ok := toUint32(ex); ok && x == n {
+			return true
+		}
+	}
+	return false
+}
+
+// describe says who holds an allocation, for conflict errors
+func describe(a *models.IPAllocation) string {
+	switch {
+	case a.SN == "":
+		return "reserved"
+	case a.TaskID != "":
+		return fmt.Sprintf("allocated to %s (task %s)", a.SN, a.TaskID)
+	default:
+		return "reserved for " + a.SN
+	}
+}
+
+// Commit writes a single claim
+func Commit(client *etcd.Client, c *Claim) error {
+	return client.Transaction(c.Ops, c.Conditions...)
+}
+
+// Release gives up the address of a machine whose task was deleted. A
+// reserved address stays with the machine and only forgets the task.
+// Nothing is written when the machine has a task again by then. It returns
+// the allocation released, or nil when the machine held none.
+func Release(client *etcd.Client, idc, sn string) (*models.IPAllocation, error) {
+	a, err := Load(client, idc)
+	if err != nil {
+		return nil, err
+	}
+	h, ok := a.bySN[sn]
+	if !ok || (h.alloc.Reserved && h.alloc.TaskID == "") {
+		return nil, nil
+	}
+
+	c := &Claim{Allocation: h.alloc}
+	if h.alloc.Reserved {
+		kept := h.alloc
+		kept.TaskID = ""
+		kept.UpdatedAt = time.Now()
+		value, err := json.Marshal(kept)
+		if err != nil {
+			return nil, err
+		}
+		c.put(etcd.IPAllocationKey(idc, h.alloc.IP), string(value), h.rev, h.raw)
+	} else {
+		a.free(c, h)
+	}
+	c.Conditions = append(c.Conditions, clientv3.Compare(clientv3.Version(etcd.TaskKeyV3(idc, sn)), "=", 0))
+	if err := Commit(client, c); err != nil {
+		return nil, err
+	}
+	return &h.alloc, nil
+}
+
+// Free removes the allocation or reservation of ip and its hostname
+func Free(client *etcd.Client, idc, ip string) (*models.IPAllocation, error) {
+	a, err := Load(client, idc)
+	if err != nil {
+		return nil, err
+	}
+	h, ok := a.byIP[ip]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not allocated", etcd.ErrKeyNotFound, ip)
+	}
+	c := &Claim{Allocation: h.alloc}
+	a.free(c, h)
+	if err := Commit(client, c); err != nil {
+		return nil, err
+	}
+	return &h.alloc, nil
+}
+
+// free adds the removal of an allocation and its hostname to c
+func (a *Allocator) free(c *Claim, h *held) {
+	c.remove(etcd.IPAllocationKey(a.idc, h.alloc.IP), h.rev, h.raw)
+	if n, ok := a.hostnames[h.alloc.Hostname]; ok && n.ip == h.alloc.IP {
+		c.remove(etcd.HostnameKey(a.idc, h.alloc.Hostname), n.rev, []byte(n.ip))
+	}
+}
@@ -0,0 +1,352 @@
+// Package ipam hands out install addresses and hostnames from per-IDC
+// pools. A claim is a set of etcd operations guarded by the revisions of
+// the keys it read, committed in the same transaction as the task that
+// needs the address, so two tasks never end up with the same address or
+// name. Addresses the regional client's DHCP server has leased are skipped.
+package ipam
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+var (
+	// ErrUnknownPool is returned for a pool that does not exist
+	ErrUnknownPool = errors.New("unknown IP pool")
+	// ErrNoPool is returned when no pool was named and there is no default
+	ErrNoPool = errors.New("no IP pool")
+	// ErrConflict is returned when an address or hostname is taken
+	ErrConflict = errors.New("address conflict")
+	// ErrExhausted is returned when a pool has no free address left
+	ErrExhausted = errors.New("IP pool exhausted")
+	// ErrInvalid is returned for a malformed address or hostname
+	ErrInvalid = errors.New("invalid address request")
+)
+
+var (
+	namePattern     = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+	hostnamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+	placeholder     = regexp.MustCompile(`\{([a-z]+)(?::([1-9]))?\}`)
+)
+
+// Vars are the values of the hostname template placeholders {idc}, {rack},
+// {sn} and {pool}
+type Vars struct {
+	IDC  string
+	Rack string
+	SN   string
+	Pool string
+}
+
+// Render fills in a hostname template. {seq:N} pads the number to N digits.
+// The result is lower-case and must be a valid hostname.
+func Render(template string, v Vars, seq int) (string, error) {
+	var errs []string
+	name := placeholder.ReplaceAllStringFunc(template, func(m string) string {
+		parts := placeholder.FindStringSubmatch(m)
+		var value string
+		switch parts[1] {
+		case "idc":
+			value = v.IDC
+		case "rack":
+			value = v.Rack
+		case "sn":
+			value = v.SN
+		case "pool":
+			value = v.Pool
+		case "seq":
+			width, _ := strconv.Atoi(parts[2])
+			return fmt.Sprintf("%0*d", width, seq)
+		default:
+			errs = append(errs, "unknown placeholder "+m)
+			return m
+		}
+		if value == "" {
+			errs = append(errs, fmt.Sprintf("%s is empty for this machine", m))
+		}
+		return value
+	})
+	if len(errs) > 0 {
+		return "", errors.New(strings.Join(errs, "; "))
+	}
+	name = strings.ToLower(name)
+	if len(name) > 253 || !hostnamePattern.MatchString(name) {
+		return "", fmt.Errorf("%q is not a valid hostname", name)
+	}
+	return name, nil
+}
+
+// Validate checks a pool before it is stored
+func Validate(p *models.IPPool) error {
+	var errs []string
+	if !namePattern.MatchString(p.Name) {
+		errs = append(errs, "name must be 1-64 letters, digits, '.', '_' or '-'")
+	}
+	if _, _, err := span(p); err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, ip := range p.Exclude {
+		if _, ok := toUint32(ip); !ok {
+			errs = append(errs, fmt.Sprintf("exclude: %q is not an IPv4 address", ip))
+		}
+	}
+	if p.HostnameTemplate != "" {
+		for _, m := range placeholder.FindAllStringSubmatch(p.HostnameTemplate, -1) {
+			switch m[1] {
+			case "idc", "rack", "sn", "pool", "seq":
+			default:
+				errs = append(errs, "hostname_template: unknown placeholder "+m[0])
+			}
+		}
+		sample := Vars{IDC: "idc", Rack: "rack", SN: "sn", Pool: "pool"}
+		if _, err := Render(p.HostnameTemplate, sample, 1); err != nil && len(errs) == 0 {
+			errs = append(errs, "hostname_template: "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// span returns the first and last address a pool hands out. Without Start
+// and End these are the hosts of the CIDR, leaving out the network and
+// broadcast addresses.
+func span(p *models.IPPool) (first, last uint32, err error) {
+	_, network, err := net.ParseCIDR(p.CIDR)
+	if err != nil || network.IP.To4() == nil {
+		return 0, 0, fmt.Errorf("cidr: %q is not an IPv4 CIDR", p.CIDR)
+	}
+	ones, bits := network.Mask.Size()
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	size := uint32(1) << (bits - ones)
+	first, last = base, base+size-1
+	if size > 2 {
+		first, last = first+1, last-1
+	}
+
+	for _, bound := range []struct {
+		name  string
+		value string
+		dst   *uint32
+	}{{"start", p.Start, &first}, {"end", p.End, &last}} {
+		if bound.value == "" {
+			continue
+		}
+		ip, ok := toUint32(bound.value)
+		if !ok || !network.Contains(fromUint32(ip)) {
+			return 0, 0, fmt.Errorf("%s: %q is not an address of %s", bound.name, bound.value, p.CIDR)
+		}
+		*bound.dst = ip
+	}
+	if first > last {
+		return 0, 0, fmt.Errorf("start %s is after end %s", fromUint32(first), fromUint32(last))
+	}
+	return first, last, nil
+}
+
+func toUint32(s string) (uint32, bool) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip), true
+}
+
+func fromUint32(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// held is an allocation and the mod revision of its key, 0 for one claimed
+// but not written yet
+type held struct {
+	alloc models.IPAllocation
+	raw   []byte
+	rev   int64
+}
+
+// hostnameEntry is a claimed hostname and the address it belongs to
+type hostnameEntry struct {
+	ip  string
+	rev int64
+}
+
+// Allocator claims addresses in one IDC against a single read of its IPAM
+// keys. Claims made through the same Allocator see each other, so a batch
+// of tasks can be planned before anything is written.
+type Allocator struct {
+	idc       string
+	pools     map[string]*models.IPPool
+	byIP      map[string]*held
+	bySN      map[string]*held
+	hostnames map[string]hostnameEntry
+	dhcp      *models.DHCPLeases
+	leases    map[string]models.DHCPLease // active dynamic leases by IP
+}
+
+// Load reads the pools, allocations and DHCP leases of an IDC
+func Load(client *etcd.Client, idc string) (*Allocator, error) {
+	prefix := etcd.IPAMPrefix(idc)
+	kvs, _, _, err := client.Range(prefix, clientv3.GetPrefixRangeEnd(prefix), 0, false, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Allocator{
+		idc:       idc,
+		pools:     map[string]*models.IPPool{},
+		byIP:      map[string]*held{},
+		bySN:      map[string]*held{},
+		hostnames: map[string]hostnameEntry{},
+		leases:    map[string]models.DHCPLease{},
+	}
+	now := time.Now()
+	for _, kv := range kvs {
+		rest := strings.TrimPrefix(kv.Key, prefix)
+		switch {
+		case strings.HasPrefix(rest, "pools/"):
+			var p models.IPPool
+			if err := json.Unmarshal(kv.Value, &p); err != nil {
+				return nil, fmt.Errorf("invalid IP pool %s: %w", kv.Key, err)
+			}
+			a.pools[p.Name] = &p
+		case strings.HasPrefix(rest, "ips/"):
+			h := &held{raw: kv.Value, rev: kv.ModRevision}
+			if err := json.Unmarshal(kv.Value, &h.alloc); err != nil {
+				return nil, fmt.Errorf("invalid IP allocation %s: %w", kv.Key, err)
+			}
+			a.byIP[h.alloc.IP] = h
+			if h.alloc.SN != "" {
+				a.bySN[h.alloc.SN] = h
+			}
+		case strings.HasPrefix(rest, "hostnames/"):
+			a.hostnames[strings.TrimPrefix(rest, "hostnames/")] = hostnameEntry{ip: string(kv.Value), rev: kv.ModRevision}
+		case rest == "dhcp_leases":
+			var l models.DHCPLeases
+			if err := json.Unmarshal(kv.Value, &l); err != nil {
+				return nil, fmt.Errorf("invalid DHCP leases %s: %w", kv.Key, err)
+			}
+			a.dhcp = &l
+			for _, lease := range l.Leases {
+				if lease.ExpiresAt.After(now) {
+					a.leases[lease.IP] = lease
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// Active reports whether the IDC has any pool; without one IPAM stays out
+// of task creation
+func (a *Allocator) Active() bool {
+	return len(a.pools) > 0
+}
+
+// Pools returns the pools of the IDC sorted by name
+func (a *Allocator) Pools() []models.IPPool {
+	pools := make([]models.IPPool, 0, len(a.pools))
+	for _, p := range a.pools {
+		pools = append(pools, *p)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	return pools
+}
+
+// Pool returns the pool called name
+func (a *Allocator) Pool(name string) (*models.IPPool, error) {
+	p, ok := a.pools[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q in %s", ErrUnknownPool, name, a.idc)
+	}
+	return p, nil
+}
+
+// Allocations returns the allocations of the IDC ordered by address,
+// optionally only those of one pool or machine
+func (a *Allocator) Allocations(pool, sn string) []models.IPAllocation {
+	var list []models.IPAllocation
+	for _, h := range a.byIP {
+		if (pool == "" || h.alloc.Pool == pool) && (sn == "" || h.alloc.SN == sn) {
+			list = append(list, h.alloc)
+		}
+	}
+	sortByIP(list)
+	return list
+}
+
+// Allocation returns the allocation of an address, or nil when it is free
+func (a *Allocator) Allocation(ip string) *models.IPAllocation {
+	if h, ok := a.byIP[ip]; ok {
+		return &h.alloc
+	}
+	return nil
+}
+
+func sortByIP(list []models.IPAllocation) {
+	sort.Slice(list, func(i, j int) bool {
+		x, _ := toUint32(list[i].IP)
+		y, _ := toUint32(list[j].IP)
+		return x < y
+	})
+}
+
+// poolOf returns the pool handing out ip, or nil
+func (a *Allocator) poolOf(ip uint32) *models.IPPool {
+	for _, p := range a.pools {
+		if first, last, err := span(p); err == nil && ip >= first && ip <= last {
+			return p
+		}
+	}
+	return nil
+}
+
+// defaultPool is the pool marked default, or the only one
+func (a *Allocator) defaultPool() (*models.IPPool, error) {
+	var found *models.IPPool
+	for _, p := range a.pools {
+		if p.Default {
+			if found != nil {
+				return nil, fmt.Errorf("%w: pools %s and %s of %s are both marked default", ErrNoPool, found.Name, p.Name, a.idc)
+			}
+			found = p
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	if len(a.pools) == 1 {
+		for _, p := range a.pools {
+			return p, nil
+		}
+	}
+	if len(a.pools) == 0 {
+		return nil, fmt.Errorf("%w in %s", ErrNoPool, a.idc)
+	}
+	return nil, fmt.Errorf("%w: %s has %d pools and none is the default, name one with ip_pool", ErrNoPool, a.idc, len(a.pools))
+}
+
+// leasedToOther reports whether the DHCP server leased ip to a MAC other
+// than mac
+func (a *Allocator) leasedToOther(ip, mac string) (models.DHCPLease, bool) {
+	lease, ok := a.leases[ip]
+	if !ok || (mac != "" && strings.EqualFold(lease.MAC, mac)) {
+		return lease, false
+	}
+	return lease, true
+}
@@ -0,0 +1,219 @@
+package ipam
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+func newAllocator(pools ...models.IPPool) *Allocator {
+	a := &Allocator{
+		idc:       "dc1",
+		pools:     map[string]*models.IPPool{},
+		byIP:      map[string]*held{},
+		bySN:      map[string]*held{},
+		hostnames: map[string]hostnameEntry{},
+		leases:    map[string]models.DHCPLease{},
+	}
+	for i := range pools {
+		a.pools[pools[i].Name] = &pools[i]
+	}
+	return a
+}
+
+func TestRender(t *testing.T) {
+	v := Vars{IDC: "DC1", Rack: "r07", SN: "SN-1", Pool: "prod"}
+	tests := map[string]struct {
+		template string
+		want     string
+		wantErr  bool
+	}{
+		"all placeholders": {"{idc}-{rack}-{seq:3}", "dc1-r07-042", false},
+		"unpadded seq":     {"node{seq}.{pool}", "node42.prod", false},
+		"sn":               {"{sn}", "sn-1", false},
+		"unknown":          {"{host}-{seq}", "", true},
+		"invalid result":   {"{sn}_x", "", true},
+	}
+	for name, tt := range tests {
+		got, err := Render(tt.template, v, 42)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: Render(%q) = %q, %v", name, tt.template, got, err)
+		}
+	}
+
+	if _, err := Render("{rack}-{seq}", Vars{IDC: "dc1"}, 1); err == nil {
+		t.Error("Render() with an empty rack succeeded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	good := models.IPPool{Name: "prod", CIDR: "10.0.0.0/24", Start: "10.0.0.10", End: "10.0.0.20",
+		Exclude: []string{"10.0.0.15"}, HostnameTemplate: "{idc}-{seq:3}"}
+	if err := Validate(&good); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+
+	bad := map[string]models.IPPool{
+		"name":       {Name: "a b", CIDR: "10.0.0.0/24"},
+		"cidr":       {Name: "p", CIDR: "10.0.0.0"},
+		"ipv6":       {Name: "p", CIDR: "fd00::/64"},
+		"start":      {Name: "p", CIDR: "10.0.0.0/24", Start: "10.0.1.1"},
+		"reversed":   {Name: "p", CIDR: "10.0.0.0/24", Start: "10.0.0.20", End: "10.0.0.10"},
+		"exclude":    {Name: "p", CIDR: "10.0.0.0/24", Exclude: []string{"x"}},
+		"template":   {Name: "p", CIDR: "10.0.0.0/24", HostnameTemplate: "{foo}"},
+		"bad result": {Name: "p", CIDR: "10.0.0.0/24", HostnameTemplate: "a_{seq}"},
+	}
+	for name, p := range bad {
+		if err := Validate(&p); err == nil {
+			t.Errorf("%s: Validate() succeeded", name)
+		}
+	}
+}
+
+func TestSpan(t *testing.T) {
+	tests := map[string]struct {
+		pool        models.IPPool
+		first, last string
+	}{
+		"hosts":  {models.IPPool{CIDR: "10.0.0.0/24"}, "10.0.0.1", "10.0.0.254"},
+		"bounds": {models.IPPool{CIDR: "10.0.0.0/24", Start: "10.0.0.100", End: "10.0.0.110"}, "10.0.0.100", "10.0.0.110"},
+		"/31":    {models.IPPool{CIDR: "10.0.0.0/31"}, "10.0.0.0", "10.0.0.1"},
+	}
+	for name, tt := range tests {
+		first, last, err := span(&tt.pool)
+		if err != nil || fromUint32(first).String() != tt.first || fromUint32(last).String() != tt.last {
+			t.Errorf("%s: span() = %s, %s, %v", name, fromUint32(first), fromUint32(last), err)
+		}
+	}
+}
+
+func TestAssign(t *testing.T) {
+	a := newAllocator(models.IPPool{Name: "prod", CIDR: "10.0.0.0/24", Start: "10.0.0.10", End: "10.0.0.13",
+		Exclude: []string{"10.0.0.11"}, HostnameTemplate: "{idc}-{rack}-{seq:2}"})
+	a.leases["10.0.0.12"] = models.DHCPLease{IP: "10.0.0.12", MAC: "aa:aa:aa:aa:aa:aa", ExpiresAt: time.Now().Add(time.Hour)}
+
+	first, err := a.Assign(Request{SN: "sn-1", TaskID: "task-1", Rack: "r1"})
+	if err != nil {
+		t.Fatalf("Assign() = %v", err)
+	}
+	if got := first.Allocation; got.IP != "10.0.0.10" || got.Hostname != "dc1-r1-01" || got.Pool != "prod" {
+		t.Errorf("first allocation = %+v", got)
+	}
+	if len(first.Ops) != 2 || len(first.Conditions) != 2 {
+		t.Errorf("first claim has %d ops and %d conditions, want 2 and 2", len(first.Ops), len(first.Conditions))
+	}
+
+	// .11 is excluded and .12 leased to another machine
+	second, err := a.Assign(Request{SN: "sn-2", TaskID: "task-2", Rack: "r1"})
+	if err != nil {
+		t.Fatalf("Assign() = %v", err)
+	}
+	if got := second.Allocation; got.IP != "10.0.0.13" || got.Hostname != "dc1-r1-02" {
+		t.Errorf("second allocation = %+v", got)
+	}
+
+	// A machine keeps its address and name on a new task
+	again, err := a.Assign(Request{SN: "sn-1", TaskID: "task-3", Rack: "r1"})
+	if err != nil || again.Allocation.IP != "10.0.0.10" || again.Allocation.Hostname != "dc1-r1-01" {
+		t.Errorf("Assign() for the same machine = %+v, %v", again, err)
+	}
+
+	if _, err := a.Assign(Request{SN: "sn-3"}); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Assign() from a full pool = %v, want ErrExhausted", err)
+	}
+
+	conflicts := map[string]Request{
+		"held":     {SN: "sn-3", IP: "10.0.0.13"},
+		"leased":   {SN: "sn-3", IP: "10.0.0.12", MAC: "bb:bb:bb:bb:bb:bb"},
+		"excluded": {SN: "sn-3", IP: "10.0.0.11"},
+		"hostname": {SN: "sn-3", IP: "10.0.0.50", Hostname: "DC1-R1-02"},
+	}
+	for name, r := range conflicts {
+		if _, err := a.Assign(r); !errors.Is(err, ErrConflict) {
+			t.Errorf("%s: Assign() = %v, want ErrConflict", name, err)
+		}
+	}
+
+	// The lease holder itself may have its leased address
+	own, err := a.Assign(Request{SN: "sn-3", IP: "10.0.0.12", MAC: "AA:AA:AA:AA:AA:AA", Hostname: "Spare"})
+	if err != nil || own.Allocation.Pool != "prod" || own.Allocation.Hostname != "spare" {
+		t.Errorf("Assign() of the lease holder = %+v, %v", own, err)
+	}
+
+	if _, err := a.Assign(Request{SN: "sn-4", Pool: "test"}); !errors.Is(err, ErrUnknownPool) {
+		t.Errorf("Assign() from an unknown pool = %v, want ErrUnknownPool", err)
+	}
+	if _, err := a.Assign(Request{SN: "sn-4", IP: "10.0.0.300"}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Assign() of an invalid address = %v, want ErrInvalid", err)
+	}
+}
+
+func TestDefaultPool(t *testing.T) {
+	a := newAllocator(
+		models.IPPool{Name: "a", CIDR: "10.0.0.0/24"},
+		models.IPPool{Name: "b", CIDR: "10.0.1.0/24"},
+	)
+	if _, err := a.Assign(Request{SN: "sn-1"}); !errors.Is(err, ErrNoPool) {
+		t.Errorf("Assign() without a default pool = %v, want ErrNoPool", err)
+	}
+	a.pools["b"].Default = true
+	c, err := a.Assign(Request{SN: "sn-1"})
+	if err != nil || c.Allocation.IP != "10.0.1.1" {
+		t.Errorf("Assign() from the default pool = %+v, %v", c, err)
+	}
+}
+
+func TestUsageAndConflicts(t *testing.T) {
+	a := newAllocator(models.IPPool{Name: "prod", CIDR: "10.0.0.0/29", Exclude: []string{"10.0.0.6"}})
+	a.dhcp = &models.DHCPLeases{RangeStart: "10.0.0.5", RangeEnd: "10.0.0.20"}
+	if _, err := a.Assign(Request{SN: "sn-1", MAC: "00:00:00:00:00:01"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Assign(Request{IP: "10.0.0.2", Reserve: true}); err != nil {
+		t.Fatal(err)
+	}
+	// Leased after the allocation was made
+	expires := time.Now().Add(time.Hour)
+	a.leases["10.0.0.1"] = models.DHCPLease{IP: "10.0.0.1", MAC: "00:00:00:00:00:99", ExpiresAt: expires}
+	a.leases["10.0.0.5"] = models.DHCPLease{IP: "10.0.0.5", MAC: "00:00:00:00:00:98", ExpiresAt: expires}
+
+	u, err := a.Usage("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PoolUsage{IPPool: *a.pools["prod"], Size: 6, Excluded: 1, Allocated: 2, Reserved: 1, Leased: 1, Free: 2}
+	if !reflect.DeepEqual(*u, want) {
+		t.Errorf("Usage() = %+v, want %+v", *u, want)
+	}
+
+	conflicts := a.Conflicts()
+	if len(conflicts) != 2 || conflicts[0].IP != "10.0.0.1" || conflicts[0].SN != "sn-1" || conflicts[1].IP != "10.0.0.5-10.0.0.6" {
+		t.Errorf("Conflicts() = %+v", conflicts)
+	}
+}
+
+func TestCheckPool(t *testing.T) {
+	a := newAllocator(models.IPPool{Name: "a", CIDR: "10.0.0.0/24", Default: true})
+	if _, err := a.Assign(Request{SN: "sn-1", IP: "10.0.0.200"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		pool models.IPPool
+		ok   bool
+	}{
+		"separate":       {models.IPPool{Name: "b", CIDR: "10.0.1.0/24"}, true},
+		"overlap":        {models.IPPool{Name: "b", CIDR: "10.0.0.128/25"}, false},
+		"second default": {models.IPPool{Name: "b", CIDR: "10.0.1.0/24", Default: true}, false},
+		"stranded":       {models.IPPool{Name: "a", CIDR: "10.0.0.0/24", End: "10.0.0.100"}, false},
+		"shrunk":         {models.IPPool{Name: "a", CIDR: "10.0.0.0/24", Start: "10.0.0.150"}, true},
+	}
+	for name, tt := range tests {
+		if err := a.CheckPool(&tt.pool); (err == nil) != tt.ok {
+			t.Errorf("%s: CheckPool() = %v", name, err)
+		}
+	}
+}
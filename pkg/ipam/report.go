@@ -0,0 +1,127 @@
+package ipam
+
+import (
+	"fmt"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// PoolUsage counts the addresses of a pool
+type PoolUsage struct {
+	models.IPPool
+	Size      int `json:"size"`      // addresses between start and end
+	Excluded  int `json:"excluded"`  // of those, never handed out
+	Allocated int `json:"allocated"` // held by machines or reserved
+	Reserved  int `json:"reserved"`  // of those, reserved by operators
+	Leased    int `json:"leased"`    // not allocated but leased by the DHCP server
+	Free      int `json:"free"`
+}
+
+// Usage counts the addresses of the pool called name
+func (a *Allocator) Usage(name string) (*PoolUsage, error) {
+	p, err := a.Pool(name)
+	if err != nil {
+		return nil, err
+	}
+	first, last, err := span(p)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", p.Name, err)
+	}
+
+	u := &PoolUsage{IPPool: *p, Size: int(last - first + 1)}
+	for _, ex := range p.Exclude {
+		if n, ok := toUint32(ex); ok && n >= first && n <= last {
+			u.Excluded++
+		}
+	}
+	for ip, h := range a.byIP {
+		if n, ok := toUint32(ip); ok && n >= first && n <= last {
+			u.Allocated++
+			if h.alloc.Reserved {
+				u.Reserved++
+			}
+		}
+	}
+	for ip := range a.leases {
+		_, allocated := a.byIP[ip]
+		if n, ok := toUint32(ip); ok && n >= first && n <= last && !allocated && !isExcluded(p, n) {
+			u.Leased++
+		}
+	}
+	u.Free = u.Size - u.Excluded - u.Allocated - u.Leased
+	return u, nil
+}
+
+// Conflict is an address IPAM and the DHCP server could both hand out
+type Conflict struct {
+	IP       string `json:"ip"` // an address, or a range for an overlapping pool
+	Pool     string `json:"pool,omitempty"`
+	SN       string `json:"sn,omitempty"`
+	LeaseMAC string `json:"lease_mac,omitempty"`
+	Message  string `json:"message"`
+}
+
+// Conflicts lists the allocations the DHCP server has leased to another
+// MAC, and the pools overlapping its dynamic range. Allocation already
+// skips leased addresses; these are the clashes left over from before the
+// lease, or waiting to happen.
+func (a *Allocator) Conflicts() []Conflict {
+	var conflicts []Conflict
+	for _, alloc := range a.Allocations("", "") {
+		if lease, leased := a.leasedToOther(alloc.IP, alloc.MAC); leased {
+			conflicts = append(conflicts, Conflict{IP: alloc.IP, Pool: alloc.Pool, SN: alloc.SN, LeaseMAC: lease.MAC,
+				Message: fmt.Sprintf("%s is %s but leased by DHCP to %s", alloc.IP, describe(&alloc), lease.MAC)})
+		}
+	}
+
+	if a.dhcp == nil {
+		return conflicts
+	}
+	start, okStart := toUint32(a.dhcp.RangeStart)
+	end, okEnd := toUint32(a.dhcp.RangeEnd)
+	if !okStart || !okEnd {
+		return conflicts
+	}
+	for _, p := range a.Pools() {
+		first, last, err := span(&p)
+		if err != nil || last < start || first > end {
+			continue
+		}
+		from, to := max(first, start), min(last, end)
+		conflicts = append(conflicts, Conflict{IP: fmt.Sprintf("%s-%s", fromUint32(from), fromUint32(to)), Pool: p.Name,
+			Message: fmt.Sprintf("pool %s overlaps the DHCP range %s-%s", p.Name, a.dhcp.RangeStart, a.dhcp.RangeEnd)})
+	}
+	return conflicts
+}
+
+// CheckPool checks a new or changed pool against the others of the IDC: it
+// may not overlap them, only one may be the default, and a changed range
+// must still hold every address allocated from it
+func (a *Allocator) CheckPool(p *models.IPPool) error {
+	first, last, err := span(p)
+	if err != nil {
+		return err
+	}
+	for _, other := range a.pools {
+		if other.Name == p.Name {
+			continue
+		}
+		if f, l, err := span(other); err == nil && first <= l && f <= last {
+			return fmt.Errorf("%w: pool %s overlaps pool %s", ErrConflict, p.Name, other.Name)
+		}
+		if p.Default && other.Default {
+			return fmt.Errorf("%w: pool %s is already the default", ErrConflict, other.Name)
+		}
+	}
+
+	stranded := 0
+	for _, alloc := range a.Allocations(p.Name, "") {
+		if n, _ := toUint32(alloc.IP); n < first || n > last {
+			stranded++
+		}
+	}
+	if stranded > 0 {
+		return fmt.Errorf("%w: %d allocated addresses of pool %s fall outside the new range", ErrConflict, stranded, p.Name)
+	}
+	return nil
+}
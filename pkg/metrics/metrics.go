@@ -0,0 +1,426 @@
+// Package metrics exposes counters, gauges and histograms in the Prometheus
+// text format. Metrics are declared as package variables next to the code
+// they measure and registered in Default, which Handler serves.
+//
+// Label values are given in the order the labels were declared:
+//
+//	var packets = metrics.NewCounter("lpmos_dhcp_packets_total", "DHCP packets received", "type")
+//	packets.With("discover").Inc()
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefBuckets suit request latencies in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DurationBuckets suit installation steps, from seconds to hours
+var DurationBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+
+// Sample is one value of a function-backed metric
+type Sample struct {
+	Labels []string // values in label order
+	Value  float64
+}
+
+// Collector writes the current state of a metric family
+type Collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds collectors, listed by name on exposition
+type Registry struct {
+	mu         sync.RWMutex
+	collectors map[string]Collector
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]Collector)}
+}
+
+// Default is the registry package-level constructors register in
+var Default = NewRegistry()
+
+// Register adds c; a second collector with the same name panics
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.collectors[c.name()]; ok {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	r.collectors[c.name()] = c
+}
+
+// Write writes every metric in the text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.RLock()
+	collectors := make([]Collector, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		collectors = append(collectors, c)
+	}
+	r.mu.RUnlock()
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name() < collectors[j].name() })
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry for Prometheus to scrape
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// Handler serves the default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// ListenAndServe serves the default registry at path on its own listener
+func ListenAndServe(addr, path string) error {
+	mux := http.NewServeMux()
+	mux.Handle(path, Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// Serve exposes the default registry when monitoring is enabled: at path
+// on router, or on its own listener when port is set. It takes the
+// monitoring settings as values because config depends on this package.
+func Serve(enabled bool, port int, path string, router gin.IRoutes) {
+	if !enabled {
+		return
+	}
+	if port == 0 {
+		router.GET(path, gin.WrapH(Handler()))
+		log.Printf("Prometheus metrics served at %s on the API port", path)
+		return
+	}
+
+	addr := fmt.Sprintf(":%d", port)
+	go func() {
+		log.Printf("Prometheus metrics listening on %s%s", addr, path)
+		if err := ListenAndServe(addr, path); err != nil {
+			log.Printf("Metrics listener stopped: %v", err)
+		}
+	}()
+}
+
+// desc describes a metric family
+type desc struct {
+	fqName string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) name() string { return d.fqName }
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.fqName, escapeHelp(d.help), d.fqName, d.kind)
+}
+
+// sample writes one line; extra is a pre-rendered label such as le="0.5"
+func (d *desc) sample(w *bufio.Writer, suffix string, values []string, extra string, v float64) {
+	w.WriteString(d.fqName)
+	w.WriteString(suffix)
+	if len(values) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, l := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, l, escapeLabel(values[i]))
+		}
+		if extra != "" {
+			if len(values) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func (d *desc) check(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.fqName, len(d.labels), len(values)))
+	}
+}
+
+// vec keeps the series of a metric family by label values
+type vec[T any] struct {
+	desc
+	mu     sync.RWMutex
+	series map[string]*entry[T]
+	newFn  func() *T
+}
+
+type entry[T any] struct {
+	values []string
+	metric *T
+}
+
+func (v *vec[T]) with(values []string) *T {
+	v.check(values)
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	e, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return e.metric
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if e, ok := v.series[key]; ok {
+		return e.metric
+	}
+	e = &entry[T]{values: append([]string(nil), values...), metric: v.newFn()}
+	v.series[key] = e
+	return e.metric
+}
+
+// sorted returns the series ordered by label values
+func (v *vec[T]) sorted() []*entry[T] {
+	v.mu.RLock()
+	entries := make([]*entry[T], 0, len(v.series))
+	for _, e := range v.series {
+		entries = append(entries, e)
+	}
+	v.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.Join(entries[i].values, "\xff") < strings.Join(entries[j].values, "\xff")
+	})
+	return entries
+}
+
+func newVec[T any](name, help, kind string, labels []string, newFn func() *T) vec[T] {
+	return vec[T]{
+		desc:   desc{fqName: name, help: help, kind: kind, labels: labels},
+		series: make(map[string]*entry[T]),
+		newFn:  newFn,
+	}
+}
+
+// value is a float64 safe for concurrent use
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) add(d float64) {
+	v.mu.Lock()
+	v.v += d
+	v.mu.Unlock()
+}
+
+func (v *value) set(x float64) {
+	v.mu.Lock()
+	v.v = x
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+// Counter only goes up
+type Counter struct{ v value }
+
+// Inc adds one
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add adds d, which must not be negative
+func (c *Counter) Add(d float64) {
+	if d < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.v.add(d)
+}
+
+// CounterVec is a counter family
+type CounterVec struct{ vec[Counter] }
+
+// NewCounter declares a counter family in the default registry
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	Default.Register(c)
+	return c
+}
+
+// With returns the counter for the label values
+func (c *CounterVec) With(values ...string) *Counter { return c.with(values) }
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.header(w)
+	for _, e := range c.sorted() {
+		c.sample(w, "", e.values, "", e.metric.v.get())
+	}
+}
+
+// Gauge goes up and down
+type Gauge struct{ v value }
+
+// Set replaces the value
+func (g *Gauge) Set(x float64) { g.v.set(x) }
+
+// Add adds d, which may be negative
+func (g *Gauge) Add(d float64) { g.v.add(d) }
+
+// Inc adds one
+func (g *Gauge) Inc() { g.v.add(1) }
+
+// Dec subtracts one
+func (g *Gauge) Dec() { g.v.add(-1) }
+
+// GaugeVec is a gauge family
+type GaugeVec struct{ vec[Gauge] }
+
+// NewGauge declares a gauge family in the default registry
+func NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	Default.Register(g)
+	return g
+}
+
+// With returns the gauge for the label values
+func (g *GaugeVec) With(values ...string) *Gauge { return g.with(values) }
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.header(w)
+	for _, e := range g.sorted() {
+		g.sample(w, "", e.values, "", e.metric.v.get())
+	}
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// HistogramVec is a histogram family
+type HistogramVec struct{ vec[Histogram] }
+
+// NewHistogram declares a histogram family with the given upper bucket
+// bounds in the default registry
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	h := &HistogramVec{newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+	})}
+	Default.Register(h)
+	return h
+}
+
+// With returns the histogram for the label values
+func (h *HistogramVec) With(values ...string) *Histogram { return h.with(values) }
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.header(w)
+	for _, e := range h.sorted() {
+		m := e.metric
+		m.mu.Lock()
+		var cumulative uint64
+		for i, bound := range m.bounds {
+			cumulative += m.counts[i]
+			h.sample(w, "_bucket", e.values, `le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		h.sample(w, "_bucket", e.values, `le="+Inf"`, float64(m.count))
+		h.sample(w, "_sum", e.values, "", m.sum)
+		h.sample(w, "_count", e.values, "", float64(m.count))
+		m.mu.Unlock()
+	}
+}
+
+// funcCollector reads its samples when scraped
+type funcCollector struct {
+	desc
+	fn func() []Sample
+}
+
+func (f *funcCollector) write(w *bufio.Writer) {
+	f.header(w)
+	samples := f.fn()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+	for _, s := range samples {
+		if len(s.Labels) != len(f.labels) {
+			continue
+		}
+		f.sample(w, "", s.Labels, "", s.Value)
+	}
+}
+
+// NewGaugeFunc declares a gauge family in the default registry whose
+// samples fn returns at scrape time
+func NewGaugeFunc(name, help string, labels []string, fn func() []Sample) {
+	Default.Register(&funcCollector{desc{fqName: name, help: help, kind: "gauge", labels: labels}, fn})
+}
+
+// NewCounterFunc is NewGaugeFunc for values that only go up
+func NewCounterFunc(name, help string, labels []string, fn func() []Sample) {
+	Default.Register(&funcCollector{desc{fqName: name, help: help, kind: "counter", labels: labels}, fn})
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// expose writes a single collector the way the registry does
+func expose(c Collector) string {
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	c.write(w)
+	w.Flush()
+	return b.String()
+}
+
+func TestCounter(t *testing.T) {
+	c := &CounterVec{newVec("test_requests_total", "Requests\nserved", "counter", []string{"code"}, func() *Counter { return &Counter{} })}
+	c.With("500").Inc()
+	c.With("200").Add(2)
+	c.With("200").Inc()
+
+	want := `# HELP test_requests_total Requests\nserved
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 3
+test_requests_total{code="500"} 1
+`
+	if got := expose(c); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("wrong label count did not panic")
+		}
+	}()
+	c.With("200", "extra")
+}
+
+func TestHistogram(t *testing.T) {
+	h := &HistogramVec{newVec("test_seconds", "Latency", "histogram", nil, func() *Histogram {
+		return &Histogram{bounds: []float64{0.1, 1}, counts: make([]uint64, 2)}
+	})}
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.With().Observe(v)
+	}
+
+	want := `# HELP test_seconds Latency
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 3.65
+test_seconds_count 4
+`
+	if got := expose(h); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFuncCollectorAndHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Register(&funcCollector{desc{fqName: "test_pool", help: "Pool", kind: "gauge", labels: []string{"idc"}}, func() []Sample {
+		return []Sample{
+			{Labels: []string{`dc"2`}, Value: 0.5},
+			{Labels: []string{"dc1"}, Value: 1},
+			{Labels: nil, Value: 9}, // wrong arity, skipped
+		}
+	}})
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	want := `# HELP test_pool Pool
+# TYPE test_pool gauge
+test_pool{idc="dc\"2"} 0.5
+test_pool{idc="dc1"} 1
+`
+	if rec.Body.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", rec.Body.String(), want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicate registration did not panic")
+		}
+	}()
+	r.Register(&funcCollector{desc{fqName: "test_pool"}, nil})
+}
+
+func TestServe(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	Serve(false, 0, "/metrics", router)
+	if len(router.Routes()) != 0 {
+		t.Fatalf("disabled monitoring mounted %v", router.Routes())
+	}
+
+	Serve(true, 0, "/custom-metrics", router)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/custom-metrics", nil))
+	if rec.Code != 200 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("GET /custom-metrics = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
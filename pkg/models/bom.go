@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// BOMProfile is the hardware a server is expected to ship with, stored at
+// /os/global/bom_profiles/{name}. A task uses the profile it names, or else
+// the profile listing its SKU. Zero fields are not checked.
+type BOMProfile struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	SKUs        []string `json:"skus,omitempty"`
+
+	CPUModel   string    `json:"cpu_model,omitempty"` // case-insensitive substring of the reported model
+	CPUCores   int       `json:"cpu_cores,omitempty"`
+	DIMMCount  int       `json:"dimm_count,omitempty"` // populated slots
+	DIMMSizeGB int       `json:"dimm_size_gb,omitempty"`
+	Disks      []BOMDisk `json:"disks,omitempty"`
+	NICCount   int       `json:"nic_count,omitempty"`
+
+	// How far disk sizes and total memory may be from the expected value,
+	// in percent; vendors round capacities differently
+	SizeTolerancePct int `json:"size_tolerance_pct,omitempty"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+}
+
+// BOMDisk expects Count disks of a type and size. Groups should not overlap:
+// every reported disk must fit exactly one.
+type BOMDisk struct {
+	Type   string `json:"type,omitempty"` // SSD, HDD, NVMe; any when empty
+	SizeGB int    `json:"size_gb,omitempty"`
+	Count  int    `json:"count"`
+}
+
+// BOMMismatch is one expectation the reported hardware does not meet
+type BOMMismatch struct {
+	Field    string      `json:"field"` // e.g. cpu.cores, memory.dimm_count, disks[NVMe 960GB]
+	Expected interface{} `json:"expected"`
+	Actual   interface{} `json:"actual"`
+	Message  string      `json:"message"`
+}
+
+// BOMCheck is the acceptance check of the hardware an attempt reported.
+// A failed check blocks approval until an approver accepts the mismatch.
+type BOMCheck struct {
+	Profile    string        `json:"profile"`
+	Passed     bool          `json:"passed"`
+	Mismatches []BOMMismatch `json:"mismatches,omitempty"`
+	CheckedAt  time.Time     `json:"checked_at"`
+	WaivedBy   string        `json:"waived_by,omitempty"`
+	WaivedAt   *time.Time    `json:"waived_at,omitempty"`
+}
+
+// Blocking reports whether the check stops the task from being approved
+func (c *BOMCheck) Blocking() bool {
+	return c != nil && !c.Passed && c.WaivedBy == ""
+}
@@ -0,0 +1,76 @@
+package models
+
+import "time"
+
+// IPPool is a range of install addresses of an IDC and how the machines
+// given one are named, stored at /os/ipam/{idc}/pools/{name}. An IDC without
+// pools keeps the addresses and hostnames of task requests unchecked.
+type IPPool struct {
+	IDC         string `json:"idc"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	CIDR    string   `json:"cidr"`            // e.g. 10.20.0.0/24
+	Start   string   `json:"start,omitempty"` // first address handed out; the first host when empty
+	End     string   `json:"end,omitempty"`   // last address handed out; the last host when empty
+	Exclude []string `json:"exclude,omitempty"`
+
+	// HostnameTemplate names machines without a hostname, e.g.
+	// {idc}-{rack}-{seq:3}. {seq} is the lowest number giving a free name.
+	HostnameTemplate string `json:"hostname_template,omitempty"`
+
+	// Default marks the pool used for tasks naming none; an IDC with a
+	// single pool uses it either way
+	Default bool `json:"default,omitempty"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+}
+
+// IPAllocation is an address held by a machine or reserved by an operator,
+// stored at /os/ipam/{idc}/ips/{ip}. A reserved address outlives the tasks
+// of its machine; one without SN is kept out of allocation altogether.
+type IPAllocation struct {
+	IP       string `json:"ip"`
+	IDC      string `json:"idc"`
+	Pool     string `json:"pool,omitempty"` // empty for addresses outside every pool
+	SN       string `json:"sn,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	TaskID   string `json:"task_id,omitempty"` // the task that last claimed it
+	Reserved bool   `json:"reserved,omitempty"`
+	Note     string `json:"note,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// IPReservationRequest reserves an address: the one given, or the next free
+// one of Pool (the default pool when empty)
+type IPReservationRequest struct {
+	IP       string `json:"ip,omitempty"`
+	Pool     string `json:"pool,omitempty"`
+	SN       string `json:"sn,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Note     string `json:"note,omitempty"`
+}
+
+// DHCPLease is a dynamic lease handed out by a regional client
+type DHCPLease struct {
+	IP        string    `json:"ip"`
+	MAC       string    `json:"mac"`
+	Hostname  string    `json:"hostname,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DHCPLeases is what a regional client publishes at
+// /os/ipam/{idc}/dhcp_leases: its dynamic range and active leases. The key
+// expires when the regional client stops refreshing it.
+type DHCPLeases struct {
+	RangeStart string      `json:"range_start"`
+	RangeEnd   string      `json:"range_end"`
+	Leases     []DHCPLease `json:"leases"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+}
@@ -0,0 +1,247 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MachineState is where a machine is in its life in the data center,
+// independent of any installation task
+type MachineState string
+
+const (
+	MachineStateDiscovered MachineState = "discovered" // seen, not yet checked
+	MachineStateReady      MachineState = "ready"      // free for installation
+	MachineStateAllocated  MachineState = "allocated"  // an installation task owns it
+	MachineStateDeployed   MachineState = "deployed"   // installed and in service
+	MachineStateBroken     MachineState = "broken"     // needs repair
+	MachineStateRetired    MachineState = "retired"    // decommissioned
+)
+
+// machineTransitions is the machine lifecycle; a missing entry is refused
+var machineTransitions = map[MachineState][]MachineState{
+	MachineStateDiscovered: {MachineStateReady, MachineStateAllocated, MachineStateBroken, MachineStateRetired},
+	MachineStateReady:      {MachineStateAllocated, MachineStateBroken, MachineStateRetired},
+	MachineStateAllocated:  {MachineStateDeployed, MachineStateReady, MachineStateBroken, MachineStateRetired},
+	MachineStateDeployed:   {MachineStateAllocated, MachineStateReady, MachineStateBroken, MachineStateRetired},
+	MachineStateBroken:     {MachineStateReady, MachineStateRetired},
+	MachineStateRetired:    {},
+}
+
+// ValidMachineState reports whether s is a known machine state
+func ValidMachineState(s MachineState) bool {
+	_, ok := machineTransitions[s]
+	return ok
+}
+
+// Installable reports whether a new installation may start on a machine in
+// state s
+func (s MachineState) Installable() bool {
+	return s != MachineStateBroken && s != MachineStateRetired
+}
+
+// MachineTransitionError is returned when the machine lifecycle refuses a
+// state change. It matches ErrInvalidTransition.
+type MachineTransitionError struct {
+	SN   string
+	From MachineState
+	To   MachineState
+}
+
+func (e *MachineTransitionError) Error() string {
+	return fmt.Sprintf("cannot move machine %s from %s to %s", e.SN, e.From, e.To)
+}
+
+// Is makes errors.Is(err, ErrInvalidTransition) succeed
+func (e *MachineTransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+// MachineStateChange records one lifecycle change of a machine
+type MachineStateChange struct {
+	State     MachineState `json:"state"`
+	Timestamp time.Time    `json:"timestamp"`
+	Reason    string       `json:"reason,omitempty"`
+	By        string       `json:"by,omitempty"`
+}
+
+// Machine is a physical server in the inventory, stored at
+// /os/inventory/{idc}/{sn}. It outlives installation tasks: the task of a
+// machine is /os/{idc}/machines/{sn}/task, and CurrentTaskID names the
+// attempt that last allocated it.
+type Machine struct {
+	IDC      string            `json:"idc"`
+	SN       string            `json:"sn"`
+	MAC      string            `json:"mac,omitempty"`
+	Hostname string            `json:"hostname,omitempty"`
+	Rack     string            `json:"rack,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Note     string            `json:"note,omitempty"`
+
+	State        MachineState         `json:"state"`
+	StateHistory []MachineStateChange `json:"state_history,omitempty"` // the last MachineHistoryLimit changes
+
+	// Latest reported hardware; earlier versions are kept under
+	// /os/{idc}/machines/{sn}/hardware/
+	Hardware          *HardwareInfo `json:"hardware,omitempty"`
+	HardwareUpdatedAt *time.Time    `json:"hardware_updated_at,omitempty"`
+
+	CurrentTaskID string `json:"current_task_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+// MachineHistoryLimit is how many state changes a machine keeps
+const MachineHistoryLimit = 50
+
+// NewMachine returns a machine in state, created by actor
+func NewMachine(idc, sn string, state MachineState, actor, reason string) *Machine {
+	now := time.Now()
+	return &Machine{
+		IDC:          idc,
+		SN:           sn,
+		State:        state,
+		StateHistory: []MachineStateChange{{State: state, Timestamp: now, Reason: reason, By: actor}},
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		CreatedBy:    actor,
+	}
+}
+
+// TransitionTo moves the machine to state and records the change. Moving
+// to the current state is a no-op.
+func (m *Machine) TransitionTo(to MachineState, reason, actor string) error {
+	if m.State == to {
+		return nil
+	}
+	allowed := false
+	for _, s := range machineTransitions[m.State] {
+		allowed = allowed || s == to
+	}
+	if !allowed {
+		return &MachineTransitionError{SN: m.SN, From: m.State, To: to}
+	}
+
+	now := time.Now()
+	m.State = to
+	m.StateHistory = append(m.StateHistory, MachineStateChange{State: to, Timestamp: now, Reason: reason, By: actor})
+	if n := len(m.StateHistory); n > MachineHistoryLimit {
+		m.StateHistory = append([]MachineStateChange(nil), m.StateHistory[n-MachineHistoryLimit:]...)
+	}
+	m.UpdatedAt = now
+	return nil
+}
+
+// HardwareRecord is one version of a machine's reported hardware
+type HardwareRecord struct {
+	ReportedAt time.Time    `json:"reported_at"`
+	Source     string       `json:"source,omitempty"` // agent, operator
+	TaskID     string       `json:"task_id,omitempty"`
+	Hardware   HardwareInfo `json:"hardware"`
+
+	// Drift is what changed since the previous version; nil for the first
+	// version or when only fields outside the drift check changed
+	Drift *HardwareDrift `json:"drift,omitempty"`
+}
+
+// HardwareDrift lists the parts that appeared or disappeared between two
+// hardware reports of a machine, and a changed BIOS version
+type HardwareDrift struct {
+	DisksAdded   []DiskInfo    `json:"disks_added,omitempty"`
+	DisksRemoved []DiskInfo    `json:"disks_removed,omitempty"`
+	DIMMsAdded   []DIMMInfo    `json:"dimms_added,omitempty"`
+	DIMMsRemoved []DIMMInfo    `json:"dimms_removed,omitempty"`
+	NICsAdded    []NetworkInfo `json:"nics_added,omitempty"`
+	NICsRemoved  []NetworkInfo `json:"nics_removed,omitempty"`
+	BIOS         *BIOSChange   `json:"bios,omitempty"`
+}
+
+// BIOSChange is a BIOS version change
+type BIOSChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Empty reports whether nothing drifted
+func (d *HardwareDrift) Empty() bool {
+	return d == nil || len(d.DisksAdded)+len(d.DisksRemoved)+len(d.DIMMsAdded)+len(d.DIMMsRemoved)+
+		len(d.NICsAdded)+len(d.NICsRemoved) == 0 && d.BIOS == nil
+}
+
+// Summary describes the drift in one line, e.g. "1 disk removed (/dev/sdb),
+// BIOS 2.1 -> 2.3"
+func (d *HardwareDrift) Summary() string {
+	if d.Empty() {
+		return "no drift"
+	}
+	var parts []string
+	list := func(verb, noun string, names []string) {
+		if len(names) == 0 {
+			return
+		}
+		if len(names) > 1 {
+			noun += "s"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s %s (%s)", len(names), noun, verb, strings.Join(names, ", ")))
+	}
+
+	list("removed", "disk", diskNames(d.DisksRemoved))
+	list("added", "disk", diskNames(d.DisksAdded))
+	list("removed", "DIMM", dimmNames(d.DIMMsRemoved))
+	list("added", "DIMM", dimmNames(d.DIMMsAdded))
+	list("removed", "NIC", nicNames(d.NICsRemoved))
+	list("added", "NIC", nicNames(d.NICsAdded))
+	if d.BIOS != nil {
+		parts = append(parts, fmt.Sprintf("BIOS %s -> %s", d.BIOS.From, d.BIOS.To))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func diskNames(disks []DiskInfo) []string {
+	names := make([]string, len(disks))
+	for i, d := range disks {
+		names[i] = d.Device
+	}
+	return names
+}
+
+func dimmNames(dimms []DIMMInfo) []string {
+	names := make([]string, len(dimms))
+	for i, d := range dimms {
+		names[i] = d.Slot
+	}
+	return names
+}
+
+func nicNames(nics []NetworkInfo) []string {
+	names := make([]string, len(nics))
+	for i, n := range nics {
+		names[i] = n.Interface
+		if n.MAC != "" {
+			names[i] += " " + n.MAC
+		}
+	}
+	return names
+}
+
+// MachineRequest creates a machine or updates its descriptive fields. On
+// update, IDC, SN and State are ignored and empty fields are left alone.
+type MachineRequest struct {
+	IDC      string            `json:"idc"`
+	SN       string            `json:"sn"`
+	MAC      string            `json:"mac,omitempty"`
+	Hostname string            `json:"hostname,omitempty"`
+	Rack     string            `json:"rack,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Note     string            `json:"note,omitempty"`
+	State    MachineState      `json:"state,omitempty"` // initial state, ready by default
+}
+
+// MachineStateRequest moves a machine to another lifecycle state
+type MachineStateRequest struct {
+	State  MachineState `json:"state" binding:"required"`
+	Reason string       `json:"reason"`
+}
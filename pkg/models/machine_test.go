@@ -0,0 +1,99 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMachineTransitionTo(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    MachineState
+		to      MachineState
+		wantErr bool
+	}{
+		{"check discovered", MachineStateDiscovered, MachineStateReady, false},
+		{"allocate ready", MachineStateReady, MachineStateAllocated, false},
+		{"deploy allocated", MachineStateAllocated, MachineStateDeployed, false},
+		{"release allocated", MachineStateAllocated, MachineStateReady, false},
+		{"reinstall deployed", MachineStateDeployed, MachineStateAllocated, false},
+		{"deploy without task", MachineStateReady, MachineStateDeployed, true},
+		{"repair broken", MachineStateBroken, MachineStateReady, false},
+		{"allocate broken", MachineStateBroken, MachineStateAllocated, true},
+		{"revive retired", MachineStateRetired, MachineStateReady, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMachine("dc1", "SN1", tt.from, "tester", "")
+			err := m.TransitionTo(tt.to, "test", "tester")
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTransition) {
+					t.Fatalf("TransitionTo() error = %v, want ErrInvalidTransition", err)
+				}
+				if m.State != tt.from || len(m.StateHistory) != 1 {
+					t.Errorf("refused transition changed the machine: %s, %d history entries", m.State, len(m.StateHistory))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TransitionTo() error = %v", err)
+			}
+			last := m.StateHistory[len(m.StateHistory)-1]
+			if m.State != tt.to || last.State != tt.to || last.By != "tester" {
+				t.Errorf("State = %s, last change = %+v", m.State, last)
+			}
+		})
+	}
+
+	// Staying in a state is not recorded
+	m := NewMachine("dc1", "SN1", MachineStateReady, "tester", "")
+	if err := m.TransitionTo(MachineStateReady, "again", "tester"); err != nil || len(m.StateHistory) != 1 {
+		t.Errorf("same state: err = %v, %d history entries", err, len(m.StateHistory))
+	}
+}
+
+func TestMachineHistoryLimit(t *testing.T) {
+	m := NewMachine("dc1", "SN1", MachineStateReady, "tester", "")
+	for i := 0; i < MachineHistoryLimit; i++ {
+		to := MachineStateAllocated
+		if m.State == to {
+			to = MachineStateReady
+		}
+		if err := m.TransitionTo(to, "", "tester"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.StateHistory) != MachineHistoryLimit || m.StateHistory[len(m.StateHistory)-1].State != m.State {
+		t.Errorf("%d history entries, last %+v", len(m.StateHistory), m.StateHistory[len(m.StateHistory)-1])
+	}
+}
+
+func TestMachineStateTableCoversAllStates(t *testing.T) {
+	for _, s := range []MachineState{
+		MachineStateDiscovered, MachineStateReady, MachineStateAllocated,
+		MachineStateDeployed, MachineStateBroken, MachineStateRetired,
+	} {
+		if !ValidMachineState(s) {
+			t.Errorf("state %s missing from transition table", s)
+		}
+	}
+	if ValidMachineState("lost") {
+		t.Error("unknown state accepted")
+	}
+}
+
+func TestHardwareDriftSummary(t *testing.T) {
+	var none *HardwareDrift
+	if !none.Empty() || !(&HardwareDrift{}).Empty() {
+		t.Error("no drift is not empty")
+	}
+	d := &HardwareDrift{
+		DisksRemoved: []DiskInfo{{Device: "/dev/sdb"}, {Device: "/dev/sdc"}},
+		NICsAdded:    []NetworkInfo{{Interface: "eth2", MAC: "aa:bb"}},
+		BIOS:         &BIOSChange{From: "2.1", To: "2.3"},
+	}
+	want := "2 disks removed (/dev/sdb, /dev/sdc), 1 NIC added (eth2 aa:bb), BIOS 2.1 -> 2.3"
+	if d.Empty() || d.Summary() != want {
+		t.Errorf("Summary() = %q, want %q", d.Summary(), want)
+	}
+}
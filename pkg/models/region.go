@@ -0,0 +1,74 @@
+package models
+
+import "time"
+
+// Region status values
+const (
+	RegionOnline  = "online"
+	RegionOffline = "offline"
+)
+
+// RegionInfo is what a regional client registers under /os/region/{idc}/info.
+// It stays after the client stops, which is how an IDC is known to exist.
+type RegionInfo struct {
+	IDC         string     `json:"idc"`
+	ServerIP    string     `json:"server_ip"`
+	APIPort     string     `json:"api_port"`
+	DHCPEnabled bool       `json:"dhcp_enabled"`
+	TFTPEnabled bool       `json:"tftp_enabled"`
+	StartedAt   time.Time  `json:"started_at"`
+	StoppedAt   *time.Time `json:"stopped_at,omitempty"`
+	Status      string     `json:"status"` // as last reported by the client
+}
+
+// RegionHeartbeat is stored under /os/region/{idc}/heartbeat with a lease;
+// the key disappears when the regional client stops renewing it
+type RegionHeartbeat struct {
+	Status      string    `json:"status"`
+	LastUpdated time.Time `json:"last_updated"`
+	LeaseID     int64     `json:"lease_id"`
+}
+
+// Region is the health of a regional client as served by GET /api/v1/regions
+type Region struct {
+	ID            string     `json:"id"`
+	Status        string     `json:"status"` // online while the heartbeat lease is alive
+	ServerIP      string     `json:"server_ip"`
+	APIPort       string     `json:"api_port"`
+	DHCPEnabled   bool       `json:"dhcp_enabled"`
+	TFTPEnabled   bool       `json:"tftp_enabled"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	StoppedAt     *time.Time `json:"stopped_at,omitempty"`
+	UptimeSeconds int64      `json:"uptime_seconds"` // 0 while offline
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+}
+
+// NewRegion merges the registration and heartbeat of a regional client.
+// heartbeat is nil when the lease has expired; the info status alone does
+// not count as online because a crashed client never marks itself offline.
+func NewRegion(idc string, info RegionInfo, heartbeat *RegionHeartbeat, now time.Time) Region {
+	region := Region{
+		ID:          idc,
+		Status:      RegionOffline,
+		ServerIP:    info.ServerIP,
+		APIPort:     info.APIPort,
+		DHCPEnabled: info.DHCPEnabled,
+		TFTPEnabled: info.TFTPEnabled,
+		StoppedAt:   info.StoppedAt,
+	}
+	if !info.StartedAt.IsZero() {
+		startedAt := info.StartedAt
+		region.StartedAt = &startedAt
+	}
+
+	if heartbeat != nil {
+		region.Status = RegionOnline
+		region.StoppedAt = nil
+		lastHeartbeat := heartbeat.LastUpdated
+		region.LastHeartbeat = &lastHeartbeat
+		if region.StartedAt != nil && now.After(*region.StartedAt) {
+			region.UptimeSeconds = int64(now.Sub(*region.StartedAt) / time.Second)
+		}
+	}
+	return region
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewRegion(t *testing.T) {
+	started := time.Date(2026, 5, 1, 10, 0, 0, 0, time.UTC)
+	now := started.Add(90 * time.Minute)
+	info := RegionInfo{IDC: "dc1", ServerIP: "10.0.0.1", DHCPEnabled: true, StartedAt: started, Status: RegionOnline}
+
+	online := NewRegion("dc1", info, &RegionHeartbeat{Status: RegionOnline, LastUpdated: now}, now)
+	if online.Status != RegionOnline || online.UptimeSeconds != 5400 || !online.DHCPEnabled || online.LastHeartbeat == nil {
+		t.Errorf("online region = %+v", online)
+	}
+
+	// A crashed client still says online in its info; the missing lease wins
+	crashed := NewRegion("dc1", info, nil, now)
+	if crashed.Status != RegionOffline || crashed.UptimeSeconds != 0 || crashed.StartedAt == nil {
+		t.Errorf("crashed region = %+v", crashed)
+	}
+}
@@ -0,0 +1,292 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidTransition matches every TransitionError via errors.Is
+var ErrInvalidTransition = errors.New("invalid task status transition")
+
+// TransitionError is returned when the state machine refuses a status change.
+// API handlers map it to 409 Conflict.
+type TransitionError struct {
+	From   TaskStatus
+	To     TaskStatus
+	Reason string // set when a guard refused an otherwise legal transition
+}
+
+func (e *TransitionError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("cannot move task from %s to %s: %s", e.From, e.To, e.Reason)
+	}
+	return fmt.Sprintf("cannot move task from %s to %s", e.From, e.To)
+}
+
+// Is makes errors.Is(err, ErrInvalidTransition) succeed
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+// TransitionGuard vetoes a transition by returning a non-empty reason
+type TransitionGuard func(task *TaskV3) string
+
+// taskTransitions is the task lifecycle. A nil guard means the transition is
+// always allowed; a missing entry means it never is.
+var taskTransitions = map[TaskStatus]map[TaskStatus]TransitionGuard{
+	TaskStatusPending: {
+		TaskStatusReady:           nil,
+		TaskStatusBooting:         nil,
+		TaskStatusPendingApproval: nil,
+		TaskStatusApproved:        requireApproval,
+		TaskStatusFailed:          nil,
+		TaskStatusCancelled:       nil,
+	},
+	TaskStatusReady: {
+		TaskStatusBooting:         nil,
+		TaskStatusPendingApproval: nil,
+		TaskStatusApproved:        requireApproval,
+		TaskStatusFailed:          nil,
+		TaskStatusCancelled:       nil,
+	},
+	TaskStatusBooting: {
+		TaskStatusPendingApproval: nil,
+		TaskStatusApproved:        requireApproval,
+		TaskStatusFailed:          nil,
+		TaskStatusCancelled:       nil,
+	},
+	TaskStatusPendingApproval: {
+		TaskStatusApproved:  requireApproval,
+		TaskStatusFailed:    nil,
+		TaskStatusCancelled: nil,
+	},
+	TaskStatusApproved: {
+		TaskStatusPendingApproval: nil, // the hardware failed its BOM check
+		TaskStatusInstalling:      nil,
+		TaskStatusCompleted:       nil, // kickstart installs may finish without progress reports
+		TaskStatusFailed:          forbidRejection,
+		TaskStatusCancelled:       nil,
+	},
+	TaskStatusInstalling: {
+		TaskStatusCompleted: nil,
+		TaskStatusFailed:    forbidRejection,
+		TaskStatusCancelled: nil,
+	},
+	// Retry and reinstall start a new attempt: straight back to approved when
+	// the approval still stands, otherwise through approval again
+	TaskStatusCompleted: {
+		TaskStatusPending: nil,
+	},
+	TaskStatusFailed: {
+		TaskStatusPending:  nil,
+		TaskStatusApproved: requireApproval,
+	},
+	TaskStatusCancelled: {
+		TaskStatusPending:  nil,
+		TaskStatusApproved: requireApproval,
+	},
+}
+
+// requireApproval only lets a task reach approved with a granted approval
+// and hardware that passed its BOM check, or whose mismatch was accepted
+func requireApproval(task *TaskV3) string {
+	if task.Approval == nil || task.Approval.Status != ApprovalStatusApproved {
+		return "approval has not been granted"
+	}
+	if task.BOMCheck.Blocking() {
+		return fmt.Sprintf("hardware does not match BOM profile %s", task.BOMCheck.Profile)
+	}
+	return ""
+}
+
+// forbidRejection stops an already approved task from being rejected;
+// it may still fail for operational reasons
+func forbidRejection(task *TaskV3) string {
+	if task.Approval != nil && task.Approval.Status == ApprovalStatusRejected {
+		return "task was already approved"
+	}
+	return ""
+}
+
+// CanTransition reports whether the table allows from -> to, ignoring guards
+func CanTransition(from, to TaskStatus) bool {
+	_, ok := taskTransitions[from][to]
+	return ok
+}
+
+// IsFinished reports whether the current attempt of a task has ended.
+// Only retry or reinstall move a task out of these states.
+func IsFinished(status TaskStatus) bool {
+	switch status {
+	case TaskStatusCompleted, TaskStatusFailed, TaskStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// CheckTransition validates moving task to status without changing it
+func (t *TaskV3) CheckTransition(to TaskStatus) error {
+	guard, ok := taskTransitions[t.Status][to]
+	if !ok {
+		return &TransitionError{From: t.Status, To: to}
+	}
+	if guard != nil {
+		if reason := guard(t); reason != "" {
+			return &TransitionError{From: t.Status, To: to, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// TransitionTo moves the task to status and records it in StatusHistory.
+// It is the only place task status should change after creation.
+func (t *TaskV3) TransitionTo(to TaskStatus, reason string) error {
+	if err := t.CheckTransition(to); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	t.Status = to
+	t.StatusHistory = append(t.StatusHistory, StatusChange{
+		Status:    to,
+		Timestamp: now,
+		Reason:    reason,
+	})
+	t.UpdatedAt = now
+	return nil
+}
+
+// Archive returns a copy of the task marked as a finished attempt, ready to be
+// stored under its attempts key
+func (t *TaskV3) Archive(reason string) *TaskV3 {
+	now := time.Now()
+	archived := *t
+	archived.ArchivedAt = &now
+	archived.ArchiveReason = reason
+	return &archived
+}
+
+// StartNewAttempt archives the finished attempt and resets the task for
+// another installation under newTaskID. The caller stores the returned
+// archive and transitions the task afterwards. PXEConfigured is left alone:
+// the regional client owns it and cleans up or regenerates the boot config
+// when it sees the new status.
+func (t *TaskV3) StartNewAttempt(newTaskID, reason string) (*TaskV3, error) {
+	if !IsFinished(t.Status) {
+		return nil, &TransitionError{From: t.Status, To: TaskStatusPending, Reason: "current attempt is still running"}
+	}
+
+	if t.Attempt == 0 {
+		t.Attempt = 1 // tasks created before attempts were tracked
+	}
+	archived := t.Archive(reason)
+
+	now := time.Now()
+	t.Attempt++
+	t.PreviousTaskID = t.TaskID
+	t.TaskID = newTaskID
+	t.StatusHistory = []StatusChange{}
+	t.Log, t.LogSeq, t.LastProgress, t.StepStarted = nil, 0, nil, nil
+	t.Progress, t.Logs = nil, nil
+	t.Error = nil
+	t.BOMCheck = nil
+	t.HardwareReportedAt = nil
+	t.CreatedAt = now
+	t.UpdatedAt = now
+	return archived, nil
+}
+
+// StatusSince is when the task last entered its current status, or its
+// last update when the history does not say
+func (t *TaskV3) StatusSince() time.Time {
+	for i := len(t.StatusHistory) - 1; i >= 0; i-- {
+		if t.StatusHistory[i].Status == t.Status {
+			return t.StatusHistory[i].Timestamp
+		}
+	}
+	return t.UpdatedAt
+}
+
+// AwaitingApproval reports whether the task waits for an approval decision:
+// held in pending_approval, or not yet installing with its approval pending
+func (t *TaskV3) AwaitingApproval() bool {
+	switch t.Status {
+	case TaskStatusPendingApproval:
+		return true
+	case TaskStatusPending, TaskStatusReady, TaskStatusBooting:
+		return t.Approval == nil || t.Approval.Status == ApprovalStatusPending
+	}
+	return false
+}
+
+// ApprovalWaitSince is when the task started waiting for approval: when it
+// entered pending_approval, otherwise its first hardware report or, before
+// one, its creation
+func (t *TaskV3) ApprovalWaitSince() time.Time {
+	switch {
+	case t.Status == TaskStatusPendingApproval:
+		return t.StatusSince()
+	case t.HardwareReportedAt != nil:
+		return *t.HardwareReportedAt
+	}
+	return t.CreatedAt
+}
+
+// TaskLogTail is how many recent log entries the task value keeps
+const TaskLogTail = 20
+
+// AddLog appends a log line to the attempt
+func (t *TaskV3) AddLog(line string) {
+	t.appendLog(TaskLogEntry{Time: time.Now(), Line: line})
+}
+
+// AddProgress appends a progress step to the attempt
+func (t *TaskV3) AddProgress(step ProgressStep) {
+	if step.Timestamp.IsZero() {
+		step.Timestamp = time.Now()
+	}
+	if t.LastProgress == nil || t.LastProgress.Step != step.Step {
+		started := step.Timestamp
+		t.StepStarted = &started
+	}
+	t.LastProgress = &step
+	t.appendLog(TaskLogEntry{Time: step.Timestamp, Progress: &step})
+}
+
+func (t *TaskV3) appendLog(e TaskLogEntry) {
+	t.LogSeq++
+	e.Seq = t.LogSeq
+	tail := append(t.Log[:len(t.Log):len(t.Log)], e) // never write into a copy's array
+	if len(tail) > TaskLogTail {
+		tail = tail[len(tail)-TaskLogTail:]
+	}
+	t.Log = tail
+}
+
+// LatestProgress is the last progress step reported, including tasks
+// written before LastProgress existed
+func (t *TaskV3) LatestProgress() *ProgressStep {
+	if t.LastProgress != nil {
+		return t.LastProgress
+	}
+	if n := len(t.Progress); n > 0 {
+		return &t.Progress[n-1]
+	}
+	return nil
+}
+
+// LegacyLogEntries converts the Progress and Logs of a task written before
+// logs had their own keys. Their order relative to each other is unknown, so
+// progress steps come first.
+func (t *TaskV3) LegacyLogEntries() []TaskLogEntry {
+	var entries []TaskLogEntry
+	for i := range t.Progress {
+		step := t.Progress[i]
+		entries = append(entries, TaskLogEntry{Seq: int64(len(entries) + 1), Time: step.Timestamp, Progress: &step})
+	}
+	for _, line := range t.Logs {
+		entries = append(entries, TaskLogEntry{Seq: int64(len(entries) + 1), Time: t.UpdatedAt, Line: line})
+	}
+	return entries
+}
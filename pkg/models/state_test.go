@@ -0,0 +1,204 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTransitionTo(t *testing.T) {
+	approved := &Approval{Status: ApprovalStatusApproved}
+	rejected := &Approval{Status: ApprovalStatusRejected}
+
+	tests := []struct {
+		name     string
+		from     TaskStatus
+		approval *Approval
+		to       TaskStatus
+		wantErr  bool
+	}{
+		{"approve pending", TaskStatusPending, approved, TaskStatusApproved, false},
+		{"approve without approval", TaskStatusPending, nil, TaskStatusApproved, true},
+		{"reject pending", TaskStatusPending, rejected, TaskStatusFailed, false},
+		{"reject installing", TaskStatusInstalling, rejected, TaskStatusFailed, true},
+		{"agent lost while installing", TaskStatusInstalling, approved, TaskStatusFailed, false},
+		{"start install", TaskStatusApproved, approved, TaskStatusInstalling, false},
+		{"BOM check revokes approval", TaskStatusApproved, approved, TaskStatusPendingApproval, false},
+		{"install before approval", TaskStatusPending, nil, TaskStatusInstalling, true},
+		{"progress after completion", TaskStatusCompleted, approved, TaskStatusInstalling, true},
+		{"cancel installing", TaskStatusInstalling, approved, TaskStatusCancelled, false},
+		{"retry failed", TaskStatusFailed, approved, TaskStatusApproved, false},
+		{"retry rejected", TaskStatusFailed, rejected, TaskStatusApproved, true},
+		{"cancel completed", TaskStatusCompleted, approved, TaskStatusCancelled, true},
+		{"same state", TaskStatusApproved, approved, TaskStatusApproved, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := &TaskV3{Status: tt.from, Approval: tt.approval}
+			err := task.TransitionTo(tt.to, "test")
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTransition) {
+					t.Fatalf("TransitionTo() error = %v, want ErrInvalidTransition", err)
+				}
+				if task.Status != tt.from || len(task.StatusHistory) != 0 {
+					t.Errorf("refused transition changed the task: %s, %d history entries", task.Status, len(task.StatusHistory))
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("TransitionTo() error = %v", err)
+			}
+			if task.Status != tt.to {
+				t.Errorf("Status = %s, want %s", task.Status, tt.to)
+			}
+			if n := len(task.StatusHistory); n != 1 || task.StatusHistory[0].Status != tt.to || task.StatusHistory[0].Reason != "test" {
+				t.Errorf("StatusHistory = %+v", task.StatusHistory)
+			}
+		})
+	}
+}
+
+func TestTransitionTableCoversAllStatuses(t *testing.T) {
+	all := []TaskStatus{
+		TaskStatusPending, TaskStatusReady, TaskStatusBooting, TaskStatusPendingApproval,
+		TaskStatusApproved, TaskStatusInstalling, TaskStatusCompleted, TaskStatusFailed,
+		TaskStatusCancelled,
+	}
+	for _, s := range all {
+		if _, ok := taskTransitions[s]; !ok {
+			t.Errorf("status %s missing from transition table", s)
+		}
+	}
+}
+
+func TestStartNewAttempt(t *testing.T) {
+	task := &TaskV3{
+		TaskID:   "task-1",
+		Status:   TaskStatusFailed,
+		OSType:   "ubuntu",
+		Progress: []ProgressStep{{Step: "partition", Percent: 30}},
+		Logs:     []string{"[ERROR] disk not found"},
+		Approval: &Approval{Status: ApprovalStatusApproved},
+	}
+	task.AddProgress(ProgressStep{Step: "partition", Percent: 40})
+	task.AddLog("[ERROR] still no disk")
+
+	archived, err := task.StartNewAttempt("task-2", "retry")
+	if err != nil {
+		t.Fatalf("StartNewAttempt() error = %v", err)
+	}
+	if archived.TaskID != "task-1" || archived.Attempt != 1 || archived.Status != TaskStatusFailed ||
+		len(archived.Progress) != 1 || archived.LogSeq != 2 || archived.ArchivedAt == nil || archived.ArchiveReason != "retry" {
+		t.Errorf("archived attempt = %+v", archived)
+	}
+	if task.TaskID != "task-2" || task.PreviousTaskID != "task-1" || task.Attempt != 2 {
+		t.Errorf("new attempt = %s (prev %s) #%d", task.TaskID, task.PreviousTaskID, task.Attempt)
+	}
+	if len(task.Progress) != 0 || len(task.Logs) != 0 || len(task.StatusHistory) != 0 ||
+		len(task.Log) != 0 || task.LogSeq != 0 || task.LastProgress != nil {
+		t.Error("task was not reset for the new attempt")
+	}
+	if err := task.TransitionTo(TaskStatusApproved, "retry"); err != nil {
+		t.Errorf("TransitionTo(approved) after retry: %v", err)
+	}
+
+	if _, err := task.StartNewAttempt("task-3", "retry"); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("StartNewAttempt() on a running attempt error = %v", err)
+	}
+}
+
+func TestTaskLog(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	task := &TaskV3{TaskID: "task-1"}
+	task.AddProgress(ProgressStep{Step: "partition", Percent: 10, Timestamp: t0})
+	task.AddProgress(ProgressStep{Step: "partition", Percent: 50, Timestamp: t0.Add(time.Minute)})
+	if task.LastProgress.Percent != 50 || !task.StepStarted.Equal(t0) {
+		t.Errorf("last progress %+v started %v", task.LastProgress, task.StepStarted)
+	}
+	task.AddProgress(ProgressStep{Step: "packages", Timestamp: t0.Add(2 * time.Minute)})
+	if !task.StepStarted.Equal(t0.Add(2 * time.Minute)) {
+		t.Errorf("new step started %v", task.StepStarted)
+	}
+
+	snapshot := *task
+	for i := 0; i < TaskLogTail+5; i++ {
+		task.AddLog(fmt.Sprintf("line %d", i))
+	}
+	if task.LogSeq != TaskLogTail+8 || len(task.Log) != TaskLogTail {
+		t.Fatalf("LogSeq %d with %d entries kept", task.LogSeq, len(task.Log))
+	}
+	if first := task.Log[0]; first.Seq != 9 || first.Line != "line 5" {
+		t.Errorf("oldest kept entry %+v", first)
+	}
+	if len(snapshot.Log) != 3 || snapshot.Log[2].Progress == nil {
+		t.Errorf("appending changed a copy: %+v", snapshot.Log)
+	}
+}
+
+func TestLatestProgress(t *testing.T) {
+	legacy := &TaskV3{Progress: []ProgressStep{{Step: "partition"}, {Step: "packages"}}}
+	if p := legacy.LatestProgress(); p == nil || p.Step != "packages" {
+		t.Errorf("legacy LatestProgress() = %+v", p)
+	}
+	if entries := legacy.LegacyLogEntries(); len(entries) != 2 || entries[1].Seq != 2 || entries[1].Progress.Step != "packages" {
+		t.Errorf("LegacyLogEntries() = %+v", entries)
+	}
+	if p := (&TaskV3{}).LatestProgress(); p != nil {
+		t.Errorf("LatestProgress() of a new task = %+v", p)
+	}
+}
+
+func TestStatusSince(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	task := &TaskV3{
+		Status: TaskStatusApproved,
+		StatusHistory: []StatusChange{
+			{Status: TaskStatusPending, Timestamp: t0},
+			{Status: TaskStatusApproved, Timestamp: t0.Add(time.Minute)},
+			{Status: TaskStatusFailed, Timestamp: t0.Add(2 * time.Minute)},
+			{Status: TaskStatusApproved, Timestamp: t0.Add(3 * time.Minute)},
+		},
+		UpdatedAt: t0.Add(time.Hour),
+	}
+	if got := task.StatusSince(); !got.Equal(t0.Add(3 * time.Minute)) {
+		t.Errorf("StatusSince() = %v, want the last entry into approved", got)
+	}
+	task.Status = TaskStatusInstalling
+	if got := task.StatusSince(); !got.Equal(task.UpdatedAt) {
+		t.Errorf("StatusSince() without history = %v, want UpdatedAt", got)
+	}
+}
+
+func TestAwaitingApproval(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	task := &TaskV3{Status: TaskStatusBooting, CreatedAt: t0}
+	if !task.AwaitingApproval() || !task.ApprovalWaitSince().Equal(t0) {
+		t.Errorf("new task: AwaitingApproval() = %v, since %v", task.AwaitingApproval(), task.ApprovalWaitSince())
+	}
+
+	reported := t0.Add(time.Minute)
+	task.HardwareReportedAt = &reported
+	if !task.ApprovalWaitSince().Equal(reported) {
+		t.Errorf("ApprovalWaitSince() after the hardware report = %v", task.ApprovalWaitSince())
+	}
+
+	task.Status = TaskStatusPendingApproval
+	task.StatusHistory = []StatusChange{{Status: TaskStatusPendingApproval, Timestamp: t0.Add(2 * time.Minute)}}
+	if !task.AwaitingApproval() || !task.ApprovalWaitSince().Equal(t0.Add(2*time.Minute)) {
+		t.Errorf("held task: AwaitingApproval() = %v, since %v", task.AwaitingApproval(), task.ApprovalWaitSince())
+	}
+
+	task.Status = TaskStatusBooting
+	task.Approval = &Approval{Status: ApprovalStatusApproved}
+	if task.AwaitingApproval() {
+		t.Error("approved task is awaiting approval")
+	}
+	task.Approval, task.Status = nil, TaskStatusInstalling
+	if task.AwaitingApproval() {
+		t.Error("installing task is awaiting approval")
+	}
+}
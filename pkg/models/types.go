@@ -14,6 +14,7 @@ const (
 	TaskStatusInstalling      TaskStatus = "installing"
 	TaskStatusCompleted       TaskStatus = "completed"
 	TaskStatusFailed          TaskStatus = "failed"
+	TaskStatusCancelled       TaskStatus = "cancelled"
 )
 
 // ApprovalStatus represents the approval state
@@ -117,6 +118,13 @@ type TaskError struct {
 	OccurredAt time.Time `json:"occurred_at"`
 }
 
+// TaskError codes set by the control plane watchdog
+const (
+	ErrorCodeBootTimeout    = "boot_timeout"    // approved, but the agent never reported
+	ErrorCodeStepTimeout    = "step_timeout"    // a progress step ran past its deadline
+	ErrorCodeInstallTimeout = "install_timeout" // the installation ran past its deadline
+)
+
 // Progress represents installation progress information
 type Progress struct {
 	TaskID     string                 `json:"task_id"`
@@ -153,6 +161,9 @@ type ApprovalRequest struct {
 	Approved bool   `json:"approved"`
 	Notes    string `json:"notes"`
 	Reason   string `json:"reason"` // For rejection
+
+	// Approve although the hardware failed its BOM check
+	AcceptBOMMismatch bool `json:"accept_bom_mismatch,omitempty"`
 }
 
 // AgentReportRequest represents hardware report from agent
@@ -216,6 +227,15 @@ type ProgressStep struct {
 	Message   string    `json:"message,omitempty"`
 }
 
+// TaskLogEntry is one log line or progress step of an installation
+// attempt, numbered from 1 in the order they were appended
+type TaskLogEntry struct {
+	Seq      int64         `json:"seq"`
+	Time     time.Time     `json:"time"`
+	Line     string        `json:"line,omitempty"`
+	Progress *ProgressStep `json:"progress,omitempty"`
+}
+
 // StatusChange tracks status transitions (v3.0)
 type StatusChange struct {
 	Status    TaskStatus `json:"status"`
@@ -236,6 +256,7 @@ type ServerEntry struct {
 // This combines the old separate "tasks" and "state" keys into a single atomic structure
 type TaskV3 struct {
 	TaskID    string     `json:"task_id"`
+	IDC       string     `json:"idc,omitempty"` // Older tasks lack it; readers fill it in from the key
 	SN        string     `json:"sn"`         // Serial number
 	MAC       string     `json:"mac"`        // MAC address (for compatibility)
 	IP        string     `json:"ip"`         // IP address for PXE boot
@@ -249,25 +270,61 @@ type TaskV3 struct {
 	Status        TaskStatus      `json:"status"`
 	StatusHistory []StatusChange  `json:"status_history,omitempty"`
 
-	// Progress steps with details
-	Progress []ProgressStep `json:"progress"`
+	// The most recent log lines and progress steps of the attempt, at most
+	// TaskLogTail. Every entry is also stored under its own key,
+	// /os/{idc}/machines/{sn}/logs/{task_id}/{seq}, which is the full log.
+	Log          []TaskLogEntry `json:"log,omitempty"`
+	LogSeq       int64          `json:"log_seq,omitempty"` // entries appended this attempt
+	LastProgress *ProgressStep  `json:"last_progress,omitempty"`
+	StepStarted  *time.Time     `json:"step_started,omitempty"` // first report of LastProgress.Step
 
-	// Logs array
-	Logs []string `json:"logs"`
+	// Deprecated: tasks written before logs moved to their own keys carry
+	// their whole history here. Nothing appends to them any more.
+	Progress []ProgressStep `json:"progress,omitempty"`
+	Logs     []string       `json:"logs,omitempty"`
 
 	// Approval info (embedded)
 	Approval *Approval `json:"approval,omitempty"`
 
+	// First hardware report of the attempt, when the task starts waiting
+	// for its approval
+	HardwareReportedAt *time.Time `json:"hardware_reported_at,omitempty"`
+
+	// Why the attempt failed, when the failure has a structured cause
+	Error *TaskError `json:"error,omitempty"`
+
+	// Hardware acceptance: the BOM profile to check the agent report
+	// against (by name, or by SKU) and the result for this attempt
+	BOMProfile string    `json:"bom_profile,omitempty"`
+	SKU        string    `json:"sku,omitempty"`
+	BOMCheck   *BOMCheck `json:"bom_check,omitempty"`
+
 	// PXE configuration flag
 	PXEConfigured bool `json:"pxe_configured,omitempty"`
 
+	// Installation attempt. Finished attempts are archived under
+	// /os/{idc}/machines/{sn}/attempts/{task_id} when the next one starts.
+	Attempt        int        `json:"attempt,omitempty"`
+	PreviousTaskID string     `json:"previous_task_id,omitempty"`
+	ArchivedAt     *time.Time `json:"archived_at,omitempty"`
+	ArchiveReason  string     `json:"archive_reason,omitempty"`
+
 	// Metadata
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	CreatedBy string    `json:"created_by,omitempty"`
 }
 
+// TaskActionRequest is the optional body of cancel, retry and reinstall
+type TaskActionRequest struct {
+	Reason    string `json:"reason"`
+	OSType    string `json:"os_type,omitempty"`    // reinstall only
+	OSVersion string `json:"os_version,omitempty"` // reinstall only
+}
+
 // IDCStats represents statistics for an IDC (stored in /os/global/stats/{idc}) (v3.0)
+// The control plane keeps them live from task events; Pending, Installing,
+// Completed and Failed mirror ByStatus for older clients.
 type IDCStats struct {
 	IDC           string    `json:"idc"`
 	TotalMachines int       `json:"total_machines"`
@@ -276,6 +333,10 @@ type IDCStats struct {
 	Completed     int       `json:"completed"`
 	Failed        int       `json:"failed"`
 	LastUpdated   time.Time `json:"last_updated"`
+
+	ByStatus       map[TaskStatus]int `json:"by_status"`
+	ByOS           map[string]int     `json:"by_os"`
+	LastReconciled time.Time          `json:"last_reconciled"`
 }
 
 // CreateTaskRequestV3 represents the request to create a task (v3.0)
@@ -283,11 +344,16 @@ type CreateTaskRequestV3 struct {
 	IDC         string            `json:"idc" binding:"required"`
 	SN          string            `json:"sn" binding:"required"`
 	MAC         string            `json:"mac"`                          // Optional, for compatibility
+	IP          string            `json:"ip,omitempty"`                 // Optional, static install address; IPAM allocates one when empty
+	Hostname    string            `json:"hostname,omitempty"`           // Optional; IPAM names the machine when empty
 	OSType      string            `json:"os_type" binding:"required"`
 	OSVersion   string            `json:"os_version" binding:"required"`
 	DiskLayout  string            `json:"disk_layout"`
 	NetworkConf string            `json:"network_config"`
 	Tags        map[string]string `json:"tags"`
+	BOMProfile  string            `json:"bom_profile,omitempty"` // Optional, checked against the agent report
+	SKU         string            `json:"sku,omitempty"`         // Optional, selects a BOM profile by SKU
+	IPPool      string            `json:"ip_pool,omitempty"`     // Optional, IPAM pool for an address when ip is empty
 }
 
 // AgentReportRequestV3 represents hardware report from agent (v3.0)
@@ -297,6 +363,33 @@ type AgentReportRequestV3 struct {
 	Hardware HardwareInfo `json:"hardware" binding:"required"`
 }
 
+// UnmatchedReport is a hardware report no task matched, kept at
+// /os/unmatched_reports/{idc}/{mac} until an operator adopts or deletes it
+type UnmatchedReport struct {
+	IDC        string       `json:"idc,omitempty"`
+	SN         string       `json:"sn"`
+	MAC        string       `json:"mac_address"`
+	Hardware   HardwareInfo `json:"hardware"`
+	Reason     string       `json:"reason,omitempty"`      // why no task matched
+	ReportedAt time.Time    `json:"reported_at,omitempty"` // latest report
+}
+
+// AdoptReportRequest turns an unmatched report into a task, or only a
+// servers directory entry when As is "server". SN defaults to the reported
+// one; OSType and OSVersion are required for a task.
+type AdoptReportRequest struct {
+	As          string            `json:"as,omitempty"` // task (default) or server
+	SN          string            `json:"sn,omitempty"`
+	IP          string            `json:"ip,omitempty"`
+	Hostname    string            `json:"hostname,omitempty"`
+	OSType      string            `json:"os_type,omitempty"`
+	OSVersion   string            `json:"os_version,omitempty"`
+	DiskLayout  string            `json:"disk_layout,omitempty"`
+	NetworkConf string            `json:"network_config,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Note        string            `json:"note,omitempty"` // servers directory note
+}
+
 // AgentProgressRequestV3 represents progress update from agent (v3.0)
 type AgentProgressRequestV3 struct {
 	SN         string                 `json:"sn" binding:"required"`
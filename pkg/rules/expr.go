@@ -0,0 +1,611 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Expr is a compiled rule condition. Conditions read the hardware report and
+// the task through dotted paths and combine comparisons with boolean logic:
+//
+//	hardware.bios.vendor == 'Dell Inc.' && hardware.memory.total_gb >= 128
+//	len(hardware.disks) >= 2 || hardware.disks[0].type == 'NVMe'
+//	lower(hardware.cpu.model) contains 'xeon' and task.os_type in ['ubuntu', 'rocky']
+//	not (hardware.system.serial =~ '^TEST-')
+//	hardware.disks.type contains 'NVMe' and sum(hardware.disks.size_gb) >= 4000
+//
+// A field of a list is the list of that field of its elements, so
+// hardware.disks.type lists the type of every disk; len, sum, max and min
+// reduce such a list. Comparison operators are == != < <= > >= =~ (regular expression),
+// contains (substring or list element) and in (list membership). Boolean
+// operators are && || ! and their spellings and, or, not. A path that does
+// not exist is null, so a rule about a missing field simply does not match.
+type Expr struct {
+	source string
+	root   node
+}
+
+// Roots are the names an approval condition may start a path with
+var Roots = []string{"hardware", "task"}
+
+// String returns the condition as written
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Match evaluates the condition against env, whose keys are the roots
+func (e *Expr) Match(env map[string]interface{}) bool {
+	return truthy(e.root.eval(env))
+}
+
+// Eval returns the value of the expression against env: a string, float64,
+// bool, list, object or nil
+func (e *Expr) Eval(env map[string]interface{}) interface{} {
+	return e.root.eval(env)
+}
+
+// Compile parses an approval condition
+func Compile(source string) (*Expr, error) {
+	return CompileWith(source, Roots...)
+}
+
+// CompileWith parses an expression whose paths start with one of roots
+func CompileWith(source string, roots ...string) (*Expr, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, roots: roots}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+// ===== Lexer =====
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string // operator or identifier; the unquoted value of a string
+	pos  int
+}
+
+// operators, longest first so "<=" wins over "<"
+var operators = []string{"==", "!=", "<=", ">=", "=~", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			tokens = append(tokens, token{kind: tokString, text: b.String(), pos: i})
+			i = j + 1
+
+		case isDigit(c) || (c == '-' && i+1 < len(s) && isDigit(s[i+1])):
+			j := i + 1
+			for j < len(s) && (isDigit(s[j]) || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: s[i:j], pos: i})
+			i = j
+
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(s) && (isIdentStart(s[j]) || isDigit(s[j])) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: s[i:j], pos: i})
+			i = j
+
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, text: "end of condition", pos: len(s)}), nil
+}
+
+func isDigit(c byte) bool      { return c >= '0' && c <= '9' }
+func isIdentStart(c byte) bool { return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+
+// ===== Parser =====
+
+type parser struct {
+	tokens []token
+	pos    int
+	roots  []string
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is one of the given operators or
+// keywords
+func (p *parser) accept(texts ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp && t.kind != tokIdent {
+		return "", false
+	}
+	for _, text := range texts {
+		if t.text == text {
+			p.pos++
+			return text, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if t := p.next(); t.kind != tokOp || t.text != op {
+		return fmt.Errorf("expected %q at offset %d, found %q", op, t.pos, t.text)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||", "or"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logical{and: false, left: left, right: right}
+	}
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logical{and: true, left: left, right: right}
+	}
+}
+
+func (p *parser) parseNot() (node, error) {
+	if _, ok := p.accept("!", "not"); ok {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &negation{x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "=~", "contains", "in")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &comparison{op: op, left: left, right: right}
+	if op == "=~" {
+		lit, ok := right.(*literal)
+		pattern, isString := lit.valueOrNil().(string)
+		if !ok || !isString {
+			return nil, fmt.Errorf("=~ needs a string pattern")
+		}
+		if c.re, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+		}
+	}
+	if _, isList := right.(*list); op == "in" && !isList {
+		return nil, fmt.Errorf("in needs a list such as ['a', 'b']")
+	}
+	return c, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return &literal{value: t.text}, nil
+
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at offset %d", t.text, t.pos)
+		}
+		return &literal{value: f}, nil
+
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			l := &list{}
+			if _, ok := p.accept("]"); ok {
+				return l, nil
+			}
+			for {
+				item, err := p.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				l.items = append(l.items, item)
+				if _, ok := p.accept(","); !ok {
+					return l, p.expect("]")
+				}
+			}
+		}
+
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literal{value: true}, nil
+		case "false":
+			return &literal{value: false}, nil
+		case "null":
+			return &literal{value: nil}, nil
+		case "len", "lower", "sum", "max", "min":
+			if p.peek().text == "(" {
+				p.next()
+				arg, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				return &call{fn: t.text, arg: arg}, p.expect(")")
+			}
+		}
+		return p.parsePath(t)
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+func (p *parser) parsePath(root token) (node, error) {
+	known := false
+	for _, r := range p.roots {
+		known = known || r == root.text
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown name %q at offset %d (paths start with %s)", root.text, root.pos, strings.Join(p.roots, " or "))
+	}
+
+	path := &path{steps: []interface{}{root.text}}
+	for {
+		if _, ok := p.accept("."); ok {
+			t := p.next()
+			if t.kind != tokIdent {
+				return nil, fmt.Errorf("expected a field name at offset %d", t.pos)
+			}
+			path.steps = append(path.steps, t.text)
+			continue
+		}
+		if _, ok := p.accept("["); ok {
+			t := p.next()
+			n, err := strconv.Atoi(t.text)
+			if t.kind != tokNumber || err != nil || n < 0 {
+				return nil, fmt.Errorf("expected an index at offset %d", t.pos)
+			}
+			path.steps = append(path.steps, n)
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return path, nil
+	}
+}
+
+// ===== Evaluation =====
+
+type node interface {
+	eval(env map[string]interface{}) interface{}
+}
+
+type literal struct{ value interface{} }
+
+func (l *literal) eval(map[string]interface{}) interface{} { return l.value }
+
+// valueOrNil tolerates a nil literal so callers can type-assert in one step
+func (l *literal) valueOrNil() interface{} {
+	if l == nil {
+		return nil
+	}
+	return l.value
+}
+
+type list struct{ items []node }
+
+func (l *list) eval(env map[string]interface{}) interface{} {
+	values := make([]interface{}, len(l.items))
+	for i, item := range l.items {
+		values[i] = item.eval(env)
+	}
+	return values
+}
+
+// path walks decoded JSON; string steps are object fields, int steps list
+// indexes. A field step on a list projects it over the elements.
+type path struct{ steps []interface{} }
+
+func (p *path) eval(env map[string]interface{}) interface{} {
+	var v interface{} = env
+	for _, step := range p.steps {
+		switch s := step.(type) {
+		case string:
+			if l, ok := v.([]interface{}); ok {
+				v = project(l, s)
+				continue
+			}
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = m[s]
+		case int:
+			l, ok := v.([]interface{})
+			if !ok || s >= len(l) {
+				return nil
+			}
+			v = l[s]
+		}
+	}
+	return v
+}
+
+// project collects field of every object in l, flattening list values
+func project(l []interface{}, field string) []interface{} {
+	values := []interface{}{}
+	for _, item := range l {
+		m, ok := item.(map[string]interface{})
+		if !ok || m[field] == nil {
+			continue
+		}
+		if sub, ok := m[field].([]interface{}); ok {
+			values = append(values, sub...)
+		} else {
+			values = append(values, m[field])
+		}
+	}
+	return values
+}
+
+type call struct {
+	fn  string
+	arg node
+}
+
+func (c *call) eval(env map[string]interface{}) interface{} {
+	v := c.arg.eval(env)
+	switch c.fn {
+	case "len":
+		switch x := v.(type) {
+		case string:
+			return float64(len(x))
+		case []interface{}:
+			return float64(len(x))
+		case map[string]interface{}:
+			return float64(len(x))
+		}
+		return float64(0)
+	case "lower":
+		if s, ok := v.(string); ok {
+			return strings.ToLower(s)
+		}
+	case "sum", "max", "min":
+		return reduce(c.fn, v)
+	}
+	return nil
+}
+
+// reduce folds the numbers of a list, or a single number; sum of nothing is
+// 0, max and min of nothing are null
+func reduce(fn string, v interface{}) interface{} {
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+	var result interface{}
+	if fn == "sum" {
+		result = float64(0)
+	}
+	for _, item := range items {
+		x, ok := item.(float64)
+		if !ok {
+			continue
+		}
+		acc, _ := result.(float64)
+		switch {
+		case result == nil:
+			result = x
+		case fn == "sum":
+			result = acc + x
+		case fn == "max" && x > acc, fn == "min" && x < acc:
+			result = x
+		}
+	}
+	return result
+}
+
+type negation struct{ x node }
+
+func (n *negation) eval(env map[string]interface{}) interface{} { return !truthy(n.x.eval(env)) }
+
+type logical struct {
+	and         bool
+	left, right node
+}
+
+func (l *logical) eval(env map[string]interface{}) interface{} {
+	if truthy(l.left.eval(env)) != l.and {
+		return !l.and // short circuit: false && ..., true || ...
+	}
+	return truthy(l.right.eval(env))
+}
+
+type comparison struct {
+	op          string
+	left, right node
+	re          *regexp.Regexp
+}
+
+func (c *comparison) eval(env map[string]interface{}) interface{} {
+	l, r := c.left.eval(env), c.right.eval(env)
+	switch c.op {
+	case "==":
+		return equal(l, r)
+	case "!=":
+		return !equal(l, r)
+	case "=~":
+		s, ok := l.(string)
+		return ok && c.re.MatchString(s)
+	case "contains":
+		switch x := l.(type) {
+		case string:
+			s, ok := r.(string)
+			return ok && strings.Contains(x, s)
+		case []interface{}:
+			return member(r, x)
+		}
+		return false
+	case "in":
+		items, _ := r.([]interface{})
+		return member(l, items)
+	}
+
+	// Ordering compares two numbers or two strings; anything else is false
+	var cmp int
+	switch x := l.(type) {
+	case float64:
+		y, ok := r.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case x < y:
+			cmp = -1
+		case x > y:
+			cmp = 1
+		}
+	case string:
+		y, ok := r.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(x, y)
+	default:
+		return false
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func equal(a, b interface{}) bool {
+	switch a.(type) {
+	case nil:
+		return b == nil
+	case float64, string, bool:
+		return a == b
+	}
+	return false // lists and objects are never equal
+}
+
+func member(v interface{}, items []interface{}) bool {
+	for _, item := range items {
+		if equal(v, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// truthy decides whether a value satisfies a condition on its own
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	case []interface{}:
+		return len(x) > 0
+	case map[string]interface{}:
+		return len(x) > 0
+	}
+	return false
+}
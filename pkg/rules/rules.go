@@ -0,0 +1,121 @@
+// Package rules decides the approval of a task from its hardware report.
+// A Set is an ordered list of rules; the first rule whose condition matches
+// decides, and a task no rule matches waits for a human as before.
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Actions a rule can take
+const (
+	ActionApprove = "approve" // approve the task so installation starts
+	ActionReject  = "reject"  // reject the task
+	ActionHold    = "hold"    // stop evaluating and keep the task for a human
+)
+
+// Rule approves, rejects or holds the tasks whose hardware matches Condition
+type Rule struct {
+	Name      string `json:"name"`
+	Condition string `json:"condition"`
+	Action    string `json:"action"`
+}
+
+// Set is one version of the auto-approval rules
+type Set struct {
+	Version   int       `json:"version"`
+	Enabled   bool      `json:"enabled"`
+	Rules     []Rule    `json:"rules"`
+	Comment   string    `json:"comment,omitempty"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Engine is a compiled Set
+type Engine struct {
+	set   Set
+	exprs []*Expr
+}
+
+// Match is the rule that decided a task
+type Match struct {
+	Rule    Rule
+	Version int
+}
+
+// Notes describes the match for Approval.Notes
+func (m *Match) Notes() string {
+	return fmt.Sprintf("auto-approval rule %q (v%d, %s): %s", m.Rule.Name, m.Version, m.Rule.Action, m.Rule.Condition)
+}
+
+// New compiles a set, reporting every invalid rule
+func New(set Set) (*Engine, error) {
+	e := &Engine{set: set}
+	var errs []string
+	names := make(map[string]bool)
+	for i, r := range set.Rules {
+		if strings.TrimSpace(r.Name) == "" {
+			errs = append(errs, fmt.Sprintf("rules[%d] needs a name", i))
+		} else if names[r.Name] {
+			errs = append(errs, fmt.Sprintf("rules[%d] reuses the name %q", i, r.Name))
+		}
+		names[r.Name] = true
+
+		if err := ValidateAction(r.Action); err != nil {
+			errs = append(errs, fmt.Sprintf("rules[%d] (%s): %v", i, r.Name, err))
+		}
+		expr, err := Compile(r.Condition)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("rules[%d] (%s): condition: %v", i, r.Name, err))
+		}
+		e.exprs = append(e.exprs, expr)
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return e, nil
+}
+
+// ValidateAction checks that action is one a rule can take
+func ValidateAction(action string) error {
+	switch action {
+	case ActionApprove, ActionReject, ActionHold:
+		return nil
+	}
+	return fmt.Errorf("unknown action %q (want approve, reject or hold)", action)
+}
+
+// Set returns the rules the engine was compiled from
+func (e *Engine) Set() Set {
+	return e.set
+}
+
+// Evaluate returns the first rule matching the hardware report and task, both
+// given as JSON, or nil when none does or the set is disabled
+func (e *Engine) Evaluate(hardware, task []byte) (*Match, error) {
+	if !e.set.Enabled || len(e.exprs) == 0 {
+		return nil, nil
+	}
+
+	env := make(map[string]interface{}, 2)
+	for name, data := range map[string][]byte{"hardware": hardware, "task": task} {
+		var v interface{}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &v); err != nil {
+				return nil, fmt.Errorf("decode %s: %w", name, err)
+			}
+		}
+		env[name] = v
+	}
+
+	for i, expr := range e.exprs {
+		if expr.Match(env) {
+			return &Match{Rule: e.set.Rules[i], Version: e.set.Version}, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,173 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+const hardware = `{
+	"bios": {"vendor": "Dell Inc.", "version": "2.1.0"},
+	"memory": {"total_gb": 256},
+	"cpu": {"model": "Intel(R) Xeon(R) Gold 6248", "cores": 40},
+	"disks": [{"name": "sda", "size_gb": 960, "type": "ssd"}, {"name": "sdb", "size_gb": 4000, "type": "hdd"}],
+	"tags": ["gpu", "rack-12"]
+}`
+
+func TestExprMatch(t *testing.T) {
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{"hardware.bios.vendor == 'Dell Inc.'", true},
+		{`hardware.bios.vendor != "Dell Inc."`, false},
+		{"hardware.memory.total_gb >= 128", true},
+		{"hardware.memory.total_gb < 128", false},
+		{"hardware.memory.total_gb >= 128 && hardware.cpu.cores > 32", true},
+		{"hardware.memory.total_gb > 512 || hardware.cpu.cores == 40", true},
+		{"not (hardware.memory.total_gb > 512) and hardware.bios.vendor == 'Dell Inc.'", true},
+		{"!hardware.missing", true},
+		{"hardware.missing == null", true},
+		{"hardware.missing > 3", false},
+		{"hardware.cpu.model =~ 'Xeon.*Gold'", true},
+		{"lower(hardware.bios.vendor) contains 'dell'", true},
+		{"hardware.tags contains 'gpu'", true},
+		{"len(hardware.disks) == 2", true},
+		{"hardware.disks[1].size_gb > 2000", true},
+		{"hardware.disks[5].size_gb > 2000", false},
+		{"hardware.bios.vendor in ['HP', 'Dell Inc.']", true},
+		{"task.idc == 'dc1' && task.os_type == 'ubuntu'", true},
+		{"hardware.memory.total_gb > -1", true},
+		{"hardware.tags", true},
+		{"hardware.disks.type contains 'hdd'", true},
+		{"hardware.disks.type contains 'nvme'", false},
+		{"sum(hardware.disks.size_gb) == 4960", true},
+		{"max(hardware.disks.size_gb) > 2000 && min(hardware.disks.size_gb) < 1000", true},
+		{"len(hardware.disks.name) == 2", true},
+		{"max(hardware.missing.size_gb) > 0", false},
+	}
+
+	task := []byte(`{"idc": "dc1", "os_type": "ubuntu"}`)
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			expr, err := Compile(tt.condition)
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+			engine, err := New(Set{Enabled: true, Rules: []Rule{{Name: "r", Condition: tt.condition, Action: ActionApprove}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			match, err := engine.Evaluate([]byte(hardware), task)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := match != nil; got != tt.want {
+				t.Errorf("%s matched = %v, want %v", expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, condition := range []string{
+		"",
+		"hardware.memory.total_gb >=",
+		"hardware.bios.vendor == 'Dell",
+		"machine.memory > 1",
+		"(hardware.memory.total_gb > 1",
+		"hardware.cpu.model =~ '['",
+		"size(hardware.disks) > 1",
+		"hardware.memory.total_gb > 1 extra",
+	} {
+		if _, err := Compile(condition); err == nil {
+			t.Errorf("Compile(%q) succeeded, want an error", condition)
+		}
+	}
+}
+
+func TestCompileWith(t *testing.T) {
+	expr, err := CompileWith("machine.state == 'ready' && hardware.cpu.cores >= 32", "machine", "hardware")
+	if err != nil {
+		t.Fatalf("CompileWith() error = %v", err)
+	}
+	env := map[string]interface{}{
+		"machine":  map[string]interface{}{"state": "ready"},
+		"hardware": map[string]interface{}{"cpu": map[string]interface{}{"cores": float64(40)}},
+	}
+	if !expr.Match(env) {
+		t.Error("expression did not match")
+	}
+	if _, err := CompileWith("task.os_type == 'ubuntu'", "machine", "hardware"); err == nil {
+		t.Error("CompileWith() accepted a root it was not given")
+	}
+
+	sum, _ := CompileWith("sum(hardware.disks.size_gb)", "hardware")
+	if got := sum.Eval(map[string]interface{}{"hardware": map[string]interface{}{}}); got != float64(0) {
+		t.Errorf("sum of nothing = %v, want 0", got)
+	}
+}
+
+func TestEngineEvaluate(t *testing.T) {
+	set := Set{
+		Version: 3,
+		Enabled: true,
+		Rules: []Rule{
+			{Name: "small_memory", Condition: "hardware.memory.total_gb < 64", Action: ActionHold},
+			{Name: "untrusted_vendor", Condition: "hardware.bios.vendor == 'Acme'", Action: ActionReject},
+			{Name: "trusted_vendor", Condition: "hardware.bios.vendor == 'Dell Inc.'", Action: ActionApprove},
+		},
+	}
+	engine, err := New(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match, err := engine.Evaluate([]byte(hardware), nil)
+	if err != nil || match == nil {
+		t.Fatalf("Evaluate() = %v, %v", match, err)
+	}
+	if match.Rule.Name != "trusted_vendor" || match.Version != 3 {
+		t.Errorf("matched %s v%d, want trusted_vendor v3", match.Rule.Name, match.Version)
+	}
+	if notes := match.Notes(); !strings.Contains(notes, `"trusted_vendor"`) || !strings.Contains(notes, "v3") {
+		t.Errorf("Notes() = %q", notes)
+	}
+
+	// The first matching rule decides
+	match, _ = engine.Evaluate([]byte(`{"bios": {"vendor": "Dell Inc."}, "memory": {"total_gb": 32}}`), nil)
+	if match == nil || match.Rule.Action != ActionHold {
+		t.Errorf("small Dell machine matched %+v, want the hold rule", match)
+	}
+
+	if match, _ := engine.Evaluate([]byte(`{"bios": {"vendor": "HP"}, "memory": {"total_gb": 128}}`), nil); match != nil {
+		t.Errorf("no rule should match, got %s", match.Rule.Name)
+	}
+
+	set.Enabled = false
+	disabled, _ := New(set)
+	if match, _ := disabled.Evaluate([]byte(hardware), nil); match != nil {
+		t.Errorf("disabled set matched %s", match.Rule.Name)
+	}
+
+	if _, err := engine.Evaluate([]byte(`{not json`), nil); err == nil {
+		t.Error("Evaluate() accepted invalid hardware JSON")
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	_, err := New(Set{Rules: []Rule{
+		{Name: "a", Condition: "hardware.memory.total_gb > 1", Action: "approve"},
+		{Name: "a", Condition: "hardware.memory.total_gb > 1", Action: "approve"},
+		{Name: "", Condition: "hardware.memory.total_gb > 1", Action: "approve"},
+		{Name: "b", Condition: "hardware.memory.total_gb > 1", Action: "install"},
+		{Name: "c", Condition: "hardware.memory.total_gb >", Action: "hold"},
+	}})
+	if err == nil {
+		t.Fatal("New() accepted invalid rules")
+	}
+	for _, want := range []string{"reuses the name", "needs a name", "unknown action", "rules[4]"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package stats
+
+import (
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/metrics"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+var (
+	taskTransitions = metrics.NewCounter("lpmos_task_transitions_total",
+		"Tasks entering each status", "idc", "status")
+	stepDuration = metrics.NewHistogram("lpmos_install_step_duration_seconds",
+		"Time spent in each installation progress step", metrics.DurationBuckets, "idc", "step")
+	installDuration = metrics.NewHistogram("lpmos_install_duration_seconds",
+		"Time from the start of an installation until it completed or failed", metrics.DurationBuckets, "idc", "os_type", "status")
+)
+
+// stepTiming is how long a progress step took
+type stepTiming struct {
+	step     string
+	duration time.Duration
+}
+
+// ObserveTaskWrite records the metrics of a task write seen on the watch
+// stream: status transitions, finished progress steps and, when the
+// installation ends, its total duration. prev is nil for a new task.
+func ObserveTaskWrite(idc string, prev, next *models.TaskV3) {
+	if next == nil {
+		return
+	}
+	if prev != nil && prev.TaskID != next.TaskID {
+		prev = nil // a new attempt starts from scratch
+	}
+
+	if prev == nil || prev.Status != next.Status {
+		taskTransitions.With(idc, string(next.Status)).Inc()
+		if d, ok := installTime(next); ok {
+			installDuration.With(idc, next.OSType, string(next.Status)).Observe(d.Seconds())
+		}
+	}
+	for _, s := range finishedSteps(prev, next) {
+		stepDuration.With(idc, s.step).Observe(s.duration.Seconds())
+	}
+}
+
+// finishedSteps returns the steps that ended with the progress entries
+// added by this write. A step ends when an entry for another step follows
+// it and lasts from its first entry to that one.
+func finishedSteps(prev, next *models.TaskV3) []stepTiming {
+	var (
+		seen  int64
+		cur   string
+		start time.Time
+	)
+	if prev != nil && prev.TaskID == next.TaskID {
+		seen = prev.LogSeq
+		if prev.LastProgress != nil && prev.StepStarted != nil {
+			cur, start = prev.LastProgress.Step, *prev.StepStarted
+		}
+	}
+
+	var steps []stepTiming
+	for _, e := range next.Log {
+		if e.Seq <= seen || e.Progress == nil || e.Progress.Step == cur {
+			continue
+		}
+		if cur != "" {
+			steps = append(steps, stepTiming{step: cur, duration: e.Progress.Timestamp.Sub(start)})
+		}
+		cur, start = e.Progress.Step, e.Progress.Timestamp
+	}
+	return steps
+}
+
+// installTime is how long a finished installation ran, from its first move
+// to installing until its final status
+func installTime(task *models.TaskV3) (time.Duration, bool) {
+	if !models.IsFinished(task.Status) || task.Status == models.TaskStatusCancelled {
+		return 0, false
+	}
+
+	var started, ended time.Time
+	for _, change := range task.StatusHistory {
+		if change.Status == models.TaskStatusInstalling && started.IsZero() {
+			started = change.Timestamp
+		}
+		if change.Status == task.Status {
+			ended = change.Timestamp
+		}
+	}
+	if started.IsZero() || ended.Before(started) {
+		return 0, false
+	}
+	return ended.Sub(started), true
+}
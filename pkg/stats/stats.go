@@ -0,0 +1,224 @@
+// Package stats keeps per-IDC task counters current from the task watch
+// stream. Every update carries the etcd revision of the task write so late
+// or replayed events never overwrite newer state, and Reconcile periodically
+// recounts from the task indexes to correct any drift.
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/taskindex"
+)
+
+// machine is the last known task state of one machine
+type machine struct {
+	status  models.TaskStatus
+	osType  string
+	rev     int64
+	deleted bool // tombstone so an older snapshot cannot resurrect the task
+}
+
+// counters are the live totals of one IDC
+type counters struct {
+	total    int
+	byStatus map[models.TaskStatus]int
+	byOS     map[string]int
+	updated  time.Time
+}
+
+// Tracker counts tasks per IDC, status and OS. It is safe for concurrent use.
+type Tracker struct {
+	mu         sync.RWMutex
+	machines   map[string]map[string]*machine // idc -> sn -> state
+	idcs       map[string]*counters
+	reconciled time.Time
+}
+
+// NewTracker creates an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		machines: make(map[string]map[string]*machine),
+		idcs:     make(map[string]*counters),
+	}
+}
+
+// Apply records the task of machine sn as written at revision rev
+func (t *Tracker) Apply(idc, sn string, status models.TaskStatus, osType string, rev int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.apply(idc, sn, &machine{status: status, osType: osType, rev: rev}, time.Now())
+}
+
+// Delete records that the task of machine sn was deleted at revision rev
+func (t *Tracker) Delete(idc, sn string, rev int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.apply(idc, sn, &machine{rev: rev, deleted: true}, time.Now())
+}
+
+// Reconcile merges a full listing of the task indexes taken after revision
+// rev. Machines missing from it that were last seen at or before rev are
+// gone; everything newer came from events and is kept. The counters are
+// then recounted from scratch.
+func (t *Tracker) Reconcile(entries []taskindex.Entry, rev int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	seen := make(map[string]map[string]bool)
+	for _, e := range entries {
+		t.apply(e.IDC, e.SN, &machine{status: e.Status, osType: e.OSType, rev: e.Revision}, now)
+		if seen[e.IDC] == nil {
+			seen[e.IDC] = make(map[string]bool)
+		}
+		seen[e.IDC][e.SN] = true
+	}
+
+	for idc, machines := range t.machines {
+		for sn, m := range machines {
+			if m.rev > rev {
+				continue
+			}
+			if m.deleted || !seen[idc][sn] {
+				delete(machines, sn)
+			}
+		}
+		if len(machines) == 0 {
+			delete(t.machines, idc)
+		}
+	}
+
+	// Recount so the counters cannot drift from the machine states
+	recounted := make(map[string]*counters, len(t.machines))
+	for idc, machines := range t.machines {
+		c := newCounters()
+		if old, ok := t.idcs[idc]; ok {
+			c.updated = old.updated
+		}
+		for _, m := range machines {
+			c.add(m, 1)
+		}
+		if c.total > 0 {
+			recounted[idc] = c
+		}
+	}
+	t.idcs = recounted
+	t.reconciled = now
+}
+
+// Get returns the statistics of one IDC; an IDC without tasks has zero counts
+func (t *Tracker) Get(idc string) models.IDCStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.snapshot(idc, t.idcs[idc])
+}
+
+// All returns the statistics of every IDC with tasks, sorted by IDC
+func (t *Tracker) All() []models.IDCStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	all := make([]models.IDCStats, 0, len(t.idcs))
+	for idc, c := range t.idcs {
+		if c.total > 0 {
+			all = append(all, t.snapshot(idc, c))
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].IDC < all[j].IDC })
+	return all
+}
+
+// apply replaces the state of a machine unless it is older than what is
+// known, adjusting the counters. The caller holds the write lock.
+func (t *Tracker) apply(idc, sn string, next *machine, now time.Time) {
+	machines := t.machines[idc]
+	if machines == nil {
+		machines = make(map[string]*machine)
+		t.machines[idc] = machines
+	}
+
+	prev := machines[sn]
+	if prev != nil && prev.rev >= next.rev {
+		return
+	}
+	machines[sn] = next
+
+	wasCounted := prev != nil && !prev.deleted
+	switch {
+	case !wasCounted && next.deleted:
+		return
+	case wasCounted && !next.deleted && prev.status == next.status && prev.osType == next.osType:
+		return
+	}
+
+	c := t.idcs[idc]
+	if c == nil {
+		c = newCounters()
+		t.idcs[idc] = c
+	}
+	if wasCounted {
+		c.add(prev, -1)
+	}
+	c.add(next, 1)
+	c.updated = now
+}
+
+func newCounters() *counters {
+	return &counters{
+		byStatus: make(map[models.TaskStatus]int),
+		byOS:     make(map[string]int),
+	}
+}
+
+// add counts (delta 1) or uncounts (delta -1) a machine
+func (c *counters) add(m *machine, delta int) {
+	if m.deleted {
+		return
+	}
+	c.total += delta
+	c.byStatus[m.status] += delta
+	if c.byStatus[m.status] == 0 {
+		delete(c.byStatus, m.status)
+	}
+	osType := m.osType
+	if osType == "" {
+		osType = "unknown"
+	}
+	c.byOS[osType] += delta
+	if c.byOS[osType] == 0 {
+		delete(c.byOS, osType)
+	}
+}
+
+// snapshot copies counters into an IDCStats. The caller holds the lock.
+func (t *Tracker) snapshot(idc string, c *counters) models.IDCStats {
+	stats := models.IDCStats{
+		IDC:            idc,
+		ByStatus:       make(map[models.TaskStatus]int),
+		ByOS:           make(map[string]int),
+		LastUpdated:    t.reconciled,
+		LastReconciled: t.reconciled,
+	}
+	if c == nil {
+		return stats
+	}
+
+	for status, n := range c.byStatus {
+		stats.ByStatus[status] = n
+	}
+	for osType, n := range c.byOS {
+		stats.ByOS[osType] = n
+	}
+	stats.TotalMachines = c.total
+	stats.Pending = c.byStatus[models.TaskStatusPending]
+	stats.Installing = c.byStatus[models.TaskStatusInstalling]
+	stats.Completed = c.byStatus[models.TaskStatusCompleted]
+	stats.Failed = c.byStatus[models.TaskStatusFailed]
+	if c.updated.After(stats.LastUpdated) {
+		stats.LastUpdated = c.updated
+	}
+	return stats
+}
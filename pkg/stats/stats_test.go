@@ -0,0 +1,113 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/taskindex"
+)
+
+func TestTrackerApply(t *testing.T) {
+	tr := NewTracker()
+	tr.Apply("dc1", "sn-1", models.TaskStatusPending, "ubuntu", 10)
+	tr.Apply("dc1", "sn-2", models.TaskStatusPendingApproval, "centos", 11)
+	tr.Apply("dc1", "sn-1", models.TaskStatusInstalling, "ubuntu", 12)
+	tr.Apply("dc1", "sn-1", models.TaskStatusPending, "ubuntu", 10) // replayed, older
+	tr.Apply("dc2", "sn-9", models.TaskStatusCancelled, "", 13)
+
+	s := tr.Get("dc1")
+	if s.TotalMachines != 2 || s.Installing != 1 || s.Pending != 0 ||
+		s.ByStatus[models.TaskStatusPendingApproval] != 1 || s.ByOS["ubuntu"] != 1 || s.ByOS["centos"] != 1 {
+		t.Errorf("dc1 = %+v", s)
+	}
+	if _, ok := s.ByStatus[models.TaskStatusPending]; ok {
+		t.Error("empty status bucket kept")
+	}
+	if s.LastUpdated.IsZero() {
+		t.Error("LastUpdated not set")
+	}
+
+	tr.Delete("dc2", "sn-9", 14)
+	if all := tr.All(); len(all) != 1 || all[0].IDC != "dc1" {
+		t.Errorf("All() = %+v", all)
+	}
+	if s := tr.Get("dc2"); s.TotalMachines != 0 || s.IDC != "dc2" {
+		t.Errorf("deleted IDC = %+v", s)
+	}
+}
+
+func TestTrackerReconcile(t *testing.T) {
+	tr := NewTracker()
+	tr.Apply("dc1", "stale", models.TaskStatusInstalling, "ubuntu", 5) // gone from etcd
+	tr.Apply("dc1", "fresh", models.TaskStatusCompleted, "ubuntu", 25) // written after the listing started
+	tr.Apply("dc1", "moved", models.TaskStatusInstalling, "ubuntu", 8) // missed its completion event
+	tr.Delete("dc1", "removed", 22)                                    // deleted after the listing started
+
+	tr.Reconcile([]taskindex.Entry{
+		{IDC: "dc1", SN: "moved", Status: models.TaskStatusCompleted, OSType: "ubuntu", Revision: 15},
+		{IDC: "dc1", SN: "removed", Status: models.TaskStatusFailed, OSType: "rocky", Revision: 18},
+		{IDC: "dc2", SN: "new", Status: models.TaskStatusPending, OSType: "debian", Revision: 19},
+	}, 20)
+
+	s := tr.Get("dc1")
+	if s.TotalMachines != 2 || s.Completed != 2 || s.Installing != 0 || s.Failed != 0 {
+		t.Errorf("dc1 after reconcile = %+v", s)
+	}
+	if s.LastReconciled.IsZero() {
+		t.Error("LastReconciled not set")
+	}
+	if s := tr.Get("dc2"); s.Pending != 1 || s.ByOS["debian"] != 1 {
+		t.Errorf("dc2 after reconcile = %+v", s)
+	}
+
+	// The tombstone outlives the first reconcile, then goes once it is older
+	tr.Reconcile(nil, 30)
+	if all := tr.All(); len(all) != 0 {
+		t.Errorf("All() after empty reconcile = %+v", all)
+	}
+}
+
+func TestFinishedSteps(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return t0.Add(time.Duration(min) * time.Minute) }
+
+	prev := &models.TaskV3{TaskID: "t1"}
+	prev.AddProgress(models.ProgressStep{Step: "partition", Timestamp: at(0)})
+	prev.AddProgress(models.ProgressStep{Step: "partition", Timestamp: at(1)})
+	next := *prev
+	next.AddProgress(models.ProgressStep{Step: "packages", Timestamp: at(3)})
+	next.AddLog("installing packages")
+	next.AddProgress(models.ProgressStep{Step: "packages", Timestamp: at(10)})
+	next.AddProgress(models.ProgressStep{Step: "bootloader", Timestamp: at(12)})
+
+	steps := finishedSteps(prev, &next)
+	if len(steps) != 2 ||
+		steps[0] != (stepTiming{"partition", 3 * time.Minute}) ||
+		steps[1] != (stepTiming{"packages", 9 * time.Minute}) {
+		t.Errorf("steps = %+v", steps)
+	}
+
+	// Nothing new, nothing finished
+	if steps := finishedSteps(&next, &next); len(steps) != 0 {
+		t.Errorf("unchanged progress finished %+v", steps)
+	}
+}
+
+func TestInstallTime(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	task := &models.TaskV3{Status: models.TaskStatusCompleted, StatusHistory: []models.StatusChange{
+		{Status: models.TaskStatusPending, Timestamp: t0},
+		{Status: models.TaskStatusInstalling, Timestamp: t0.Add(time.Minute)},
+		{Status: models.TaskStatusCompleted, Timestamp: t0.Add(21 * time.Minute)},
+	}}
+	if d, ok := installTime(task); !ok || d != 20*time.Minute {
+		t.Errorf("installTime = %v, %v", d, ok)
+	}
+
+	// Cancelled before installing: no duration
+	task.Status = models.TaskStatusCancelled
+	if _, ok := installTime(task); ok {
+		t.Error("cancelled task has an install time")
+	}
+}
@@ -0,0 +1,180 @@
+package taskindex
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+)
+
+// RebuildResult reports what Rebuild changed
+type RebuildResult struct {
+	Tasks   int `json:"tasks"`
+	Written int `json:"written"`
+	Removed int `json:"removed"`
+}
+
+// guarded is a set of operations that only applies while cmps hold
+type guarded struct {
+	ops  []clientv3.Op
+	cmps []clientv3.Cmp
+}
+
+// Rebuild brings the indexes in line with the stored tasks. It backfills
+// tasks written before the indexes existed, or by a writer without the
+// indexer, and removes entries of tasks that are gone. Every write is
+// conditional so it never undoes a task written while it runs.
+func Rebuild(c *etcd.Client) (RebuildResult, error) {
+	var result RebuildResult
+
+	// Snapshot every task at one revision; the indexes themselves are skipped
+	expected := map[string]string{} // index key -> entry
+	taskOf := map[string]string{}   // index key -> task key
+	taskRev := map[string]int64{}   // task key -> mod revision in the snapshot
+
+	indexEnd := clientv3.GetPrefixRangeEnd(Prefix)
+	start, end := "/os/", clientv3.GetPrefixRangeEnd("/os/")
+	var rev int64
+	for {
+		kvs, readRev, more, err := c.Range(start, end, 1000, false, rev)
+		if err != nil {
+			return result, err
+		}
+		if rev == 0 {
+			rev = readRev
+		}
+
+		for _, kv := range kvs {
+			idc, sn, ok := ParseTaskKey(kv.Key)
+			if !ok {
+				continue
+			}
+			e := entryOf(idc, sn, kv.Value)
+			if e == nil {
+				continue
+			}
+			value, _ := json.Marshal(e)
+			for _, k := range e.keys() {
+				expected[k] = string(value)
+				taskOf[k] = kv.Key
+			}
+			taskRev[kv.Key] = kv.ModRevision
+			result.Tasks++
+		}
+
+		if !more || len(kvs) == 0 {
+			break
+		}
+		start = kvs[len(kvs)-1].Key + "\x00"
+		if strings.HasPrefix(start, Prefix) {
+			start = indexEnd // skip over the indexes
+		}
+	}
+
+	// Compare with the current indexes
+	var removals []guarded
+	start = Prefix
+	for {
+		kvs, _, more, err := c.Range(start, indexEnd, 1000, false, 0)
+		if err != nil {
+			return result, err
+		}
+
+		for _, kv := range kvs {
+			want, ok := expected[kv.Key]
+			switch {
+			case ok && want == string(kv.Value):
+				delete(expected, kv.Key)
+			case !ok && kv.ModRevision <= rev:
+				// Written before the snapshot for a task that no longer has
+				// this key; anything newer belongs to a task we did not see
+				removals = append(removals, guarded{
+					ops:  []clientv3.Op{clientv3.OpDelete(kv.Key)},
+					cmps: []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(kv.Key), "=", kv.ModRevision)},
+				})
+			}
+		}
+
+		if !more || len(kvs) == 0 {
+			break
+		}
+		start = kvs[len(kvs)-1].Key + "\x00"
+	}
+
+	// Whatever is left is missing or outdated; write it per task, only if the
+	// task has not changed since the snapshot
+	byTask := map[string]*guarded{}
+	var writes []guarded
+	for k, value := range expected {
+		taskKey := taskOf[k]
+		g, ok := byTask[taskKey]
+		if !ok {
+			g = &guarded{cmps: []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(taskKey), "=", taskRev[taskKey])}}
+			byTask[taskKey] = g
+		}
+		g.ops = append(g.ops, clientv3.OpPut(k, value))
+	}
+	for _, g := range byTask {
+		writes = append(writes, *g)
+	}
+
+	written, err := commitGuarded(c, writes, 20)
+	if err != nil {
+		return result, err
+	}
+	for _, g := range written {
+		result.Written += len(g.ops)
+	}
+
+	removed, err := commitGuarded(c, removals, 100)
+	if err != nil {
+		return result, err
+	}
+	result.Removed = len(removed)
+
+	return result, nil
+}
+
+// commitGuarded commits groups perTxn at a time. When a batch conflicts its
+// groups are retried one by one and the conflicting ones are dropped.
+// It returns the groups that were committed.
+func commitGuarded(c *etcd.Client, groups []guarded, perTxn int) ([]guarded, error) {
+	var committed []guarded
+	for start := 0; start < len(groups); start += perTxn {
+		end := start + perTxn
+		if end > len(groups) {
+			end = len(groups)
+		}
+		batch := groups[start:end]
+
+		var ops []clientv3.Op
+		var cmps []clientv3.Cmp
+		for _, g := range batch {
+			ops = append(ops, g.ops...)
+			cmps = append(cmps, g.cmps...)
+		}
+
+		err := c.Transaction(ops, cmps...)
+		if err == nil {
+			committed = append(committed, batch...)
+			continue
+		}
+		if !errors.Is(err, etcd.ErrTxnConflict) {
+			return committed, err
+		}
+
+		for _, g := range batch {
+			err := c.Transaction(g.ops, g.cmps...)
+			switch {
+			case err == nil:
+				committed = append(committed, g)
+			case !errors.Is(err, etcd.ErrTxnConflict):
+				return committed, err
+			}
+		}
+	}
+	return committed, nil
+}
@@ -0,0 +1,266 @@
+// Package taskindex maintains secondary indexes over the task keys
+// (/os/{idc}/machines/{sn}/task) so tasks can be listed by status, OS, IDC
+// or creation date without loading the whole /os/ keyspace.
+//
+// Every task has one key in each index, all ending in the creation time so a
+// range over an index is also a range over dates:
+//
+//	/os/index/created/{created}/{idc}/{sn}
+//	/os/index/status/{status}/{created}/{idc}/{sn}
+//	/os/index/os/{os_type}/{created}/{idc}/{sn}
+//	/os/index/idc/{idc}/{created}/{sn}
+//
+// The value of each key is an Entry. Ops is registered as an etcd.Indexer so
+// the index keys are written in the same transaction as the task itself.
+package taskindex
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// Prefix is the root of all task indexes
+const Prefix = "/os/index/"
+
+// stampLayout is fixed-width so index keys sort by creation time
+const stampLayout = "20060102T150405.000000000Z"
+
+// ErrBadCursor is returned when a cursor does not belong to the query
+var ErrBadCursor = errors.New("invalid cursor")
+
+// Entry summarises a task. It is the value of every index key, enough to
+// filter and count tasks without reading them.
+type Entry struct {
+	IDC       string            `json:"idc"`
+	SN        string            `json:"sn"`
+	TaskID    string            `json:"task_id"`
+	Status    models.TaskStatus `json:"status"`
+	OSType    string            `json:"os_type"`
+	CreatedAt time.Time         `json:"created_at"`
+
+	// Revision is the etcd revision of the task write the entry reflects
+	Revision int64 `json:"-"`
+}
+
+// Query selects and orders index entries. Zero fields do not filter.
+type Query struct {
+	IDC           string
+	Statuses      []models.TaskStatus
+	OSType        string
+	CreatedAfter  time.Time // inclusive
+	CreatedBefore time.Time // exclusive
+	Ascending     bool      // oldest first; newest first by default
+	Limit         int
+	Cursor        string
+	Revision      int64 // read the indexes as of this revision; 0 for the latest
+
+	// Allow filters entries by IDC, e.g. to the IDCs a user may see
+	Allow func(idc string) bool
+}
+
+// Ops is an etcd.Indexer for task keys: it moves the index keys of a task
+// when its summary changes and removes them when the task is deleted
+func Ops(key string, prev, next []byte) []clientv3.Op {
+	idc, sn, ok := ParseTaskKey(key)
+	if !ok {
+		return nil
+	}
+
+	before := entryOf(idc, sn, prev)
+	after := entryOf(idc, sn, next)
+	if before != nil && after != nil && before.equal(after) {
+		return nil // progress or log update, nothing indexed changed
+	}
+
+	var ops []clientv3.Op
+	keep := map[string]bool{}
+	if after != nil {
+		value, _ := json.Marshal(after)
+		for _, k := range after.keys() {
+			keep[k] = true
+			ops = append(ops, clientv3.OpPut(k, string(value)))
+		}
+	}
+	if before != nil {
+		for _, k := range before.keys() {
+			if !keep[k] {
+				ops = append(ops, clientv3.OpDelete(k))
+			}
+		}
+	}
+	return ops
+}
+
+// List returns up to q.Limit tasks matching q and the cursor of the next
+// page, which is empty on the last page
+func List(c *etcd.Client, q Query) ([]Entry, string, error) {
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+
+	var entries []Entry
+	var keys []string
+	err := Each(c, q, func(key string, e Entry) bool {
+		entries = append(entries, e)
+		keys = append(keys, key)
+		return len(entries) <= q.Limit // one extra tells whether a next page exists
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(entries) <= q.Limit {
+		return entries, "", nil
+	}
+	return entries[:q.Limit], base64.RawURLEncoding.EncodeToString([]byte(keys[q.Limit-1])), nil
+}
+
+// Each calls fn for every entry matching q in order until fn returns false.
+// q.Limit is ignored.
+func Each(c *etcd.Client, q Query, fn func(key string, e Entry) bool) error {
+	start, end, err := q.bounds()
+	if err != nil {
+		return err
+	}
+
+	statuses := map[models.TaskStatus]bool{}
+	for _, s := range q.Statuses {
+		statuses[s] = true
+	}
+
+	const batch = 500
+	for {
+		kvs, _, more, err := c.Range(start, end, batch, !q.Ascending, q.Revision)
+		if err != nil {
+			return err
+		}
+
+		for _, kv := range kvs {
+			var e Entry
+			if err := json.Unmarshal(kv.Value, &e); err != nil {
+				continue
+			}
+			e.Revision = kv.ModRevision
+			if (q.IDC != "" && e.IDC != q.IDC) ||
+				(len(statuses) > 0 && !statuses[e.Status]) ||
+				(q.OSType != "" && e.OSType != q.OSType) ||
+				(q.Allow != nil && !q.Allow(e.IDC)) {
+				continue
+			}
+			if !fn(kv.Key, e) {
+				return nil
+			}
+		}
+
+		if !more || len(kvs) == 0 {
+			return nil
+		}
+		last := kvs[len(kvs)-1].Key
+		if q.Ascending {
+			start = last + "\x00"
+		} else {
+			end = last
+		}
+	}
+}
+
+// bounds picks the most selective index for q and returns the key range to
+// scan, narrowed by the creation window and the cursor
+func (q Query) bounds() (start, end string, err error) {
+	var prefix string
+	switch {
+	case len(q.Statuses) == 1:
+		prefix = Prefix + "status/" + string(q.Statuses[0]) + "/"
+	case q.OSType != "":
+		prefix = Prefix + "os/" + q.OSType + "/"
+	case q.IDC != "":
+		prefix = Prefix + "idc/" + q.IDC + "/"
+	default:
+		prefix = Prefix + "created/"
+	}
+
+	start, end = prefix, clientv3.GetPrefixRangeEnd(prefix)
+	if !q.CreatedAfter.IsZero() {
+		start = prefix + stamp(q.CreatedAfter)
+	}
+	if !q.CreatedBefore.IsZero() {
+		end = prefix + stamp(q.CreatedBefore)
+	}
+
+	if q.Cursor != "" {
+		raw, decodeErr := base64.RawURLEncoding.DecodeString(q.Cursor)
+		cursor := string(raw)
+		if decodeErr != nil || !strings.HasPrefix(cursor, prefix) {
+			return "", "", ErrBadCursor
+		}
+		if q.Ascending {
+			if next := cursor + "\x00"; next > start {
+				start = next
+			}
+		} else if cursor < end {
+			end = cursor
+		}
+	}
+	return start, end, nil
+}
+
+func (e *Entry) equal(o *Entry) bool {
+	return e.IDC == o.IDC && e.SN == o.SN && e.TaskID == o.TaskID && e.Status == o.Status &&
+		e.OSType == o.OSType && e.CreatedAt.Equal(o.CreatedAt)
+}
+
+// keys returns the index keys of the entry
+func (e *Entry) keys() []string {
+	created := stamp(e.CreatedAt)
+	osType := e.OSType
+	if osType == "" {
+		osType = "unknown"
+	}
+	return []string{
+		Prefix + "created/" + created + "/" + e.IDC + "/" + e.SN,
+		Prefix + "status/" + string(e.Status) + "/" + created + "/" + e.IDC + "/" + e.SN,
+		Prefix + "os/" + osType + "/" + created + "/" + e.IDC + "/" + e.SN,
+		Prefix + "idc/" + e.IDC + "/" + created + "/" + e.SN,
+	}
+}
+
+func stamp(t time.Time) string {
+	return t.UTC().Format(stampLayout)
+}
+
+// ParseTaskKey splits /os/{idc}/machines/{sn}/task; ok is false for any
+// other key
+func ParseTaskKey(key string) (idc, sn string, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "os" || parts[3] != "machines" || parts[5] != "task" {
+		return "", "", false
+	}
+	return parts[2], parts[4], true
+}
+
+// entryOf summarises a stored task, nil if there is none
+func entryOf(idc, sn string, value []byte) *Entry {
+	if value == nil {
+		return nil
+	}
+	var task models.TaskV3
+	if err := json.Unmarshal(value, &task); err != nil {
+		return nil
+	}
+	return &Entry{
+		IDC:       idc,
+		SN:        sn,
+		TaskID:    task.TaskID,
+		Status:    task.Status,
+		OSType:    task.OSType,
+		CreatedAt: task.CreatedAt.UTC(),
+	}
+}
@@ -0,0 +1,130 @@
+package taskindex
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+var created = time.Date(2026, 3, 1, 8, 30, 0, 0, time.UTC)
+
+func taskJSON(t *testing.T, status models.TaskStatus, progress int) []byte {
+	t.Helper()
+	data, err := json.Marshal(models.TaskV3{
+		TaskID:    "task-1",
+		SN:        "sn-001",
+		OSType:    "ubuntu",
+		Status:    status,
+		Progress:  []models.ProgressStep{{Percent: progress}},
+		CreatedAt: created,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// opKeys returns the sorted keys put and deleted by ops
+func opKeys(ops []clientv3.Op) (puts, deletes []string) {
+	for _, op := range ops {
+		switch {
+		case op.IsPut():
+			puts = append(puts, string(op.KeyBytes()))
+		case op.IsDelete():
+			deletes = append(deletes, string(op.KeyBytes()))
+		}
+	}
+	sort.Strings(puts)
+	sort.Strings(deletes)
+	return puts, deletes
+}
+
+func TestOps(t *testing.T) {
+	key := "/os/dc1/machines/sn-001/task"
+	stamp := "20260301T083000.000000000Z"
+
+	puts, deletes := opKeys(Ops(key, nil, taskJSON(t, models.TaskStatusPending, 0)))
+	want := []string{
+		"/os/index/created/" + stamp + "/dc1/sn-001",
+		"/os/index/idc/dc1/" + stamp + "/sn-001",
+		"/os/index/os/ubuntu/" + stamp + "/dc1/sn-001",
+		"/os/index/status/pending/" + stamp + "/dc1/sn-001",
+	}
+	if len(deletes) != 0 || len(puts) != len(want) {
+		t.Fatalf("create: puts %v, deletes %v", puts, deletes)
+	}
+	for i := range want {
+		if puts[i] != want[i] {
+			t.Errorf("create: put %s, want %s", puts[i], want[i])
+		}
+	}
+
+	// Progress does not touch the indexes
+	if ops := Ops(key, taskJSON(t, models.TaskStatusInstalling, 10), taskJSON(t, models.TaskStatusInstalling, 60)); len(ops) != 0 {
+		t.Errorf("progress update produced %d index ops", len(ops))
+	}
+
+	// A status change moves the status key and rewrites the others
+	puts, deletes = opKeys(Ops(key, taskJSON(t, models.TaskStatusInstalling, 60), taskJSON(t, models.TaskStatusCompleted, 100)))
+	if len(puts) != 4 || len(deletes) != 1 || deletes[0] != "/os/index/status/installing/"+stamp+"/dc1/sn-001" {
+		t.Errorf("status change: puts %v, deletes %v", puts, deletes)
+	}
+
+	// Deleting the task removes every key
+	if puts, deletes = opKeys(Ops(key, taskJSON(t, models.TaskStatusCompleted, 100), nil)); len(puts) != 0 || len(deletes) != 4 {
+		t.Errorf("delete: puts %v, deletes %v", puts, deletes)
+	}
+
+	for _, other := range []string{"/os/dc1/machines/sn-001/meta", "/os/dc1/machines/sn-001/attempts/task-1", "/os/dc1/servers/sn-001"} {
+		if ops := Ops(other, nil, taskJSON(t, models.TaskStatusPending, 0)); len(ops) != 0 {
+			t.Errorf("%s is not a task key but produced %d ops", other, len(ops))
+		}
+	}
+}
+
+func TestQueryBounds(t *testing.T) {
+	after := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cursor := func(key string) string { return base64.RawURLEncoding.EncodeToString([]byte(key)) }
+
+	tests := []struct {
+		name       string
+		q          Query
+		start, end string
+		wantErr    bool
+	}{
+		{"all", Query{}, "/os/index/created/", "/os/index/created0", false},
+		{"one status wins", Query{Statuses: []models.TaskStatus{models.TaskStatusFailed}, OSType: "ubuntu", IDC: "dc1"},
+			"/os/index/status/failed/", "/os/index/status/failed0", false},
+		{"several statuses use the next index", Query{Statuses: []models.TaskStatus{models.TaskStatusFailed, models.TaskStatusCancelled}, IDC: "dc1"},
+			"/os/index/idc/dc1/", "/os/index/idc/dc10", false},
+		{"created after", Query{OSType: "centos", CreatedAfter: after},
+			"/os/index/os/centos/20260101T000000.000000000Z", "/os/index/os/centos0", false},
+		{"newest first resumes before the cursor", Query{Cursor: cursor("/os/index/created/x/dc1/sn-9")},
+			"/os/index/created/", "/os/index/created/x/dc1/sn-9", false},
+		{"oldest first resumes after the cursor", Query{Ascending: true, Cursor: cursor("/os/index/created/x/dc1/sn-9")},
+			"/os/index/created/x/dc1/sn-9\x00", "/os/index/created0", false},
+		{"cursor of another index", Query{IDC: "dc1", Cursor: cursor("/os/index/created/x/dc1/sn-9")}, "", "", true},
+		{"garbage cursor", Query{Cursor: "!!"}, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := tt.q.bounds()
+			if tt.wantErr {
+				if err != ErrBadCursor {
+					t.Fatalf("bounds() error = %v, want ErrBadCursor", err)
+				}
+				return
+			}
+			if err != nil || start != tt.start || end != tt.end {
+				t.Errorf("bounds() = %q, %q, %v; want %q, %q", start, end, err, tt.start, tt.end)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// Package tasklog keeps the log lines and progress steps of installation
+// attempts under their own etcd keys, so the task value stays small:
+//
+//	/os/{idc}/machines/{sn}/logs/{task_id}/{seq}
+//
+// Writers append through models.TaskV3.AddLog and AddProgress, which keep
+// only a short tail in the task. Ops, registered as an etcd indexer, stores
+// the entries that are new in each task write in the same transaction and
+// drops the oldest once an attempt has more than MaxEntries.
+package tasklog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+	"github.com/lpmos/lpmos-go/pkg/taskindex"
+)
+
+// MaxEntries is how many entries are kept per attempt
+const MaxEntries = 2000
+
+// listPage is how many entries List reads per etcd request
+const listPage = 500
+
+// logState is the part of a task value Ops looks at
+type logState struct {
+	TaskID string                `json:"task_id"`
+	Log    []models.TaskLogEntry `json:"log"`
+	LogSeq int64                 `json:"log_seq"`
+}
+
+func decodeState(value []byte) *logState {
+	if value == nil {
+		return nil
+	}
+	var s logState
+	if json.Unmarshal(value, &s) != nil {
+		return nil
+	}
+	return &s
+}
+
+// Ops is an etcd.Indexer storing the log entries appended by a task write
+func Ops(key string, prev, next []byte) []clientv3.Op {
+	idc, sn, ok := taskindex.ParseTaskKey(key)
+	if !ok {
+		return nil
+	}
+	after := decodeState(next)
+	if after == nil || after.TaskID == "" {
+		return nil
+	}
+	var seen int64
+	if before := decodeState(prev); before != nil && before.TaskID == after.TaskID {
+		seen = before.LogSeq
+	}
+
+	var ops []clientv3.Op
+	for _, e := range after.Log {
+		if e.Seq <= seen {
+			continue
+		}
+		value, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		ops = append(ops, clientv3.OpPut(etcd.TaskLogKey(idc, sn, after.TaskID, e.Seq), string(value)))
+		if e.Seq > MaxEntries {
+			ops = append(ops, clientv3.OpDelete(etcd.TaskLogKey(idc, sn, after.TaskID, e.Seq-MaxEntries)))
+		}
+	}
+	return ops
+}
+
+// ParseKey splits /os/{idc}/machines/{sn}/logs/{task_id}/{seq}; ok is false
+// for any other key
+func ParseKey(key string) (idc, sn, taskID string, seq int64, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 8 || parts[0] != "" || parts[1] != "os" || parts[3] != "machines" || parts[5] != "logs" {
+		return "", "", "", 0, false
+	}
+	seq, err := strconv.ParseInt(parts[7], 10, 64)
+	if err != nil {
+		return "", "", "", 0, false
+	}
+	return parts[2], parts[4], parts[6], seq, true
+}
+
+// List returns the stored entries of an attempt with a sequence number
+// above after, oldest first, and the etcd revision they were read at
+func List(client *etcd.Client, idc, sn, taskID string, after int64) ([]models.TaskLogEntry, int64, error) {
+	start := etcd.TaskLogKey(idc, sn, taskID, after+1)
+	end := clientv3.GetPrefixRangeEnd(etcd.TaskLogPrefix(idc, sn, taskID))
+
+	entries := []models.TaskLogEntry{}
+	var rev int64
+	for {
+		kvs, readRev, more, err := client.Range(start, end, listPage, false, rev)
+		if err != nil {
+			return nil, 0, err
+		}
+		rev = readRev
+		for _, kv := range kvs {
+			var e models.TaskLogEntry
+			if err := json.Unmarshal(kv.Value, &e); err != nil {
+				return nil, 0, fmt.Errorf("invalid log entry %s: %w", kv.Key, err)
+			}
+			entries = append(entries, e)
+		}
+		if !more || len(kvs) == 0 {
+			return entries, rev, nil
+		}
+		start = kvs[len(kvs)-1].Key + "\x00"
+	}
+}
+
+// Follow passes fn the entries of an attempt appended after revision rev,
+// as they are written. It returns once the attempt has finished or been
+// replaced by a new one, when ctx is done, or when fn fails.
+func Follow(ctx context.Context, client *etcd.Client, idc, sn, taskID string, rev int64, fn func(models.TaskLogEntry) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	taskKey := etcd.TaskKeyV3(idc, sn)
+	watch := client.Watch(ctx, etcd.MachineKey(idc, sn, ""), true, clientv3.WithRev(rev+1))
+	for resp := range watch {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+
+		// A transaction's events arrive together: finish the response so
+		// the entries written with the final status are not cut off
+		done := false
+		for _, ev := range resp.Events {
+			key := string(ev.Kv.Key)
+			if key == taskKey {
+				var task models.TaskV3
+				if ev.Type == clientv3.EventTypeDelete ||
+					(json.Unmarshal(ev.Kv.Value, &task) == nil && (task.TaskID != taskID || models.IsFinished(task.Status))) {
+					done = true
+				}
+				continue
+			}
+			if ev.Type != clientv3.EventTypePut {
+				continue
+			}
+			if _, _, id, _, ok := ParseKey(key); !ok || id != taskID {
+				continue
+			}
+			var e models.TaskLogEntry
+			if json.Unmarshal(ev.Kv.Value, &e) != nil {
+				continue
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,116 @@
+package tasklog
+
+import (
+	"encoding/json"
+	"testing"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+const taskKey = "/os/dc1/machines/sn-001/task"
+
+func encode(t *testing.T, task *models.TaskV3) []byte {
+	t.Helper()
+	data, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// opKeys returns the keys put and deleted by ops, in order
+func opKeys(ops []clientv3.Op) (puts, deletes []string) {
+	for _, op := range ops {
+		switch {
+		case op.IsPut():
+			puts = append(puts, string(op.KeyBytes()))
+		case op.IsDelete():
+			deletes = append(deletes, string(op.KeyBytes()))
+		}
+	}
+	return puts, deletes
+}
+
+func TestOps(t *testing.T) {
+	task := &models.TaskV3{TaskID: "task-1", SN: "sn-001"}
+	task.AddLog("created")
+	created := encode(t, task)
+
+	puts, deletes := opKeys(Ops(taskKey, nil, created))
+	if len(puts) != 1 || puts[0] != etcd.TaskLogKey("dc1", "sn-001", "task-1", 1) || len(deletes) != 0 {
+		t.Fatalf("new task: puts %v, deletes %v", puts, deletes)
+	}
+
+	task.AddProgress(models.ProgressStep{Step: "partitioning", Percent: 10})
+	task.AddLog("partitioning /dev/sda")
+	puts, _ = opKeys(Ops(taskKey, created, encode(t, task)))
+	if len(puts) != 2 || puts[0] != etcd.TaskLogKey("dc1", "sn-001", "task-1", 2) || puts[1] != etcd.TaskLogKey("dc1", "sn-001", "task-1", 3) {
+		t.Errorf("appended entries: puts %v", puts)
+	}
+
+	// Unchanged log, nothing to write
+	if ops := Ops(taskKey, encode(t, task), encode(t, task)); len(ops) != 0 {
+		t.Errorf("unchanged log wrote %d ops", len(ops))
+	}
+
+	// Not a task key
+	if ops := Ops("/os/dc1/machines/sn-001/meta", nil, created); len(ops) != 0 {
+		t.Errorf("meta key wrote %d ops", len(ops))
+	}
+}
+
+func TestOpsTrimsOldEntries(t *testing.T) {
+	task := &models.TaskV3{TaskID: "task-1"}
+	for i := 0; i < MaxEntries; i++ {
+		task.AddLog("line")
+	}
+	prev := encode(t, task)
+	task.AddLog("one too many")
+
+	puts, deletes := opKeys(Ops(taskKey, prev, encode(t, task)))
+	if len(puts) != 1 || puts[0] != etcd.TaskLogKey("dc1", "sn-001", "task-1", MaxEntries+1) {
+		t.Errorf("puts %v", puts)
+	}
+	if len(deletes) != 1 || deletes[0] != etcd.TaskLogKey("dc1", "sn-001", "task-1", 1) {
+		t.Errorf("deletes %v", deletes)
+	}
+}
+
+func TestOpsNewAttempt(t *testing.T) {
+	task := &models.TaskV3{TaskID: "task-1", Status: models.TaskStatusFailed}
+	for i := 0; i < 5; i++ {
+		task.AddLog("old")
+	}
+	prev := encode(t, task)
+	if _, err := task.StartNewAttempt("task-2", "retry"); err != nil {
+		t.Fatal(err)
+	}
+	task.AddLog("retried")
+
+	// The new attempt numbers from 1 under its own prefix
+	puts, _ := opKeys(Ops(taskKey, prev, encode(t, task)))
+	if len(puts) != 1 || puts[0] != etcd.TaskLogKey("dc1", "sn-001", "task-2", 1) {
+		t.Errorf("puts %v", puts)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	idc, sn, taskID, seq, ok := ParseKey(etcd.TaskLogKey("dc1", "sn-001", "task-1", 42))
+	if !ok || idc != "dc1" || sn != "sn-001" || taskID != "task-1" || seq != 42 {
+		t.Errorf("ParseKey() = %q %q %q %d %v", idc, sn, taskID, seq, ok)
+	}
+
+	for _, key := range []string{
+		taskKey,
+		"/os/dc1/machines/sn-001/logs/task-1/",
+		"/os/dc1/machines/sn-001/logs/task-1/x",
+		"/os/dc1/machines/sn-001/attempts/task-1/1",
+	} {
+		if _, _, _, _, ok := ParseKey(key); ok {
+			t.Errorf("ParseKey(%q) matched", key)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Package watchdog decides when an installation attempt has run past its
+// deadlines. The control plane checks approved and installing tasks against
+// the limits for their IDC and OS and fails the ones that expired.
+package watchdog
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/config"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// Limits are the deadlines that apply to a task; zero disables one
+type Limits struct {
+	BootTimeout    time.Duration
+	InstallTimeout time.Duration
+	StepTimeout    time.Duration
+	StepTimeouts   map[string]time.Duration
+	RetryAttempts  int
+}
+
+// Policy resolves the limits of a task from the watchdog configuration
+type Policy struct {
+	base      Limits
+	overrides []config.WatchdogOverride
+}
+
+// NewPolicy builds the policy of cfg. The overall deadline and the retry
+// count are installation's unless the watchdog sets them.
+func NewPolicy(cfg config.WatchdogConfig, installation config.InstallationConfig) *Policy {
+	base := Limits{
+		InstallTimeout: installation.Timeout,
+		RetryAttempts:  installation.RetryAttempts,
+		StepTimeouts:   map[string]time.Duration{},
+	}
+	merge(&base, cfg.Limits)
+	return &Policy{base: base, overrides: cfg.Overrides}
+}
+
+// Limits returns the limits for a task of idc installing osType
+func (p *Policy) Limits(idc, osType string) Limits {
+	l := p.base
+	l.StepTimeouts = make(map[string]time.Duration, len(p.base.StepTimeouts))
+	for step, d := range p.base.StepTimeouts {
+		l.StepTimeouts[step] = d
+	}
+	for _, o := range p.overrides {
+		if (o.IDC == "" || o.IDC == idc) && (o.OSType == "" || strings.EqualFold(o.OSType, osType)) {
+			merge(&l, o.Limits)
+		}
+	}
+	return l
+}
+
+// merge replaces the limits of dst that src sets, zero included
+func merge(dst *Limits, src config.InstallLimits) {
+	if src.BootTimeout != nil {
+		dst.BootTimeout = *src.BootTimeout
+	}
+	if src.InstallTimeout != nil {
+		dst.InstallTimeout = *src.InstallTimeout
+	}
+	if src.StepTimeout != nil {
+		dst.StepTimeout = *src.StepTimeout
+	}
+	for step, d := range src.StepTimeouts {
+		dst.StepTimeouts[step] = d
+	}
+	if src.RetryAttempts != nil {
+		dst.RetryAttempts = *src.RetryAttempts
+	}
+}
+
+// Check returns the error to fail task with when it has run past one of
+// limits at now, nil while it is within them or not running
+func Check(task *models.TaskV3, l Limits, now time.Time) *models.TaskError {
+	if task.Status != models.TaskStatusApproved && task.Status != models.TaskStatusInstalling {
+		return nil
+	}
+	expired := func(code, message string) *models.TaskError {
+		return &models.TaskError{Code: code, Message: message, OccurredAt: now}
+	}
+
+	if started := runningSince(task); l.InstallTimeout > 0 && now.Sub(started) > l.InstallTimeout {
+		return expired(models.ErrorCodeInstallTimeout, fmt.Sprintf("Installation running for %s, limit %s",
+			now.Sub(started).Round(time.Second), l.InstallTimeout))
+	}
+
+	if task.Status == models.TaskStatusApproved {
+		if since := task.StatusSince(); l.BootTimeout > 0 && now.Sub(since) > l.BootTimeout {
+			return expired(models.ErrorCodeBootTimeout, fmt.Sprintf("No report from the agent %s after approval, limit %s",
+				now.Sub(since).Round(time.Second), l.BootTimeout))
+		}
+		return nil
+	}
+
+	step := task.LastProgress
+	if step == nil || task.StepStarted == nil {
+		return nil
+	}
+	limit := l.StepTimeout
+	if d, ok := l.StepTimeouts[step.Step]; ok {
+		limit = d
+	}
+	if limit > 0 && now.Sub(*task.StepStarted) > limit {
+		return expired(models.ErrorCodeStepTimeout, fmt.Sprintf("Step %q running for %s, limit %s",
+			step.Step, now.Sub(*task.StepStarted).Round(time.Second), limit))
+	}
+	return nil
+}
+
+// RetryAllowed reports whether another attempt may follow task's within
+// the retry_attempts of l
+func RetryAllowed(task *models.TaskV3, l Limits) bool {
+	return max(task.Attempt, 1)-1 < l.RetryAttempts
+}
+
+// runningSince is when the attempt was first approved or started
+// installing, whichever came first
+func runningSince(task *models.TaskV3) time.Time {
+	for _, change := range task.StatusHistory {
+		if change.Status == models.TaskStatusApproved || change.Status == models.TaskStatusInstalling {
+			return change.Timestamp
+		}
+	}
+	return task.StatusSince()
+}
@@ -0,0 +1,130 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/config"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+var t0 = time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+
+func TestPolicyLimits(t *testing.T) {
+	p := NewPolicy(config.WatchdogConfig{
+		Limits: config.InstallLimits{
+			BootTimeout:  config.Duration(30 * time.Minute),
+			StepTimeout:  config.Duration(20 * time.Minute),
+			StepTimeouts: map[string]time.Duration{"packages": 40 * time.Minute},
+		},
+		Overrides: []config.WatchdogOverride{
+			{OSType: "centos", Limits: config.InstallLimits{InstallTimeout: config.Duration(2 * time.Hour), StepTimeouts: map[string]time.Duration{"packages": time.Hour}}},
+			{IDC: "dc2", Limits: config.InstallLimits{BootTimeout: config.Duration(time.Hour), RetryAttempts: config.Int(1)}},
+		},
+	}, config.InstallationConfig{Timeout: time.Hour, RetryAttempts: 3})
+
+	l := p.Limits("dc1", "ubuntu")
+	if l.InstallTimeout != time.Hour || l.RetryAttempts != 3 || l.BootTimeout != 30*time.Minute || l.StepTimeouts["packages"] != 40*time.Minute {
+		t.Errorf("dc1 ubuntu limits = %+v", l)
+	}
+
+	l = p.Limits("dc2", "CentOS")
+	if l.InstallTimeout != 2*time.Hour || l.BootTimeout != time.Hour || l.RetryAttempts != 1 ||
+		l.StepTimeout != 20*time.Minute || l.StepTimeouts["packages"] != time.Hour {
+		t.Errorf("dc2 centos limits = %+v", l)
+	}
+
+	// Overrides must not leak into the base step limits
+	if l := p.Limits("dc1", "ubuntu"); l.StepTimeouts["packages"] != 40*time.Minute {
+		t.Errorf("base step limit changed to %v", l.StepTimeouts["packages"])
+	}
+}
+
+func TestPolicyDisable(t *testing.T) {
+	p := NewPolicy(config.WatchdogConfig{
+		Limits: config.InstallLimits{
+			BootTimeout:    config.Duration(30 * time.Minute),
+			InstallTimeout: config.Duration(0),
+			RetryAttempts:  config.Int(0),
+		},
+		Overrides: []config.WatchdogOverride{
+			{IDC: "dc2", Limits: config.InstallLimits{BootTimeout: config.Duration(0), InstallTimeout: config.Duration(4 * time.Hour)}},
+		},
+	}, config.InstallationConfig{Timeout: time.Hour, RetryAttempts: 3})
+
+	// An explicit zero disables instead of falling back to installation's
+	if l := p.Limits("dc1", "ubuntu"); l.InstallTimeout != 0 || l.RetryAttempts != 0 || l.BootTimeout != 30*time.Minute {
+		t.Errorf("dc1 limits = %+v", l)
+	}
+	// ...also in an override
+	if l := p.Limits("dc2", "ubuntu"); l.BootTimeout != 0 || l.InstallTimeout != 4*time.Hour {
+		t.Errorf("dc2 limits = %+v", l)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	limits := Limits{
+		BootTimeout:    30 * time.Minute,
+		InstallTimeout: 2 * time.Hour,
+		StepTimeout:    20 * time.Minute,
+		StepTimeouts:   map[string]time.Duration{"packages": time.Hour},
+	}
+	approved := func() *models.TaskV3 {
+		return &models.TaskV3{
+			TaskID:        "task-1",
+			Status:        models.TaskStatusApproved,
+			StatusHistory: []models.StatusChange{{Status: models.TaskStatusApproved, Timestamp: t0}},
+		}
+	}
+	installing := func(step string, started time.Time) *models.TaskV3 {
+		task := approved()
+		task.Status = models.TaskStatusInstalling
+		task.StatusHistory = append(task.StatusHistory, models.StatusChange{Status: models.TaskStatusInstalling, Timestamp: t0.Add(5 * time.Minute)})
+		task.AddProgress(models.ProgressStep{Step: step, Timestamp: started})
+		return task
+	}
+
+	tests := []struct {
+		name string
+		task *models.TaskV3
+		now  time.Time
+		want string
+	}{
+		{"approved in time", approved(), t0.Add(29 * time.Minute), ""},
+		{"never booted", approved(), t0.Add(31 * time.Minute), models.ErrorCodeBootTimeout},
+		{"step in time", installing("partition", t0.Add(10*time.Minute)), t0.Add(29 * time.Minute), ""},
+		{"step stuck", installing("partition", t0.Add(10*time.Minute)), t0.Add(31 * time.Minute), models.ErrorCodeStepTimeout},
+		{"own step limit", installing("packages", t0.Add(10*time.Minute)), t0.Add(69 * time.Minute), ""},
+		{"too long overall", installing("packages", t0.Add(90*time.Minute)), t0.Add(121 * time.Minute), models.ErrorCodeInstallTimeout},
+		{"installing without progress", &models.TaskV3{
+			Status:        models.TaskStatusInstalling,
+			StatusHistory: []models.StatusChange{{Status: models.TaskStatusInstalling, Timestamp: t0}},
+		}, t0.Add(time.Hour), ""},
+		{"finished", &models.TaskV3{Status: models.TaskStatusFailed, UpdatedAt: t0}, t0.Add(24 * time.Hour), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Check(tt.task, limits, tt.now)
+			switch {
+			case tt.want == "" && got != nil:
+				t.Errorf("Check() = %+v, want nil", got)
+			case tt.want != "" && (got == nil || got.Code != tt.want || got.Message == ""):
+				t.Errorf("Check() = %+v, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// A zero limit never expires
+	if got := Check(approved(), Limits{}, t0.Add(48*time.Hour)); got != nil {
+		t.Errorf("Check() without limits = %+v", got)
+	}
+}
+
+func TestRetryAllowed(t *testing.T) {
+	limits := Limits{RetryAttempts: 2}
+	for attempt, want := range map[int]bool{0: true, 1: true, 2: true, 3: false} {
+		if got := RetryAllowed(&models.TaskV3{Attempt: attempt}, limits); got != want {
+			t.Errorf("RetryAllowed(attempt %d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrQueueFull is returned when a redelivery cannot be queued
+var ErrQueueFull = errors.New("webhook queue is full")
+
+// ErrUnknownSubscription is returned when redelivering to a subscription
+// that no longer exists
+var ErrUnknownSubscription = errors.New("webhook subscription not found")
+
+// Store keeps the subscriptions and the dead-letter list
+type Store interface {
+	Subscriptions() ([]Subscription, error)
+	AddDeadLetter(DeadLetter) error
+}
+
+// DeadLetter is a delivery that used up its attempts or was refused
+type DeadLetter struct {
+	ID             string    `json:"id"`
+	SubscriptionID string    `json:"subscription_id"`
+	URL            string    `json:"url"`
+	Event          Event     `json:"event"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error"`
+	LastStatus     int       `json:"last_status,omitempty"`
+	FirstAttemptAt time.Time `json:"first_attempt_at"`
+	FailedAt       time.Time `json:"failed_at"`
+}
+
+// Options tune delivery
+type Options struct {
+	MaxAttempts    int           // attempts before a delivery is dead-lettered
+	InitialBackoff time.Duration // wait after the first failure, doubled after each
+	MaxBackoff     time.Duration
+	Timeout        time.Duration // per request
+	Workers        int
+	QueueSize      int
+	Static         []Subscription // subscriptions from the config file, not in the store
+}
+
+// DefaultOptions retry for about an hour before giving up
+func DefaultOptions() Options {
+	return Options{
+		MaxAttempts:    8,
+		InitialBackoff: 10 * time.Second,
+		MaxBackoff:     15 * time.Minute,
+		Timeout:        10 * time.Second,
+		Workers:        4,
+		QueueSize:      1024,
+	}
+}
+
+// delivery is one event on its way to one subscription
+type delivery struct {
+	sub        Subscription
+	event      Event
+	body       []byte
+	attempts   int
+	first      time.Time
+	lastErr    string
+	lastStatus int
+}
+
+// Dispatcher fans events out to the subscriptions that want them. Notify
+// never blocks; deliveries run on a fixed number of workers.
+type Dispatcher struct {
+	store      Store
+	opts       Options
+	client     *http.Client
+	events     chan Event
+	deliveries chan *delivery
+	done       chan struct{}
+}
+
+// NewDispatcher creates a dispatcher; Run starts delivering
+func NewDispatcher(store Store, opts Options) *Dispatcher {
+	def := DefaultOptions()
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = def.MaxAttempts
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = def.InitialBackoff
+	}
+	if opts.MaxBackoff < opts.InitialBackoff {
+		opts.MaxBackoff = opts.InitialBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = def.Timeout
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = def.Workers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = def.QueueSize
+	}
+
+	return &Dispatcher{
+		store:      store,
+		opts:       opts,
+		client:     &http.Client{Timeout: opts.Timeout},
+		events:     make(chan Event, opts.QueueSize),
+		deliveries: make(chan *delivery, opts.QueueSize),
+		done:       make(chan struct{}),
+	}
+}
+
+// Run delivers events until ctx is cancelled. Pending retries are abandoned.
+func (d *Dispatcher) Run(ctx context.Context) {
+	for i := 0; i < d.opts.Workers; i++ {
+		go d.worker(ctx)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			close(d.done)
+			return
+		case e := <-d.events:
+			d.fanOut(e)
+		}
+	}
+}
+
+// Notify queues an event for every subscription that wants it. The event is
+// dropped when the queue is full.
+func (d *Dispatcher) Notify(e Event) {
+	select {
+	case d.events <- e:
+	default:
+		log.Printf("Webhook queue full, dropping %s for %s/%s", e.Type, e.IDC, e.SN)
+	}
+}
+
+// Redeliver sends a dead letter again, with a fresh set of attempts, to the
+// current URL and secret of its subscription
+func (d *Dispatcher) Redeliver(dl DeadLetter) error {
+	sub, err := d.subscription(dl.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	if sub == nil {
+		return ErrUnknownSubscription
+	}
+	del, err := newDelivery(*sub, dl.Event)
+	if err != nil {
+		return err
+	}
+	select {
+	case d.deliveries <- del:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (d *Dispatcher) subscriptions() ([]Subscription, error) {
+	subs, err := d.store.Subscriptions()
+	return append(subs, d.opts.Static...), err
+}
+
+func (d *Dispatcher) subscription(id string) (*Subscription, error) {
+	subs, err := d.subscriptions()
+	for i := range subs {
+		if subs[i].ID == id {
+			return &subs[i], nil
+		}
+	}
+	return nil, err
+}
+
+func (d *Dispatcher) fanOut(e Event) {
+	subs, err := d.subscriptions()
+	if err != nil {
+		// Static subscriptions still get the event
+		log.Printf("Warning: failed to load webhook subscriptions: %v", err)
+	}
+	for _, sub := range subs {
+		if !sub.Wants(&e) {
+			continue
+		}
+		del, err := newDelivery(sub, e)
+		if err != nil {
+			log.Printf("Webhook %s: %v", sub.ID, err)
+			continue
+		}
+		d.enqueue(del)
+	}
+}
+
+func newDelivery(sub Subscription, e Event) (*delivery, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("encode %s: %w", e.Type, err)
+	}
+	return &delivery{sub: sub, event: e, body: body}, nil
+}
+
+// enqueue waits for room so retries are not lost, unless the dispatcher stopped
+func (d *Dispatcher) enqueue(del *delivery) {
+	select {
+	case d.deliveries <- del:
+	case <-d.done:
+	}
+}
+
+func (d *Dispatcher) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case del := <-d.deliveries:
+			d.attempt(ctx, del)
+		}
+	}
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, del *delivery) {
+	if del.attempts > 0 {
+		// The subscription may have been changed or removed while waiting
+		sub, err := d.subscription(del.sub.ID)
+		if err == nil && (sub == nil || !sub.Enabled) {
+			log.Printf("Webhook %s was removed or disabled, dropping retry of %s", del.sub.ID, del.event.ID)
+			return
+		}
+		if sub != nil {
+			del.sub = *sub
+		}
+	}
+	if del.attempts == 0 {
+		del.first = time.Now()
+	}
+	del.attempts++
+
+	status, retryAfter, err := d.post(ctx, del)
+	if err == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	del.lastErr, del.lastStatus = err.Error(), status
+
+	if !retryable(status) || del.attempts >= d.opts.MaxAttempts {
+		d.deadLetter(del)
+		return
+	}
+
+	wait := d.backoff(del.attempts)
+	if retryAfter > wait {
+		wait = min(retryAfter, d.opts.MaxBackoff)
+	}
+	log.Printf("Webhook %s %s to %s failed (attempt %d/%d), retrying in %v: %v",
+		del.sub.ID, del.event.Type, del.sub.URL, del.attempts, d.opts.MaxAttempts, wait, err)
+	time.AfterFunc(wait, func() { d.enqueue(del) })
+}
+
+// post sends one attempt, returning the HTTP status (0 without a response)
+// and any Retry-After the receiver asked for
+func (d *Dispatcher) post(ctx context.Context, del *delivery) (int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.sub.URL, bytes.NewReader(del.body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "lpmos-webhook/1")
+	req.Header.Set(HeaderEvent, del.event.Type)
+	req.Header.Set(HeaderDelivery, del.event.ID)
+	if del.sub.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(del.sub.Secret, time.Now(), del.body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, 0, nil
+	}
+	var retryAfter time.Duration
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		retryAfter = time.Duration(s) * time.Second
+	}
+	return resp.StatusCode, retryAfter, fmt.Errorf("receiver answered HTTP %d", resp.StatusCode)
+}
+
+// retryable reports whether a failure may succeed later. Other client
+// errors mean the receiver refuses the request, so retrying cannot help.
+func retryable(status int) bool {
+	return status == 0 || status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// backoff is the wait after the given number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.opts.InitialBackoff
+	for i := 1; i < attempts && wait < d.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, d.opts.MaxBackoff)
+}
+
+func (d *Dispatcher) deadLetter(del *delivery) {
+	dl := DeadLetter{
+		ID:             uuid.New().String(),
+		SubscriptionID: del.sub.ID,
+		URL:            del.sub.URL,
+		Event:          del.event,
+		Attempts:       del.attempts,
+		LastError:      del.lastErr,
+		LastStatus:     del.lastStatus,
+		FirstAttemptAt: del.first,
+		FailedAt:       time.Now(),
+	}
+	log.Printf("Webhook %s %s to %s dead-lettered after %d attempts: %s",
+		dl.SubscriptionID, dl.Event.Type, dl.URL, dl.Attempts, dl.LastError)
+	if err := d.store.AddDeadLetter(dl); err != nil {
+		log.Printf("Warning: failed to store webhook dead letter %s: %v", dl.ID, err)
+	}
+}
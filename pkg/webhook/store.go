@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/lpmos/lpmos-go/pkg/etcd"
+)
+
+// EtcdStore keeps subscriptions and dead letters under
+// /os/global/webhooks/
+type EtcdStore struct {
+	client *etcd.Client
+}
+
+// NewEtcdStore creates a store backed by etcd
+func NewEtcdStore(client *etcd.Client) *EtcdStore {
+	return &EtcdStore{client: client}
+}
+
+// Subscriptions lists the stored subscriptions, oldest first
+func (s *EtcdStore) Subscriptions() ([]Subscription, error) {
+	values, err := s.client.GetWithPrefix(etcd.WebhookSubscriptionKey(""))
+	if err != nil {
+		return nil, err
+	}
+	subs := make([]Subscription, 0, len(values))
+	for _, value := range values {
+		var sub Subscription
+		if json.Unmarshal(value, &sub) == nil {
+			subs = append(subs, sub)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt) })
+	return subs, nil
+}
+
+// Subscription loads one subscription
+func (s *EtcdStore) Subscription(id string) (*Subscription, error) {
+	var sub Subscription
+	if err := s.client.GetJSON(etcd.WebhookSubscriptionKey(id), &sub); err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// SaveSubscription creates or replaces a subscription
+func (s *EtcdStore) SaveSubscription(sub *Subscription) error {
+	return s.client.Put(etcd.WebhookSubscriptionKey(sub.ID), sub)
+}
+
+// DeleteSubscription removes a subscription; its dead letters are kept
+func (s *EtcdStore) DeleteSubscription(id string) error {
+	return s.client.Delete(etcd.WebhookSubscriptionKey(id))
+}
+
+// AddDeadLetter stores a failed delivery
+func (s *EtcdStore) AddDeadLetter(dl DeadLetter) error {
+	return s.client.Put(etcd.WebhookDeadLetterKey(dl.ID), dl)
+}
+
+// DeadLetters lists the failed deliveries, newest first
+func (s *EtcdStore) DeadLetters() ([]DeadLetter, error) {
+	values, err := s.client.GetWithPrefix(etcd.WebhookDeadLetterKey(""))
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(values))
+	for _, value := range values {
+		var dl DeadLetter
+		if json.Unmarshal(value, &dl) == nil {
+			letters = append(letters, dl)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].FailedAt.After(letters[j].FailedAt) })
+	return letters, nil
+}
+
+// DeadLetter loads one failed delivery
+func (s *EtcdStore) DeadLetter(id string) (*DeadLetter, error) {
+	var dl DeadLetter
+	if err := s.client.GetJSON(etcd.WebhookDeadLetterKey(id), &dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// DeleteDeadLetter removes a failed delivery from the list
+func (s *EtcdStore) DeleteDeadLetter(id string) error {
+	return s.client.Delete(etcd.WebhookDeadLetterKey(id))
+}
@@ -0,0 +1,272 @@
+// Package webhook delivers task lifecycle and hardware drift events to
+// subscribed HTTP endpoints. Payloads are JSON signed with the subscription's secret;
+// failed deliveries are retried with exponential backoff and end up in a
+// dead-letter list once the attempts are used up.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// Event types a subscription can filter on
+const (
+	EventCreated         = "task.created"
+	EventPendingApproval = "task.pending_approval"
+	EventApproved        = "task.approved"
+	EventFailed          = "task.failed"
+	EventCompleted       = "task.completed"
+	EventHardwareDrift   = "hardware.drift"
+)
+
+// EventTypes lists every event type
+var EventTypes = []string{EventCreated, EventPendingApproval, EventApproved, EventFailed, EventCompleted, EventHardwareDrift}
+
+// Request headers of a delivery
+const (
+	HeaderEvent     = "X-LPMOS-Event"
+	HeaderDelivery  = "X-LPMOS-Delivery" // event ID, the same on every retry
+	HeaderSignature = "X-LPMOS-Signature"
+)
+
+// statusEvents maps the task statuses that are announced to their event
+var statusEvents = map[models.TaskStatus]string{
+	models.TaskStatusPendingApproval: EventPendingApproval,
+	models.TaskStatusApproved:        EventApproved,
+	models.TaskStatusFailed:          EventFailed,
+	models.TaskStatusCompleted:       EventCompleted,
+}
+
+// Subscription sends the events it selects to URL. Empty Events or IDCs
+// select all of them.
+type Subscription struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Secret      string    `json:"secret,omitempty"`
+	Events      []string  `json:"events,omitempty"`
+	IDCs        []string  `json:"idcs,omitempty"`
+	Enabled     bool      `json:"enabled"`
+	Description string    `json:"description,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Validate checks the URL and event types of a subscription
+func (s *Subscription) Validate() error {
+	var errs []error
+	if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("url %q must be an absolute http or https URL", s.URL))
+	}
+	for _, e := range s.Events {
+		if !contains(EventTypes, e) {
+			errs = append(errs, fmt.Errorf("unknown event %q (want one of %s)", e, strings.Join(EventTypes, ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Wants reports whether the subscription receives e
+func (s *Subscription) Wants(e *Event) bool {
+	return s.Enabled &&
+		(len(s.Events) == 0 || contains(s.Events, e.Type)) &&
+		(len(s.IDCs) == 0 || contains(s.IDCs, e.IDC))
+}
+
+// Redacted returns a copy safe to show through the API
+func (s Subscription) Redacted() Subscription {
+	if s.Secret != "" {
+		s.Secret = "********"
+	}
+	return s
+}
+
+// Event is the JSON body of a delivery. Text is a one-line summary so chat
+// incoming webhooks can show it as is.
+type Event struct {
+	ID             string           `json:"id"`
+	Type           string           `json:"type"`
+	Timestamp      time.Time        `json:"timestamp"`
+	IDC            string           `json:"idc"`
+	SN             string           `json:"sn"`
+	TaskID         string           `json:"task_id"`
+	Status         string           `json:"status"`
+	PreviousStatus string           `json:"previous_status,omitempty"`
+	Reason         string           `json:"reason,omitempty"`
+	OSType         string           `json:"os_type,omitempty"`
+	OSVersion      string           `json:"os_version,omitempty"`
+	Hostname       string           `json:"hostname,omitempty"`
+	MAC            string           `json:"mac,omitempty"`
+	Attempt        int              `json:"attempt,omitempty"`
+	Approval       *models.Approval `json:"approval,omitempty"`
+	Text           string           `json:"text"`
+
+	Drift *models.HardwareDrift `json:"drift,omitempty"` // hardware.drift only
+}
+
+// TaskEvents returns the events announced by a task write: task.created for
+// a new task or installation attempt, and an event for each status change
+// subscribers can follow. A nil next is a deletion and announces nothing,
+// nor does a rolled-back attempt giving way to the one it replaced.
+func TaskEvents(idc, sn string, prev, next *models.TaskV3, now time.Time) []Event {
+	if next == nil || prev != nil && prev.PreviousTaskID != "" && prev.PreviousTaskID == next.TaskID {
+		return nil
+	}
+
+	var types []string
+	var from models.TaskStatus
+	if prev == nil || prev.TaskID != next.TaskID {
+		types = append(types, EventCreated)
+	} else {
+		from = prev.Status
+	}
+	if next.Status != from {
+		if t, ok := statusEvents[next.Status]; ok {
+			types = append(types, t)
+		}
+	}
+
+	events := make([]Event, 0, len(types))
+	for _, t := range types {
+		e := taskEvent(t, idc, sn, next, now)
+		e.PreviousStatus = string(from)
+		if n := len(next.StatusHistory); n > 0 && next.StatusHistory[n-1].Status == next.Status {
+			e.Reason = next.StatusHistory[n-1].Reason
+		}
+		e.Text = summary(&e)
+		events = append(events, e)
+	}
+	return events
+}
+
+// PendingApprovalEvent returns the task.pending_approval event of a task
+// whose hardware was reported while its approval is still pending. Unlike
+// a task held in pending_approval, its status does not change.
+func PendingApprovalEvent(idc, sn string, task *models.TaskV3, now time.Time) Event {
+	e := taskEvent(EventPendingApproval, idc, sn, task, now)
+	e.Reason = "hardware reported"
+	e.Text = summary(&e)
+	return e
+}
+
+func taskEvent(eventType, idc, sn string, task *models.TaskV3, now time.Time) Event {
+	return Event{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		Timestamp: now,
+		IDC:       idc,
+		SN:        sn,
+		TaskID:    task.TaskID,
+		Status:    string(task.Status),
+		OSType:    task.OSType,
+		OSVersion: task.OSVersion,
+		Hostname:  task.Hostname,
+		MAC:       task.MAC,
+		Attempt:   task.Attempt,
+		Approval:  task.Approval,
+	}
+}
+
+// DriftEvent returns the hardware.drift event of a hardware version whose
+// parts differ from the previous one
+func DriftEvent(idc, sn string, r *models.HardwareRecord, now time.Time) Event {
+	e := Event{
+		ID:        uuid.New().String(),
+		Type:      EventHardwareDrift,
+		Timestamp: now,
+		IDC:       idc,
+		SN:        sn,
+		TaskID:    r.TaskID,
+		Reason:    r.Drift.Summary(),
+		MAC:       r.Hardware.MACAddress,
+		Drift:     r.Drift,
+	}
+	e.Text = summary(&e)
+	return e
+}
+
+func summary(e *Event) string {
+	var text string
+	switch e.Type {
+	case EventCreated:
+		text = fmt.Sprintf("[%s] Installation task created for %s (%s %s)", e.IDC, e.SN, e.OSType, e.OSVersion)
+	case EventPendingApproval:
+		text = fmt.Sprintf("[%s] Task for %s is waiting for approval", e.IDC, e.SN)
+	case EventApproved:
+		text = fmt.Sprintf("[%s] Task for %s was approved", e.IDC, e.SN)
+	case EventFailed:
+		text = fmt.Sprintf("[%s] Installation of %s failed", e.IDC, e.SN)
+	case EventCompleted:
+		text = fmt.Sprintf("[%s] Installation of %s completed", e.IDC, e.SN)
+	case EventHardwareDrift:
+		text = fmt.Sprintf("[%s] Hardware of %s changed", e.IDC, e.SN)
+	default:
+		text = fmt.Sprintf("[%s] %s: %s", e.IDC, e.SN, e.Type)
+	}
+	if e.Reason != "" {
+		text += ": " + e.Reason
+	}
+	return text
+}
+
+// Sign computes the signature header of a body sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<body>">".
+// Including the time lets receivers reject replayed requests.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + mac(secret, ts, body)
+}
+
+// Verify checks a signature header made by Sign, rejecting it when it is
+// older than tolerance (zero disables the check)
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return errors.New("malformed signature header")
+	}
+	if !hmac.Equal([]byte(sig), []byte(mac(secret, ts, body))) {
+		return errors.New("signature mismatch")
+	}
+	if tolerance > 0 && now.Sub(time.Unix(unix, 0)) > tolerance {
+		return errors.New("signature expired")
+	}
+	return nil
+}
+
+func mac(secret, ts string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,282 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// memStore keeps subscriptions and dead letters in memory
+type memStore struct {
+	mu      sync.Mutex
+	subs    []Subscription
+	letters []DeadLetter
+	added   chan DeadLetter
+}
+
+func newMemStore(subs ...Subscription) *memStore {
+	return &memStore{subs: subs, added: make(chan DeadLetter, 10)}
+}
+
+func (s *memStore) Subscriptions() ([]Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Subscription(nil), s.subs...), nil
+}
+
+func (s *memStore) AddDeadLetter(dl DeadLetter) error {
+	s.mu.Lock()
+	s.letters = append(s.letters, dl)
+	s.mu.Unlock()
+	s.added <- dl
+	return nil
+}
+
+func fastOptions() Options {
+	return Options{MaxAttempts: 3, InitialBackoff: 5 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, Timeout: time.Second}
+}
+
+func TestTaskEvents(t *testing.T) {
+	now := time.Now()
+	pending := &models.TaskV3{TaskID: "t1", Status: models.TaskStatusPendingApproval}
+	approved := &models.TaskV3{TaskID: "t1", Status: models.TaskStatusApproved}
+	installing := &models.TaskV3{TaskID: "t1", Status: models.TaskStatusInstalling}
+	retried := &models.TaskV3{TaskID: "t2", Status: models.TaskStatusPending}
+	failed := &models.TaskV3{TaskID: "t1", Status: models.TaskStatusFailed,
+		StatusHistory: []models.StatusChange{{Status: models.TaskStatusFailed, Reason: "disk error"}}}
+
+	tests := []struct {
+		name       string
+		prev, next *models.TaskV3
+		want       []string
+	}{
+		{"new task", nil, pending, []string{EventCreated, EventPendingApproval}},
+		{"approved", pending, approved, []string{EventApproved}},
+		{"not announced", approved, installing, nil},
+		{"unchanged", approved, approved, nil},
+		{"new attempt", failed, retried, []string{EventCreated}},
+		{"rolled back", &models.TaskV3{TaskID: "t2", PreviousTaskID: "t1", Status: models.TaskStatusPending}, failed, nil},
+		{"deleted", approved, nil, nil},
+		{"failed", installing, failed, []string{EventFailed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := TaskEvents("dc1", "sn-1", tt.prev, tt.next, now)
+			if len(events) != len(tt.want) {
+				t.Fatalf("TaskEvents() = %d events, want %v", len(events), tt.want)
+			}
+			for i, e := range events {
+				if e.Type != tt.want[i] || e.IDC != "dc1" || e.SN != "sn-1" || e.Text == "" {
+					t.Errorf("event %d = %+v, want type %s", i, e, tt.want[i])
+				}
+			}
+		})
+	}
+
+	events := TaskEvents("dc1", "sn-1", installing, failed, now)
+	if events[0].Reason != "disk error" || events[0].PreviousStatus != string(models.TaskStatusInstalling) {
+		t.Errorf("failed event = %+v", events[0])
+	}
+
+	booting := &models.TaskV3{TaskID: "t1", Status: models.TaskStatusBooting, Approval: &models.Approval{Status: models.ApprovalStatusPending}}
+	e := PendingApprovalEvent("dc1", "sn-1", booting, now)
+	if e.Type != EventPendingApproval || e.Status != string(models.TaskStatusBooting) || e.TaskID != "t1" || e.Text == "" {
+		t.Errorf("pending approval event = %+v", e)
+	}
+}
+
+func TestDriftEvent(t *testing.T) {
+	r := &models.HardwareRecord{
+		TaskID: "t1",
+		Drift:  &models.HardwareDrift{DisksRemoved: []models.DiskInfo{{Device: "/dev/sdb"}}},
+	}
+	e := DriftEvent("dc1", "sn-1", r, time.Now())
+	if e.Type != EventHardwareDrift || e.TaskID != "t1" || e.Drift != r.Drift {
+		t.Errorf("DriftEvent() = %+v", e)
+	}
+	if want := "[dc1] Hardware of sn-1 changed: 1 disk removed (/dev/sdb)"; e.Text != want {
+		t.Errorf("text = %q, want %q", e.Text, want)
+	}
+}
+
+func TestSubscriptionWants(t *testing.T) {
+	sub := Subscription{Enabled: true, Events: []string{EventFailed}, IDCs: []string{"dc1"}}
+	if !sub.Wants(&Event{Type: EventFailed, IDC: "dc1"}) {
+		t.Error("matching event not wanted")
+	}
+	if sub.Wants(&Event{Type: EventCompleted, IDC: "dc1"}) || sub.Wants(&Event{Type: EventFailed, IDC: "dc2"}) {
+		t.Error("filtered event wanted")
+	}
+	sub.Enabled = false
+	if sub.Wants(&Event{Type: EventFailed, IDC: "dc1"}) {
+		t.Error("disabled subscription wants events")
+	}
+	if err := (&Subscription{URL: "ftp://x", Events: []string{"task.bogus"}}).Validate(); err == nil {
+		t.Error("Validate() accepted a bad URL and event")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"type":"task.failed"}`)
+	now := time.Now()
+	header := Sign("s3cret", now, body)
+
+	if err := Verify("s3cret", header, body, time.Minute, now); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+	if Verify("other", header, body, time.Minute, now) == nil {
+		t.Error("wrong secret verified")
+	}
+	if Verify("s3cret", header, []byte(`{}`), time.Minute, now) == nil {
+		t.Error("changed body verified")
+	}
+	if Verify("s3cret", header, body, time.Minute, now.Add(time.Hour)) == nil {
+		t.Error("expired signature verified")
+	}
+	if Verify("s3cret", "garbage", body, 0, now) == nil {
+		t.Error("malformed header verified")
+	}
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	store := newMemStore(
+		Subscription{ID: "all", URL: srv.URL, Secret: "k", Enabled: true},
+		Subscription{ID: "completed", URL: srv.URL, Enabled: true, Events: []string{EventCompleted}},
+	)
+	d := NewDispatcher(store, fastOptions())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	events := TaskEvents("dc1", "sn-1", nil, &models.TaskV3{TaskID: "t1", Status: models.TaskStatusPending}, time.Now())
+	d.Notify(events[0])
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		if r.Header.Get(HeaderEvent) != EventCreated || r.Header.Get(HeaderDelivery) != events[0].ID {
+			t.Errorf("headers = %v", r.Header)
+		}
+		if err := Verify("k", r.Header.Get(HeaderSignature), body, time.Minute, time.Now()); err != nil {
+			t.Errorf("signature: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not delivered")
+	}
+	select {
+	case r := <-received:
+		t.Errorf("filtered subscription got %s", r.Header.Get(HeaderEvent))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDispatcherRetriesThenDeadLetters(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	store := newMemStore(Subscription{ID: "s", URL: srv.URL, Enabled: true})
+	d := NewDispatcher(store, fastOptions())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	d.Notify(Event{ID: "e1", Type: EventFailed, IDC: "dc1", SN: "sn-1"})
+
+	select {
+	case dl := <-store.added:
+		if dl.Attempts != 3 || dl.LastStatus != http.StatusBadGateway || dl.SubscriptionID != "s" || dl.Event.ID != "e1" {
+			t.Errorf("dead letter = %+v", dl)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("delivery was not dead-lettered")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("receiver saw %d attempts, want 3", attempts)
+	}
+}
+
+func TestDispatcherDoesNotRetryRefusals(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer srv.Close()
+
+	store := newMemStore(Subscription{ID: "s", URL: srv.URL, Enabled: true})
+	d := NewDispatcher(store, fastOptions())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	d.Notify(Event{ID: "e1", Type: EventFailed, IDC: "dc1"})
+	select {
+	case dl := <-store.added:
+		if dl.Attempts != 1 {
+			t.Errorf("refused delivery attempted %d times", dl.Attempts)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("refused delivery was not dead-lettered")
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	got := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Get(HeaderDelivery)
+	}))
+	defer srv.Close()
+
+	store := newMemStore(Subscription{ID: "s", URL: srv.URL, Enabled: true})
+	d := NewDispatcher(store, fastOptions())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	if err := d.Redeliver(DeadLetter{SubscriptionID: "gone"}); err != ErrUnknownSubscription {
+		t.Errorf("Redeliver() to a removed subscription = %v", err)
+	}
+	if err := d.Redeliver(DeadLetter{SubscriptionID: "s", Event: Event{ID: "e1"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-got:
+		if id != "e1" {
+			t.Errorf("redelivered %s, want e1", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("dead letter not redelivered")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher(newMemStore(), Options{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second})
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := d.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
@@ -4,73 +4,352 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/lpmos/lpmos-go/pkg/auth"
 	"github.com/lpmos/lpmos-go/pkg/models"
 )
 
+// maxPending bounds the events held for a client while its snapshot loads;
+// beyond it the snapshot is reloaded instead
+const maxPending = 1024
+
 // Client represents a WebSocket client connection
 type Client struct {
-	Hub  *Hub
-	Conn *websocket.Conn
-	Send chan []byte
+	Hub       *Hub
+	Conn      *websocket.Conn
+	Principal *auth.Principal // nil when authentication is disabled
+
+	queue *queue
+
+	// Protocol v2 subscription
+	mu      sync.Mutex
+	filter  *Filter    // nil while the client speaks v1
+	gen     uint64     // bumped per snapshot so stale ones are dropped
+	waiting bool       // a snapshot is loading
+	pending []*message // events held back until the snapshot is queued
+	floor   int64      // snapshot revision; task events up to it are in the snapshot
+}
+
+// message is one broadcast in both protocol versions
+type message struct {
+	idc    string
+	event  *Event
+	body   []byte // event marshalled without a sequence number
+	key    string // coalescing key of the event
+	legacy []byte // v1 form, nil if v1 clients do not get it
+	legKey string // coalescing key of the v1 form
+}
+
+// Stats are the hub's counters since it started
+type Stats struct {
+	Clients   int    `json:"clients"`
+	QueueSize int    `json:"queue_size"` // per client
+	Queued    int    `json:"queued"`     // messages waiting to be written now
+	Published uint64 `json:"published"`
+	Delivered uint64 `json:"delivered"` // messages queued for a client
+	Coalesced uint64 `json:"coalesced"` // replaced a queued update of the same task
+	Dropped   uint64 `json:"dropped"`   // pushed out of a full queue
 }
 
-// Hub maintains active WebSocket connections and broadcasts messages
+// Hub maintains active WebSocket connections and broadcasts messages.
+// Publishing never blocks on slow clients: every client has a bounded queue
+// drained by its own writer.
 type Hub struct {
-	clients    map[*Client]bool
-	broadcast  chan []byte
-	Register   chan *Client
-	Unregister chan *Client
-	mu         sync.RWMutex
+	mu             sync.RWMutex
+	clients        map[*Client]bool
+	allowedOrigins map[string]bool
+	snapshot       SnapshotFunc
+	queueSize      int
+
+	published atomic.Uint64
+	delivered atomic.Uint64
+	coalesced atomic.Uint64
+	dropped   atomic.Uint64
 }
 
 // NewHub creates a new WebSocket hub
 func NewHub() *Hub {
 	return &Hub{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte, 256),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
+		clients:   make(map[*Client]bool),
+		queueSize: DefaultQueueSize,
 	}
 }
 
-// Run starts the hub's main loop
-func (h *Hub) Run() {
-	for {
-		select {
-		case client := <-h.Register:
-			h.mu.Lock()
-			h.clients[client] = true
-			h.mu.Unlock()
-			log.Printf("WebSocket client connected (total: %d)", len(h.clients))
-
-		case client := <-h.Unregister:
-			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.Send)
+// SetSnapshot sets how the tasks of a new subscription are loaded. It must be
+// called before clients connect; without it snapshots are empty.
+func (h *Hub) SetSnapshot(fn SnapshotFunc) {
+	h.snapshot = fn
+}
+
+// AllowOrigins permits cross-origin WebSocket connections from the given
+// origins (e.g. "https://ops.example.com"). Same-origin is always allowed.
+func (h *Hub) AllowOrigins(origins ...string) {
+	h.allowedOrigins = make(map[string]bool, len(origins))
+	for _, o := range origins {
+		h.allowedOrigins[strings.TrimSuffix(strings.ToLower(o), "/")] = true
+	}
+}
+
+// checkOrigin accepts requests without an Origin header (non-browser
+// clients), same-origin requests and explicitly allowed origins
+func (h *Hub) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if h.allowedOrigins[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Stats returns the hub's counters
+func (h *Hub) Stats() Stats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stats := Stats{
+		Clients:   len(h.clients),
+		QueueSize: h.queueSize,
+		Published: h.published.Load(),
+		Delivered: h.delivered.Load(),
+		Coalesced: h.coalesced.Load(),
+		Dropped:   h.dropped.Load(),
+	}
+	for c := range h.clients {
+		stats.Queued += c.queue.len()
+	}
+	return stats
+}
+
+// newClient creates a client for conn and registers it
+func (h *Hub) newClient(conn *websocket.Conn, principal *auth.Principal) *Client {
+	c := &Client{Hub: h, Conn: conn, Principal: principal, queue: newQueue(h.queueSize)}
+
+	h.mu.Lock()
+	h.clients[c] = true
+	n := len(h.clients)
+	h.mu.Unlock()
+
+	log.Printf("WebSocket client connected (total: %d)", n)
+	return c
+}
+
+// unregister removes c and stops its writer. It is safe to call twice.
+func (h *Hub) unregister(c *Client) {
+	h.mu.Lock()
+	_, ok := h.clients[c]
+	delete(h.clients, c)
+	n := len(h.clients)
+	h.mu.Unlock()
+
+	if ok {
+		c.queue.close()
+		log.Printf("WebSocket client disconnected (total: %d)", n)
+	}
+}
+
+// Publish sends e to the v2 clients subscribed to it and legacy to the v1
+// clients. Either may be nil. Clients only get messages of IDCs they may see.
+// Progress and v1 status updates of a task replace the client's queued update
+// of the same task instead of queueing behind it.
+func (h *Hub) Publish(e *Event, legacy *models.WebSocketMessage) {
+	m := &message{event: e}
+	if e != nil {
+		e.Seq = 0
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Failed to marshal %s event: %v", e.Type, err)
+			return
+		}
+		m.idc, m.body = e.IDC, body
+		if e.Type == EventProgress {
+			if step, ok := e.Payload.(models.ProgressStep); ok {
+				m.key = "progress/" + e.IDC + "/" + e.SN + "/" + e.TaskID + "/" + step.Step
 			}
-			h.mu.Unlock()
-			log.Printf("WebSocket client disconnected (total: %d)", len(h.clients))
-
-		case message := <-h.broadcast:
-			h.mu.RLock()
-			for client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client)
-				}
+		}
+	}
+	if legacy != nil {
+		data, err := json.Marshal(legacy)
+		if err != nil {
+			log.Printf("Failed to marshal %s message: %v", legacy.Type, err)
+			return
+		}
+		m.legacy = data
+		if m.idc == "" {
+			m.idc = legacy.IDC
+		}
+		switch legacy.Type {
+		case "status":
+			m.legKey = "status/" + legacy.IDC + "/" + legacy.SN
+		case "progress":
+			m.legKey = "progress/" + legacy.TaskID
+		}
+	}
+
+	h.published.Add(1)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		h.deliver(c, m)
+	}
+}
+
+// deliver queues m for c in the client's protocol version
+func (h *Hub) deliver(c *Client, m *message) {
+	if m.idc != "" && !canSee(c, m.idc) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h.deliverLocked(c, m)
+}
+
+// deliverLocked is deliver with c.mu held
+func (h *Hub) deliverLocked(c *Client, m *message) {
+	if c.filter == nil {
+		if m.legacy != nil {
+			h.enqueue(c, item{data: m.legacy, key: m.legKey})
+		}
+		return
+	}
+
+	if m.event == nil || !c.filter.Match(m.event) {
+		return
+	}
+	if c.waiting {
+		if len(c.pending) >= maxPending {
+			h.resync(c) // the new snapshot is read after these events
+			return
+		}
+		c.pending = append(c.pending, m)
+		return
+	}
+	if m.event.Revision > 0 && m.event.Revision <= c.floor {
+		return // already in the snapshot
+	}
+	h.enqueue(c, item{data: m.body, key: m.key, sequenced: true})
+}
+
+// enqueue pushes it onto the client's queue and counts the outcome
+func (h *Hub) enqueue(c *Client, it item) {
+	coalesced, dropped := c.queue.push(it)
+	h.delivered.Add(1)
+	if coalesced {
+		h.coalesced.Add(1)
+	}
+	if dropped {
+		h.dropped.Add(1)
+	}
+}
+
+// handleRequest acts on a client request
+func (h *Hub) handleRequest(c *Client, req Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch req.Type {
+	case RequestSubscribe:
+		for _, idc := range req.Filter.IDCs {
+			if !canSee(c, idc) {
+				h.sendError(c, "no access to IDC "+idc)
+				return
 			}
-			h.mu.RUnlock()
 		}
+		f := req.Filter
+		c.filter = &f
+		h.resync(c)
+	case RequestResync:
+		if c.filter == nil {
+			h.sendError(c, "not subscribed")
+			return
+		}
+		h.resync(c)
+	default:
+		h.sendError(c, "unknown request type "+strconv.Quote(req.Type))
+	}
+}
+
+// resync starts loading a fresh snapshot for c; events are held back until
+// it is queued. The caller holds c.mu.
+func (h *Hub) resync(c *Client) {
+	c.gen++
+	c.waiting = true
+	c.pending = nil
+
+	filter, gen := *c.filter, c.gen
+	go func() {
+		snapshot, err := &Snapshot{}, error(nil)
+		if h.snapshot != nil {
+			snapshot, err = h.snapshot(filter, c.Principal)
+		}
+		h.sendSnapshot(c, gen, snapshot, err)
+	}()
+}
+
+// sendSnapshot queues a loaded snapshot followed by the events held back
+// while it loaded, unless the client subscribed again meanwhile
+func (h *Hub) sendSnapshot(c *Client, gen uint64, snapshot *Snapshot, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+
+	pending := c.pending
+	c.waiting, c.pending = false, nil
+
+	if err != nil {
+		log.Printf("WebSocket snapshot failed: %v", err)
+		c.floor = 0
+		h.sendError(c, "snapshot failed, resync to retry")
+	} else {
+		body, err := json.Marshal(&Event{Type: EventSnapshot, Revision: snapshot.Revision, Payload: snapshot})
+		if err != nil {
+			log.Printf("Failed to marshal snapshot: %v", err)
+			return
+		}
+		c.floor = snapshot.Revision
+		h.enqueue(c, item{data: body, sequenced: true})
+	}
+
+	for _, m := range pending {
+		h.deliverLocked(c, m)
 	}
 }
 
+// sendError tells a v2 client its request was rejected
+func (h *Hub) sendError(c *Client, msg string) {
+	body, _ := json.Marshal(&Event{Type: EventError, Payload: map[string]string{"error": msg}})
+	h.enqueue(c, item{data: body, sequenced: true})
+}
+
+// sequenced inserts a sequence number into an event marshalled without one
+func sequenced(seq uint64, body []byte) []byte {
+	data := make([]byte, 0, len(body)+24)
+	data = append(data, `{"seq":`...)
+	data = strconv.AppendUint(data, seq, 10)
+	data = append(data, ',')
+	return append(data, body[1:]...)
+}
+
+// canSee reports whether the client may receive messages of idc
+func canSee(c *Client, idc string) bool {
+	return c.Principal == nil || c.Principal.CanAccessIDC(idc)
+}
+
 // BroadcastProgress sends a progress update to all connected clients
 func (h *Hub) BroadcastProgress(taskID string, progress *models.Progress) {
 	msg := models.WebSocketMessage{
@@ -81,30 +360,18 @@ func (h *Hub) BroadcastProgress(taskID string, progress *models.Progress) {
 		Message:    progress.Message,
 	}
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Failed to marshal progress message: %v", err)
-		return
-	}
-
-	h.broadcast <- data
+	h.Publish(nil, &msg)
 }
 
-// BroadcastStatus sends a status update to all connected clients
-func (h *Hub) BroadcastStatus(taskID string, status models.TaskStatus) {
-	msg := models.WebSocketMessage{
+// BroadcastStatus sends a task's status to the v1 clients that may see its IDC
+func (h *Hub) BroadcastStatus(idc, sn, taskID string, status models.TaskStatus) {
+	h.Publish(nil, &models.WebSocketMessage{
 		Type:   "status",
 		TaskID: taskID,
+		IDC:    idc,
+		SN:     sn,
 		Status: string(status),
-	}
-
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Failed to marshal status message: %v", err)
-		return
-	}
-
-	h.broadcast <- data
+	})
 }
 
 // BroadcastHardware sends a hardware report to all connected clients
@@ -115,19 +382,26 @@ func (h *Hub) BroadcastHardware(taskID string, hardware *models.HardwareInfo) {
 		Hardware: hardware,
 	}
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Failed to marshal hardware message: %v", err)
-		return
-	}
+	h.Publish(nil, &msg)
+}
 
-	h.broadcast <- data
+// BroadcastRegion sends a regional client going online or offline to all
+// connected clients
+func (h *Hub) BroadcastRegion(region models.Region) {
+	h.Publish(&Event{Type: EventRegion, IDC: region.ID, Status: region.Status, Payload: region},
+		&models.WebSocketMessage{
+			Type:    "region",
+			IDC:     region.ID,
+			Status:  region.Status,
+			Payload: region,
+		})
 }
 
-// ReadPump pumps messages from the WebSocket connection to the hub
+// ReadPump reads client requests until the connection closes, then
+// unregisters the client
 func (c *Client) ReadPump() {
 	defer func() {
-		c.Hub.Unregister <- c
+		c.Hub.unregister(c)
 		c.Conn.Close()
 	}()
 
@@ -146,47 +420,46 @@ func (c *Client) ReadPump() {
 			break
 		}
 
-		// Handle incoming messages (e.g., subscribe to specific tasks)
-		log.Printf("Received WebSocket message: %s", message)
+		var req Request
+		if err := json.Unmarshal(message, &req); err != nil {
+			req.Type = "" // answered with an error
+		}
+		c.Hub.handleRequest(c, req)
 	}
 }
 
-// WritePump pumps messages from the hub to the WebSocket connection
+// WritePump writes the client's queue to the WebSocket connection, one
+// message per frame so clients can parse every frame as a single JSON value
 func (c *Client) WritePump() {
 	ticker := time.NewTicker(54 * time.Second)
 	defer func() {
 		ticker.Stop()
+		c.Hub.unregister(c)
 		c.Conn.Close()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.Send:
+		case <-c.queue.ready:
+			messages, closed := c.queue.popAll()
 			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued messages to the current websocket message
-			n := len(c.Send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.Send)
+			for _, m := range messages {
+				if err := c.Conn.WriteMessage(websocket.TextMessage, m); err != nil {
+					return
+				}
 			}
-
-			if err := w.Close(); err != nil {
+			if closed {
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
 		case <-ticker.C:
 			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if c.Principal.Expired() {
+				c.Conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session expired"))
+				return
+			}
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -194,12 +467,11 @@ func (c *Client) WritePump() {
 	}
 }
 
-// ServeWs handles WebSocket upgrade requests
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+// ServeWs handles WebSocket upgrade requests. The connection is bound to
+// principal and closed once the principal's session expires.
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, principal *auth.Principal) {
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins in development
-		},
+		CheckOrigin: hub.checkOrigin,
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -208,14 +480,7 @@ func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := &Client{
-		Hub:  hub,
-		Conn: conn,
-		Send: make(chan []byte, 256),
-	}
-
-	client.Hub.Register <- client
-
+	client := hub.newClient(conn, principal)
 	go client.WritePump()
 	go client.ReadPump()
 }
@@ -0,0 +1,247 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// raceEnabled is set when the tests run under the race detector
+var raceEnabled bool
+
+func TestQueue(t *testing.T) {
+	q := newQueue(3)
+	event := func(n int) item { return item{data: []byte(fmt.Sprintf(`{"n":%d}`, n)), sequenced: true} }
+
+	q.push(event(1))
+	q.push(item{data: []byte(`{"step":"a","percent":10}`), key: "a"})
+	if coalesced, _ := q.push(item{data: []byte(`{"step":"a","percent":50}`), key: "a"}); !coalesced {
+		t.Error("progress of the same step was not coalesced")
+	}
+	q.push(event(2))
+	if _, dropped := q.push(event(3)); !dropped {
+		t.Error("full queue did not drop")
+	}
+
+	// {"n":1} was dropped: the next number skips one so the client resyncs
+	messages, closed := q.popAll()
+	want := []string{`{"step":"a","percent":50}`, `{"seq":2,"n":2}`, `{"seq":3,"n":3}`}
+	if closed || len(messages) != len(want) {
+		t.Fatalf("popAll() = %q, %v", messages, closed)
+	}
+	for i := range want {
+		if string(messages[i]) != want[i] {
+			t.Errorf("message %d = %s, want %s", i, messages[i], want[i])
+		}
+	}
+
+	q.push(event(4))
+	if messages, _ := q.popAll(); string(messages[0]) != `{"seq":4,"n":4}` {
+		t.Errorf("after a clean pop got %s", messages[0])
+	}
+
+	q.close()
+	q.push(event(5))
+	if messages, closed := q.popAll(); len(messages) != 0 || !closed {
+		t.Errorf("closed queue: %q, %v", messages, closed)
+	}
+}
+
+// smallBufferListener shrinks the socket buffers of accepted connections so
+// a client that stops reading backs up into its queue quickly
+type smallBufferListener struct{ net.Listener }
+
+func (l smallBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetWriteBuffer(4096)
+	}
+	return conn, err
+}
+
+// TestHubLoad connects 5,000 dashboards, a tenth of which never read, and
+// checks that publishing the way watchTasks does never waits for them
+func TestHubLoad(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("load test; the race detector cannot run this many goroutines")
+	}
+	const sockets, stalled, idcs, events = 5000, 500, 10, 500
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err == nil && limit.Cur < 2*sockets+200 {
+		limit.Cur = limit.Max
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+		if limit.Cur < 2*sockets+200 {
+			t.Skipf("needs %d open files, limit is %d", 2*sockets+200, limit.Cur)
+		}
+	}
+
+	h := NewHub()
+	h.queueSize = 32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(h, w, r, nil)
+	}))
+	srv.Listener = smallBufferListener{srv.Listener}
+	srv.Start()
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: 30 * time.Second,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetReadBuffer(4096)
+			}
+			return conn, err
+		},
+	}
+
+	// Readers subscribe to one IDC and wait for its final status event;
+	// stalled clients follow every IDC so their queues overflow
+	conns := make([]*websocket.Conn, sockets)
+	done := make(chan int, sockets)
+	var dial sync.WaitGroup
+	sem := make(chan struct{}, 64)
+	for i := 0; i < sockets; i++ {
+		dial.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer dial.Done()
+			defer func() { <-sem }()
+			conn, _, err := dialer.Dial(wsURL, nil)
+			if err != nil {
+				t.Errorf("dial %d: %v", i, err)
+				return
+			}
+			conns[i] = conn
+			if i < stalled {
+				conn.WriteJSON(Request{Type: RequestSubscribe})
+				return // never reads
+			}
+			conn.WriteJSON(Request{Type: RequestSubscribe, Filter: Filter{IDCs: []string{fmt.Sprintf("dc%d", i%idcs)}}})
+			go func() {
+				for {
+					_, r, err := conn.NextReader()
+					if err != nil {
+						return
+					}
+					data, _ := io.ReadAll(r)
+					if strings.Contains(string(data), `"sn":"final"`) {
+						done <- i
+						io.Copy(io.Discard, r)
+					}
+				}
+			}()
+		}(i)
+	}
+	dial.Wait()
+	defer func() {
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+	if t.Failed() {
+		return
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for h.Stats().Clients < sockets && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give the subscriptions time to take effect
+	time.Sleep(time.Second)
+
+	// Publish like watchTasks: progress of a few machines per IDC, a status
+	// change now and then
+	start := time.Now()
+	var slowest time.Duration
+	for n := 0; n < events; n++ {
+		idc := fmt.Sprintf("dc%d", n%idcs)
+		e := &Event{Type: EventProgress, IDC: idc, SN: fmt.Sprintf("sn-%d", n%50), TaskID: "task", Status: "installing",
+			Payload: models.ProgressStep{Step: fmt.Sprintf("step-%d", n/25), Percent: n % 100, Message: strings.Repeat("x", 200)}}
+		if n%10 == 0 {
+			e = &Event{Type: EventLog, IDC: idc, SN: fmt.Sprintf("sn-%d", n%50), Status: "installing",
+				Payload: map[string]string{"line": strings.Repeat("y", 200)}}
+		}
+		began := time.Now()
+		h.Publish(e, nil)
+		if d := time.Since(began); d > slowest {
+			slowest = d
+		}
+	}
+	for i := 0; i < idcs; i++ {
+		h.Publish(&Event{Type: EventStatus, IDC: fmt.Sprintf("dc%d", i), SN: "final", Status: "completed"}, nil)
+	}
+	elapsed := time.Since(start)
+
+	stats := h.Stats()
+	t.Logf("published %d events to %d clients in %v (slowest %v); delivered %d, coalesced %d, dropped %d",
+		events, stats.Clients, elapsed, slowest, stats.Delivered, stats.Coalesced, stats.Dropped)
+
+	// A blocking hub would wait for the stalled sockets' write deadline
+	if slowest > time.Second {
+		t.Errorf("Publish took %v; it must not wait for slow clients", slowest)
+	}
+	if stats.Dropped == 0 {
+		t.Error("stalled clients never dropped a message; the test did not fill their queues")
+	}
+
+	// Every reader still gets the end of the stream
+	for got := 0; got < sockets-stalled; got++ {
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("only %d of %d readers got the final event", got, sockets-stalled)
+		}
+	}
+}
+
+func TestWritePumpFrames(t *testing.T) {
+	h := NewHub()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(h, w, r, nil)
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Stats().Clients < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A v1 client gets a backlog as one JSON message per frame
+	const n = 20
+	for i := 0; i < n; i++ {
+		h.Publish(nil, &models.WebSocketMessage{Type: "hardware", TaskID: fmt.Sprintf("task-%d", i)})
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < n; i++ {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		var msg models.WebSocketMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.TaskID != fmt.Sprintf("task-%d", i) {
+			t.Fatalf("frame %d = %q, %v", i, data, err)
+		}
+	}
+}
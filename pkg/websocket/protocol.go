@@ -0,0 +1,153 @@
+package websocket
+
+import (
+	"reflect"
+
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+// Protocol v2. A client opts in by sending a subscribe request; until then it
+// receives the v1 messages (models.WebSocketMessage) for every task.
+//
+//	-> {"type":"subscribe","filter":{"idcs":["dc1"],"statuses":["installing"]}}
+//	<- {"seq":1,"type":"snapshot","revision":812,"payload":{"tasks":[...],"truncated":false}}
+//	<- {"seq":2,"type":"progress","idc":"dc1","sn":"sn-001","task_id":"task-1","status":"installing","revision":815,"payload":{...}}
+//	-> {"type":"resync"}
+//
+// Every message to a v2 client carries a sequence number counting up from 1
+// per connection. A skipped number means messages were lost and the client
+// should send resync (or subscribe again) to get a fresh snapshot. Events
+// already reflected in a snapshot are never sent after it.
+
+// Event types of protocol v2
+const (
+	EventSnapshot = "snapshot" // the tasks matching the subscription; payload is a Snapshot
+	EventTask     = "task"     // a task was created or started a new attempt; payload is the task
+	EventDeleted  = "deleted"  // a task was removed
+	EventStatus   = "status"   // payload is the models.StatusChange; from is the previous status
+	EventProgress = "progress" // payload is the new or updated models.ProgressStep
+	EventLog      = "log"      // payload is {"line": "..."}
+	EventApproval = "approval" // payload is the models.Approval
+	EventHardware = "hardware" // payload is the hardware report
+	EventDrift    = "drift"    // payload is the models.HardwareRecord of a report whose parts changed
+	EventRegion   = "region"   // payload is the models.Region
+	EventError    = "error"    // a request was rejected; payload is {"error": "..."}
+)
+
+// Request types sent by clients
+const (
+	RequestSubscribe = "subscribe"
+	RequestResync    = "resync"
+)
+
+// Event is a protocol v2 message
+type Event struct {
+	Seq      uint64      `json:"seq,omitempty"` // set per client when sent
+	Type     string      `json:"type"`
+	IDC      string      `json:"idc,omitempty"`
+	SN       string      `json:"sn,omitempty"`
+	TaskID   string      `json:"task_id,omitempty"`
+	Status   string      `json:"status,omitempty"`
+	From     string      `json:"from,omitempty"`     // previous status of a status event
+	Revision int64       `json:"revision,omitempty"` // etcd revision of the task write or snapshot
+	Payload  interface{} `json:"payload,omitempty"`
+}
+
+// Filter selects the events of a subscription. Empty fields match everything.
+type Filter struct {
+	IDCs     []string `json:"idcs,omitempty"`
+	SNs      []string `json:"sns,omitempty"`
+	Statuses []string `json:"statuses,omitempty"`
+}
+
+// Request is a message from a client
+type Request struct {
+	Type   string `json:"type"`
+	Filter Filter `json:"filter"`
+}
+
+// Snapshot is the state a subscription starts from
+type Snapshot struct {
+	Revision  int64           `json:"-"` // sent as the event revision
+	Tasks     []models.TaskV3 `json:"tasks"`
+	Truncated bool            `json:"truncated"` // more tasks match than were sent
+}
+
+// SnapshotFunc loads the tasks matching f that principal may see
+type SnapshotFunc func(f Filter, principal *auth.Principal) (*Snapshot, error)
+
+// Match reports whether e belongs to the subscription. Machine filters only
+// apply to task events; a status event matches on its old or new status so
+// subscribers see tasks leave the statuses they follow.
+func (f Filter) Match(e *Event) bool {
+	if e.IDC != "" && len(f.IDCs) > 0 && !contains(f.IDCs, e.IDC) {
+		return false
+	}
+	if e.SN == "" {
+		return true
+	}
+	if len(f.SNs) > 0 && !contains(f.SNs, e.SN) {
+		return false
+	}
+	if len(f.Statuses) > 0 && !contains(f.Statuses, e.Status) && (e.From == "" || !contains(f.Statuses, e.From)) {
+		return false
+	}
+	return true
+}
+
+// TaskEvents describes a task write at revision rev as events: what changed
+// between prev (nil when the task is new) and next (nil when it was deleted)
+func TaskEvents(idc, sn string, prev, next *models.TaskV3, rev int64) []Event {
+	if next == nil {
+		if prev == nil {
+			return nil
+		}
+		return []Event{{Type: EventDeleted, IDC: idc, SN: sn, TaskID: prev.TaskID, Status: string(prev.Status), Revision: rev}}
+	}
+
+	event := func(typ string, payload interface{}) Event {
+		return Event{Type: typ, IDC: idc, SN: sn, TaskID: next.TaskID, Status: string(next.Status), Revision: rev, Payload: payload}
+	}
+
+	// A new task, a new attempt or a rewritten history is sent whole
+	if prev == nil || prev.TaskID != next.TaskID || next.LogSeq < prev.LogSeq {
+		return []Event{event(EventTask, next)}
+	}
+
+	var events []Event
+	if prev.Status != next.Status {
+		change := models.StatusChange{Status: next.Status, Timestamp: next.UpdatedAt}
+		if n := len(next.StatusHistory); n > 0 && next.StatusHistory[n-1].Status == next.Status {
+			change = next.StatusHistory[n-1]
+		}
+		e := event(EventStatus, change)
+		e.From = string(prev.Status)
+		events = append(events, e)
+	}
+
+	if next.Approval != nil && !reflect.DeepEqual(prev.Approval, next.Approval) {
+		events = append(events, event(EventApproval, next.Approval))
+	}
+
+	// Entries are numbered, so the new ones are those above prev's count
+	for _, e := range next.Log {
+		switch {
+		case e.Seq <= prev.LogSeq:
+		case e.Progress != nil:
+			events = append(events, event(EventProgress, *e.Progress))
+		default:
+			events = append(events, event(EventLog, map[string]string{"line": e.Line}))
+		}
+	}
+	return events
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lpmos/lpmos-go/pkg/auth"
+	"github.com/lpmos/lpmos-go/pkg/models"
+)
+
+func TestFilterMatch(t *testing.T) {
+	f := Filter{IDCs: []string{"dc1"}, Statuses: []string{"installing"}}
+
+	tests := []struct {
+		name string
+		e    Event
+		want bool
+	}{
+		{"matching task", Event{IDC: "dc1", SN: "sn-1", Status: "installing"}, true},
+		{"other idc", Event{IDC: "dc2", SN: "sn-1", Status: "installing"}, false},
+		{"other status", Event{IDC: "dc1", SN: "sn-1", Status: "pending"}, false},
+		{"leaving the status", Event{IDC: "dc1", SN: "sn-1", Status: "completed", From: "installing"}, true},
+		{"region of the idc", Event{Type: EventRegion, IDC: "dc1", Status: "offline"}, true},
+		{"region of another idc", Event{Type: EventRegion, IDC: "dc2"}, false},
+	}
+	for _, tt := range tests {
+		if got := f.Match(&tt.e); got != tt.want {
+			t.Errorf("%s: Match() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if !(Filter{}).Match(&Event{IDC: "dc9", SN: "sn-9", Status: "failed"}) {
+		t.Error("empty filter should match everything")
+	}
+}
+
+func TestTaskEvents(t *testing.T) {
+	now := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	prev := &models.TaskV3{
+		TaskID: "task-1",
+		SN:     "sn-1",
+		Status: models.TaskStatusInstalling,
+	}
+	prev.AddProgress(models.ProgressStep{Step: "partitioning", Percent: 10, Timestamp: now})
+	prev.AddLog("a")
+
+	next := *prev
+	next.Status = models.TaskStatusCompleted
+	next.StatusHistory = []models.StatusChange{{Status: models.TaskStatusCompleted, Timestamp: now, Reason: "done"}}
+	next.AddProgress(models.ProgressStep{Step: "partitioning", Percent: 40, Timestamp: now})
+	next.AddProgress(models.ProgressStep{Step: "reboot", Percent: 100, Timestamp: now})
+	next.AddLog("b")
+	next.AddLog("c")
+
+	var types []string
+	for _, e := range TaskEvents("dc1", "sn-1", prev, &next, 7) {
+		types = append(types, e.Type)
+		if e.IDC != "dc1" || e.SN != "sn-1" || e.Revision != 7 || e.Status != "completed" {
+			t.Errorf("event %+v lacks task fields", e)
+		}
+		if e.Type == EventStatus && (e.From != "installing" || e.Payload.(models.StatusChange).Reason != "done") {
+			t.Errorf("status event %+v", e)
+		}
+	}
+	want := []string{EventStatus, EventProgress, EventProgress, EventLog, EventLog}
+	if len(types) != len(want) {
+		t.Fatalf("events %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("events %v, want %v", types, want)
+		}
+	}
+
+	retried := next
+	retried.TaskID = "task-2"
+	if events := TaskEvents("dc1", "sn-1", &next, &retried, 8); len(events) != 1 || events[0].Type != EventTask {
+		t.Errorf("new attempt: %+v", events)
+	}
+	if events := TaskEvents("dc1", "sn-1", &next, nil, 9); len(events) != 1 || events[0].Type != EventDeleted || events[0].TaskID != "task-1" {
+		t.Errorf("delete: %+v", events)
+	}
+	if events := TaskEvents("dc1", "sn-1", &next, &next, 10); len(events) != 0 {
+		t.Errorf("unchanged task: %+v", events)
+	}
+}
+
+// inbox holds messages taken from client queues but not yet received
+var inbox = map[*Client][][]byte{}
+
+// receive returns the next message queued for c
+func receive(t *testing.T, c *Client) map[string]interface{} {
+	t.Helper()
+	for len(inbox[c]) == 0 {
+		select {
+		case <-c.queue.ready:
+			messages, _ := c.queue.popAll()
+			inbox[c] = append(inbox[c], messages...)
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message")
+		}
+	}
+
+	data := inbox[c][0]
+	inbox[c] = inbox[c][1:]
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("bad message %s: %v", data, err)
+	}
+	return msg
+}
+
+func TestHubSubscription(t *testing.T) {
+	loading, release := make(chan struct{}), make(chan struct{})
+	h := NewHub()
+	h.SetSnapshot(func(f Filter, p *auth.Principal) (*Snapshot, error) {
+		close(loading)
+		<-release
+		return &Snapshot{Revision: 10, Tasks: []models.TaskV3{{SN: "sn-1"}}}, nil
+	})
+
+	v1 := h.newClient(nil, nil)
+	v2 := h.newClient(nil, &auth.Principal{IDCs: map[string]bool{"dc1": true}})
+	h.handleRequest(v2, Request{Type: RequestSubscribe, Filter: Filter{Statuses: []string{"installing"}}})
+
+	<-loading
+
+	status := &models.WebSocketMessage{Type: "status", IDC: "dc1", SN: "sn-1", Status: "installing"}
+	// Published while the snapshot loads: the first is already in it
+	h.Publish(&Event{Type: EventLog, IDC: "dc1", SN: "sn-1", Status: "installing", Revision: 9}, status)
+	h.Publish(&Event{Type: EventLog, IDC: "dc1", SN: "sn-1", Status: "installing", Revision: 11}, nil)
+	close(release)
+	h.Publish(&Event{Type: EventLog, IDC: "dc2", SN: "sn-2", Status: "installing", Revision: 12}, nil) // no access
+	h.Publish(&Event{Type: EventLog, IDC: "dc1", SN: "sn-3", Status: "pending", Revision: 13}, nil)    // filtered
+	h.Publish(&Event{Type: EventStatus, IDC: "dc1", SN: "sn-1", Status: "completed", From: "installing", Revision: 14}, nil)
+
+	if msg := receive(t, v1); msg["type"] != "status" || msg["seq"] != nil {
+		t.Errorf("v1 client got %v", msg)
+	}
+
+	want := []struct {
+		typ string
+		rev float64
+	}{{EventSnapshot, 10}, {EventLog, 11}, {EventStatus, 14}}
+	for i, w := range want {
+		msg := receive(t, v2)
+		if msg["seq"] != float64(i+1) || msg["type"] != w.typ || msg["revision"] != w.rev {
+			t.Errorf("message %d = %v, want seq %d %s at %v", i, msg, i+1, w.typ, w.rev)
+		}
+	}
+
+	h.handleRequest(v2, Request{Type: "bogus"})
+	if msg := receive(t, v2); msg["type"] != EventError || msg["seq"] != float64(4) {
+		t.Errorf("bogus request answered with %v", msg)
+	}
+	h.handleRequest(v2, Request{Type: RequestSubscribe, Filter: Filter{IDCs: []string{"dc2"}}})
+	if msg := receive(t, v2); msg["type"] != EventError {
+		t.Errorf("subscribing to a forbidden IDC answered with %v", msg)
+	}
+}
@@ -0,0 +1,106 @@
+package websocket
+
+import "sync"
+
+// DefaultQueueSize is how many messages a client may have waiting to be
+// written before the oldest are dropped
+const DefaultQueueSize = 256
+
+// item is a message waiting in a client queue
+type item struct {
+	data      []byte
+	key       string // coalescing key; empty never coalesces
+	sequenced bool   // a v2 event, numbered when it is taken from the queue
+}
+
+// queue is the bounded outbox of one client. Pushing never blocks: a message
+// with a coalescing key replaces the queued message with the same key, and
+// when the queue is full the oldest message is dropped. Sequence numbers are
+// assigned as messages leave the queue, skipping one for every dropped v2
+// event so the client sees the gap and resyncs.
+type queue struct {
+	mu      sync.Mutex
+	items   []item
+	limit   int
+	closed  bool
+	ready   chan struct{} // signalled when items are added or the queue closes
+	seq     uint64        // last sequence number handed out
+	skipped uint64        // v2 events dropped since then
+}
+
+func newQueue(limit int) *queue {
+	return &queue{limit: limit, ready: make(chan struct{}, 1)}
+}
+
+// push adds it to the queue and reports whether it replaced a queued message
+// or pushed out the oldest one
+func (q *queue) push(it item) (coalesced, dropped bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false, false
+	}
+
+	if it.key != "" {
+		for i := len(q.items) - 1; i >= 0; i-- {
+			if q.items[i].key == it.key {
+				q.items[i] = it
+				return true, false
+			}
+		}
+	}
+
+	if len(q.items) >= q.limit {
+		if q.items[0].sequenced {
+			q.skipped++
+		}
+		q.items[0] = item{} // release the data
+		q.items = q.items[1:]
+		dropped = true
+	}
+	q.items = append(q.items, it)
+	q.signal()
+	return false, dropped
+}
+
+// popAll takes every queued message, numbering the v2 events. closed is
+// true once the queue is closed and drained.
+func (q *queue) popAll() (messages [][]byte, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages = make([][]byte, len(q.items))
+	for i, it := range q.items {
+		if it.sequenced {
+			q.seq += q.skipped + 1
+			q.skipped = 0
+			it.data = sequenced(q.seq, it.data)
+		}
+		messages[i] = it.data
+	}
+	q.items = nil
+	return messages, q.closed
+}
+
+// close stops accepting messages and wakes the writer
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+// len returns the number of queued messages
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// signal wakes the writer without blocking. The caller holds the lock.
+func (q *queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package websocket
+
+func init() {
+	raceEnabled = true
+}